@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os/signal"
 
 	"github.com/spf13/cobra"
 
@@ -13,6 +15,10 @@ import (
 
 	"time"
 
+	"io"
+	"io/ioutil"
+	"os"
+
 	"github.com/Everlag/poeitemstore/db"
 	"github.com/Everlag/poeitemstore/stash"
 	"github.com/boltdb/bolt"
@@ -439,7 +445,848 @@ var searchItemMultiModSlow = &cobra.Command{
 	},
 }
 
+// planner is shared between searches so collected stats can be reused
+var planner = db.NewQueryPlanner(db.DefaultMaxStatsAge)
+
+var searchCmd = &cobra.Command{
+	Use:     "search [\"path to MultiModSearch json\"]",
+	Short:   "Find an item with types and mods using the cheapest strategy",
+	Long:    "Plan a search using index statistics, choosing between the index and a scan of the item store",
+	Example: "search ./query.json",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) < 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+		search, err := FetchMultiModSearch(args[0])
+		if err != nil {
+			fmt.Printf("failed to get search, err=%s\n", err)
+			return
+		}
+
+		resolved, err := search.resolve(bdb)
+		if err != nil {
+			fmt.Printf("invalid search, err=%s\n", err)
+			return
+		}
+
+		plan, err := planner.Plan(resolved.rootType, resolved.rootFlavor,
+			resolved.mods, search.MinValues, resolved.league,
+			search.MaxDesired, bdb)
+		if err != nil {
+			fmt.Printf("failed to plan search, err=%s\n", err)
+			return
+		}
+		fmt.Printf("plan: %s\n", plan)
+
+		resultIDs, err := plan.Query.Run(bdb)
+		if err != nil {
+			fmt.Printf("failed to search items, err=%s\n", err)
+			return
+		}
+
+		fmt.Println("result:")
+		for _, id := range resultIDs {
+			fmt.Printf("    %x\n", id)
+		}
+	},
+}
+
+var searchParallelCmd = &cobra.Command{
+	Use:     "searchParallel [\"path to MultiModSearch json\"] [\"league\"...]",
+	Short:   "Find an item with types and mods across several leagues at once",
+	Long:    "Search the indices of each provided league in parallel, the League of the search is ignored. If no leagues are provided, every league is searched",
+	Example: "searchParallel ./query.json Standard Legacy",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) < 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+		search, err := FetchMultiModSearch(args[0])
+		if err != nil {
+			fmt.Printf("failed to get search, err=%s\n", err)
+			return
+		}
+
+		leagues := args[1:]
+		if len(leagues) == 0 {
+			leagues, err = db.ListLeagues(bdb)
+			if err != nil {
+				fmt.Printf("failed to list leagues, err=%s\n", err)
+				return
+			}
+		}
+		if len(leagues) == 0 {
+			fmt.Println("no leagues to search")
+			return
+		}
+		// Resolve with any league, we replace it afterwards
+		search.League = leagues[0]
+
+		resolved, err := search.resolve(bdb)
+		if err != nil {
+			fmt.Printf("invalid search, err=%s\n", err)
+			return
+		}
+		leagueIDs, err := db.GetLeagues(leagues, bdb)
+		if err != nil {
+			fmt.Printf("failed to fetch leagues, err=%s\n", err)
+			return
+		}
+
+		query := db.NewParallelIndexQuery(resolved.rootType, resolved.rootFlavor,
+			resolved.mods, search.MinValues, leagueIDs, search.MaxDesired,
+			db.DefaultParallelQueryWorkers)
+		results, err := query.Run(bdb)
+		if err != nil {
+			fmt.Printf("failed to search items, err=%s\n", err)
+			return
+		}
+
+		for i, result := range results {
+			fmt.Printf("result for %s:\n", leagues[i])
+			for _, id := range result.IDs {
+				fmt.Printf("    %x\n", id)
+			}
+		}
+	},
+}
+
+var indexEncodingCmd = &cobra.Command{
+	Use:   "indexEncoding [sorted|roaring]",
+	Short: "get or set how index entries are encoded",
+	Long:  "get or set the encoding newly written index entries use, existing entries are converted as they are next written",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		encodings := map[string]db.IndexEncoding{
+			"sorted":  db.IndexEncodingSorted,
+			"roaring": db.IndexEncodingRoaring,
+		}
+
+		if len(args) < 1 {
+			encoding, err := db.GetIndexEncoding(bdb)
+			if err != nil {
+				fmt.Printf("failed to get index encoding, err=%s\n", err)
+				return
+			}
+			for name, known := range encodings {
+				if known == encoding {
+					fmt.Printf("index encoding is %s\n", name)
+					return
+				}
+			}
+			fmt.Printf("index encoding is unknown, %d\n", encoding)
+			return
+		}
+
+		encoding, ok := encodings[args[0]]
+		if !ok {
+			fmt.Printf("unknown index encoding '%s'\n", args[0])
+			return
+		}
+		if err := db.SetIndexEncoding(encoding, bdb); err != nil {
+			fmt.Printf("failed to set index encoding, err=%s\n", err)
+			return
+		}
+	},
+}
+
+var pruneCmd = &cobra.Command{
+	Use:     "prune [\"maxAge [item|stash] [dry]\"]",
+	Short:   "remove items older than maxAge",
+	Long:    "remove items whose age, measured from when they were added or when their stash was last seen, exceeds maxAge. Passing dry reports what would be removed without removing anything",
+	Example: "prune 72h stash dry",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) < 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		maxAge, err := time.ParseDuration(args[0])
+		if err != nil {
+			fmt.Printf("cannot read maxAge '%s' as a duration\n", args[0])
+			return
+		}
+		policy := db.RetentionPolicy{
+			MaxAge:    maxAge,
+			Basis:     db.RetainByItem,
+			BatchSize: db.DefaultPruneBatchSize,
+		}
+
+		var dryRun bool
+		for _, arg := range args[1:] {
+			switch arg {
+			case "item":
+				policy.Basis = db.RetainByItem
+			case "stash":
+				policy.Basis = db.RetainByStash
+			case "dry":
+				dryRun = true
+			default:
+				fmt.Printf("unknown argument '%s', ex: %s\n", arg, cmd.Example)
+				return
+			}
+		}
+
+		report, err := db.Prune(policy, time.Now(), dryRun, bdb)
+		if err != nil {
+			fmt.Printf("failed to prune, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+// splitDryRun removes a trailing dry argument, returning
+// the remaining arguments and whether it was present.
+func splitDryRun(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "dry" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+var leagueCmd = &cobra.Command{
+	Use:   "league",
+	Short: "manage stored leagues",
+	Long:  "drop, archive, merge, or rename entire leagues. Passing dry as the final argument of any operation reports what would be done without changing anything",
+}
+
+var leagueDropCmd = &cobra.Command{
+	Use:     "drop [\"league [dry]\"]",
+	Short:   "remove a league and everything stored under it",
+	Long:    "remove a league's items, indices, and stashes from the database",
+	Example: "league drop Breach dry",
+	Run: func(cmd *cobra.Command, args []string) {
+		args, dryRun := splitDryRun(args)
+		if len(args) != 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.DropLeague(args[0], dryRun, bdb)
+		if err != nil {
+			fmt.Printf("failed to drop league, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var leagueArchiveCmd = &cobra.Command{
+	Use:     "archive [\"league path [dry]\"]",
+	Short:   "export a league to a file then remove it",
+	Long:    "export a league's items, stashes, and the strings they use to a compressed file at path then remove the league from the database",
+	Example: "league archive Breach breach.archive",
+	Run: func(cmd *cobra.Command, args []string) {
+		args, dryRun := splitDryRun(args)
+		if len(args) != 2 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		var w io.Writer = ioutil.Discard
+		if !dryRun {
+			f, err := os.Create(args[1])
+			if err != nil {
+				fmt.Printf("failed to create archive, err=%s\n", err)
+				return
+			}
+			defer f.Close()
+			w = f
+		}
+
+		report, err := db.ArchiveLeague(args[0], w, dryRun, bdb)
+		if err != nil {
+			fmt.Printf("failed to archive league, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var leagueMergeCmd = &cobra.Command{
+	Use:     "merge [\"from to [dry]\"]",
+	Short:   "move everything from one league into another",
+	Long:    "move every item and stash from one league into another then remove the emptied league, as happens when a temporary league ends",
+	Example: "league merge Breach Standard",
+	Run: func(cmd *cobra.Command, args []string) {
+		args, dryRun := splitDryRun(args)
+		if len(args) != 2 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.MergeLeague(args[0], args[1],
+			db.DefaultLeagueMergeBatchSize, dryRun, bdb)
+		if err != nil {
+			fmt.Printf("failed to merge league, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var leagueRenameCmd = &cobra.Command{
+	Use:     "rename [\"from to [dry]\"]",
+	Short:   "change the name a league is stored under",
+	Long:    "change the name a league is stored under, the new name must not already be in use",
+	Example: "league rename \"Hardcore Breach\" \"Hardcore Breach (ended)\"",
+	Run: func(cmd *cobra.Command, args []string) {
+		args, dryRun := splitDryRun(args)
+		if len(args) != 2 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.RenameLeague(args[0], args[1], dryRun, bdb)
+		if err != nil {
+			fmt.Printf("failed to rename league, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var gcStringsCmd = &cobra.Command{
+	Use:     "gcStrings [dry]",
+	Short:   "remove unreferenced strings from the string heap",
+	Long:    "condemn strings no longer referenced by any item and remove those condemned by a previous run which remain unreferenced. Passing dry reports what would be removed without changing anything",
+	Example: "gcStrings dry",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		args, dryRun := splitDryRun(args)
+		if len(args) != 0 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.CollectStrings(dryRun, bdb)
+		if err != nil {
+			fmt.Printf("failed to collect strings, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var compactDBCmd = &cobra.Command{
+	Use:     "compactdb [renumber]",
+	Short:   "rewrite the database into a smaller file",
+	Long:    "copy all live data into a fresh file, dropping empty index buckets, then replace the database with it. Passing renumber also reassigns item IDs to a dense sequence. Nothing else may use the database while this runs",
+	Example: "compactdb renumber",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var renumber bool
+		switch {
+		case len(args) == 0:
+		case len(args) == 1 && args[0] == "renumber":
+			renumber = true
+		default:
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.CompactDB(bdb, renumber)
+		if err != nil {
+			fmt.Printf("failed to compact database, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var fsckCmd = &cobra.Command{
+	Use:     "fsck [repair]",
+	Short:   "check the database for inconsistencies",
+	Long:    "verify the heaps, league buckets, index, and stashes are consistent with each other. Passing repair fixes every problem found",
+	Example: "fsck repair",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var repair bool
+		switch {
+		case len(args) == 0:
+		case len(args) == 1 && args[0] == "repair":
+			repair = true
+		default:
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.Fsck(repair, bdb)
+		if err != nil {
+			fmt.Printf("failed to check database, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var reindexCmd = &cobra.Command{
+	Use:     "reindex [\"league [shadow] [granularity]\"]",
+	Short:   "rebuild a league's index from its items",
+	Long:    "drop the index of a league and rebuild it from the stored items. Passing shadow builds the new index alongside the existing one, which is replaced once complete. Passing a granularity rebuilds the index with time buckets of 2^granularity seconds. An interrupted reindex continues where it left off when run again",
+	Example: "reindex Standard shadow 8",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) < 1 || len(args) > 3 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+		options := db.ReindexOptions{BatchSize: db.DefaultReindexBatchSize}
+		for _, arg := range args[1:] {
+			if arg == "shadow" && !options.Shadow {
+				options.Shadow = true
+				continue
+			}
+			parsed, err := strconv.ParseUint(arg, 10, 8)
+			if err != nil || options.Granularity != nil {
+				fmt.Printf("unknown argument '%s', ex: %s\n", arg, cmd.Example)
+				return
+			}
+			granularity := db.IndexGranularity(parsed)
+			options.Granularity = &granularity
+		}
+
+		// Only report progress as each whole percent is reached
+		reported := -1
+		progress := func(p db.ReindexProgress) {
+			percent := 100
+			if p.Total > 0 {
+				percent = p.Items * 100 / p.Total
+			}
+			if percent != reported {
+				fmt.Printf("reindexed %d/%d items, %d%%\n", p.Items, p.Total, percent)
+				reported = percent
+			}
+		}
+
+		report, err := db.Reindex(args[0], options, progress, bdb)
+		if err != nil {
+			fmt.Printf("failed to reindex, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "upgrade the database to the current schema version",
+	Long:  "apply every migration between the schema version of the database and the version this build supports. An interrupted migration continues where it left off when run again",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		progress := func(p db.MigrationProgress) {
+			if p.Done {
+				fmt.Printf("migrated to schema version %d: %s\n",
+					p.Version, p.Description)
+			}
+		}
+
+		report, err := db.Migrate(progress, bdb)
+		if err != nil {
+			fmt.Printf("failed to migrate, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var backupCmd = &cobra.Command{
+	Use:     "backup [\"path [snappy]\"]",
+	Short:   "write a consistent copy of the database to a file",
+	Long:    "copy the database to path from a single read transaction, so it can be taken while the database is in use. Passing snappy compresses the copy",
+	Example: "backup poe.db.bak snappy",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var compress bool
+		switch {
+		case len(args) == 1:
+		case len(args) == 2 && args[1] == "snappy":
+			compress = true
+		default:
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.Backup(args[0], compress, bdb)
+		if err != nil {
+			fmt.Printf("failed to backup database, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:     "restore [path]",
+	Short:   "replace the database with a backup",
+	Long:    "check a backup written by backup for consistency, migrating it if its schema is older, then replace the database with it. A backup which fails the check is refused and the database is left untouched. The database is not opened, so one which is damaged or outdated can be replaced. Nothing else may use the database while this runs",
+	Example: "restore poe.db.bak",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		report, err := db.Restore(args[0], db.DBLocation)
+		if err != nil {
+			fmt.Printf("failed to restore database, err=%s\n", err)
+			if report != nil && report.Fsck != nil {
+				fmt.Println(report.Fsck)
+			}
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:     "export [\"league csv|jsonl|parquet path [path to MultiModSearch json]\"]",
+	Short:   "write a league's items to a file for use outside the database",
+	Long:    "stream every item of a league, along with its stash and account, to path as CSV, JSON Lines, or parquet. Passing a MultiModSearch only exports the items which satisfy it, its League is ignored",
+	Example: "export Standard csv standard.csv ./query.json",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		formats := map[string]db.ExportFormat{
+			"csv":     db.ExportCSV,
+			"jsonl":   db.ExportJSONLines,
+			"parquet": db.ExportParquet,
+		}
+
+		if len(args) != 3 && len(args) != 4 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+		format, ok := formats[args[1]]
+		if !ok {
+			fmt.Printf("unknown export format '%s'\n", args[1])
+			return
+		}
+
+		var filter *db.ItemStoreQuery
+		if len(args) == 4 {
+			search, err := FetchMultiModSearch(args[3])
+			if err != nil {
+				fmt.Printf("failed to get search, err=%s\n", err)
+				return
+			}
+			search.League = args[0]
+			resolved, err := search.resolve(bdb)
+			if err != nil {
+				fmt.Printf("invalid search, err=%s\n", err)
+				return
+			}
+			query := db.NewItemStoreQuery(resolved.rootType, resolved.rootFlavor,
+				resolved.mods, search.MinValues, resolved.league, search.MaxDesired)
+			filter = &query
+		}
+
+		f, err := os.Create(args[2])
+		if err != nil {
+			fmt.Printf("failed to create export, err=%s\n", err)
+			return
+		}
+		defer f.Close()
+
+		report, err := db.ExportLeague(args[0], filter, format, f, bdb)
+		if err != nil {
+			fmt.Printf("failed to export league, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:     "import [\"path [start [step]]\"]",
+	Short:   "add stashes from a JSON Lines file",
+	Long:    "add every stash.Stash or stash.Response, one JSON record per line, from path to the database as they would have been when fetched. Passing start, as RFC3339, processes the first update at that time and each following update step later so importing is deterministic; otherwise updates are processed at the current time",
+	Example: "import stashes.jsonl 2017-04-21T15:04:00Z 1m",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) < 1 || len(args) > 3 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		var options db.ImportOptions
+		if len(args) > 1 {
+			start, err := time.Parse(time.RFC3339, args[1])
+			if err != nil {
+				fmt.Printf("invalid start, err=%s\n", err)
+				return
+			}
+			options.Start = start
+		}
+		if len(args) > 2 {
+			step, err := time.ParseDuration(args[2])
+			if err != nil {
+				fmt.Printf("invalid step, err=%s\n", err)
+				return
+			}
+			options.Step = step
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Printf("failed to open records, err=%s\n", err)
+			return
+		}
+		defer f.Close()
+
+		report, err := db.ImportJSONLines(f, options, bdb)
+		if err != nil {
+			fmt.Printf("failed to import records, err=%s\n", err)
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+var replayCmd = &cobra.Command{
+	Use:     "replay [\"changeset.msgp [step [pace]] [fresh] [synthetic]\"]",
+	Short:   "add every change of a ChangeSet in order",
+	Long:    "add each change of a ChangeSet or change archive as it would have been when fetched, processing each change at the time it was fetched when the archive recorded it and otherwise change i step after change i-1. Passing synthetic ignores recorded times. Passing pace adds changes in real time sped up by pace rather than as fast as possible. A replay continues after the last change added by an earlier replay unless fresh is passed",
+	Example: "replay \"testSet - 11 updates.msgp\" 4s 10",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		var options db.ReplayOptions
+		// Keywords may follow the other arguments in any order
+	keywords:
+		for len(args) > 0 {
+			switch args[len(args)-1] {
+			case "fresh":
+				options.FromStart = true
+			case "synthetic":
+				options.Synthetic = true
+			default:
+				break keywords
+			}
+			args = args[:len(args)-1]
+		}
+		if len(args) < 1 || len(args) > 3 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+		if len(args) > 1 {
+			step, err := time.ParseDuration(args[1])
+			if err != nil {
+				fmt.Printf("invalid step, err=%s\n", err)
+				return
+			}
+			options.Step = step
+		}
+		if len(args) > 2 {
+			pace, err := strconv.ParseFloat(args[2], 64)
+			if err != nil || pace <= 0 {
+				fmt.Printf("invalid pace '%s'\n", args[2])
+				return
+			}
+			options.Pace = pace
+		}
+		options.Progress = func(p db.ReplayProgress) {
+			fmt.Printf("change %d, id=%s at %s\n%s\n",
+				p.Index, p.ChangeID, p.When.Format(time.RFC3339), p.Stats)
+		}
+
+		// Archives are read a change at a time rather than held in memory
+		set, err := stash.OpenChangeSet(args[0])
+		if err != nil {
+			fmt.Printf("failed to open ChangeSet, err=%s\n", err)
+			return
+		}
+		defer set.Close()
+		if archive, ok := set.(*stash.ChangeArchive); ok && archive.Recovered {
+			fmt.Printf("archive was not closed, recovered %d changes\n",
+				archive.Len())
+		}
+		report, err := db.ReplayChangeSet(set, options, bdb)
+		if err != nil {
+			fmt.Printf("failed to replay ChangeSet, err=%s\n", err)
+			if report != nil {
+				fmt.Println(report)
+			}
+			return
+		}
+		fmt.Println(report)
+	},
+}
+
+// ingestSnapshots is the schedule ingest takes snapshots on, set by
+// its flags
+var ingestSnapshots db.SnapshotSchedule
+
+var ingestCmd = &cobra.Command{
+	Use:     "ingest [\"[changeID]\"]",
+	Short:   "fetch and store updates from the stash api until interrupted",
+	Long:    "fetch, decode and store updates from the stash api starting at changeID, continuing after the last update stored by an earlier ingest when absent. An OAuth bearer token is read from $" + stash.TokenEnv + " when set. Passing --snapshot-dir takes a snapshot of the database there every --snapshot-interval while ingesting. Interrupting stops fetching once every update already fetched is stored",
+	Example: "ingest 2949-5380-4594-5443-1707 --snapshot-dir snapshots --snapshot-interval 1h --snapshot-keep 24",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if len(args) > 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+		var options db.IngestOptions
+		if len(args) > 0 {
+			options.ChangeID = args[0]
+		}
+		options.Progress = func(stats db.IngestStats) {
+			fmt.Println(stats)
+		}
+		if ingestSnapshots.Dir != "" {
+			if ingestSnapshots.Interval <= 0 {
+				fmt.Printf("invalid use, --snapshot-interval must be positive, ex: %s\n",
+					cmd.Example)
+				return
+			}
+			options.Snapshots = &ingestSnapshots
+			options.Snapshotted = func(report *db.BackupReport, err error) {
+				if err != nil {
+					fmt.Printf("failed to take snapshot, err=%s\n", err)
+					return
+				}
+				fmt.Println(report)
+			}
+		}
+
+		client := stash.NewClient()
+		if token := os.Getenv(stash.TokenEnv); token != "" {
+			client.Tokens = stash.StaticToken(token)
+		}
+		fetcher := stash.NewFetcher(client)
+		fetcher.Retrying = func(changeID string, wait time.Duration, err error) {
+			fmt.Printf("id=%s retrying in %s, err=%s\n", changeID, wait, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+		go func() {
+			<-interrupt
+			fmt.Println("interrupted, storing updates already fetched")
+			cancel()
+		}()
+
+		stats, err := db.Ingest(ctx, fetcher, options, bdb)
+		if err != nil {
+			fmt.Printf("failed to ingest, err=%s\n", err)
+		}
+		if stats != nil {
+			fmt.Println(stats)
+		}
+	},
+}
+
+var basesCmd = &cobra.Command{
+	Use:   "bases",
+	Short: "list the versions of the bases items are classified by",
+	Long:  "list every version of the bases stored, marking the version items are currently classified by. Items keep the classification they were stored with",
+	Run: func(cmd *cobra.Command, args []string) {
+		versions, err := db.ListBases(bdb)
+		if err != nil {
+			fmt.Printf("failed to list bases, err=%s\n", err)
+			return
+		}
+		for _, v := range versions {
+			current := ""
+			if v.Current {
+				current = " (current)"
+			}
+			fmt.Printf("%d%s: %d bases, hash=%s, loaded %s from %s\n",
+				v.Version, current, v.Len, v.Hash,
+				v.Loaded.Format(time.RFC3339), v.Source)
+		}
+	},
+}
+
+var basesLoadCmd = &cobra.Command{
+	Use:     "load [\"path\"]",
+	Short:   "classify items by bases loaded from a file or directory",
+	Long:    "load bases from a file or every .json file of a directory, either in the format of the bundled baseInfo.json or GGG's item data, and store them as a new version merged over the current bases",
+	Example: "bases load items.json",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+
+		loaded, err := stash.LoadBases(args[0])
+		if err != nil {
+			fmt.Printf("failed to load bases, err=%s\n", err)
+			return
+		}
+		set := stash.CurrentBases().Merge(loaded)
+		version, err := db.StoreBases(set, args[0], bdb)
+		if err != nil {
+			fmt.Printf("failed to store bases, err=%s\n", err)
+			return
+		}
+		fmt.Printf("classifying items by version %d, %d bases\n",
+			version, set.Len())
+	},
+}
+
+var basesUseCmd = &cobra.Command{
+	Use:     "use [\"version\"]",
+	Short:   "classify items by a stored version of the bases",
+	Example: "bases use 1",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Printf("invalid use, ex: %s\n", cmd.Example)
+			return
+		}
+		version, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			fmt.Printf("invalid version '%s'\n", args[0])
+			return
+		}
+
+		if err := db.UseBases(uint32(version), bdb); err != nil {
+			fmt.Printf("failed to use bases, err=%s\n", err)
+			return
+		}
+		fmt.Printf("classifying items by version %d\n", version)
+	},
+}
+
+var basesUnknownCmd = &cobra.Command{
+	Use:   "unknown",
+	Short: "list typelines which failed to classify",
+	Long:  "list every typeline stored items failed to classify as a known base, most often seen first, noting those the current bases now classify",
+	Run: func(cmd *cobra.Command, args []string) {
+		unknown, err := db.ListUnknownTypelines(bdb)
+		if err != nil {
+			fmt.Printf("failed to list unknown typelines, err=%s\n", err)
+			return
+		}
+		for _, u := range unknown {
+			fmt.Printf("%d x %s, last seen %s with version %d",
+				u.Count, u.TypeLine, u.LastSeen.Format(time.RFC3339), u.Version)
+			if flavor, root, ok := stash.MatchTypeline(u.TypeLine); ok {
+				fmt.Printf(", now %s/%s", root, flavor)
+			}
+			fmt.Println()
+		}
+	},
+}
+
 func init() {
+	leagueCmd.AddCommand(leagueDropCmd)
+	leagueCmd.AddCommand(leagueArchiveCmd)
+	leagueCmd.AddCommand(leagueMergeCmd)
+	leagueCmd.AddCommand(leagueRenameCmd)
+
+	basesCmd.AddCommand(basesLoadCmd)
+	basesCmd.AddCommand(basesUseCmd)
+	basesCmd.AddCommand(basesUnknownCmd)
+
 	rootCmd.AddCommand(fetchCmd)
 	rootCmd.AddCommand(checkCmd)
 	rootCmd.AddCommand(tryCompactyCmd)
@@ -451,6 +1298,45 @@ func init() {
 	rootCmd.AddCommand(searchItemByModCmd)
 	rootCmd.AddCommand(searchItemMultiMod)
 	rootCmd.AddCommand(searchItemMultiModSlow)
+	rootCmd.AddCommand(searchCmd)
+	rootCmd.AddCommand(searchParallelCmd)
+	rootCmd.AddCommand(indexEncodingCmd)
+	rootCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(leagueCmd)
+	rootCmd.AddCommand(gcStringsCmd)
+	rootCmd.AddCommand(compactDBCmd)
+	rootCmd.AddCommand(fsckCmd)
+	rootCmd.AddCommand(reindexCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(replayCmd)
+	ingestCmd.Flags().StringVar(&ingestSnapshots.Dir, "snapshot-dir", "",
+		"directory to take snapshots in while ingesting, none are taken when empty")
+	ingestCmd.Flags().DurationVar(&ingestSnapshots.Interval,
+		"snapshot-interval", time.Hour, "time between snapshots")
+	ingestCmd.Flags().IntVar(&ingestSnapshots.Keep, "snapshot-keep", 0,
+		"number of most recent snapshots kept, all are kept when less than 1")
+	ingestCmd.Flags().BoolVar(&ingestSnapshots.Compress, "snapshot-snappy",
+		false, "compress snapshots with snappy")
+	rootCmd.AddCommand(ingestCmd)
+	rootCmd.AddCommand(basesCmd)
+}
+
+// Migrating determines if the command being run is migrate, in which
+// case the database should be opened with db.BootForMigration
+func Migrating() bool {
+	c, _, err := rootCmd.Find(os.Args[1:])
+	return err == nil && c == migrateCmd
+}
+
+// Restoring determines if the command being run is restore, in which
+// case the database is replaced rather than opened
+func Restoring() bool {
+	c, _, err := rootCmd.Find(os.Args[1:])
+	return err == nil && c == restoreCmd
 }
 
 // HandleCommands runs commands after setting up
@@ -6,7 +6,9 @@ import (
 	"os"
 	"strings"
 
+	"github.com/Everlag/poeitemstore/db"
 	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 )
 
@@ -112,3 +114,48 @@ func FetchMultiModSearch(path string) (*MultiModSearch, error) {
 
 	return &search, nil
 }
+
+// resolvedSearch is a MultiModSearch with its strings translated
+// to their identifiers in the database
+type resolvedSearch struct {
+	rootType, rootFlavor db.StringHeapID
+	mods                 []db.StringHeapID
+	league               db.LeagueHeapID
+}
+
+// resolve validates the MultiModSearch and translates its strings
+// to their identifiers in the database
+func (search *MultiModSearch) resolve(bdb *bolt.DB) (*resolvedSearch, error) {
+
+	if len(search.Mods) == 0 {
+		return nil, errors.New("no mods provided")
+	}
+
+	if len(search.MinValues) != len(search.Mods) {
+		return nil, errors.New("each mod must have a minvalue")
+	}
+
+	// Lookup the root, flavor, and mod
+	strings := []string{search.RootType, search.RootFlavor}
+	ids, err := db.GetStrings(strings, bdb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch rootType or RootFlavor id")
+	}
+	modIds, err := db.GetStrings(search.Mods, bdb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch mod id")
+	}
+
+	// And we we need to fetch the league
+	leagueIDs, err := db.GetLeagues([]string{search.League}, bdb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch league")
+	}
+
+	return &resolvedSearch{
+		rootType:   ids[0],
+		rootFlavor: ids[1],
+		mods:       modIds,
+		league:     leagueIDs[0],
+	}, nil
+}
@@ -5,7 +5,10 @@ import (
 	"github.com/pkg/errors"
 )
 
-var indexSetsPool = NewIDMapPool(10)
+// indexQueryPool holds contexts which can be reused between IndexQueries
+var indexQueryPool = NewPool(10, func() Resettable {
+	return &indexQueryContext{fresh: &idBitmap{}}
+})
 
 // LookupItemsMultiModStrideLength determines how many items
 // is included in a stride of LookupItemsMultiMod.
@@ -37,6 +40,8 @@ type IndexQuery struct {
 
 // indexQueryContext represents the necessary transaction-dependent
 // context for an IndexQuery to run.
+//
+// Contexts are pooled, retaining their allocations between queries.
 type indexQueryContext struct {
 	tx           *bolt.Tx
 	validCursors int
@@ -44,8 +49,29 @@ type indexQueryContext struct {
 	//
 	// These are positionally related to the parent's IndexQuery.mods
 	cursors []*bolt.Cursor
-	set     map[ID]int
-	result  []ID
+	// IDs found so far on each cursor
+	//
+	// These are positionally related to the parent's IndexQuery.mods
+	seen []*idBitmap
+	// IDs found for the first time on any cursor during the current stride
+	fresh  *idBitmap
+	result []ID
+}
+
+// Reset clears the context so it can be reused by another query
+func (ctx *indexQueryContext) Reset() {
+	ctx.tx = nil
+	ctx.validCursors = 0
+	for i := range ctx.cursors {
+		ctx.cursors[i] = nil
+	}
+	ctx.cursors = ctx.cursors[:0]
+	for _, seen := range ctx.seen {
+		seen.Reset()
+	}
+	ctx.seen = ctx.seen[:0]
+	ctx.fresh.Reset()
+	ctx.result = ctx.result[:0]
 }
 
 // Remove a given cursor from tracking on the context
@@ -76,59 +102,73 @@ func NewIndexQuery(rootType, rootFlavor StringHeapID,
 // initContext prepares transaction dependent context for an IndexQuery
 func (q *IndexQuery) initContext(tx *bolt.Tx) error {
 
-	// Make a place to keep our cursors
-	//
-	// NOTE: a cursor can be nil to indicate it should not be queried
-	cursors := make([]*bolt.Cursor, len(q.mods))
-
-	// Keep track of how many cursors are valid,
-	// this will let us know when we've exhausted our data
-	validCursors := len(cursors)
+	ctx := indexQueryPool.Borrow().(*indexQueryContext)
+	ctx.tx = tx
 
 	// Collect our buckets for each mod and establish cursors
-	for i, mod := range q.mods {
+	//
+	// NOTE: a cursor can be nil to indicate it should not be queried
+	for _, mod := range q.mods {
 		itemModBucket, err := getItemModIndexBucketRO(q.rootType, q.rootFlavor,
 			mod, q.league, tx)
 		if err != nil {
+			indexQueryPool.Give(ctx)
 			return errors.Errorf("faield to get item mod index bucket, mod=%d err=%s",
 				mod, err)
 		}
-		cursors[i] = itemModBucket.Cursor()
+		ctx.cursors = append(ctx.cursors, itemModBucket.Cursor())
 	}
 
-	// Create our item sets
-	prealloc := LookupItemsMultiModStrideLength * 3 * len(q.mods)
-	set := make(map[ID]int, prealloc)
-
-	// And where we store our final result, preallocated but zero length
-	result := make([]ID, 0, q.maxDesired)
+	// Keep track of how many cursors are valid,
+	// this will let us know when we've exhausted our data
+	ctx.validCursors = len(ctx.cursors)
 
-	q.ctx = &indexQueryContext{
-		tx, validCursors, cursors, set, result,
+	// Create our item sets, reusing those left by a previous query
+	for len(ctx.seen) < len(q.mods) {
+		if len(ctx.seen) < cap(ctx.seen) {
+			ctx.seen = ctx.seen[:len(ctx.seen)+1]
+			continue
+		}
+		ctx.seen = append(ctx.seen, &idBitmap{})
 	}
 
+	q.ctx = ctx
+
 	return nil
 }
 
 // clearContext removes transaction dependent context from IndexQuery
+// and returns it to the pool
 func (q *IndexQuery) clearContext() {
+	if q.ctx == nil {
+		return
+	}
+	indexQueryPool.Give(q.ctx)
 	q.ctx = nil
 }
 
 // registerID registers an ID as having matched a mod.
-//
-// When an ID has matched all mods, it is removed and added to the result
-func (q *IndexQuery) registerID(id ID) {
-	shared, ok := q.ctx.set[id]
-	if !ok {
-		shared = 0
+func (q *IndexQuery) registerID(id ID, modIndex int) {
+	seq := idToSeq(id)
+	if q.ctx.seen[modIndex].add(seq) {
+		q.ctx.fresh.add(seq)
 	}
-	shared++
-	q.ctx.set[id] = shared
-	if shared >= len(q.mods) {
-		q.ctx.result = append(q.ctx.result, id)
-		delete(q.ctx.set, id)
+}
+
+// intersect adds every ID which has now matched all mods to the result
+//
+// Only IDs found during the latest stride can have newly matched all mods,
+// so we AND those against what each cursor has seen.
+func (q *IndexQuery) intersect() {
+	matched := q.ctx.fresh
+	for _, seen := range q.ctx.seen {
+		matched = matched.and(seen)
 	}
+	matched.forEach(func(seq uint64) {
+		q.ctx.result = append(q.ctx.result, IDFromSequence(seq))
+	})
+
+	q.ctx.fresh.Reset()
 }
 
 // checkPair determines if a pair is acceptable for our query
@@ -153,7 +193,9 @@ func (q *IndexQuery) checkPair(k, v []byte, modIndex int) (int, error) {
 	var idCount int
 	if valid {
 		wrapped := IndexEntry(v)
-		wrapped.ForEachID(q.registerID)
+		wrapped.ForEachID(func(id ID) {
+			q.registerID(id, modIndex)
+		})
 	} else {
 		// Remove from cursors we're interested in
 		q.ctx.removeCursor(modIndex)
@@ -212,6 +254,7 @@ func (q *IndexQuery) Run(db *bolt.DB) ([]ID, error) {
 	// Always clear the context when we exit
 	defer q.clearContext()
 
+	var result []ID
 	err := db.View(func(tx *bolt.Tx) error {
 
 		err := q.initContext(tx)
@@ -232,6 +275,7 @@ func (q *IndexQuery) Run(db *bolt.DB) ([]ID, error) {
 				return errors.Wrap(err, "failed to check value in bucekt")
 			}
 		}
+		q.intersect()
 
 		// Perform our strides to search
 		var foundIDs int
@@ -241,13 +285,18 @@ func (q *IndexQuery) Run(db *bolt.DB) ([]ID, error) {
 			if err != nil {
 				return errors.Wrap(err, "failed a stride")
 			}
+			q.intersect()
 
 			// foundIDs = q.intersectIDSets(nil)
 			foundIDs = len(q.ctx.result)
 		}
 
+		// The context's result is reused once we return
+		result = make([]ID, len(q.ctx.result))
+		copy(result, q.ctx.result)
+
 		return nil
 	})
 
-	return q.ctx.result, err
+	return result, err
 }
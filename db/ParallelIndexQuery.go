@@ -0,0 +1,302 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// DefaultParallelQueryWorkers is a sane limit on the number of goroutines
+// a ParallelIndexQuery will scan cursors with.
+const DefaultParallelQueryWorkers = 4
+
+// ParallelIndexQuery represents an IndexQuery running over the indices
+// of several leagues at once.
+//
+// Each mod's cursor in each league is scanned on its own goroutine
+// while results are intersected per-league. Scanning proceeds in rounds
+// of a single stride per cursor with the intersection happening in mod
+// order after each round; this keeps the output deterministic regardless
+// of how the goroutines are scheduled.
+type ParallelIndexQuery struct {
+	// Type and flavor of the item we're looking up
+	rootType, rootFlavor StringHeapID
+	// Mods we are looking for
+	mods []StringHeapID
+	// Minimum mod values we are required to find
+	//
+	// Positionally related to mods
+	minModValues []uint16
+	// Leagues we are searching in
+	leagues []LeagueHeapID
+	// How many items we are limited to finding per league
+	maxDesired int
+	// Maximum number of goroutines used for the query
+	workers int
+}
+
+// LeagueQueryResult holds the IDs found in a single league
+type LeagueQueryResult struct {
+	League LeagueHeapID
+	IDs    []ID
+}
+
+// NewParallelIndexQuery returns a ParallelIndexQuery
+//
+// If workers is less than 1, DefaultParallelQueryWorkers is used.
+func NewParallelIndexQuery(rootType, rootFlavor StringHeapID,
+	mods []StringHeapID, minModValues []uint16,
+	leagues []LeagueHeapID,
+	maxDesired, workers int) ParallelIndexQuery {
+
+	minModValuesScaled := make([]uint16, len(minModValues))
+	for i, minValue := range minModValues {
+		minModValuesScaled[i] = minValue * ItemModAverageScaleFactor
+	}
+
+	if workers < 1 {
+		workers = DefaultParallelQueryWorkers
+	}
+
+	return ParallelIndexQuery{
+		rootType, rootFlavor,
+		mods, minModValuesScaled,
+		leagues, maxDesired, workers,
+	}
+}
+
+// leagueSetsPool holds the sets leagues are intersected with
+var leagueSetsPool = NewPool(10, func() Resettable {
+	return newIDCountSet(LookupItemsMultiModStrideLength * 3)
+})
+
+// modScanner walks a single mod index cursor from its highest values
+// down, collecting IDs a stride at a time.
+//
+// Every modScanner of a query shares a single read transaction so they
+// all see the same snapshot. Cursors are created serially as creating
+// one updates the transaction's stats, while moving a cursor of a
+// read-only transaction only reads the mmap and is safe to do
+// concurrently.
+type modScanner struct {
+	cursor   *bolt.Cursor
+	minValue uint16
+	started  bool
+	done     bool
+	// IDs found in the most recent stride
+	batch []ID
+	err   error
+}
+
+// checkPair adds the IDs of a pair to the batch if it satisfies the
+// minimum value. Returns the number of IDs added, zero implies the
+// scanner is finished.
+func (s *modScanner) checkPair(k, v []byte) (int, error) {
+	values, err := decodeModIndexKey(k)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to decode mod index key")
+	}
+	if len(values) == 0 {
+		return 0,
+			errors.Errorf("decoded item mod index key to no values, key=%v", k)
+	}
+
+	if values[0] < s.minValue {
+		s.done = true
+		return 0, nil
+	}
+
+	before := len(s.batch)
+	IndexEntry(v).ForEachID(func(id ID) {
+		s.batch = append(s.batch, id)
+	})
+	return len(s.batch) - before, nil
+}
+
+// stride performs a single stride, replacing the previous batch
+func (s *modScanner) stride() {
+	s.batch = s.batch[:0]
+
+	for len(s.batch) < LookupItemsMultiModStrideLength && !s.done {
+		var k, v []byte
+		if !s.started {
+			k, v = s.cursor.Last()
+			s.started = true
+		} else {
+			k, v = s.cursor.Prev()
+		}
+
+		// Ignore nested buckets but also
+		// handle reaching the start of the bucket
+		if k == nil {
+			s.done = true
+			break
+		}
+		if v == nil {
+			continue
+		}
+
+		if _, err := s.checkPair(k, v); err != nil {
+			s.err = errors.Wrap(err, "failed to check value pair")
+			s.done = true
+		}
+	}
+}
+
+// leagueQueryState holds the per-league intersection of a ParallelIndexQuery
+type leagueQueryState struct {
+	scanners []*modScanner
+	set      *idCountSet
+	result   []ID
+	done     bool
+}
+
+// intersect registers the IDs found in the last round, in mod order
+func (state *leagueQueryState) intersect(required, maxDesired int) {
+	for _, s := range state.scanners {
+		for _, id := range s.batch {
+			// IDs keep their count once matched, so only
+			// register them on the first match.
+			if state.set.Increment(id) == required {
+				state.result = append(state.result, id)
+			}
+		}
+	}
+
+	if len(state.result) >= maxDesired {
+		// A stride can overshoot, trim to what was asked for
+		state.result = state.result[:maxDesired]
+		state.done = true
+		return
+	}
+	for _, s := range state.scanners {
+		if !s.done {
+			return
+		}
+	}
+	// Every cursor is exhausted, nothing more can match
+	state.done = true
+}
+
+// initLeague prepares scanners for every mod in a league
+//
+// Missing mod buckets imply the league cannot satisfy the query,
+// so the league is marked done rather than returning an error.
+func (q *ParallelIndexQuery) initLeague(league LeagueHeapID,
+	tx *bolt.Tx) *leagueQueryState {
+
+	state := &leagueQueryState{
+		scanners: make([]*modScanner, 0, len(q.mods)),
+		set:      leagueSetsPool.Borrow().(*idCountSet),
+		result:   make([]ID, 0, q.maxDesired),
+	}
+
+	for i, mod := range q.mods {
+		s := &modScanner{
+			minValue: q.minModValues[i],
+			batch:    make([]ID, 0, LookupItemsMultiModStrideLength*2),
+		}
+		state.scanners = append(state.scanners, s)
+
+		itemModBucket, err := getItemModIndexBucketRO(q.rootType, q.rootFlavor,
+			mod, league, tx)
+		if err != nil {
+			state.done = true
+			continue
+		}
+		s.cursor = itemModBucket.Cursor()
+	}
+
+	return state
+}
+
+// Run performs the query across every league, returning results
+// in the same order as the leagues were provided.
+func (q *ParallelIndexQuery) Run(db *bolt.DB) ([]LeagueQueryResult, error) {
+
+	// A single snapshot is shared by every league so results never mix
+	// the state of the index at different times
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin read transaction")
+	}
+	defer tx.Rollback()
+
+	states := make([]*leagueQueryState, len(q.leagues))
+	defer func() {
+		for _, state := range states {
+			leagueSetsPool.Give(state.set)
+		}
+	}()
+
+	for i, league := range q.leagues {
+		states[i] = q.initLeague(league, tx)
+	}
+
+	// Start our bounded set of workers
+	jobs := make(chan func())
+	defer close(jobs)
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for {
+		// Stride every cursor of every unfinished league
+		active := 0
+		for _, state := range states {
+			if state.done {
+				continue
+			}
+			active++
+			for _, s := range state.scanners {
+				if s.done {
+					// Ensure stale batches are not intersected again
+					s.batch = s.batch[:0]
+					continue
+				}
+				s := s
+				wg.Add(1)
+				jobs <- func() {
+					s.stride()
+					wg.Done()
+				}
+			}
+		}
+		if active == 0 {
+			break
+		}
+		wg.Wait()
+
+		// Intersect each league independently
+		for _, state := range states {
+			if state.done {
+				continue
+			}
+			for _, s := range state.scanners {
+				if s.err != nil {
+					return nil, s.err
+				}
+			}
+			state := state
+			wg.Add(1)
+			jobs <- func() {
+				state.intersect(len(q.mods), q.maxDesired)
+				wg.Done()
+			}
+		}
+		wg.Wait()
+	}
+
+	results := make([]LeagueQueryResult, len(q.leagues))
+	for i, state := range states {
+		results[i] = LeagueQueryResult{q.leagues[i], state.result}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,366 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// snappyStreamHeader is the stream identifier every snappy framed
+// stream begins with, used to recognise compressed backups.
+const snappyStreamHeader = "\xff\x06\x00\x00sNaPpY"
+
+// backupSuffix is appended to the path of a backup while it is written
+const backupSuffix = ".partial"
+
+// restoreSuffix is appended to the path of the database for the
+// candidate copy of a backup being restored
+const restoreSuffix = ".restore"
+
+// BackupReport represents a backup taken by Backup
+type BackupReport struct {
+	Path       string
+	Compressed bool
+	// Size of the database copied
+	Size int64
+	// Size of the backup written, smaller than Size when Compressed
+	Written int64
+	Took    time.Duration
+}
+
+func (r BackupReport) String() string {
+	compressed := ""
+	if r.Compressed {
+		compressed = " with snappy"
+	}
+	return fmt.Sprintf("backed up %d bytes to %s%s in %s\n  wrote %d bytes",
+		r.Size, r.Path, compressed, r.Took, r.Written)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Backup writes a consistent copy of the database to path, compressing
+// it with snappy when compress is set.
+//
+// The copy is taken from a single read transaction so writers are never
+// blocked and it is safe to back up a database which is being used. The
+// backup is written beside path and only moved into place once complete,
+// so path is either the previous file or a whole backup.
+func Backup(path string, compress bool, db *bolt.DB) (*BackupReport, error) {
+	report := &BackupReport{Path: path, Compressed: compress}
+	start := time.Now()
+
+	tmpPath := path + backupSuffix
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create backup")
+	}
+	counted := &countingWriter{w: f}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		report.Size = tx.Size()
+		if !compress {
+			_, err := tx.WriteTo(counted)
+			return err
+		}
+		compressed := snappy.NewBufferedWriter(counted)
+		if _, err := tx.WriteTo(compressed); err != nil {
+			return err
+		}
+		return compressed.Close()
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, errors.Wrap(err, "failed to write backup")
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return nil, errors.Wrap(err, "failed to move backup into place")
+	}
+
+	report.Written = counted.n
+	report.Took = time.Since(start)
+	return report, nil
+}
+
+// RestoreReport represents the work done by Restore
+type RestoreReport struct {
+	// Backup restored from and the database replaced
+	From, Path string
+	Compressed bool
+	// Migration applied to a backup with an older schema, nil if
+	// the backup was current
+	Migrated *MigrationReport
+	// Consistency check the backup passed
+	Fsck *FsckReport
+}
+
+func (r RestoreReport) String() string {
+	if r.Fsck == nil {
+		return fmt.Sprintf("did not restore %s from backup %s", r.Path, r.From)
+	}
+
+	var buf bytes.Buffer
+	compressed := ""
+	if r.Compressed {
+		compressed = " snappy"
+	}
+	fmt.Fprintf(&buf, "restored %s from%s backup %s", r.Path, compressed, r.From)
+	if r.Migrated != nil {
+		fmt.Fprintf(&buf, "\n%s", r.Migrated)
+	}
+	fmt.Fprintf(&buf, "\nchecked backup, %s", r.Fsck)
+	return buf.String()
+}
+
+// copyBackup writes the database held in a backup to path, decompressing
+// it if necessary.
+//
+// Returns whether the backup was compressed.
+func copyBackup(from, path string) (bool, error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open backup")
+	}
+	defer src.Close()
+
+	r := bufio.NewReader(src)
+	header, _ := r.Peek(len(snappyStreamHeader))
+	compressed := string(header) == snappyStreamHeader
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return compressed, errors.Wrap(err, "failed to create restored database")
+	}
+	var decoded io.Reader = r
+	if compressed {
+		decoded = snappy.NewReader(r)
+	}
+	if _, err = io.Copy(dst, decoded); err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return compressed, errors.Wrap(err, "failed to copy backup")
+	}
+	return compressed, nil
+}
+
+// checkBackup opens a copy of a backup and ensures it is fit to replace
+// the database, upgrading it when its schema is older.
+func checkBackup(path string, report *RestoreReport) error {
+	candidate, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return errors.Wrap(err, "failed to open backup as boltdb")
+	}
+	defer candidate.Close()
+
+	// Page level consistency comes first, nothing else can be
+	// trusted without it
+	err = candidate.View(func(tx *bolt.Tx) error {
+		var first error
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+	if err != nil {
+		return errors.Wrap(err, "backup is corrupt")
+	}
+
+	if err := setupBuckets(candidate); err != nil {
+		return errors.Wrap(err, "failed to setup buckets")
+	}
+	version, err := checkSchemaVersion(true, candidate)
+	if err != nil {
+		return err
+	}
+	if version < CurrentSchemaVersion {
+		if report.Migrated, err = Migrate(nil, candidate); err != nil {
+			return errors.Wrap(err, "failed to migrate backup")
+		}
+	}
+
+	if report.Fsck, err = Fsck(false, candidate); err != nil {
+		return err
+	}
+	if report.Fsck.Total() > 0 {
+		return errors.Errorf("backup is inconsistent, found %d problems",
+			report.Fsck.Total())
+	}
+	return nil
+}
+
+// Restore replaces the database at path, DBLocation when empty, with the
+// backup at from, as written by Backup.
+//
+// The backup is copied beside the database and checked with Fsck before
+// anything is replaced, so a damaged or inconsistent backup is refused
+// and leaves the database untouched; the report returned alongside the
+// error holds what the check found. A backup with an older schema is
+// migrated first.
+//
+// The database is never opened, so one too damaged or outdated to Boot
+// can be restored over. It must not be open while this runs.
+func Restore(from, path string) (*RestoreReport, error) {
+	if path == "" {
+		path = DBLocation
+	}
+	report := &RestoreReport{From: from, Path: path}
+
+	tmpPath := path + restoreSuffix
+	var err error
+	if report.Compressed, err = copyBackup(from, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := checkBackup(tmpPath, report); err != nil {
+		os.Remove(tmpPath)
+		return report, errors.Wrapf(err, "refusing to restore %s", from)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, errors.Wrap(err, "failed to replace database")
+	}
+
+	return report, nil
+}
+
+// SnapshotSchedule determines when snapshots are taken by RunSnapshots
+// and how many are kept.
+type SnapshotSchedule struct {
+	// Directory snapshots are written to
+	Dir string
+	// Snapshots are named to the second, so one taken within the same
+	// second as the last replaces it
+	Interval time.Duration
+	// Number of most recent snapshots kept, all are kept when less than 1
+	Keep     int
+	Compress bool
+}
+
+// snapshotPrefix begins the name of every snapshot, which is followed
+// by when it was taken so snapshots sort chronologically by name
+const snapshotPrefix = "snapshot-"
+
+// snapshotTimeFormat is when a snapshot was taken in its name
+const snapshotTimeFormat = "20060102T150405Z"
+
+// snapshotName returns the file name of a snapshot taken at when
+func (s SnapshotSchedule) snapshotName(when time.Time) string {
+	name := snapshotPrefix + when.UTC().Format(snapshotTimeFormat) + ".db"
+	if s.Compress {
+		name += ".snappy"
+	}
+	return name
+}
+
+// Snapshots returns the paths of the snapshots in a directory,
+// oldest first.
+func Snapshots(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshots")
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) ||
+			strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Snapshot takes a single snapshot as of now under the schedule then
+// removes any beyond the number kept.
+func (s SnapshotSchedule) Snapshot(now time.Time,
+	db *bolt.DB) (*BackupReport, error) {
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create snapshot directory")
+	}
+	report, err := Backup(filepath.Join(s.Dir, s.snapshotName(now)),
+		s.Compress, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Keep < 1 {
+		return report, nil
+	}
+	paths, err := Snapshots(s.Dir)
+	if err != nil {
+		return report, err
+	}
+	for len(paths) > s.Keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return report, errors.Wrap(err, "failed to remove old snapshot")
+		}
+		paths = paths[1:]
+	}
+	return report, nil
+}
+
+// RunSnapshots takes a snapshot every Interval until stop is closed,
+// calling done with the outcome of each.
+//
+// This is meant to run alongside ingestion in the process which owns db,
+// as nothing else can open it, which Ingest does given
+// IngestOptions.Snapshots. A failed snapshot does not stop later ones.
+func RunSnapshots(schedule SnapshotSchedule, stop <-chan struct{},
+	done func(*BackupReport, error), db *bolt.DB) error {
+
+	if schedule.Interval <= 0 {
+		return errors.New("snapshot Interval must be positive")
+	}
+
+	ticker := time.NewTicker(schedule.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case now := <-ticker.C:
+			report, err := schedule.Snapshot(now, db)
+			if done != nil {
+				done(report, err)
+			}
+		}
+	}
+}
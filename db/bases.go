@@ -0,0 +1,371 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// basesBucket holds every version of the bases items have been
+// classified by, keyed by version
+const basesBucket = "bases"
+
+// basesVersionKey holds the version of the bases items are currently
+// classified by in the settings bucket
+const basesVersionKey = "basesVersion"
+
+// unknownTypelinesBucket holds every typeLine which failed to classify
+// as a known base, keyed by typeLine
+const unknownTypelinesBucket = "unknownTypelines"
+
+// storedBases is a single version of the bases as stored
+type storedBases struct {
+	Hash   string          `json:"hash"`
+	Loaded time.Time       `json:"loaded"`
+	Source string          `json:"source"`
+	Len    int             `json:"len"`
+	Bases  json.RawMessage `json:"bases"`
+}
+
+// BasesVersion describes a single version of the bases
+type BasesVersion struct {
+	Version uint32
+	// Hash of the bases, see stash.BaseSet.Hash
+	Hash   string
+	Loaded time.Time
+	// Where the bases were loaded from
+	Source string
+	// Number of bases
+	Len int
+	// Whether items are currently classified by this version
+	Current bool
+}
+
+// getBasesVersion returns the version of the bases items are currently
+// classified by, zero if none are stored
+func getBasesVersion(tx *bolt.Tx) (uint32, error) {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return 0, errors.Errorf("%s bucket not found", settingsBucket)
+	}
+
+	value := b.Get([]byte(basesVersionKey))
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != 4 {
+		return 0, errors.Errorf("malformed %s setting, value=%v",
+			basesVersionKey, value)
+	}
+	return btoi32(value), nil
+}
+
+// putBasesVersion sets the version of the bases items are classified by
+func putBasesVersion(version uint32, tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return errors.Errorf("%s bucket not found", settingsBucket)
+	}
+	return b.Put([]byte(basesVersionKey), i32tob(version))
+}
+
+// getStoredBases returns the stored version of the bases
+func getStoredBases(version uint32, tx *bolt.Tx) (*storedBases, error) {
+	b := tx.Bucket([]byte(basesBucket))
+	if b == nil {
+		return nil, errors.Errorf("%s bucket not found", basesBucket)
+	}
+
+	value := b.Get(i32tob(version))
+	if value == nil {
+		return nil, errors.Errorf("bases version %d not found", version)
+	}
+	var stored storedBases
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return nil, errors.Wrapf(err, "malformed bases version %d", version)
+	}
+	return &stored, nil
+}
+
+// putBases stores the bases as a new version, or finds the version
+// already holding them, and classifies items by it from then on.
+func putBases(set *stash.BaseSet, source string, tx *bolt.Tx) (uint32, error) {
+	b := tx.Bucket([]byte(basesBucket))
+	if b == nil {
+		return 0, errors.Errorf("%s bucket not found", basesBucket)
+	}
+
+	// Versions are few, so looking through them all is cheap
+	var version uint32
+	err := b.ForEach(func(k, v []byte) error {
+		var stored storedBases
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return errors.Wrapf(err, "malformed bases version %d", btoi32(k))
+		}
+		if stored.Hash == set.Hash() {
+			version = btoi32(k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if version == 0 {
+		raw, err := set.MarshalJSON()
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to encode bases")
+		}
+		value, err := json.Marshal(storedBases{
+			Hash:   set.Hash(),
+			Loaded: time.Now(),
+			Source: source,
+			Len:    set.Len(),
+			Bases:  raw,
+		})
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to encode bases")
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to get next bases version")
+		}
+		version = uint32(seq)
+		if err := b.Put(i32tob(version), value); err != nil {
+			return 0, err
+		}
+	}
+
+	return version, putBasesVersion(version, tx)
+}
+
+// ensureBases stores the bases bundled with the stash package as the
+// first version when the database has none
+func ensureBases(tx *bolt.Tx) error {
+	version, err := getBasesVersion(tx)
+	if err != nil || version != 0 {
+		return err
+	}
+	_, err = putBases(stash.DefaultBases(), "bundled", tx)
+	return err
+}
+
+// migrateBases stores the bundled bases as the first version, which
+// are those every item already stored was classified by
+func migrateBases(tx *bolt.Tx) (bool, error) {
+	return true, ensureBases(tx)
+}
+
+// useStoredBases classifies items by the current version of the bases
+// stored in the database, storing the bundled bases if it has none.
+//
+// The bases are set for the whole process, see stash.SetBases.
+func useStoredBases(db *bolt.DB) error {
+	var stored *storedBases
+	err := db.Update(func(tx *bolt.Tx) error {
+		if err := ensureBases(tx); err != nil {
+			return err
+		}
+		version, err := getBasesVersion(tx)
+		if err != nil {
+			return err
+		}
+		stored, err = getStoredBases(version, tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if stash.CurrentBases().Hash() == stored.Hash {
+		return nil
+	}
+	set, err := stash.ParseBases(stored.Bases)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse stored bases")
+	}
+	stash.SetBases(set)
+	return nil
+}
+
+// StoreBases stores the bases as a new version and classifies items by
+// them from then on, returning the version.
+//
+// Items already stored keep the classification they were stored with.
+// Storing bases equal to an earlier version returns to that version.
+func StoreBases(set *stash.BaseSet, source string,
+	db *bolt.DB) (uint32, error) {
+
+	var version uint32
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		version, err = putBases(set, source, tx)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to store bases")
+	}
+	stash.SetBases(set)
+	return version, nil
+}
+
+// UseBases classifies items by a stored version of the bases from
+// then on
+func UseBases(version uint32, db *bolt.DB) error {
+	var stored *storedBases
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if stored, err = getStoredBases(version, tx); err != nil {
+			return err
+		}
+		return putBasesVersion(version, tx)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to use bases")
+	}
+
+	set, err := stash.ParseBases(stored.Bases)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse stored bases")
+	}
+	stash.SetBases(set)
+	return nil
+}
+
+// GetBases returns the stored version of the bases
+func GetBases(version uint32, db *bolt.DB) (*stash.BaseSet, error) {
+	var stored *storedBases
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = getStoredBases(version, tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stash.ParseBases(stored.Bases)
+}
+
+// ListBases returns every stored version of the bases, oldest first
+func ListBases(db *bolt.DB) ([]BasesVersion, error) {
+	var versions []BasesVersion
+	err := db.View(func(tx *bolt.Tx) error {
+		current, err := getBasesVersion(tx)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(basesBucket))
+		if b == nil {
+			return errors.Errorf("%s bucket not found", basesBucket)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var stored storedBases
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return errors.Wrapf(err, "malformed bases version %d", btoi32(k))
+			}
+			versions = append(versions, BasesVersion{
+				Version: btoi32(k),
+				Hash:    stored.Hash,
+				Loaded:  stored.Loaded,
+				Source:  stored.Source,
+				Len:     stored.Len,
+				Current: btoi32(k) == current,
+			})
+			return nil
+		})
+	})
+	return versions, err
+}
+
+// unknownTypelineSize is the size of a value of unknownTypelinesBucket,
+// laid out as [count, bases version, last seen]
+const unknownTypelineSize = 4 + 4 + TimestampSize
+
+// UnknownTypeline is a typeLine which failed to classify as a known base
+type UnknownTypeline struct {
+	TypeLine string
+	// Number of items seen with the typeLine
+	Count uint32
+	// Version of the bases the typeLine was last seen with
+	Version  uint32
+	LastSeen time.Time
+}
+
+// recordUnknownTypelines notes the typeLine of every item classified
+// under stash.UnknownRoot, seen at when. TypeLines are noted by
+// stash.TypeLineBase so markup, quality and magic suffixes don't split
+// a base across many typeLines.
+func recordUnknownTypelines(items []stash.Item, when Timestamp,
+	tx *bolt.Tx) error {
+
+	var b *bolt.Bucket
+	var version uint32
+	for _, item := range items {
+		if item.RootType != stash.UnknownRoot {
+			continue
+		}
+		typeLine := stash.TypeLineBase(item.TypeLine)
+		if typeLine == "" {
+			continue
+		}
+		if b == nil {
+			if b = tx.Bucket([]byte(unknownTypelinesBucket)); b == nil {
+				return errors.Errorf("%s bucket not found", unknownTypelinesBucket)
+			}
+			var err error
+			if version, err = getBasesVersion(tx); err != nil {
+				return err
+			}
+		}
+
+		var count uint32
+		if value := b.Get([]byte(typeLine)); len(value) == unknownTypelineSize {
+			count = btoi32(value[:4])
+		}
+		value := make([]byte, 0, unknownTypelineSize)
+		value = append(value, i32tob(count+1)...)
+		value = append(value, i32tob(version)...)
+		value = append(value, when[:]...)
+		if err := b.Put([]byte(typeLine), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListUnknownTypelines returns every typeLine which failed to classify
+// as a known base, most often seen first
+func ListUnknownTypelines(db *bolt.DB) ([]UnknownTypeline, error) {
+	var unknown []UnknownTypeline
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(unknownTypelinesBucket))
+		if b == nil {
+			return errors.Errorf("%s bucket not found", unknownTypelinesBucket)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(v) != unknownTypelineSize {
+				return errors.Errorf("malformed unknown typeLine %s, value=%v", k, v)
+			}
+			var when Timestamp
+			copy(when[:], v[8:])
+			unknown = append(unknown, UnknownTypeline{
+				TypeLine: string(k),
+				Count:    btoi32(v[:4]),
+				Version:  btoi32(v[4:8]),
+				LastSeen: when.ToTime(),
+			})
+			return nil
+		})
+	})
+
+	sort.SliceStable(unknown, func(i, j int) bool {
+		return unknown[i].Count > unknown[j].Count
+	})
+	return unknown, err
+}
@@ -0,0 +1,383 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// bitmapContainerBits is the number of low bits of a sequence
+// addressed within a single container
+const bitmapContainerBits = 16
+
+// bitmapArrayMaxSize is the largest cardinality a container holds as a
+// sorted array before becoming a bitset. Past this point an array
+// would be larger than the bitset.
+const bitmapArrayMaxSize = 4096
+
+// bitmapBitsetWords is the number of words in a bitset container
+const bitmapBitsetWords = (1 << bitmapContainerBits) / 64
+
+// bitmapContainer holds the low bits of every sequence sharing
+// the same high bits.
+//
+// A container is either a sorted array or, when bitset is non-nil,
+// a bitset; whichever is smaller.
+type bitmapContainer struct {
+	key         uint64
+	cardinality int
+	array       []uint16
+	bitset      []uint64
+}
+
+// contains determines if the low bits are present in the container
+func (c *bitmapContainer) contains(low uint16) bool {
+	if c.bitset != nil {
+		return c.bitset[low/64]&(1<<(low%64)) != 0
+	}
+	i := sort.Search(len(c.array), func(i int) bool {
+		return c.array[i] >= low
+	})
+	return i < len(c.array) && c.array[i] == low
+}
+
+// add inserts the low bits into the container, returning
+// false if they were already present.
+func (c *bitmapContainer) add(low uint16) bool {
+	if c.bitset != nil {
+		word, bit := low/64, uint64(1)<<(low%64)
+		if c.bitset[word]&bit != 0 {
+			return false
+		}
+		c.bitset[word] |= bit
+		c.cardinality++
+		return true
+	}
+
+	i := sort.Search(len(c.array), func(i int) bool {
+		return c.array[i] >= low
+	})
+	if i < len(c.array) && c.array[i] == low {
+		return false
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = low
+	c.cardinality++
+
+	if c.cardinality > bitmapArrayMaxSize {
+		c.toBitset()
+	}
+	return true
+}
+
+// toBitset converts an array container into a bitset container
+func (c *bitmapContainer) toBitset() {
+	c.bitset = make([]uint64, bitmapBitsetWords)
+	for _, low := range c.array {
+		c.bitset[low/64] |= 1 << (low % 64)
+	}
+	c.array = nil
+}
+
+// forEach calls cb with every low value in ascending order
+func (c *bitmapContainer) forEach(cb func(low uint16)) {
+	if c.bitset == nil {
+		for _, low := range c.array {
+			cb(low)
+		}
+		return
+	}
+	for i, word := range c.bitset {
+		for word != 0 {
+			offset := bits.TrailingZeros64(word)
+			cb(uint16(i*64 + offset))
+			word &= word - 1
+		}
+	}
+}
+
+// and returns the intersection of two containers sharing a key
+func (c *bitmapContainer) and(other *bitmapContainer) bitmapContainer {
+	result := bitmapContainer{key: c.key}
+
+	switch {
+	case c.bitset != nil && other.bitset != nil:
+		bitset := make([]uint64, bitmapBitsetWords)
+		for i := range bitset {
+			bitset[i] = c.bitset[i] & other.bitset[i]
+			result.cardinality += bits.OnesCount64(bitset[i])
+		}
+		if result.cardinality > bitmapArrayMaxSize {
+			result.bitset = bitset
+			return result
+		}
+		result.array = make([]uint16, 0, result.cardinality)
+		result.bitset = bitset
+		result.forEach(func(low uint16) {
+			result.array = append(result.array, low)
+		})
+		result.bitset = nil
+	case c.bitset != nil || other.bitset != nil:
+		// Probe the bitset with each value of the array
+		array, bitset := c, other
+		if c.bitset != nil {
+			array, bitset = other, c
+		}
+		for _, low := range array.array {
+			if bitset.contains(low) {
+				result.array = append(result.array, low)
+			}
+		}
+		result.cardinality = len(result.array)
+	default:
+		// Both arrays are sorted, walk them together
+		var i, j int
+		for i < len(c.array) && j < len(other.array) {
+			switch {
+			case c.array[i] < other.array[j]:
+				i++
+			case c.array[i] > other.array[j]:
+				j++
+			default:
+				result.array = append(result.array, c.array[i])
+				i++
+				j++
+			}
+		}
+		result.cardinality = len(result.array)
+	}
+
+	return result
+}
+
+// idBitmap is a roaring style compressed bitmap of ID sequences
+//
+// Sequences are split by their high bits into containers, each of which
+// holds the low bits as a sorted array when sparse or a bitset when dense.
+// As IDs are assigned from a monotonic sequence, those sharing an entry
+// tend to share a handful of containers.
+type idBitmap struct {
+	// Sorted by key
+	containers []bitmapContainer
+}
+
+// container returns the position of the container for key alongside
+// whether it exists.
+func (b *idBitmap) container(key uint64) (int, bool) {
+	i := sort.Search(len(b.containers), func(i int) bool {
+		return b.containers[i].key >= key
+	})
+	return i, i < len(b.containers) && b.containers[i].key == key
+}
+
+// add inserts the sequence into the bitmap, returning false
+// if it was already present.
+func (b *idBitmap) add(seq uint64) bool {
+	key, low := seq>>bitmapContainerBits, uint16(seq)
+	i, ok := b.container(key)
+	if !ok {
+		// Reuse an array left behind by a Reset when possible
+		var spare []uint16
+		if len(b.containers) < cap(b.containers) {
+			spare = b.containers[:len(b.containers)+1][len(b.containers)].array
+		}
+		b.containers = append(b.containers, bitmapContainer{})
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = bitmapContainer{key: key, array: spare[:0]}
+	}
+	return b.containers[i].add(low)
+}
+
+// Reset empties the bitmap while retaining its containers' arrays
+func (b *idBitmap) Reset() {
+	b.containers = b.containers[:0]
+}
+
+// contains determines if the sequence is present in the bitmap
+func (b *idBitmap) contains(seq uint64) bool {
+	i, ok := b.container(seq >> bitmapContainerBits)
+	return ok && b.containers[i].contains(uint16(seq))
+}
+
+// cardinality returns the number of sequences in the bitmap
+func (b *idBitmap) cardinality() int {
+	var count int
+	for i := range b.containers {
+		count += b.containers[i].cardinality
+	}
+	return count
+}
+
+// forEach calls cb with every sequence in ascending order
+func (b *idBitmap) forEach(cb func(seq uint64)) {
+	for i := range b.containers {
+		high := b.containers[i].key << bitmapContainerBits
+		b.containers[i].forEach(func(low uint16) {
+			cb(high | uint64(low))
+		})
+	}
+}
+
+// and returns the intersection of two bitmaps
+func (b *idBitmap) and(other *idBitmap) *idBitmap {
+	result := &idBitmap{}
+	var i, j int
+	for i < len(b.containers) && j < len(other.containers) {
+		left, right := &b.containers[i], &other.containers[j]
+		switch {
+		case left.key < right.key:
+			i++
+		case left.key > right.key:
+			j++
+		default:
+			intersection := left.and(right)
+			if intersection.cardinality > 0 {
+				result.containers = append(result.containers, intersection)
+			}
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// bitmapFromSorted builds a bitmap from sorted, unique sequences
+func bitmapFromSorted(seqs []uint64) *idBitmap {
+	b := &idBitmap{}
+	for len(seqs) > 0 {
+		key := seqs[0] >> bitmapContainerBits
+		end := sort.Search(len(seqs), func(i int) bool {
+			return seqs[i]>>bitmapContainerBits > key
+		})
+
+		c := bitmapContainer{key: key, cardinality: end}
+		c.array = make([]uint16, end)
+		for i, seq := range seqs[:end] {
+			c.array[i] = uint16(seq)
+		}
+		if c.cardinality > bitmapArrayMaxSize {
+			c.toBitset()
+		}
+		b.containers = append(b.containers, c)
+
+		seqs = seqs[end:]
+	}
+	return b
+}
+
+// encodeBitmapEntry encodes a bitmap into an IndexEntry
+//
+// The layout is the entry header followed by each container:
+//
+//	[flags][count uvarint][containers uvarint]
+//	([key uvarint][cardinality uvarint][payload])...
+//
+// The payload is cardinality big endian uint16s for an array container
+// or bitmapBitsetWords big endian uint64s for a bitset container; the
+// cardinality determines which.
+//
+// Returns nil if the bitmap is empty.
+func encodeBitmapEntry(b *idBitmap) IndexEntry {
+	count := b.cardinality()
+	if count == 0 {
+		return nil
+	}
+
+	size := 1 + binary.MaxVarintLen64*2
+	for i := range b.containers {
+		size += binary.MaxVarintLen64 * 2
+		if b.containers[i].bitset != nil {
+			size += bitmapBitsetWords * 8
+		} else {
+			size += len(b.containers[i].array) * 2
+		}
+	}
+
+	entry := make([]byte, size)
+	entry[0] = indexEntryHeaderFlag | byte(IndexEncodingRoaring)
+	offset := 1
+	offset += binary.PutUvarint(entry[offset:], uint64(count))
+	offset += binary.PutUvarint(entry[offset:], uint64(len(b.containers)))
+	for i := range b.containers {
+		c := &b.containers[i]
+		offset += binary.PutUvarint(entry[offset:], c.key)
+		offset += binary.PutUvarint(entry[offset:], uint64(c.cardinality))
+		if c.bitset != nil {
+			for _, word := range c.bitset {
+				binary.BigEndian.PutUint64(entry[offset:], word)
+				offset += 8
+			}
+			continue
+		}
+		for _, low := range c.array {
+			binary.BigEndian.PutUint16(entry[offset:], low)
+			offset += 2
+		}
+	}
+
+	return IndexEntry(entry[:offset])
+}
+
+// decodeBitmapEntry decodes an IndexEncodingRoaring IndexEntry
+//
+// A malformed entry means the database is inconsistent, so we panic.
+func decodeBitmapEntry(entry IndexEntry) *idBitmap {
+	malformed := func() {
+		panic(fmt.Sprintf("malformed roaring IndexEntry, entry=%v", entry))
+	}
+
+	rest := entry[1:]
+	var header [2]uint64
+	for i := range header {
+		value, n := binary.Uvarint(rest)
+		if n <= 0 {
+			malformed()
+		}
+		header[i] = value
+		rest = rest[n:]
+	}
+
+	b := &idBitmap{containers: make([]bitmapContainer, header[1])}
+	for i := range b.containers {
+		c := &b.containers[i]
+		key, n := binary.Uvarint(rest)
+		if n <= 0 {
+			malformed()
+		}
+		rest = rest[n:]
+		cardinality, n := binary.Uvarint(rest)
+		if n <= 0 {
+			malformed()
+		}
+		rest = rest[n:]
+
+		c.key = key
+		c.cardinality = int(cardinality)
+		if c.cardinality > bitmapArrayMaxSize {
+			if len(rest) < bitmapBitsetWords*8 {
+				malformed()
+			}
+			c.bitset = make([]uint64, bitmapBitsetWords)
+			for w := range c.bitset {
+				c.bitset[w] = binary.BigEndian.Uint64(rest[w*8:])
+			}
+			rest = rest[bitmapBitsetWords*8:]
+			continue
+		}
+		if len(rest) < c.cardinality*2 {
+			malformed()
+		}
+		c.array = make([]uint16, c.cardinality)
+		for a := range c.array {
+			c.array[a] = binary.BigEndian.Uint16(rest[a*2:])
+		}
+		rest = rest[c.cardinality*2:]
+	}
+
+	if len(rest) != 0 || uint64(b.cardinality()) != header[0] {
+		malformed()
+	}
+	return b
+}
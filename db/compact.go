@@ -1,6 +1,8 @@
 package db
 
 import (
+	"bytes"
+	"math"
 	"time"
 
 	"github.com/Everlag/poeitemstore/stash"
@@ -44,27 +46,39 @@ func StashItemModToCompact(mod stash.ItemMod,
 
 }
 
-// Inflate returns an inflated equivalent item modifier for human use
-func (mod ItemMod) Inflate(db *bolt.DB) stash.ItemMod {
+// inflate returns an inflated equivalent item modifier for human use
+func (mod ItemMod) inflate(tx *bolt.Tx) stash.ItemMod {
 
 	return stash.ItemMod{
-		Template: []byte(mod.Mod.Inflate(db)),
+		Template: []byte(inflateString(mod.Mod, tx)),
 		Values:   []uint16{mod.Value},
 	}
 
 }
 
-// Inflate returns an inflated equivalent item fit for human use
-func (item Item) Inflate(db *bolt.DB) stash.Item {
+// Inflate returns an inflated equivalent item modifier for human use
+func (mod ItemMod) Inflate(db *bolt.DB) stash.ItemMod {
+
+	var fat stash.ItemMod
+	db.View(func(tx *bolt.Tx) error {
+		fat = mod.inflate(tx)
+		return nil
+	})
+	return fat
+
+}
+
+// inflate returns an inflated equivalent item fit for human use
+func (item Item) inflate(tx *bolt.Tx) stash.Item {
 
 	// Initialize with the most trivial portions
 	fat := stash.Item{
-		Name:       item.Name.Inflate(db),
-		TypeLine:   item.TypeLine.Inflate(db),
-		Note:       item.Note.Inflate(db),
-		RootType:   item.RootType.Inflate(db),
-		RootFlavor: item.RootFlavor.Inflate(db),
-		League:     item.League.Inflate(db),
+		Name:       inflateString(item.Name, tx),
+		TypeLine:   inflateString(item.TypeLine, tx),
+		Note:       inflateString(item.Note, tx),
+		RootType:   inflateString(item.RootType, tx),
+		RootFlavor: inflateString(item.RootFlavor, tx),
+		League:     inflateLeague(item.League, tx),
 		Corrupted:  item.Corrupted,
 		Identified: item.Identified,
 	}
@@ -72,7 +86,7 @@ func (item Item) Inflate(db *bolt.DB) stash.Item {
 	// And the modifiers
 	fatMods := make([]stash.ItemMod, len(item.Mods))
 	for i, mod := range item.Mods {
-		fatMods[i] = mod.Inflate(db)
+		fatMods[i] = mod.inflate(tx)
 	}
 	// Uhhhhh.... yeah okay, I don't really care about this.
 	// TODO: rethink choices
@@ -81,44 +95,180 @@ func (item Item) Inflate(db *bolt.DB) stash.Item {
 	return fat
 }
 
-// StashItemsToCompact converts fat Item records to their compact form
-//
-// This also ensures all strings present on that item will be available
-// on the StringHeap
-func StashItemsToCompact(items []stash.Item, when Timestamp,
-	db *bolt.DB) ([]Item, error) {
+// Inflate returns an inflated equivalent item fit for human use
+func (item Item) Inflate(db *bolt.DB) stash.Item {
 
-	compact := make([]Item, len(items))
+	var fat stash.Item
+	db.View(func(tx *bolt.Tx) error {
+		fat = item.inflate(tx)
+		return nil
+	})
+	return fat
+}
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		// Translate leagues on a per-item basis
-		leagues := make([]string, len(items))
-		for i, item := range items {
-			leagues[i] = item.League
+// timestampSequencesBucket holds the last sequence given to an item in
+// each second, keyed by seconds since TimestampEpoch
+const timestampSequencesBucket = "timestampSequences"
+
+// timestampSequencesKept is the number of seconds before the newest second
+// given a sequence whose sequences are kept. Pages are processed at the
+// current time, so older seconds are pruned rather than kept forever.
+const timestampSequencesKept = 60 * 60
+
+// lastTimestampKey holds the last Timestamp given to an item in the
+// settings bucket of databases which kept a single sequence rather than
+// one per second
+const lastTimestampKey = "lastTimestamp"
+
+// lastSequence returns the last sequence given to an item in the second
+// secs since TimestampEpoch, ok is false if no item has been given one
+func lastSequence(secs uint32, tx *bolt.Tx) (sequence uint32, ok bool, err error) {
+	sequences := tx.Bucket([]byte(timestampSequencesBucket))
+	if sequences == nil {
+		return 0, false,
+			errors.Errorf("%s bucket not found", timestampSequencesBucket)
+	}
+	if value := sequences.Get(i32tob(secs)); len(value) == 4 {
+		return btoi32(value), true, nil
+	}
+
+	// Continue the single sequence kept before when it ended in secs
+	settings := tx.Bucket([]byte(settingsBucket))
+	if settings == nil {
+		return 0, false, errors.Errorf("%s bucket not found", settingsBucket)
+	}
+	if value := settings.Get([]byte(lastTimestampKey)); len(value) == TimestampSize {
+		var last Timestamp
+		copy(last[:], value)
+		if last.seconds() == secs {
+			return last.Sequence(), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// pruneTimestampSequences removes the sequences of every second more than
+// timestampSequencesKept before the newest second given a sequence
+func pruneTimestampSequences(sequences *bolt.Bucket) error {
+	c := sequences.Cursor()
+	newest, _ := c.Last()
+	if len(newest) != 4 || btoi32(newest) < timestampSequencesKept {
+		return nil
+	}
+	cutoff := i32tob(btoi32(newest) - timestampSequencesKept)
+
+	// Deleting while iterating a cursor skips keys, so collect them first
+	var stale [][]byte
+	for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.Next() {
+		stale = append(stale, k)
+	}
+	for _, k := range stale {
+		if err := sequences.Delete(k); err != nil {
+			return errors.Wrap(err, "failed to prune timestamp sequence")
 		}
-		leagueIds, err := setLeagues(leagues, tx)
+	}
+	return nil
+}
+
+// reserveTimestamps returns the first of n consecutive Timestamps
+// for the items of a page processed at when.
+//
+// A page processed in the same second as an earlier page continues that
+// second's sequence. Pages keep their second regardless of those already
+// stored, so a page processed before the newest items is still placed at
+// when. Only the sequences of the last timestampSequencesKept seconds
+// are kept; a page placed further back restarts its second's sequence,
+// so its items may share a Timestamp with items already in that second.
+func reserveTimestamps(when Timestamp, n int, tx *bolt.Tx) (Timestamp, error) {
+	secs := when.seconds()
+	for {
+		last, ok, err := lastSequence(secs, tx)
 		if err != nil {
-			return errors.Wrap(err, "failed to add leagues to LeagueHeap")
+			return when, err
+		}
+		var sequence uint64
+		if ok {
+			sequence = uint64(last) + 1
+		}
+		// Move on to the next second rather than overflow the sequence
+		if sequence+uint64(n) > math.MaxUint32 {
+			secs++
+			continue
 		}
 
-		// Build compact items from the ids and fill in non-StringHeap information
-		for i, item := range items {
-			compact[i] = Item{
-				ID:         ID{}, // Explicitly empty on entrance
-				GGGID:      GGGIDFromUID(item.ID),
-				Stash:      GGGIDFromUID(item.StashID),
-				League:     leagueIds[i],
-				Identified: item.Identified,
-				Corrupted:  item.Corrupted,
-				When:       when,
-			}
+		first := timestampAt(secs, uint32(sequence))
+		if n == 0 {
+			return first, nil
 		}
+		sequences := tx.Bucket([]byte(timestampSequencesBucket))
+		err = sequences.Put(i32tob(secs), i32tob(uint32(sequence)+uint32(n-1)))
+		if err != nil {
+			return first, errors.Wrap(err, "failed to record timestamp sequence")
+		}
+		return first, pruneTimestampSequences(sequences)
+	}
+}
 
-		// Populate StringHeap related information
-		if err := setStringsForItems(items, compact, tx); err != nil {
-			return errors.New("failed to set strings")
+// compactItems converts fat Item records to their compact form without
+// their internal IDs, see StashItemsToCompact
+func compactItems(items []stash.Item, when Timestamp,
+	tx *bolt.Tx) ([]Item, error) {
+
+	compact := make([]Item, len(items))
+
+	// Translate leagues on a per-item basis
+	leagues := make([]string, len(items))
+	for i, item := range items {
+		leagues[i] = item.League
+	}
+	leagueIds, err := setLeagues(leagues, tx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to add leagues to LeagueHeap")
+	}
+
+	first, err := reserveTimestamps(when, len(items), tx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reserve timestamps")
+	}
+
+	if err := recordUnknownTypelines(items, first, tx); err != nil {
+		return nil, errors.Wrap(err, "failed to record unknown typeLines")
+	}
+
+	// Build compact items from the ids and fill in non-StringHeap information
+	for i, item := range items {
+		compact[i] = Item{
+			ID:         ID{}, // Explicitly empty on entrance
+			GGGID:      GGGIDFromUID(item.ID),
+			Stash:      GGGIDFromUID(item.StashID),
+			League:     leagueIds[i],
+			Identified: item.Identified,
+			Corrupted:  item.Corrupted,
+			When:       timestampAt(first.seconds(), first.Sequence()+uint32(i)),
 		}
-		return nil
+	}
+
+	// Populate StringHeap related information
+	if err := setStringsForItems(items, compact, tx); err != nil {
+		return nil, errors.New("failed to set strings")
+	}
+	return compact, nil
+}
+
+// StashItemsToCompact converts fat Item records to their compact form
+//
+// Each item is given its own Timestamp at when, ordered as provided.
+//
+// This also ensures all strings present on that item will be available
+// on the StringHeap
+func StashItemsToCompact(items []stash.Item, when Timestamp,
+	db *bolt.DB) ([]Item, error) {
+
+	var compact []Item
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		compact, err = compactItems(items, when, tx)
+		return err
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to translate item to db form")
@@ -136,22 +286,28 @@ func StashItemsToCompact(items []stash.Item, when Timestamp,
 
 }
 
-// StashStashToCompact converts fat Item records to their compact form
-// while also stripping items out in their compact form.
-func StashStashToCompact(stashes []stash.Stash, when time.Time,
-	db *bolt.DB) ([]Stash, [][]Item, error) {
+// flatStashes holds stashes being compacted with their items flattened
+// so they can be compacted together
+type flatStashes struct {
+	compact []Stash
+	items   []stash.Item
+	// League of each stash
+	leagues []string
+	// Number of items in each stash so we can unflatten them into
+	// per-stash item sets
+	itemsPerStash []int
+}
 
-	// Grab a new timestamp, all of the Stashes will share the same time
-	whenTS := TimeToTimestamp(when)
+// flattenStashes compacts stashes and flattens their items
+func flattenStashes(stashes []stash.Stash) flatStashes {
 
 	// Compact stashes and flatten items
-	compact := make([]Stash, len(stashes))[:0] // Sliced to zero to allow append
-	flatItems := make([]stash.Item, 0)
-	// Keep track of per-stash leagues
-	leagues := make([]string, len(stashes))[:0]
-	// Keep track of items per-stash so we can unflatten them into per-stash
-	// item sets
-	itemsPerStash := make([]int, len(stashes))[:0]
+	flat := flatStashes{
+		compact:       make([]Stash, len(stashes))[:0], // Sliced to zero to allow append
+		items:         make([]stash.Item, 0),
+		leagues:       make([]string, len(stashes))[:0],
+		itemsPerStash: make([]int, len(stashes))[:0],
+	}
 	for _, stash := range stashes {
 		// We skip empty stashes as we will be unable to assign
 		// then with a LeagueHeapID
@@ -171,43 +327,90 @@ func StashStashToCompact(stashes []stash.Stash, when time.Time,
 		}
 		compactStash.Items = ids
 
-		compact = append(compact, compactStash)
+		flat.compact = append(flat.compact, compactStash)
 
 		// Note the league for this Stash
-		leagues = append(leagues, stash.Items[0].League)
+		flat.leagues = append(flat.leagues, stash.Items[0].League)
 		// Note the number of items included in this stash
-		itemsPerStash = append(itemsPerStash, len(stash.Items))
+		flat.itemsPerStash = append(flat.itemsPerStash, len(stash.Items))
 
-		flatItems = append(flatItems, stash.Items...)
+		flat.items = append(flat.items, stash.Items...)
 	}
+	return flat
+}
 
-	// Fetch and decorate the ids to the compact stashes
-	leagueIDs, err := SetLeagues(leagues, db)
+// unflatten decorates the compact stashes with their leagues and
+// groups the compacted items by the stash they belong to
+func (flat flatStashes) unflatten(leagueIDs []LeagueHeapID,
+	flatItems []Item) ([]Stash, [][]Item) {
+
+	for i, id := range leagueIDs {
+		flat.compact[i].League = id
+	}
+
+	// Unflatten the items so they can match an associated stash
+	items := make([][]Item, len(leagueIDs)) // Sized exactly using leagueIDs
+	lastItemBase := 0
+	for i, count := range flat.itemsPerStash {
+		items[i] = flatItems[lastItemBase : lastItemBase+count]
+		lastItemBase += count
+	}
+
+	return flat.compact, items
+}
+
+// stashStashToCompact behaves as StashStashToCompact within tx
+func stashStashToCompact(stashes []stash.Stash, when time.Time,
+	tx *bolt.Tx) ([]Stash, [][]Item, error) {
+
+	flat := flattenStashes(stashes)
+
+	leagueIDs, err := setLeagues(flat.leagues, tx)
 	if err != nil {
 		err = errors.Wrap(err, "failed to add LeagueHeapIDs to stashes")
 		return nil, nil, err
 	}
-	for i, id := range leagueIDs {
-		compact[i].League = id
-	}
 
-	// Grab the compact items as their flat form
-	compactItems, err := StashItemsToCompact(flatItems, whenTS, db)
+	flatItems, err := compactItems(flat.items, TimeToTimestamp(when), tx)
 	if err != nil {
 		err = errors.Wrap(err, "failed to compact items")
 		return nil, nil, err
 	}
+	if err := getTranslations(flatItems, tx); err != nil {
+		err = errors.Wrap(err, "failed to add internal IDs to items")
+		return nil, nil, err
+	}
 
-	// Unflatten the items so they can match an associated stash
-	items := make([][]Item, len(leagueIDs)) // Sized exactly using leagueIDs
-	lastItemBase := 0
-	for i, count := range itemsPerStash {
-		itemGroup := compactItems[lastItemBase : lastItemBase+count]
-		items[i] = itemGroup
-		// items[i] = compactItems[lastItemBase:count]
-		lastItemBase += count
+	compact, items := flat.unflatten(leagueIDs, flatItems)
+	return compact, items, nil
+}
+
+// StashStashToCompact converts fat Item records to their compact form
+// while also stripping items out in their compact form.
+func StashStashToCompact(stashes []stash.Stash, when time.Time,
+	db *bolt.DB) ([]Stash, [][]Item, error) {
+
+	// Grab a new timestamp, all of the Stashes will share the same
+	// second with each item given its own sequence
+	whenTS := TimeToTimestamp(when)
+
+	flat := flattenStashes(stashes)
+
+	// Fetch and decorate the ids to the compact stashes
+	leagueIDs, err := SetLeagues(flat.leagues, db)
+	if err != nil {
+		err = errors.Wrap(err, "failed to add LeagueHeapIDs to stashes")
+		return nil, nil, err
+	}
+
+	// Grab the compact items as their flat form
+	flatItems, err := StashItemsToCompact(flat.items, whenTS, db)
+	if err != nil {
+		err = errors.Wrap(err, "failed to compact items")
+		return nil, nil, err
 	}
 
+	compact, items := flat.unflatten(leagueIDs, flatItems)
 	return compact, items, nil
 
 }
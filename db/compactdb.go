@@ -0,0 +1,433 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// compactDBSuffix is appended to the database path to name the
+// fresh file data is copied into before it replaces the original.
+const compactDBSuffix = ".compact"
+
+// compactTxMaxSize is the number of bytes written to the fresh file
+// in a single transaction before it is committed.
+//
+// Bolt holds every dirty page of a transaction in memory until commit,
+// so this bounds memory use when compacting a large database.
+const compactTxMaxSize = 16 << 20
+
+// compactFillPercent is the fill percent of every bucket in the fresh
+// file. Keys are copied in ascending order so pages never need to
+// accomodate later inserts between them.
+const compactFillPercent = 1.0
+
+// CompactDBReport represents the work done by CompactDB
+type CompactDBReport struct {
+	Path string
+	// Size of the database file before and after
+	SizeBefore, SizeAfter int64
+	// Number of key value pairs copied
+	Keys int
+	// Number of index buckets without any entries left behind
+	EmptyIndexBuckets int
+	// Number of buckets nested inside of item stores
+	StrayBuckets int
+	// Whether item IDs were renumbered and how many changed
+	Renumbered    bool
+	RenumberedIDs int
+}
+
+func (r CompactDBReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "compacted %s from %d bytes to %d bytes",
+		r.Path, r.SizeBefore, r.SizeAfter)
+	fmt.Fprintf(&buf, "\n  %d keys copied | %d empty index buckets dropped | %d stray buckets dropped",
+		r.Keys, r.EmptyIndexBuckets, r.StrayBuckets)
+	if r.Renumbered {
+		fmt.Fprintf(&buf, " | %d item IDs renumbered", r.RenumberedIDs)
+	}
+	return buf.String()
+}
+
+// idRenumbering maps the IDs of a single league onto a
+// dense sequence starting from 1.
+type idRenumbering struct {
+	ids  map[ID]ID
+	last uint64
+}
+
+// get returns the new ID for an existing ID, assigning the next
+// sequence if it has not yet been seen.
+func (r *idRenumbering) get(id ID) ID {
+	if renumbered, ok := r.ids[id]; ok {
+		return renumbered
+	}
+	r.last++
+	renumbered := IDFromSequence(r.last)
+	r.ids[id] = renumbered
+	return renumbered
+}
+
+// compactWriter writes into the fresh file, committing whenever a
+// transaction grows past compactTxMaxSize.
+type compactWriter struct {
+	db   *bolt.DB
+	tx   *bolt.Tx
+	size int
+
+	// The most recently used bucket and its path, as walking from the
+	// root for every key is wasteful when keys arrive in order
+	lastPath [][]byte
+	last     *bolt.Bucket
+}
+
+// bucket returns the bucket at path, creating it and any parents
+// if they do not yet exist.
+func (w *compactWriter) bucket(path [][]byte) (*bolt.Bucket, error) {
+	if w.last != nil && len(path) == len(w.lastPath) {
+		same := true
+		for i := range path {
+			if !bytes.Equal(path[i], w.lastPath[i]) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return w.last, nil
+		}
+	}
+
+	if w.tx == nil {
+		var err error
+		if w.tx, err = w.db.Begin(true); err != nil {
+			return nil, errors.Wrap(err, "failed to begin transaction")
+		}
+	}
+
+	b, err := w.tx.CreateBucketIfNotExists(path[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create bucket %s", path[0])
+	}
+	b.FillPercent = compactFillPercent
+	for _, name := range path[1:] {
+		if b, err = b.CreateBucketIfNotExists(name); err != nil {
+			return nil, errors.Wrapf(err, "failed to create bucket %v", name)
+		}
+		b.FillPercent = compactFillPercent
+	}
+
+	w.lastPath, w.last = path, b
+	return b, nil
+}
+
+// put writes a single key value pair into the bucket at path
+func (w *compactWriter) put(path [][]byte, k, v []byte) error {
+	if w.size+len(k)+len(v) > compactTxMaxSize {
+		if err := w.commit(); err != nil {
+			return err
+		}
+	}
+
+	b, err := w.bucket(path)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(k, v); err != nil {
+		return errors.Wrap(err, "failed to put key")
+	}
+	w.size += len(k) + len(v)
+	return nil
+}
+
+// setSequence sets the sequence of the bucket at path
+func (w *compactWriter) setSequence(path [][]byte, seq uint64) error {
+	b, err := w.bucket(path)
+	if err != nil {
+		return err
+	}
+	return b.SetSequence(seq)
+}
+
+// commit finishes the current transaction, if any
+func (w *compactWriter) commit() error {
+	w.lastPath, w.last = nil, nil
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx, w.size = nil, 0
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+	return nil
+}
+
+// dbCompactor copies every live bucket from a source transaction
+type dbCompactor struct {
+	src *bolt.Tx
+	dst *compactWriter
+
+	// Per league renumbering keyed by LeagueHeapID bytes,
+	// nil when not renumbering
+	renumber map[string]*idRenumbering
+	encoding IndexEncoding
+
+	report *CompactDBReport
+}
+
+// leagueBucketPath determines if path is of the provided bucket
+// directly under a league, returning the league's key.
+func leagueBucketPath(path [][]byte, bucket string) ([]byte, bool) {
+	if len(path) < 3 || string(path[0]) != leagueNamespaceBucket ||
+		string(path[2]) != bucket {
+		return nil, false
+	}
+	return path[1], true
+}
+
+// prepareRenumbering assigns every stored item a new ID in the
+// same order as their existing IDs.
+//
+// Order is preserved so the item store is still copied sequentially.
+func (c *dbCompactor) prepareRenumbering() error {
+	c.renumber = make(map[string]*idRenumbering)
+
+	root := c.src.Bucket([]byte(leagueNamespaceBucket))
+	if root == nil {
+		return errors.Errorf("%s not found", leagueNamespaceBucket)
+	}
+	return root.ForEach(func(k, v []byte) error {
+		// Leagues are all nested buckets
+		if v != nil {
+			return nil
+		}
+		// A reindex records its progress as an ID
+		if root.Bucket(k).Bucket([]byte(reindexBucket)) != nil {
+			return errors.Errorf("league %d is being reindexed",
+				LeagueHeapIDFromBytes(k))
+		}
+		r := &idRenumbering{ids: make(map[ID]ID)}
+		c.renumber[string(k)] = r
+
+		items := getLeagueItemBucket(LeagueHeapIDFromBytes(k), c.src)
+		return items.ForEach(func(k, v []byte) error {
+			// Ignore nested buckets
+			if v == nil {
+				return nil
+			}
+			var id ID
+			copy(id[:], k)
+			if r.get(id) != id {
+				c.report.RenumberedIDs++
+			}
+			return nil
+		})
+	})
+}
+
+// copyValue writes a single key value pair found at path, rewriting
+// any IDs it contains when renumbering.
+func (c *dbCompactor) copyValue(path [][]byte, k, v []byte) error {
+	if c.renumber != nil {
+		if league, ok := leagueBucketPath(path, itemStoreBucket); ok {
+			var item Item
+			if _, err := item.UnmarshalMsg(v); err != nil {
+				return errors.Wrap(err, "failed to Unmarshal Item")
+			}
+			item.ID = c.renumber[string(league)].get(item.ID)
+			serial, err := item.MarshalMsg(nil)
+			if err != nil {
+				return errors.Wrap(err, "failed to Marshal Item")
+			}
+			k, v = item.ID[:], serial
+		}
+
+		if league, ok := leagueBucketPath(path, idTranslateBucket); ok {
+			var id ID
+			copy(id[:], v)
+			renumbered := c.renumber[string(league)].get(id)
+			v = renumbered[:]
+		}
+
+		if league, ok := leagueBucketPath(path, indiceBucket); ok {
+			r := c.renumber[string(league)]
+			ids := IndexEntry(v).GetIDs(nil)
+			for i, id := range ids {
+				ids[i] = r.get(id)
+			}
+			v = IndexEntryMergeAs(nil, ids, nil, c.encoding)
+		}
+	}
+
+	c.report.Keys++
+	return c.dst.put(path, k, v)
+}
+
+// copyBucket copies the bucket at path and everything nested within it,
+// returning the number of key value pairs copied.
+//
+// Buckets nested inside a league's index are only created once they
+// have something in them, which drops every empty index bucket.
+func (c *dbCompactor) copyBucket(b *bolt.Bucket, path [][]byte) (int, error) {
+	_, isIndex := leagueBucketPath(path, indiceBucket)
+	lazy := isIndex && len(path) > 3
+	if !lazy {
+		if _, err := c.dst.bucket(path); err != nil {
+			return 0, err
+		}
+	}
+
+	var copied int
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			if isIndex && len(v) == 0 {
+				// An entry without any IDs is as good as not being there
+				return nil
+			}
+			copied++
+			return c.copyValue(path, k, v)
+		}
+
+		// Opening a database used to create league buckets inside of
+		// the item store, those are never used and left behind
+		if _, isItems := leagueBucketPath(path, itemStoreBucket); isItems {
+			c.report.StrayBuckets++
+			return nil
+		}
+
+		nested, err := c.copyBucket(b.Bucket(k), append(path[:len(path):len(path)], k))
+		copied += nested
+		return err
+	})
+	if err != nil {
+		return copied, err
+	}
+
+	if lazy && copied == 0 {
+		c.report.EmptyIndexBuckets++
+		return 0, nil
+	}
+
+	seq := b.Sequence()
+	if c.renumber != nil {
+		league, isItems := leagueBucketPath(path, itemStoreBucket)
+		if !isItems {
+			league, isItems = leagueBucketPath(path, idTranslateBucket)
+		}
+		if isItems && len(path) == 3 {
+			seq = c.renumber[string(league)].last
+		}
+	}
+	if seq == 0 {
+		return copied, nil
+	}
+	return copied, c.dst.setSequence(path, seq)
+}
+
+// compactInto copies the live contents of src into the fresh dst
+func compactInto(src, dst *bolt.DB, renumber bool,
+	report *CompactDBReport) error {
+
+	return src.View(func(tx *bolt.Tx) error {
+		c := dbCompactor{
+			src:    tx,
+			dst:    &compactWriter{db: dst},
+			report: report,
+		}
+
+		if renumber {
+			var err error
+			if c.encoding, err = getIndexEncoding(tx); err != nil {
+				return errors.Wrap(err, "failed to get index encoding")
+			}
+			if err := c.prepareRenumbering(); err != nil {
+				return errors.Wrap(err, "failed to renumber item IDs")
+			}
+		}
+
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			_, err := c.copyBucket(b, [][]byte{name})
+			return errors.Wrapf(err, "failed to copy bucket %s", name)
+		})
+		if err != nil {
+			if c.dst.tx != nil {
+				c.dst.tx.Rollback()
+			}
+			return err
+		}
+
+		return c.dst.commit()
+	})
+}
+
+// CompactDB rewrites the database into a fresh file and atomically
+// replaces the original with it.
+//
+// Bolt never returns free pages to the filesystem, so this is the only
+// way to shrink the file. Buckets are written with the optimal fill
+// percent and empty index buckets are dropped. When renumber is set,
+// the item IDs of each league are reassigned to a dense sequence
+// which keeps index entries small.
+//
+// This is an offline operation; db is closed once compaction is complete
+// and must be reopened to be used again. Nothing else may write to db
+// while this runs.
+func CompactDB(db *bolt.DB, renumber bool) (*CompactDBReport, error) {
+	path := db.Path()
+	report := &CompactDBReport{Path: path, Renumbered: renumber}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat database")
+	}
+	report.SizeBefore = info.Size()
+
+	// Anything left over from an earlier attempt is incomplete
+	tmpPath := path + compactDBSuffix
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to remove stale compaction")
+	}
+
+	dst, err := bolt.Open(tmpPath, info.Mode(), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s as boltdb", tmpPath)
+	}
+	// Durability only matters once everything has been copied
+	dst.NoSync = true
+
+	if err := compactInto(db, dst, renumber, report); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return nil, errors.Wrap(err, "failed to copy database")
+	}
+
+	dst.NoSync = false
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return nil, errors.Wrap(err, "failed to sync compacted database")
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return nil, errors.Wrap(err, "failed to close compacted database")
+	}
+
+	if info, err = os.Stat(tmpPath); err != nil {
+		return nil, errors.Wrap(err, "failed to stat compacted database")
+	}
+	report.SizeAfter = info.Size()
+
+	// The original must be closed before it can be replaced everywhere
+	if err := db.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to close database")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, errors.Wrap(err, "failed to replace database")
+	}
+
+	return report, nil
+}
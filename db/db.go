@@ -11,10 +11,13 @@ import (
 const DBLocation string = "poe.db"
 
 var bucketNames = [...]string{
-	stringHeapBucket, stringHeapInverseBucket,
+	stringHeapBucket, stringHeapInverseBucket, stringHeapCondemnedBucket,
 	leagueHeapBucket, leagueHeapInverseBucket,
 	updateSnapshotHistoryBuckets,
 	leagueNamespaceBucket,
+	settingsBucket,
+	basesBucket, unknownTypelinesBucket,
+	timestampSequencesBucket,
 }
 
 // i64tob returns an 8-byte big endian representation of v.
@@ -67,14 +70,32 @@ func setupBuckets(db *bolt.DB) error {
 				return errors.Wrapf(err, "create bucket: %s", bucket)
 			}
 		}
-		return nil
+		return stampSchemaVersion(tx)
 	})
 }
 
 // Boot gets the database from disk and performs necessary setup
 //
+// Databases with a schema version other than CurrentSchemaVersion are
+// refused; older databases can be opened with BootForMigration and
+// upgraded with Migrate.
+//
+// Items cleaned from then on are classified by the bases stored in the
+// database, which stash.SetBases sets for the whole process, so only a
+// single database should be open in a process at once.
+//
 // If path is empty, it uses the default DBLocation
 func Boot(path string) (*bolt.DB, error) {
+	return boot(path, false)
+}
+
+// BootForMigration behaves as Boot but also opens databases with an
+// older schema version so they can be upgraded with Migrate.
+func BootForMigration(path string) (*bolt.DB, error) {
+	return boot(path, true)
+}
+
+func boot(path string, allowOutdated bool) (*bolt.DB, error) {
 	if path == "" {
 		path = DBLocation
 	}
@@ -87,22 +108,35 @@ func Boot(path string) (*bolt.DB, error) {
 
 	// Ensure root level buckets exist
 	if err := setupBuckets(db); err != nil {
+		db.Close()
 		return nil, errors.Wrap(err, "failed to setup buckets")
 	}
 
+	version, err := checkSchemaVersion(allowOutdated, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version < CurrentSchemaVersion {
+		// League buckets of an outdated database are fixed by Migrate
+		return db, nil
+	}
+
 	// Ensure league level buckets exist on each league
 	leagueStrings, err := ListLeagues(db)
 	if err != nil {
+		db.Close()
 		return nil, errors.Wrap(err, "failed to list leagues")
 	}
 	leagueIDs, err := GetLeagues(leagueStrings, db)
 	if err != nil {
+		db.Close()
 		return nil, errors.Wrap(err, "failed to convert league strings to ids")
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
 
 		for _, id := range leagueIDs {
-			b := getLeagueItemBucket(id, tx)
+			b := getLeagueBucket(id, tx)
 			if err = checkLeague(b, tx); err != nil {
 				return err
 			}
@@ -111,8 +145,15 @@ func Boot(path string) (*bolt.DB, error) {
 		return nil
 	})
 	if err != nil {
+		db.Close()
 		return nil, errors.Wrap(err, "failed to checkLeagues")
 	}
 
+	// Classify items as those already stored were
+	if err := useStoredBases(db); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to load stored bases")
+	}
+
 	return db, nil
 }
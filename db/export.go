@@ -0,0 +1,369 @@
+package db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// ExportFormat determines how ExportLeague writes items
+type ExportFormat int
+
+const (
+	// ExportCSV writes a header then a row per item with each mod
+	// flattened into a pair of columns
+	ExportCSV ExportFormat = iota
+	// ExportJSONLines writes a JSON object per line holding the
+	// inflated item alongside its stash
+	ExportJSONLines
+	// ExportParquet writes a parquet file with the columns of ExportCSV
+	ExportParquet
+)
+
+func (format ExportFormat) String() string {
+	switch format {
+	case ExportCSV:
+		return "csv"
+	case ExportJSONLines:
+		return "jsonl"
+	case ExportParquet:
+		return "parquet"
+	default:
+		return fmt.Sprintf("ExportFormat(%d)", int(format))
+	}
+}
+
+// exportColumns are the columns of every exported item which precede
+// its mods. Each mod follows as a mod<n> and mod<n>Value pair, as many
+// as the item with the most mods requires.
+var exportColumns = []string{
+	"league", "id", "stash", "account", "added",
+	"name", "typeLine", "note", "rootType", "rootFlavor",
+	"identified", "corrupted",
+}
+
+// ExportReport represents the work done by ExportLeague
+type ExportReport struct {
+	League string
+	Format ExportFormat
+	// Whether items were filtered by a query
+	Filtered bool
+	// Number of items written
+	Items int
+	// Most mods present on a single item, which determines how many
+	// mod columns were written
+	MaxMods int
+}
+
+func (r ExportReport) String() string {
+	filtered := ""
+	if r.Filtered {
+		filtered = " matching the filter"
+	}
+	return fmt.Sprintf("exported %d items%s from %s as %s\n  %d mod columns",
+		r.Items, filtered, r.League, r.Format, r.MaxMods)
+}
+
+// exportedItem is an item as exported alongside its stash
+type exportedItem struct {
+	// ID and StashID are the hex encoded GGGIDs of the item and its stash
+	stash.Item
+	Account string
+	Added   time.Time
+	// Averaged mod values, ordered as ExplicitMods
+	Values []float64
+}
+
+// exportWriter writes exported items in a single format
+type exportWriter interface {
+	write(item exportedItem) error
+	// close writes anything buffered, it does not close the underlying writer
+	close() error
+}
+
+// csvExport writes items as CSV
+type csvExport struct {
+	w       *csv.Writer
+	maxMods int
+	record  []string
+}
+
+func newCSVExport(w io.Writer, maxMods int) (*csvExport, error) {
+	e := &csvExport{w: csv.NewWriter(w), maxMods: maxMods}
+	header := append([]string{}, exportColumns...)
+	for i := 1; i <= maxMods; i++ {
+		header = append(header, fmt.Sprintf("mod%d", i),
+			fmt.Sprintf("mod%dValue", i))
+	}
+	return e, e.w.Write(header)
+}
+
+func (e *csvExport) write(item exportedItem) error {
+	e.record = append(e.record[:0],
+		item.League, item.ID, item.StashID, item.Account,
+		item.Added.Format(time.RFC3339),
+		item.Name, item.TypeLine, item.Note, item.RootType, item.RootFlavor,
+		strconv.FormatBool(item.Identified),
+		strconv.FormatBool(item.Corrupted))
+	for i := 0; i < e.maxMods; i++ {
+		if i >= len(item.ExplicitMods) {
+			e.record = append(e.record, "", "")
+			continue
+		}
+		e.record = append(e.record, string(item.ExplicitMods[i].Template),
+			strconv.FormatFloat(item.Values[i], 'f', -1, 64))
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonLinesExport writes items as JSON Lines
+type jsonLinesExport struct {
+	w *bufio.Writer
+}
+
+// jsonLine is a single line of a JSON Lines export
+type jsonLine struct {
+	Stash   string          `json:"stash"`
+	Account string          `json:"accountName"`
+	Added   time.Time       `json:"added"`
+	Item    json.RawMessage `json:"item"`
+}
+
+func (e *jsonLinesExport) write(item exportedItem) error {
+	serial, err := item.Item.MarshalJSON()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item")
+	}
+	line, err := json.Marshal(jsonLine{
+		Stash:   item.StashID,
+		Account: item.Account,
+		Added:   item.Added,
+		Item:    serial,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal line")
+	}
+	if _, err := e.w.Write(line); err != nil {
+		return err
+	}
+	return e.w.WriteByte('\n')
+}
+
+func (e *jsonLinesExport) close() error {
+	return e.w.Flush()
+}
+
+// parquetExport writes items as parquet
+type parquetExport struct {
+	buffered *bufio.Writer
+	w        *parquetWriter
+	maxMods  int
+	row      []interface{}
+}
+
+func newParquetExport(w io.Writer, maxMods int) (*parquetExport, error) {
+	buffered := bufio.NewWriter(w)
+
+	var columns []*parquetColumn
+	for _, name := range exportColumns {
+		column := &parquetColumn{
+			name:      name,
+			kind:      parquetByteArray,
+			converted: parquetUTF8,
+		}
+		switch name {
+		case "added":
+			column.kind, column.converted = parquetInt64, parquetTimestampMillis
+		case "identified", "corrupted":
+			column.kind, column.converted = parquetBoolean, parquetNoConversion
+		}
+		columns = append(columns, column)
+	}
+	for i := 1; i <= maxMods; i++ {
+		columns = append(columns, &parquetColumn{
+			name:      fmt.Sprintf("mod%d", i),
+			kind:      parquetByteArray,
+			converted: parquetUTF8,
+			optional:  true,
+		}, &parquetColumn{
+			name:      fmt.Sprintf("mod%dValue", i),
+			kind:      parquetDouble,
+			converted: parquetNoConversion,
+			optional:  true,
+		})
+	}
+
+	p, err := newParquetWriter(buffered, columns)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetExport{buffered: buffered, w: p, maxMods: maxMods}, nil
+}
+
+func (e *parquetExport) write(item exportedItem) error {
+	e.row = append(e.row[:0],
+		item.League, item.ID, item.StashID, item.Account,
+		item.Added.UnixNano()/int64(time.Millisecond),
+		item.Name, item.TypeLine, item.Note, item.RootType, item.RootFlavor,
+		item.Identified, item.Corrupted)
+	for i := 0; i < e.maxMods; i++ {
+		if i >= len(item.ExplicitMods) {
+			e.row = append(e.row, nil, nil)
+			continue
+		}
+		e.row = append(e.row, string(item.ExplicitMods[i].Template),
+			item.Values[i])
+	}
+	return e.w.write(e.row)
+}
+
+func (e *parquetExport) close() error {
+	if err := e.w.close(); err != nil {
+		return err
+	}
+	return e.buffered.Flush()
+}
+
+// newExportWriter returns a writer for format on w
+func newExportWriter(format ExportFormat, maxMods int,
+	w io.Writer) (exportWriter, error) {
+
+	switch format {
+	case ExportCSV:
+		return newCSVExport(w, maxMods)
+	case ExportJSONLines:
+		return &jsonLinesExport{w: bufio.NewWriter(w)}, nil
+	case ExportParquet:
+		return newParquetExport(w, maxMods)
+	default:
+		return nil, errors.Errorf("unknown export format %s", format)
+	}
+}
+
+// forEachExported calls cb with every item of a league satisfying the
+// filter, up to its MaxDesired when positive. A nil filter accepts
+// every item.
+func forEachExported(league LeagueHeapID, filter *ItemStoreQuery,
+	tx *bolt.Tx, cb func(item Item) error) error {
+
+	var found int
+	return getLeagueItemBucket(league, tx).ForEach(func(k, v []byte) error {
+		// Ignore nested buckets
+		if v == nil {
+			return nil
+		}
+		if filter != nil && filter.maxDesired > 0 && found >= filter.maxDesired {
+			return nil
+		}
+
+		var item Item
+		if _, err := item.UnmarshalMsg(v); err != nil {
+			return errors.Wrap(err, "failed to Unmarshal Item")
+		}
+		if filter != nil && !filter.checkItem(item) {
+			return nil
+		}
+		found++
+		return cb(item)
+	})
+}
+
+// exportItem inflates an item with the stash it belongs to
+func exportItem(item Item, meta *bolt.Bucket, tx *bolt.Tx) (exportedItem, error) {
+	exported := exportedItem{
+		Item:   item.inflate(tx),
+		Added:  item.When.ToTime(),
+		Values: make([]float64, len(item.Mods)),
+	}
+	exported.ID = hex.EncodeToString(item.GGGID[:])
+	exported.StashID = hex.EncodeToString(item.Stash[:])
+	for i, mod := range item.Mods {
+		exported.Values[i] = float64(mod.Value) / ItemModAverageScaleFactor
+		// stash.ItemMod only holds whole values
+		exported.ExplicitMods[i].Values[0] = (mod.Value +
+			ItemModAverageScaleFactor/2) / ItemModAverageScaleFactor
+	}
+
+	if serial := meta.Get(item.Stash[:]); serial != nil {
+		var stash Stash
+		if _, err := stash.UnmarshalMsg(serial); err != nil {
+			return exported, errors.Wrap(err, "failed to Unmarshal Stash")
+		}
+		exported.Account = stash.AccountName
+	}
+	return exported, nil
+}
+
+// ExportLeague writes the items of a league to w in the provided format,
+// restricted to those satisfying filter when it is non-nil.
+//
+// Items are inflated and written as they are read from a single read
+// transaction, so the export is consistent without holding the league
+// in memory. Item and stash IDs are the hex encoded GGGIDs they are
+// stored by and mod values are averaged, as they are indexed; JSON Lines
+// rounds them to whole values.
+func ExportLeague(name string, filter *ItemStoreQuery, format ExportFormat,
+	w io.Writer, db *bolt.DB) (*ExportReport, error) {
+
+	report := &ExportReport{League: name, Format: format, Filtered: filter != nil}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		league, err := getLeague(name, tx)
+		if err != nil {
+			return err
+		}
+		if filter != nil && filter.league != league {
+			return errors.Errorf("filter is for league=%d rather than %s",
+				filter.league, name)
+		}
+
+		// Columns are fixed before the first row is written, so the
+		// number of mod columns is found first
+		err = forEachExported(league, filter, tx, func(item Item) error {
+			if len(item.Mods) > report.MaxMods {
+				report.MaxMods = len(item.Mods)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		out, err := newExportWriter(format, report.MaxMods, w)
+		if err != nil {
+			return err
+		}
+		meta := getStashMetaBucket(league, tx)
+		err = forEachExported(league, filter, tx, func(item Item) error {
+			exported, err := exportItem(item, meta, tx)
+			if err != nil {
+				return err
+			}
+			report.Items++
+			return out.write(exported)
+		})
+		if err != nil {
+			return err
+		}
+		return out.close()
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to export league=%s", name)
+	}
+
+	return report, nil
+}
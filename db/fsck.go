@@ -0,0 +1,538 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// FsckMaxProblems is the most problems described in a FsckReport,
+// further problems are only counted.
+const FsckMaxProblems = 50
+
+// FsckReport represents the inconsistencies found, and repaired
+// when requested, by Fsck.
+type FsckReport struct {
+	Repair bool
+	// Heap entries without a matching inverse entry or vice versa
+	HeapMismatches int
+	// League buckets or their sub-buckets which do not exist
+	MissingBuckets int
+	// Buckets nested inside of item stores
+	StrayBuckets int
+	// Index entries which could not be decoded
+	MalformedEntries int
+	// IDs in the index without a stored item matching the index
+	DanglingIndexIDs int
+	// Mods of stored items which are not indexed
+	UnindexedMods int
+	// Items of a stash without a stored item
+	DanglingStashItems int
+	// Descriptions of the first FsckMaxProblems problems found
+	Problems []string
+}
+
+// problem records a single problem of the kind counted by count
+func (r *FsckReport) problem(count *int, format string, args ...interface{}) {
+	*count++
+	if len(r.Problems) < FsckMaxProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// Total returns the number of problems found
+func (r FsckReport) Total() int {
+	return r.HeapMismatches + r.MissingBuckets + r.StrayBuckets +
+		r.MalformedEntries + r.DanglingIndexIDs + r.UnindexedMods +
+		r.DanglingStashItems
+}
+
+func (r FsckReport) String() string {
+	verb := "found"
+	if r.Repair {
+		verb = "repaired"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %d problems", verb, r.Total())
+	fmt.Fprintf(&buf, "\n  %d heap mismatches | %d missing buckets | %d stray buckets",
+		r.HeapMismatches, r.MissingBuckets, r.StrayBuckets)
+	fmt.Fprintf(&buf, "\n  %d malformed index entries | %d dangling index IDs | %d unindexed mods",
+		r.MalformedEntries, r.DanglingIndexIDs, r.UnindexedMods)
+	fmt.Fprintf(&buf, "\n  %d dangling stash items", r.DanglingStashItems)
+	for _, problem := range r.Problems {
+		fmt.Fprintf(&buf, "\n  - %s", problem)
+	}
+	if r.Total() > len(r.Problems) {
+		fmt.Fprintf(&buf, "\n  ... and %d more", r.Total()-len(r.Problems))
+	}
+	return buf.String()
+}
+
+// safeIDs returns every ID in an entry or false if the entry
+// is malformed.
+//
+// Decoding a malformed entry panics, so that is recovered from here.
+func safeIDs(entry IndexEntry) (ids []ID, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ids, ok = nil, false
+		}
+	}()
+	return entry.GetIDs(nil), true
+}
+
+// fsckHeap compares a heap with its inverse
+func fsckHeap(heapName, inverseName string, report *FsckReport,
+	tx *bolt.Tx) error {
+
+	heap := tx.Bucket([]byte(heapName))
+	if heap == nil {
+		return errors.Errorf("%s not found", heapName)
+	}
+	inverter := tx.Bucket([]byte(inverseName))
+	if inverter == nil {
+		return errors.Errorf("%s not found", inverseName)
+	}
+
+	// The heap is authoritative, so the inverse is fixed to match it
+	// unless the heap is missing an entry entirely.
+	type fix struct {
+		bucket *bolt.Bucket
+		k, v   []byte
+	}
+	var fixes []fix
+	err := heap.ForEach(func(k, v []byte) error {
+		if inverse := inverter.Get(v); !bytes.Equal(inverse, k) {
+			report.problem(&report.HeapMismatches,
+				"%s entry %q=%v has inverse %q", heapName, k, v, inverse)
+			fixes = append(fixes, fix{inverter, v, k})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = inverter.ForEach(func(k, v []byte) error {
+		if heap.Get(v) == nil {
+			report.problem(&report.HeapMismatches,
+				"%s entry %v=%q missing from %s", inverseName, k, v, heapName)
+			fixes = append(fixes, fix{heap, v, k})
+		}
+		return nil
+	})
+	if err != nil || !report.Repair {
+		return err
+	}
+
+	for _, f := range fixes {
+		err := f.bucket.Put(append([]byte{}, f.k...), append([]byte{}, f.v...))
+		if err != nil {
+			return errors.Wrap(err, "failed to repair heap")
+		}
+	}
+	return nil
+}
+
+// fsckLeagueBuckets ensures a league and each of its sub-buckets exist
+//
+// Returns false if the league is missing anything and was not repaired,
+// in which case it cannot be checked any further.
+func fsckLeagueBuckets(name []byte, league LeagueHeapID, report *FsckReport,
+	tx *bolt.Tx) (bool, error) {
+
+	root := tx.Bucket([]byte(leagueNamespaceBucket))
+	if root == nil {
+		return false, errors.Errorf("%s not found", leagueNamespaceBucket)
+	}
+
+	leagueBucket := root.Bucket(league.ToBytes())
+	if leagueBucket == nil {
+		report.problem(&report.MissingBuckets,
+			"league %q has no bucket", name)
+		if !report.Repair {
+			return false, nil
+		}
+		var err error
+		if leagueBucket, err = root.CreateBucket(league.ToBytes()); err != nil {
+			return false, errors.Wrap(err, "failed to create league bucket")
+		}
+	}
+
+	complete := true
+	for _, sub := range leagueSubBuckets {
+		if leagueBucket.Bucket([]byte(sub)) != nil {
+			continue
+		}
+		report.problem(&report.MissingBuckets,
+			"league %q has no %s bucket", name, sub)
+		complete = false
+	}
+	if !complete && report.Repair {
+		if err := checkLeague(leagueBucket, tx); err != nil {
+			return false, err
+		}
+		complete = true
+	}
+	if !complete {
+		return false, nil
+	}
+
+	// Opening a database used to create league buckets inside of
+	// the item store, those are never used.
+	items := leagueBucket.Bucket([]byte(itemStoreBucket))
+	var stray [][]byte
+	err := items.ForEach(func(k, v []byte) error {
+		if v == nil {
+			report.problem(&report.StrayBuckets,
+				"league %q has bucket %q in its %s", name, k, itemStoreBucket)
+			stray = append(stray, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil || !report.Repair {
+		return true, err
+	}
+	for _, k := range stray {
+		if err := items.DeleteBucket(k); err != nil {
+			return false, errors.Wrap(err, "failed to remove stray bucket")
+		}
+	}
+	return true, nil
+}
+
+// danglingIndexID is a single ID to be removed from the index
+type danglingIndexID struct {
+	bucketKey indexBatchKey
+	key       []byte
+	id        ID
+}
+
+// indexedMod determines if the provided mod of an item is indexed
+func indexedMod(item Item, mod ItemMod, granularity IndexGranularity,
+	tx *bolt.Tx) bool {
+
+	b, err := getItemModIndexBucketRO(item.RootType, item.RootFlavor,
+		mod.Mod, item.League, tx)
+	if err != nil {
+		return false
+	}
+	ids, ok := safeIDs(IndexEntry(b.Get(encodeModIndexKey(mod, item.When, granularity))))
+	if !ok {
+		return false
+	}
+	for _, id := range ids {
+		if id == item.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesIndex determines if an item belongs at a key within
+// the provided mod index bucket.
+func matchesIndex(item Item, bucketKey indexBatchKey, key []byte,
+	granularity IndexGranularity) bool {
+
+	if item.RootType != bucketKey.rootType ||
+		item.RootFlavor != bucketKey.rootFlavor ||
+		item.League != bucketKey.league {
+		return false
+	}
+	for _, mod := range item.Mods {
+		if mod.Mod == bucketKey.mod &&
+			bytes.Equal(encodeModIndexKey(mod, item.When, granularity), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// fsckIndex checks every item of a league is indexed under each of its
+// mods and every index entry only contains items belonging there.
+func fsckIndex(name []byte, league LeagueHeapID, report *FsckReport,
+	tx *bolt.Tx) error {
+
+	granularity, err := getIndexGranularity(league, tx)
+	if err != nil {
+		return err
+	}
+
+	itemBucket := getLeagueItemBucket(league, tx)
+	getItem := func(id ID) (Item, bool) {
+		var item Item
+		itemBytes := itemBucket.Get(id[:])
+		if itemBytes == nil {
+			return item, false
+		}
+		_, err := item.UnmarshalMsg(itemBytes)
+		return item, err == nil && item.ID == id
+	}
+
+	var unindexed []Item
+	err = itemBucket.ForEach(func(k, v []byte) error {
+		// Ignore nested buckets
+		if v == nil {
+			return nil
+		}
+		var id ID
+		copy(id[:], k)
+		item, ok := getItem(id)
+		if !ok {
+			return errors.Errorf("league %q has malformed item, id=%v", name, k)
+		}
+
+		var missing []ItemMod
+		for _, mod := range item.Mods {
+			if !indexedMod(item, mod, granularity, tx) {
+				report.problem(&report.UnindexedMods,
+					"league %q item %v is not indexed under mod %d",
+					name, id, mod.Mod)
+				missing = append(missing, mod)
+			}
+		}
+		if len(missing) > 0 {
+			item.Mods = missing
+			unindexed = append(unindexed, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var dangling []danglingIndexID
+	var malformed []danglingIndexID
+	indices := getLeagueIndexBucket(league, tx)
+	err = indices.ForEach(func(rootType, v []byte) error {
+		rootTypeBucket := indices.Bucket(rootType)
+		if rootTypeBucket == nil {
+			return nil
+		}
+		return rootTypeBucket.ForEach(func(rootFlavor, v []byte) error {
+			rootFlavorBucket := rootTypeBucket.Bucket(rootFlavor)
+			if rootFlavorBucket == nil {
+				return nil
+			}
+			return rootFlavorBucket.ForEach(func(mod, v []byte) error {
+				modBucket := rootFlavorBucket.Bucket(mod)
+				if modBucket == nil {
+					return nil
+				}
+				bucketKey := indexBatchKey{
+					StringHeapIDFromBytes(rootType),
+					StringHeapIDFromBytes(rootFlavor),
+					StringHeapIDFromBytes(mod),
+					league,
+					false,
+				}
+
+				return modBucket.ForEach(func(k, v []byte) error {
+					// Ignore nested buckets
+					if v == nil {
+						return nil
+					}
+					key := append([]byte{}, k...)
+
+					ids, ok := safeIDs(IndexEntry(v))
+					if !ok {
+						report.problem(&report.MalformedEntries,
+							"league %q has malformed index entry, key=%v",
+							name, key)
+						malformed = append(malformed,
+							danglingIndexID{bucketKey: bucketKey, key: key})
+						return nil
+					}
+					for _, id := range ids {
+						item, ok := getItem(id)
+						if ok && matchesIndex(item, bucketKey, key, granularity) {
+							continue
+						}
+						report.problem(&report.DanglingIndexIDs,
+							"league %q index entry, key=%v, has dangling item %v",
+							name, key, id)
+						dangling = append(dangling,
+							danglingIndexID{bucketKey, key, id})
+					}
+					return nil
+				})
+			})
+		})
+	})
+	if err != nil || !report.Repair {
+		return err
+	}
+
+	// Malformed entries are removed entirely, their items were already
+	// found to be unindexed so they are added back below.
+	for _, entry := range malformed {
+		b, err := getItemModIndexBucketRO(entry.bucketKey.rootType,
+			entry.bucketKey.rootFlavor, entry.bucketKey.mod, league, tx)
+		if err != nil {
+			return errors.Wrap(err, "failed to get item mod bucket")
+		}
+		if err := b.Delete(entry.key); err != nil {
+			return errors.Wrap(err, "failed to remove malformed index entry")
+		}
+	}
+
+	batch, err := newIndexBatch(tx)
+	if err != nil {
+		return err
+	}
+	for _, id := range dangling {
+		pending, err := batch.pendingAt(id.bucketKey, id.key)
+		if err != nil {
+			return err
+		}
+		pending.remove = append(pending.remove, id.id)
+	}
+	for _, item := range unindexed {
+		if _, err := batch.add(item); err != nil {
+			return err
+		}
+	}
+	return batch.write()
+}
+
+// fsckStashes checks every item of every stash in a league is stored
+func fsckStashes(name []byte, league LeagueHeapID, report *FsckReport,
+	tx *bolt.Tx) error {
+
+	meta := getStashMetaBucket(league, tx)
+	translator := getIDTranslateItemBucket(league, tx)
+	items := getLeagueItemBucket(league, tx)
+
+	var damaged []Stash
+	err := meta.ForEach(func(k, v []byte) error {
+		var stash Stash
+		if _, err := stash.UnmarshalMsg(v); err != nil {
+			return errors.Wrapf(err, "league %q has malformed stash", name)
+		}
+
+		kept := make([]GGGID, 0, len(stash.Items))
+		for _, gggID := range stash.Items {
+			id := translator.Get(gggID[:])
+			if id != nil && items.Get(id) != nil {
+				kept = append(kept, gggID)
+				continue
+			}
+			report.problem(&report.DanglingStashItems,
+				"league %q stash %v has dangling item %v", name, stash.ID, gggID)
+		}
+		if len(kept) != len(stash.Items) {
+			stash.Items = kept
+			damaged = append(damaged, stash)
+		}
+		return nil
+	})
+	if err != nil || !report.Repair {
+		return err
+	}
+
+	seen := getStashSeenBucket(league, tx)
+	for _, stash := range damaged {
+		if len(stash.Items) == 0 {
+			if err := meta.Delete(stash.ID[:]); err != nil {
+				return errors.Wrap(err, "failed to remove stash")
+			}
+			if err := seen.Delete(stash.ID[:]); err != nil {
+				return errors.Wrap(err, "failed to remove stash seen time")
+			}
+			continue
+		}
+		serial, err := stash.MarshalMsg(nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to Marshal Stash")
+		}
+		if err := meta.Put(stash.ID[:], serial); err != nil {
+			return errors.Wrap(err, "failed to update stash")
+		}
+	}
+	return nil
+}
+
+// fsck checks, and repairs if requested, the entire database
+func fsck(report *FsckReport, tx *bolt.Tx) error {
+	if err := fsckHeap(stringHeapBucket, stringHeapInverseBucket,
+		report, tx); err != nil {
+		return errors.Wrap(err, "failed to check string heap")
+	}
+	if err := fsckHeap(leagueHeapBucket, leagueHeapInverseBucket,
+		report, tx); err != nil {
+		return errors.Wrap(err, "failed to check league heap")
+	}
+
+	// Copy the leagues out as the heap may be modified by repairs
+	var names [][]byte
+	var leagues []LeagueHeapID
+	err := tx.Bucket([]byte(leagueHeapBucket)).ForEach(func(k, v []byte) error {
+		if v != nil {
+			names = append(names, append([]byte{}, k...))
+			leagues = append(leagues, LeagueHeapIDFromBytes(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, league := range leagues {
+		name := names[i]
+		ok, err := fsckLeagueBuckets(name, league, report, tx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check buckets of league %q", name)
+		}
+		if !ok {
+			continue
+		}
+		// An index being rebuilt is incomplete by design
+		state, err := getReindexState(league, tx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check reindex of league %q", name)
+		}
+		if state == nil {
+			if err := fsckIndex(name, league, report, tx); err != nil {
+				return errors.Wrapf(err, "failed to check index of league %q", name)
+			}
+		}
+		if err := fsckStashes(name, league, report, tx); err != nil {
+			return errors.Wrapf(err, "failed to check stashes of league %q", name)
+		}
+	}
+
+	return nil
+}
+
+// Fsck verifies the invariants the rest of the database relies on,
+// repairing any problems found when repair is set.
+//
+// This checks that:
+//   - each heap matches its inverse
+//   - each league and its sub-buckets exist
+//   - each stored item is indexed under each of its mods
+//   - each index entry only holds items with that mod, value and time
+//   - each item of each stash is stored
+//
+// The index of a league being reindexed is not checked.
+//
+// Repairing happens in a single write transaction so the database is
+// never left partially repaired.
+func Fsck(repair bool, db *bolt.DB) (*FsckReport, error) {
+	report := &FsckReport{Repair: repair}
+
+	update := db.View
+	if repair {
+		update = db.Update
+	}
+	err := update(func(tx *bolt.Tx) error {
+		return fsck(report, tx)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to check database")
+	}
+
+	return report, nil
+}
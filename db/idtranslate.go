@@ -67,19 +67,23 @@ func getTranslation(league LeagueHeapID,
 // This modifies the provided items if they are assigned an ID
 func GetTranslations(items []Item, db *bolt.DB) error {
 	return db.Update(func(tx *bolt.Tx) error {
+		return getTranslations(items, tx)
+	})
+}
 
-		for i, item := range items {
-			id, err := getTranslation(item.League, item.GGGID, tx)
-			if err != nil {
-				return err
-			}
-
-			item.ID = id
-			items[i] = item
+// getTranslations behaves as GetTranslations within tx
+func getTranslations(items []Item, tx *bolt.Tx) error {
+	for i, item := range items {
+		id, err := getTranslation(item.League, item.GGGID, tx)
+		if err != nil {
+			return err
 		}
 
-		return nil
-	})
+		item.ID = id
+		items[i] = item
+	}
+
+	return nil
 }
 
 // GetGGGIDTranslations associates each provided item with an interal ID
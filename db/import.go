@@ -0,0 +1,226 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// DefaultImportBatchSize is a sane number of stashes to add in a
+// single update when importing stash records.
+const DefaultImportBatchSize = 100
+
+// ImportOptions determines how records are imported by ImportJSONLines
+type ImportOptions struct {
+	// Time the first update is processed at, each following update is
+	// Step later. When zero, every update uses the time it is added.
+	Start time.Time
+	Step  time.Duration
+	// Maximum number of consecutive stash records added as a single
+	// update, DefaultImportBatchSize is used when less than 1
+	BatchSize int
+}
+
+// ImportReport represents the work done by ImportJSONLines
+type ImportReport struct {
+	// Number of records read of each kind
+	Responses, Stashes int
+	// Number of updates added, each processed at its own time
+	Updates int
+	// Combined stats of every update
+	Stats StashUpdateStats
+}
+
+func (r ImportReport) String() string {
+	return fmt.Sprintf("imported %d responses and %d stashes as %d updates\n%s",
+		r.Responses, r.Stashes, r.Updates, r.Stats)
+}
+
+// importer adds batches of stashes as updates
+type importer struct {
+	options ImportOptions
+	report  *ImportReport
+	db      *bolt.DB
+
+	// Stashes waiting to be added as a single update
+	pending []stash.Stash
+	// IDs of pending stashes so a stash is never in an update twice
+	pendingIDs map[string]struct{}
+}
+
+// when returns the time the next update is processed at
+func (im *importer) when() time.Time {
+	if im.options.Start.IsZero() {
+		return time.Now()
+	}
+	return im.options.Start.Add(time.Duration(im.report.Updates) * im.options.Step)
+}
+
+// add adds cleaned stashes as a single update
+func (im *importer) add(stashes []stash.Stash) error {
+	compactStashes, items, err := StashStashToCompact(stashes,
+		im.when(), im.db)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert fat stashes to compact")
+	}
+	stats, err := AddStashes(compactStashes, items, im.db)
+	if err != nil {
+		return errors.Wrap(err, "failed to store stashes")
+	}
+
+	im.report.Updates++
+	if stats != nil {
+		im.report.Stats.add(*stats)
+	}
+	return nil
+}
+
+// flush adds any pending stashes as an update
+func (im *importer) flush() error {
+	if len(im.pending) == 0 {
+		return nil
+	}
+	err := im.add(im.pending)
+	im.pending = nil
+	im.pendingIDs = make(map[string]struct{})
+	return err
+}
+
+// addStash queues a stash to be added alongside its neighbours
+func (im *importer) addStash(s stash.Stash) error {
+	if _, ok := im.pendingIDs[s.ID]; ok || len(im.pending) >= im.options.BatchSize {
+		if err := im.flush(); err != nil {
+			return err
+		}
+	}
+	im.pending = append(im.pending, s)
+	im.pendingIDs[s.ID] = struct{}{}
+	return nil
+}
+
+// addResponse adds a response as its own update, preserving the
+// order of everything read before it
+func (im *importer) addResponse(response stash.Response) error {
+	if err := im.flush(); err != nil {
+		return err
+	}
+	return im.add(response.Stashes)
+}
+
+// importLine adds the record on a single line
+func (im *importer) importLine(line []byte) error {
+	// A stash never has either key of a response
+	var response stash.Response
+	if err := response.UnmarshalJSON(line); err != nil {
+		return errors.Wrap(err, "failed to unmarshal record")
+	}
+	if response.NextChangeID != "" || response.Stashes != nil {
+		im.report.Responses++
+		if err := stash.CleanResponse(&response); err != nil {
+			return errors.Wrap(err, "failed to clean response")
+		}
+		return im.addResponse(response)
+	}
+
+	var s stash.Stash
+	if err := s.UnmarshalJSON(line); err != nil {
+		return errors.Wrap(err, "failed to unmarshal stash")
+	}
+	if err := stash.CleanStash(&s); err != nil {
+		return errors.Wrap(err, "failed to clean stash")
+	}
+	im.report.Stashes++
+	return im.addStash(s)
+}
+
+// ImportJSONLines adds the records in r, one JSON encoded stash.Stash or
+// stash.Response per line, as they would have been added when fetched.
+//
+// Each response is added as its own update while consecutive stashes are
+// added together in updates of up to options.BatchSize stashes. Setting
+// options.Start gives every update a fixed time so importing the same
+// records always produces the same database.
+func ImportJSONLines(r io.Reader, options ImportOptions,
+	db *bolt.DB) (*ImportReport, error) {
+
+	if options.BatchSize < 1 {
+		options.BatchSize = DefaultImportBatchSize
+	}
+	report := &ImportReport{}
+	im := &importer{
+		options:    options,
+		report:     report,
+		db:         db,
+		pendingIDs: make(map[string]struct{}),
+	}
+
+	// Lines holding entire responses are too long for a bufio.Scanner
+	reader := bufio.NewReader(r)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return report, errors.Wrap(err, "failed to read records")
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if err := im.importLine(trimmed); err != nil {
+				return report, errors.Wrapf(err, "failed to import line %d", number)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := im.flush(); err != nil {
+		return report, errors.Wrap(err, "failed to import stashes")
+	}
+	return report, nil
+}
+
+// ImportStashes adds every stash read from dec as processed at when,
+// in updates of up to batchSize stashes. A response can then be stored
+// as it is read without ever being held in memory whole.
+//
+// DefaultImportBatchSize is used when batchSize is less than 1.
+func ImportStashes(dec *stash.StashDecoder, when time.Time, batchSize int,
+	db *bolt.DB) (*ImportReport, error) {
+
+	if batchSize < 1 {
+		batchSize = DefaultImportBatchSize
+	}
+	report := &ImportReport{}
+	// Every update shares the same time, as they are a single response
+	im := &importer{
+		options:    ImportOptions{Start: when, BatchSize: batchSize},
+		report:     report,
+		db:         db,
+		pendingIDs: make(map[string]struct{}),
+	}
+
+	for {
+		var s stash.Stash
+		err := dec.Next(&s)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to read stash %d",
+				report.Stashes+1)
+		}
+		report.Stashes++
+		if err := im.addStash(s); err != nil {
+			return report, errors.Wrap(err, "failed to import stashes")
+		}
+	}
+
+	if err := im.flush(); err != nil {
+		return report, errors.Wrap(err, "failed to import stashes")
+	}
+	return report, nil
+}
@@ -3,8 +3,6 @@ package db
 import (
 	"fmt"
 
-	"bytes"
-
 	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 )
@@ -37,10 +35,19 @@ func getLeagueIndexBucket(league LeagueHeapID, tx *bolt.Tx) *bolt.Bucket {
 func getItemModIndexBucket(rootType, rootFlavor, mod StringHeapID,
 	league LeagueHeapID, tx *bolt.Tx) (*bolt.Bucket, error) {
 
+	return getModIndexBucketIn(getLeagueIndexBucket(league, tx),
+		rootType, rootFlavor, mod)
+}
+
+// getModIndexBucketIn returns the bucket for a given mod within
+// the provided index bucket.
+//
+// This WILL write if a bucket is not found. Hence, readonly tx unsafe.
+func getModIndexBucketIn(indexBucket *bolt.Bucket,
+	rootType, rootFlavor, mod StringHeapID) (*bolt.Bucket, error) {
+
 	var err error
 
-	// Start at the index bucket
-	indexBucket := getLeagueIndexBucket(league, tx)
 	rootTypeBucket := indexBucket.Bucket(rootType.ToBytes())
 	if rootTypeBucket == nil {
 		rootTypeBucket, err = indexBucket.CreateBucket(rootType.ToBytes())
@@ -100,12 +107,16 @@ func getItemModIndexBucketRO(rootType, rootFlavor, mod StringHeapID,
 
 // ModIndexKeySuffixLength allows us to fetch variable numbers
 // of pre-pended values given their length.
-const ModIndexKeySuffixLength = TimestampSize
+//
+// The suffix is the seconds of a Timestamp truncated to an index bucket.
+const ModIndexKeySuffixLength = timestampSecondsSize
 
 // encodeModIndexKey generates a mod key based off of the provided data
 //
 // The mod index key is generated as [mod.Values..., now, updateSequence]
-func encodeModIndexKey(mod ItemMod, now Timestamp) []byte {
+// where now is truncated to the league's IndexGranularity.
+func encodeModIndexKey(mod ItemMod, now Timestamp,
+	granularity IndexGranularity) []byte {
 
 	// Pre-allocate index key so the entire key can be
 	// encoded with a single allocation.
@@ -114,7 +125,7 @@ func encodeModIndexKey(mod ItemMod, now Timestamp) []byte {
 
 	// Generate the suffix
 	suffix := (indexKey[modsLength:])[:0] // Deal with pre-allocated space
-	suffix = append(suffix, now.TruncateToIndexBucket()[:]...)
+	suffix = append(suffix, now.TruncateToIndexBucket(granularity)[:]...)
 
 	if len(suffix) != ModIndexKeySuffixLength {
 		panic(fmt.Sprintf("unexpected suffix length, got %d, expected %d",
@@ -160,198 +171,324 @@ func decodeModIndexKey(key []byte) ([]uint16, error) {
 
 }
 
-// IndexItems adds tbe given items to their correct indices
-// for efficient lookup. Returns number of index entries added.
-//
-// Provided items CAN differ in their league.
-func IndexItems(items []Item, tx *bolt.Tx) (int, error) {
+// indexBatchKey identifies a single mod index bucket
+type indexBatchKey struct {
+	rootType, rootFlavor, mod StringHeapID
+	league                    LeagueHeapID
+	// Whether the bucket is within the league's shadow index
+	shadow bool
+}
 
-	// Sanity check passed in transaction, better to do this than panic.
-	if !tx.Writable() {
-		return 0, errors.New("cannot IndexItems on readonly transaction")
-	}
+// pendingIndexEntry holds every change to a single index key
+// which has yet to be written.
+type pendingIndexEntry struct {
+	bucket      *bolt.Bucket
+	key         []byte
+	add, remove []ID
+}
 
-	// Silently exit when no items present to add
-	if len(items) < 1 {
-		return 0, nil
+// indexBatch collects changes to the index so each key touched
+// is only read and rewritten once, regardless of how many items
+// share that key.
+type indexBatch struct {
+	tx *bolt.Tx
+	// Encoding every entry touched is written as
+	encoding IndexEncoding
+	buckets  map[indexBatchKey]*bolt.Bucket
+	entries  map[string]*pendingIndexEntry
+	// Pending entries in the order they were first touched
+	order []*pendingIndexEntry
+	// Reindexing state of each league touched, nil when not reindexing
+	reindexing map[LeagueHeapID]*reindexState
+	// IndexGranularity of each league touched
+	granularities map[LeagueHeapID]IndexGranularity
+}
+
+// newIndexBatch returns an empty indexBatch on a writable transaction
+func newIndexBatch(tx *bolt.Tx) (*indexBatch, error) {
+	encoding, err := getIndexEncoding(tx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get index encoding")
 	}
 
-	var added int
+	return &indexBatch{
+		tx:            tx,
+		encoding:      encoding,
+		buckets:       make(map[indexBatchKey]*bolt.Bucket),
+		entries:       make(map[string]*pendingIndexEntry),
+		reindexing:    make(map[LeagueHeapID]*reindexState),
+		granularities: make(map[LeagueHeapID]IndexGranularity),
+	}, nil
+}
 
-	for _, item := range items {
+// pending returns the pendingIndexEntry for a mod on an item
+// in either the league's index or its shadow index.
+func (batch *indexBatch) pending(item Item, mod ItemMod,
+	shadow bool) (*pendingIndexEntry, error) {
+
+	granularity, err := batch.granularity(item.League, shadow)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, mod := range item.Mods {
-			// Grab the bucket we can actually insert things into
+	bucketKey := indexBatchKey{item.RootType, item.RootFlavor, mod.Mod,
+		item.League, shadow}
+	return batch.pendingAt(bucketKey,
+		encodeModIndexKey(mod, item.When, granularity))
+}
 
-			itemModBucket, err := getItemModIndexBucket(item.RootType, item.RootFlavor,
-				mod.Mod, item.League, tx)
-			if err != nil {
-				return 0, errors.New("failed to get item mod bucket")
-			}
+// pendingAt returns the pendingIndexEntry for a key within
+// a mod index bucket
+func (batch *indexBatch) pendingAt(bucketKey indexBatchKey,
+	modKey []byte) (*pendingIndexEntry, error) {
 
-			modKey := encodeModIndexKey(mod, item.When)
+	bucket, ok := batch.buckets[bucketKey]
+	if !ok {
+		indexBucket := getLeagueIndexBucket(bucketKey.league, batch.tx)
+		if bucketKey.shadow {
+			indexBucket = getLeagueShadowIndexBucket(bucketKey.league, batch.tx)
+		}
 
-			// Check for pre-existing items in the bucket, if none, we establish
-			// the bucket
-			existing := itemModBucket.Get(modKey)
-			wrapped := IndexEntry(existing)
-			wrapped = IndexEntryAppend(wrapped, item.ID)
-			itemModBucket.Put(modKey, wrapped)
-			added++
+		var err error
+		bucket, err = getModIndexBucketIn(indexBucket, bucketKey.rootType,
+			bucketKey.rootFlavor, bucketKey.mod)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get item mod bucket")
 		}
+		batch.buckets[bucketKey] = bucket
 	}
 
-	return added, nil
+	// Key the pending entry by both its bucket and index key
+	entryKey := make([]byte, 0, StringHeapIDSize*3+LeagueHeapIDSize+1+len(modKey))
+	entryKey = append(entryKey, bucketKey.rootType.ToBytes()...)
+	entryKey = append(entryKey, bucketKey.rootFlavor.ToBytes()...)
+	entryKey = append(entryKey, bucketKey.mod.ToBytes()...)
+	entryKey = append(entryKey, bucketKey.league.ToBytes()...)
+	if bucketKey.shadow {
+		entryKey = append(entryKey, 1)
+	} else {
+		entryKey = append(entryKey, 0)
+	}
+	entryKey = append(entryKey, modKey...)
+
+	entry, ok := batch.entries[string(entryKey)]
+	if !ok {
+		entry = &pendingIndexEntry{bucket: bucket, key: modKey}
+		batch.entries[string(entryKey)] = entry
+		batch.order = append(batch.order, entry)
+	}
 
+	return entry, nil
 }
 
-// DeindexItems removes tbe given items from their correct indices
-//
-// If an index entry cannot be removed, we return an error. This ensures
-// all existing index entries must be alive
-func DeindexItems(items []Item, tx *bolt.Tx) error {
+// reindexState returns the reindexing state of a league,
+// nil when not reindexing
+func (batch *indexBatch) reindexState(league LeagueHeapID) (*reindexState, error) {
+	state, ok := batch.reindexing[league]
+	if !ok {
+		var err error
+		if state, err = getReindexState(league, batch.tx); err != nil {
+			return nil, err
+		}
+		batch.reindexing[league] = state
+	}
+	return state, nil
+}
 
-	// Sanity check passed in transaction, better to do this than panic.
-	if !tx.Writable() {
-		return errors.New("cannot IndexItems on readonly transaction")
+// granularity returns the IndexGranularity of either a league's
+// index or its shadow index.
+func (batch *indexBatch) granularity(league LeagueHeapID,
+	shadow bool) (IndexGranularity, error) {
+
+	if shadow {
+		state, err := batch.reindexState(league)
+		if err != nil {
+			return 0, err
+		}
+		if state == nil {
+			return 0, errors.Errorf("league=%d has no shadow index", league)
+		}
+		return state.Granularity, nil
 	}
 
-	// Silently exit when no items present to add
-	if len(items) < 1 {
-		return nil
+	granularity, ok := batch.granularities[league]
+	if !ok {
+		var err error
+		if granularity, err = getIndexGranularity(league, batch.tx); err != nil {
+			return 0, err
+		}
+		batch.granularities[league] = granularity
 	}
+	return granularity, nil
+}
 
-	for _, item := range items {
+// targets returns whether an item's changes belong in the
+// league's index and its shadow index.
+//
+// While a league is being reindexed, only items the rebuild has already
+// passed are changed in the index being rebuilt; the rest are picked up
+// by the rebuild itself.
+func (batch *indexBatch) targets(item Item) (index, shadow bool, err error) {
+	state, err := batch.reindexState(item.League)
+	if err != nil {
+		return false, false, err
+	}
+	if state == nil {
+		return true, false, nil
+	}
 
-		for _, mod := range item.Mods {
-			// Grab the bucket we can actually insert things into
-			itemModBucket, err := getItemModIndexBucket(item.RootType, item.RootFlavor,
-				mod.Mod, item.League, tx)
-			if err != nil {
-				return errors.New("failed to get item mod bucket")
-			}
+	passed := state.passed(item.ID)
+	if state.Shadow {
+		return true, passed, nil
+	}
+	return passed, false, nil
+}
 
-			modKey := encodeModIndexKey(mod, item.When)
-			existing := itemModBucket.Get(modKey)
-			wrapped := IndexEntry(existing)
-			wrapped = IndexEntryRemove(wrapped, item.ID)
-			if wrapped == nil {
-				// Nothing else resides at this index
-				itemModBucket.Delete(modKey)
-			} else {
-				// Add back with removed data
-				itemModBucket.Put(modKey, wrapped)
-			}
+// addTo registers every mod of an item to be indexed in either the
+// league's index or its shadow index.
+func (batch *indexBatch) addTo(item Item, shadow bool) error {
+	for _, mod := range item.Mods {
+		entry, err := batch.pending(item, mod, shadow)
+		if err != nil {
+			return err
 		}
+		entry.add = append(entry.add, item.ID)
 	}
-
 	return nil
+}
 
+// add registers every mod of an item to be indexed
+func (batch *indexBatch) add(item Item) (int, error) {
+	index, shadow, err := batch.targets(item)
+	if err != nil {
+		return 0, err
+	}
+	if index {
+		if err := batch.addTo(item, false); err != nil {
+			return 0, err
+		}
+	}
+	if shadow {
+		if err := batch.addTo(item, true); err != nil {
+			return 0, err
+		}
+	}
+	return len(item.Mods), nil
 }
 
-// IndexEntry represents bytes interpreted as an entry within the index
-//
-// Whenever possible, we avoid allocations.
-type IndexEntry []byte
+// removeFrom registers every mod of an item to be deindexed from
+// either the league's index or its shadow index.
+func (batch *indexBatch) removeFrom(item Item, shadow bool) error {
+	for _, mod := range item.Mods {
+		entry, err := batch.pending(item, mod, shadow)
+		if err != nil {
+			return err
+		}
+		entry.remove = append(entry.remove, item.ID)
+	}
+	return nil
+}
 
-// IndexEntryAppend adds another ID to the entry
-//
-// If an id is already present in the id, we end up with a duplicate.
-// Such is life.
-func IndexEntryAppend(entry IndexEntry, id ID) IndexEntry {
-	var result []byte
-	if entry == nil {
-		// Copy necessary due to boltdb semantics for passed buffers
-		result = make([]byte, len(id))
-		copy(result, id[:])
-	} else {
-		// We assume item not already present in bucket.
-		// If it is, we end up with a duplicate.
-		//
-		// Allocate a buffer large enough for an append
-		// without another allocation.
-		// Yes, this looks super dirty. TODO: cleanup D:
-		result = make([]byte, len(entry)+IDSize)[:0]
-		result = append(result, entry...)
-		result = append(result, id[:]...)
-	}
-
-	return IndexEntry(result)
+// remove registers every mod of an item to be deindexed
+func (batch *indexBatch) remove(item Item) error {
+	index, shadow, err := batch.targets(item)
+	if err != nil {
+		return err
+	}
+	if index {
+		if err := batch.removeFrom(item, false); err != nil {
+			return err
+		}
+	}
+	if shadow {
+		return batch.removeFrom(item, true)
+	}
+	return nil
 }
 
-// IndexEntryRemove removes a given ID from the entry
-//
-// If the ID is the last of the entry, the backing slice is set
-// to nil. In that case, its the callers responsibility to ensure they
-// Unwrap a valid byte slice.
-func IndexEntryRemove(entry IndexEntry, id ID) IndexEntry {
-
-	// If the backing array is nil, then we can't remove an ID
-	// and the database is inconsistent.
-	if entry == nil {
-		panic(fmt.Sprintf("attempted to remove ID from nil IndexEntry, id=%v",
-			id))
-	}
-
-	// For removal, we Stride over the array in IDSize increments
-	// and call Equal to determine which index we remove.
-	index := -1 // Index is in terms of IDSize increments
-	for i := 0; i < len(entry); i += IDSize {
-		equal := bytes.Equal(id[:], entry[i:i+IDSize])
-		if equal {
-			index = i
-			break
+// write merges every pending change into the index
+func (batch *indexBatch) write() error {
+	for _, pending := range batch.order {
+		existing := IndexEntry(pending.bucket.Get(pending.key))
+		merged := IndexEntryMergeAs(existing, pending.add, pending.remove,
+			batch.encoding)
+
+		var err error
+		if merged == nil {
+			// Nothing else resides at this index
+			err = pending.bucket.Delete(pending.key)
+		} else {
+			err = pending.bucket.Put(pending.key, merged)
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to write index entry")
 		}
 	}
+	return nil
+}
+
+// IndexItems adds tbe given items to their correct indices
+// for efficient lookup. Returns number of index entries added.
+//
+// Provided items CAN differ in their league.
+func IndexItems(items []Item, tx *bolt.Tx) (int, error) {
 
-	// If we can't find the ID, invalid index state, so panic.
-	if index == -1 {
-		panic(fmt.Sprintf("attempted to remove non-existent ID, id=%v", id))
+	// Sanity check passed in transaction, better to do this than panic.
+	if !tx.Writable() {
+		return 0, errors.New("cannot IndexItems on readonly transaction")
 	}
 
-	// Check if this is the last entry, if yes, then easy nil.
-	if len(entry) == IDSize {
-		return nil
+	// Silently exit when no items present to add
+	if len(items) < 1 {
+		return 0, nil
 	}
-	// Remove the entry using fewest allocations possible.
-	//
-	// We have to asssume our internal buffer for the entry came from
-	// bolt, hence the new buffer to mutate.
-	removed := make([]byte, len(entry)-IDSize)[:0]
-	removed = append(removed, entry[:index]...)
-	removed = append(removed, entry[index+IDSize:]...)
-	return removed
-}
 
-// ForEachID calls the provided callback with each id contained
-// within the IndexEntry. Order of returned IDs is in Append-descending
-func (entry IndexEntry) ForEachID(cb func(id ID)) {
-	var id ID
-	for i := 0; i < len(entry); i += IDSize {
-		copy(id[:], entry[i:i+IDSize])
-		cb(id)
+	var added int
+
+	batch, err := newIndexBatch(tx)
+	if err != nil {
+		return 0, err
 	}
+	for _, item := range items {
+		count, err := batch.add(item)
+		if err != nil {
+			return 0, err
+		}
+		added += count
+	}
+
+	return added, batch.write()
+
 }
 
-// GetIDs returns all IDs in the entry.
+// DeindexItems removes tbe given items from their correct indices
 //
-// Provided array slice will be resized if necessary or a new one
-// will be created if passed nil. Updated slice will be returned.
-func (entry IndexEntry) GetIDs(ids []ID) []ID {
+// If an index entry cannot be removed, we return an error. This ensures
+// all existing index entries must be alive
+func DeindexItems(items []Item, tx *bolt.Tx) error {
 
-	idCount := len(entry) / IDSize
-	if ids == nil || cap(ids) < idCount {
-		ids = make([]ID, idCount)
+	// Sanity check passed in transaction, better to do this than panic.
+	if !tx.Writable() {
+		return errors.New("cannot IndexItems on readonly transaction")
 	}
-	ids = ids[:0]
 
-	for i := 0; i < len(entry); i += IDSize {
-		var id ID
-		copy(id[:], entry[i:i+IDSize])
-		ids = append(ids, id)
+	// Silently exit when no items present to add
+	if len(items) < 1 {
+		return nil
+	}
+
+	batch, err := newIndexBatch(tx)
+	if err != nil {
+		return err
 	}
+	for _, item := range items {
+		if err := batch.remove(item); err != nil {
+			return err
+		}
+	}
+
+	return batch.write()
 
-	return ids
 }
 
 // IndexEntryCount returns the number of index entries across all leagues
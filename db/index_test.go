@@ -2,6 +2,8 @@ package db
 
 import "testing"
 import "bytes"
+import "fmt"
+import "sort"
 
 func TestIndexEntryAppendGet(t *testing.T) {
 	ids := []ID{
@@ -27,9 +29,333 @@ func TestIndexEntryAppendGet(t *testing.T) {
 			len(tinyIDs), len(ids))
 	}
 
+	// Entries are kept sorted
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
 	for i, id := range ids {
 		if !bytes.Equal(id[:], tinyIDs[i][:]) {
 			t.Fatal("mismatched compressed and decompressed results")
 		}
 	}
 }
+
+func TestIndexEntryRemove(t *testing.T) {
+	entry := IndexEntry(nil)
+	for i := uint64(1); i <= 300; i++ {
+		entry = IndexEntryAppend(entry, IDFromSequence(i*3))
+	}
+
+	// Remove every other ID, including the base
+	for i := uint64(1); i <= 300; i += 2 {
+		entry = IndexEntryRemove(entry, IDFromSequence(i*3))
+	}
+
+	if entry.Count() != 150 {
+		t.Fatalf("expected 150 ids after removal, got %d", entry.Count())
+	}
+	for i := uint64(1); i <= 300; i++ {
+		expected := i%2 == 0
+		if entry.Contains(IDFromSequence(i*3)) != expected {
+			t.Fatalf("wrong membership for %d, expected %t", i*3, expected)
+		}
+	}
+
+	for i := uint64(2); i <= 300; i += 2 {
+		entry = IndexEntryRemove(entry, IDFromSequence(i*3))
+	}
+	if entry != nil {
+		t.Fatalf("expected nil entry after removing every ID")
+	}
+}
+
+func TestIndexEntryMerge(t *testing.T) {
+	entry := IndexEntry(nil)
+	entry = IndexEntryMerge(entry, []ID{
+		IDFromSequence(10), IDFromSequence(5), IDFromSequence(70000),
+		IDFromSequence(5),
+	}, nil)
+	if entry.Count() != 3 {
+		t.Fatalf("expected 3 ids, got %d", entry.Count())
+	}
+
+	entry = IndexEntryMerge(entry,
+		[]ID{IDFromSequence(1), IDFromSequence(11)},
+		[]ID{IDFromSequence(10), IDFromSequence(70000)})
+
+	got := entry.GetIDs(nil)
+	expected := []ID{IDFromSequence(1), IDFromSequence(5), IDFromSequence(11)}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d ids, got %d", len(expected), len(got))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("mismatched id at %d, expected %v got %v",
+				i, expected[i], got[i])
+		}
+	}
+}
+
+func TestIndexEntryLegacy(t *testing.T) {
+	// Build an entry exactly as it used to be written
+	var legacy IndexEntry
+	for _, seq := range []uint64{9, 3, 7} {
+		legacy = legacyIndexEntryAppend(legacy, IDFromSequence(seq))
+	}
+	if legacy.Encoding() != IndexEncodingLegacy {
+		t.Fatalf("legacy entry detected as encoding %d", legacy.Encoding())
+	}
+	if !legacy.Contains(IDFromSequence(7)) || legacy.Count() != 3 {
+		t.Fatalf("failed to read legacy entry")
+	}
+
+	// Any write upgrades the entry
+	upgraded := IndexEntryRemove(legacy, IDFromSequence(9))
+	if upgraded.Encoding() != IndexEncodingSorted {
+		t.Fatalf("legacy entry not upgraded, encoding %d", upgraded.Encoding())
+	}
+	got := upgraded.GetIDs(nil)
+	if len(got) != 2 || got[0] != IDFromSequence(3) || got[1] != IDFromSequence(7) {
+		t.Fatalf("wrong ids after upgrade, got %v", got)
+	}
+
+	// Sequential IDs should be far more compact than the legacy format
+	var sorted IndexEntry
+	legacy = nil
+	for i := uint64(1000); i < 1100; i++ {
+		sorted = IndexEntryAppend(sorted, IDFromSequence(i))
+		legacy = legacyIndexEntryAppend(legacy, IDFromSequence(i))
+	}
+	if len(sorted)*2 > len(legacy) {
+		t.Fatalf("sorted entry not compact, %d bytes vs legacy %d bytes",
+			len(sorted), len(legacy))
+	}
+}
+
+// legacyIndexEntryAppend is IndexEntryAppend as it was prior to
+// entries being sorted, it exists to benchmark against.
+func legacyIndexEntryAppend(entry IndexEntry, id ID) IndexEntry {
+	result := make([]byte, len(entry)+IDSize)[:0]
+	result = append(result, entry...)
+	result = append(result, id[:]...)
+	return IndexEntry(result)
+}
+
+// legacyIndexEntryRemove is IndexEntryRemove as it was prior to
+// entries being sorted, it exists to benchmark against.
+func legacyIndexEntryRemove(entry IndexEntry, id ID) IndexEntry {
+	index := -1
+	for i := 0; i < len(entry); i += IDSize {
+		if bytes.Equal(id[:], entry[i:i+IDSize]) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		panic(fmt.Sprintf("attempted to remove non-existent ID, id=%v", id))
+	}
+	if len(entry) == IDSize {
+		return nil
+	}
+	removed := make([]byte, len(entry)-IDSize)[:0]
+	removed = append(removed, entry[:index]...)
+	removed = append(removed, entry[index+IDSize:]...)
+	return removed
+}
+
+// indexEntrySizes are the number of IDs sharing a key we benchmark with,
+// the largest approximates a hot bucket.
+var indexEntrySizes = []int{10, 100, 1000, 10000}
+
+// benchIndexEntry builds an entry of the given size using append
+func benchIndexEntry(size int,
+	appender func(IndexEntry, ID) IndexEntry) IndexEntry {
+
+	var entry IndexEntry
+	for i := 0; i < size; i++ {
+		entry = appender(entry, IDFromSequence(uint64(100000+i)))
+	}
+	return entry
+}
+
+func BenchmarkIndexEntryAppend(b *testing.B) {
+	for _, size := range indexEntrySizes {
+		b.Run(fmt.Sprintf("Sorted%d", size), func(b *testing.B) {
+			entry := benchIndexEntry(size, IndexEntryAppend)
+			next := IDFromSequence(uint64(100000 + size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				IndexEntryAppend(entry, next)
+			}
+		})
+		b.Run(fmt.Sprintf("Legacy%d", size), func(b *testing.B) {
+			entry := benchIndexEntry(size, legacyIndexEntryAppend)
+			next := IDFromSequence(uint64(100000 + size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				legacyIndexEntryAppend(entry, next)
+			}
+		})
+	}
+}
+
+func BenchmarkIndexEntryRemove(b *testing.B) {
+	for _, size := range indexEntrySizes {
+		// Remove from the end, the worst case for a linear scan
+		target := IDFromSequence(uint64(100000 + size - 1))
+		b.Run(fmt.Sprintf("Sorted%d", size), func(b *testing.B) {
+			entry := benchIndexEntry(size, IndexEntryAppend)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				IndexEntryRemove(entry, target)
+			}
+		})
+		b.Run(fmt.Sprintf("Legacy%d", size), func(b *testing.B) {
+			entry := benchIndexEntry(size, legacyIndexEntryAppend)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				legacyIndexEntryRemove(entry, target)
+			}
+		})
+	}
+}
+
+// BenchmarkIndexEntryMergeBatch adds 100 IDs to a single key, as happens
+// when a page touches the same key many times.
+func BenchmarkIndexEntryMergeBatch(b *testing.B) {
+	const batchSize = 100
+	for _, size := range indexEntrySizes {
+		batch := make([]ID, batchSize)
+		for i := range batch {
+			batch[i] = IDFromSequence(uint64(100000 + size + i))
+		}
+
+		b.Run(fmt.Sprintf("Sorted%d", size), func(b *testing.B) {
+			entry := benchIndexEntry(size, IndexEntryAppend)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				IndexEntryMerge(entry, batch, nil)
+			}
+		})
+		b.Run(fmt.Sprintf("Legacy%d", size), func(b *testing.B) {
+			entry := benchIndexEntry(size, legacyIndexEntryAppend)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				result := entry
+				for _, id := range batch {
+					result = legacyIndexEntryAppend(result, id)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexEntryRoaring(t *testing.T) {
+	// Span several containers with one dense enough to be a bitset
+	var add []ID
+	for i := uint64(0); i < bitmapArrayMaxSize+100; i++ {
+		add = append(add, IDFromSequence(70000+i))
+	}
+	for i := uint64(0); i < 10; i++ {
+		add = append(add, IDFromSequence(i*300000+1))
+	}
+
+	entry := IndexEntryMergeAs(nil, add, nil, IndexEncodingRoaring)
+	if entry.Encoding() != IndexEncodingRoaring {
+		t.Fatalf("expected roaring entry, got encoding %d", entry.Encoding())
+	}
+	if entry.Count() != len(add) {
+		t.Fatalf("expected %d ids, got %d", len(add), entry.Count())
+	}
+	for _, id := range add {
+		if !entry.Contains(id) {
+			t.Fatalf("roaring entry missing id %v", id)
+		}
+	}
+	if entry.Contains(IDFromSequence(2)) {
+		t.Fatalf("roaring entry contains id never added")
+	}
+
+	// Round trips must match the sorted encoding exactly
+	sorted := IndexEntryMergeAs(nil, add, nil, IndexEncodingSorted)
+	got, expected := entry.GetIDs(nil), sorted.GetIDs(nil)
+	if len(got) != len(expected) {
+		t.Fatalf("mismatched lengths, %d roaring != %d sorted",
+			len(got), len(expected))
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("mismatched id at %d, expected %v got %v",
+				i, expected[i], got[i])
+		}
+	}
+
+	// Writes preserve the encoding
+	entry = IndexEntryRemove(entry, IDFromSequence(70000))
+	entry = IndexEntryAppend(entry, IDFromSequence(5))
+	if entry.Encoding() != IndexEncodingRoaring {
+		t.Fatalf("write changed encoding to %d", entry.Encoding())
+	}
+	if entry.Contains(IDFromSequence(70000)) || !entry.Contains(IDFromSequence(5)) {
+		t.Fatalf("wrong membership after write")
+	}
+	if entry.Count() != len(add) {
+		t.Fatalf("expected %d ids after write, got %d", len(add), entry.Count())
+	}
+}
+
+func TestIDBitmapAnd(t *testing.T) {
+	// Cover array-array, array-bitset, and bitset-bitset containers
+	var left, right []uint64
+	for i := uint64(0); i < bitmapArrayMaxSize*2; i++ {
+		left = append(left, i*2)
+		right = append(right, i*3)
+	}
+	for i := uint64(0); i < 100; i++ {
+		left = append(left, 1<<20+i)
+		right = append(right, 1<<20+i*2)
+	}
+	left = sortUniqueSeqs(left)
+	right = sortUniqueSeqs(right)
+
+	var expected []uint64
+	contained := make(map[uint64]struct{})
+	for _, seq := range right {
+		contained[seq] = struct{}{}
+	}
+	for _, seq := range left {
+		if _, ok := contained[seq]; ok {
+			expected = append(expected, seq)
+		}
+	}
+
+	// Force an array container against the bitset in the first container
+	sparse := bitmapFromSorted(right[:50])
+	for _, pair := range []struct {
+		a, b     *idBitmap
+		expected int
+	}{
+		{bitmapFromSorted(left), bitmapFromSorted(right), len(expected)},
+		{bitmapFromSorted(left), sparse, 25},
+	} {
+		var got []uint64
+		pair.a.and(pair.b).forEach(func(seq uint64) {
+			got = append(got, seq)
+		})
+		if len(got) != pair.expected {
+			t.Fatalf("expected %d sequences, got %d", pair.expected, len(got))
+		}
+		for i, seq := range got {
+			if seq != expected[i] {
+				t.Fatalf("mismatched sequence at %d, expected %d got %d",
+					i, expected[i], seq)
+			}
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// IndexEntry represents bytes interpreted as an entry within the index
+//
+// An entry holds a sorted set of IDs and begins with a header describing
+// how they are encoded:
+//
+//	[flags][count uvarint][base uvarint][width][count*width deltas]
+//
+// Each ID is stored as its big endian delta from base using width bytes.
+// As IDs are assigned from a monotonic sequence, the IDs sharing an entry
+// are typically close together and the deltas are small. Fixed width deltas
+// keep the entry binary searchable.
+//
+// Entries can alternatively be encoded as a roaring style bitmap, see
+// encodeBitmapEntry, which is chosen per database by SetIndexEncoding.
+//
+// Entries written before the header existed are a plain concatenation
+// of IDs. Migrate rewrites those, though they are still read and are
+// upgraded on their next write.
+//
+// Whenever possible, we avoid allocations.
+type IndexEntry []byte
+
+// indexEntryHeaderFlag is set on the first byte of every entry
+// with a header.
+//
+// Legacy entries begin with the most significant byte of an ID, which
+// is always zero for any sequence we could realistically reach.
+const indexEntryHeaderFlag = 0x80
+
+// indexEntryEncodingMask masks the encoding out of the flags
+const indexEntryEncodingMask = 0x0f
+
+// IndexEncoding determines the layout of the IDs inside an IndexEntry
+type IndexEncoding byte
+
+const (
+	// IndexEncodingLegacy is a plain, unsorted concatenation of IDs
+	IndexEncodingLegacy IndexEncoding = 0
+	// IndexEncodingSorted is a sorted list of fixed width deltas
+	IndexEncodingSorted IndexEncoding = 1
+	// IndexEncodingRoaring is a roaring style bitmap
+	IndexEncodingRoaring IndexEncoding = 2
+)
+
+// Encoding returns how the entry is encoded
+func (entry IndexEntry) Encoding() IndexEncoding {
+	if len(entry) == 0 || entry[0]&indexEntryHeaderFlag == 0 {
+		return IndexEncodingLegacy
+	}
+	return IndexEncoding(entry[0] & indexEntryEncodingMask)
+}
+
+// sortedEntry is a decoded view over an IndexEncodingSorted IndexEntry
+type sortedEntry struct {
+	count  int
+	base   uint64
+	width  int
+	deltas []byte
+}
+
+// decodeSortedEntry returns a view over a sorted entry
+//
+// A malformed entry means the database is inconsistent, so we panic.
+func decodeSortedEntry(entry IndexEntry) sortedEntry {
+	var view sortedEntry
+
+	rest := entry[1:]
+	count, n := binary.Uvarint(rest)
+	if n <= 0 {
+		panic(fmt.Sprintf("malformed IndexEntry count, entry=%v", entry))
+	}
+	rest = rest[n:]
+	base, n := binary.Uvarint(rest)
+	if n <= 0 || len(rest) < n+1 {
+		panic(fmt.Sprintf("malformed IndexEntry base, entry=%v", entry))
+	}
+	rest = rest[n:]
+
+	view.count = int(count)
+	view.base = base
+	view.width = int(rest[0])
+	view.deltas = rest[1:]
+	if view.width < 1 || view.width > IDSize ||
+		len(view.deltas) != view.count*view.width {
+		panic(fmt.Sprintf("malformed IndexEntry deltas, entry=%v", entry))
+	}
+
+	return view
+}
+
+// at returns the sequence at the provided position
+func (view sortedEntry) at(i int) uint64 {
+	var delta uint64
+	for _, b := range view.deltas[i*view.width : (i+1)*view.width] {
+		delta = delta<<8 | uint64(b)
+	}
+	return view.base + delta
+}
+
+// search returns the position of seq in the entry or where it
+// would be inserted alongside whether it was found.
+func (view sortedEntry) search(seq uint64) (int, bool) {
+	i := sort.Search(view.count, func(i int) bool {
+		return view.at(i) >= seq
+	})
+	return i, i < view.count && view.at(i) == seq
+}
+
+// deltaWidth returns the number of bytes needed to represent delta
+func deltaWidth(delta uint64) int {
+	width := 1
+	for delta > 0xff {
+		delta >>= 8
+		width++
+	}
+	return width
+}
+
+// sortedHeaderMaxSize is the largest a sorted entry's header can be
+const sortedHeaderMaxSize = 1 + binary.MaxVarintLen64*2 + 1
+
+// putSortedHeader writes the header of a sorted entry to the front of buf,
+// returning the number of bytes written.
+func putSortedHeader(buf []byte, count int, base uint64, width int) int {
+	buf[0] = indexEntryHeaderFlag | byte(IndexEncodingSorted)
+	offset := 1
+	offset += binary.PutUvarint(buf[offset:], uint64(count))
+	offset += binary.PutUvarint(buf[offset:], base)
+	buf[offset] = byte(width)
+	return offset + 1
+}
+
+// putDelta writes delta as width big endian bytes to the front of buf
+func putDelta(buf []byte, delta uint64, width int) {
+	for b := width - 1; b >= 0; b-- {
+		buf[b] = byte(delta)
+		delta >>= 8
+	}
+}
+
+// encodeSortedEntry encodes sorted, unique sequences into an IndexEntry
+//
+// Returns nil if no sequences are provided.
+func encodeSortedEntry(seqs []uint64) IndexEntry {
+	if len(seqs) == 0 {
+		return nil
+	}
+
+	base := seqs[0]
+	width := deltaWidth(seqs[len(seqs)-1] - base)
+
+	entry := make([]byte, sortedHeaderMaxSize+len(seqs)*width)
+	offset := putSortedHeader(entry, len(seqs), base, width)
+	for _, seq := range seqs {
+		putDelta(entry[offset:], seq-base, width)
+		offset += width
+	}
+
+	return IndexEntry(entry[:offset])
+}
+
+// idToSeq converts an ID back into the sequence it was created from
+func idToSeq(id ID) uint64 {
+	return btoi64(id[:])
+}
+
+// sequences returns every ID in the entry as sorted, unique sequences
+func (entry IndexEntry) sequences() []uint64 {
+	if len(entry) == 0 {
+		return nil
+	}
+
+	if entry.Encoding() == IndexEncodingLegacy {
+		seqs := make([]uint64, 0, len(entry)/IDSize)
+		for i := 0; i+IDSize <= len(entry); i += IDSize {
+			seqs = append(seqs, btoi64(entry[i:i+IDSize]))
+		}
+		return sortUniqueSeqs(seqs)
+	}
+
+	if entry.Encoding() == IndexEncodingRoaring {
+		seqs := make([]uint64, 0, entry.Count())
+		decodeBitmapEntry(entry).forEach(func(seq uint64) {
+			seqs = append(seqs, seq)
+		})
+		return seqs
+	}
+
+	view := decodeSortedEntry(entry)
+	seqs := make([]uint64, view.count)
+	for i := range seqs {
+		seqs[i] = view.at(i)
+	}
+	return seqs
+}
+
+// bitmap returns every ID in the entry as an idBitmap
+func (entry IndexEntry) bitmap() *idBitmap {
+	if entry.Encoding() == IndexEncodingRoaring {
+		return decodeBitmapEntry(entry)
+	}
+	return bitmapFromSorted(entry.sequences())
+}
+
+// sortUniqueSeqs sorts the provided sequences and removes duplicates
+// in place, returning the result.
+func sortUniqueSeqs(seqs []uint64) []uint64 {
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	unique := seqs[:0]
+	for i, seq := range seqs {
+		if i > 0 && seq == seqs[i-1] {
+			continue
+		}
+		unique = append(unique, seq)
+	}
+	return unique
+}
+
+// IndexEntryAppend adds another ID to the entry
+//
+// If an id is already present in the entry, the entry is unchanged.
+func IndexEntryAppend(entry IndexEntry, id ID) IndexEntry {
+	if len(entry) == 0 || entry.Encoding() != IndexEncodingSorted {
+		return IndexEntryMerge(entry, []ID{id}, nil)
+	}
+
+	view := decodeSortedEntry(entry)
+	seq := idToSeq(id)
+
+	// An ID outside of what the base and width can represent
+	// requires the entire entry be re-encoded.
+	if seq < view.base || deltaWidth(seq-view.base) > view.width {
+		return IndexEntryMerge(entry, []ID{id}, nil)
+	}
+
+	// Copy necessary due to boltdb semantics for passed buffers
+	index, ok := view.search(seq)
+	if ok {
+		result := make([]byte, len(entry))
+		copy(result, entry)
+		return IndexEntry(result)
+	}
+
+	// Insert the delta in place, as IDs are sequentially assigned this
+	// is almost always at the end.
+	result := make([]byte, sortedHeaderMaxSize+len(view.deltas)+view.width)
+	offset := putSortedHeader(result, view.count+1, view.base, view.width)
+	offset += copy(result[offset:], view.deltas[:index*view.width])
+	putDelta(result[offset:], seq-view.base, view.width)
+	offset += view.width
+	offset += copy(result[offset:], view.deltas[index*view.width:])
+
+	return IndexEntry(result[:offset])
+}
+
+// IndexEntryRemove removes a given ID from the entry
+//
+// If the ID is the last of the entry, the backing slice is set
+// to nil. In that case, its the callers responsibility to ensure they
+// Unwrap a valid byte slice.
+func IndexEntryRemove(entry IndexEntry, id ID) IndexEntry {
+
+	// If the backing array is nil, then we can't remove an ID
+	// and the database is inconsistent.
+	if entry == nil {
+		panic(fmt.Sprintf("attempted to remove ID from nil IndexEntry, id=%v",
+			id))
+	}
+
+	if entry.Encoding() != IndexEncodingSorted {
+		return IndexEntryMerge(entry, nil, []ID{id})
+	}
+
+	view := decodeSortedEntry(entry)
+	index, ok := view.search(idToSeq(id))
+
+	// If we can't find the ID, invalid index state, so panic.
+	if !ok {
+		panic(fmt.Sprintf("attempted to remove non-existent ID, id=%v", id))
+	}
+
+	// Check if this is the last entry, if yes, then easy nil.
+	if view.count == 1 {
+		return nil
+	}
+
+	// The remaining deltas are still valid against the same base
+	// and width, so the entry only needs a fresh header.
+	//
+	// We have to asssume our internal buffer for the entry came from
+	// bolt, hence the new buffer to mutate.
+	removed := make([]byte, sortedHeaderMaxSize+len(view.deltas)-view.width)
+	offset := putSortedHeader(removed, view.count-1, view.base, view.width)
+	offset += copy(removed[offset:], view.deltas[:index*view.width])
+	offset += copy(removed[offset:], view.deltas[(index+1)*view.width:])
+
+	return IndexEntry(removed[:offset])
+}
+
+// IndexEntryMerge adds and removes many IDs from the entry at once,
+// rewriting the entry a single time.
+//
+// IDs to add which are already present are ignored. Removing an ID which
+// is not present means the index is inconsistent, so we panic.
+//
+// The entry keeps its encoding unless it is a legacy entry, which
+// becomes IndexEncodingSorted.
+//
+// If no IDs remain, nil is returned.
+func IndexEntryMerge(entry IndexEntry, add, remove []ID) IndexEntry {
+	encoding := entry.Encoding()
+	if encoding == IndexEncodingLegacy {
+		encoding = IndexEncodingSorted
+	}
+	return IndexEntryMergeAs(entry, add, remove, encoding)
+}
+
+// IndexEntryMergeAs behaves as IndexEntryMerge but always writes the
+// result with the provided encoding.
+func IndexEntryMergeAs(entry IndexEntry, add, remove []ID,
+	encoding IndexEncoding) IndexEntry {
+
+	existing := entry.sequences()
+
+	adding := make([]uint64, len(add))
+	for i, id := range add {
+		adding[i] = idToSeq(id)
+	}
+	adding = sortUniqueSeqs(adding)
+
+	removing := make([]uint64, len(remove))
+	for i, id := range remove {
+		removing[i] = idToSeq(id)
+	}
+	removing = sortUniqueSeqs(removing)
+
+	// Merge the three sorted lists in a single pass
+	merged := make([]uint64, 0, len(existing)+len(adding))
+	var e, a, r int
+	for e < len(existing) || a < len(adding) {
+		var next uint64
+		switch {
+		case a >= len(adding) ||
+			(e < len(existing) && existing[e] < adding[a]):
+			next = existing[e]
+			e++
+		case e >= len(existing) || adding[a] < existing[e]:
+			next = adding[a]
+			a++
+		default:
+			// Present in both, keep a single copy
+			next = existing[e]
+			e++
+			a++
+		}
+
+		// Skip anything we're removing
+		for r < len(removing) && removing[r] < next {
+			panic(fmt.Sprintf("attempted to remove non-existent ID, id=%v",
+				IDFromSequence(removing[r])))
+		}
+		if r < len(removing) && removing[r] == next {
+			r++
+			continue
+		}
+		merged = append(merged, next)
+	}
+	if r < len(removing) {
+		panic(fmt.Sprintf("attempted to remove non-existent ID, id=%v",
+			IDFromSequence(removing[r])))
+	}
+
+	switch encoding {
+	case IndexEncodingSorted:
+		return encodeSortedEntry(merged)
+	case IndexEncodingRoaring:
+		return encodeBitmapEntry(bitmapFromSorted(merged))
+	default:
+		panic(fmt.Sprintf("cannot write IndexEntry with encoding %d", encoding))
+	}
+}
+
+// Contains determines if the provided ID is present in the entry
+func (entry IndexEntry) Contains(id ID) bool {
+	if len(entry) == 0 {
+		return false
+	}
+
+	if entry.Encoding() == IndexEncodingLegacy {
+		for i := 0; i+IDSize <= len(entry); i += IDSize {
+			if bytes.Equal(id[:], entry[i:i+IDSize]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if entry.Encoding() == IndexEncodingRoaring {
+		return decodeBitmapEntry(entry).contains(idToSeq(id))
+	}
+
+	_, ok := decodeSortedEntry(entry).search(idToSeq(id))
+	return ok
+}
+
+// ForEachID calls the provided callback with each id contained
+// within the IndexEntry. IDs are provided in ascending order unless
+// the entry is a legacy entry, which is in Append-order.
+func (entry IndexEntry) ForEachID(cb func(id ID)) {
+	if len(entry) == 0 {
+		return
+	}
+
+	if entry.Encoding() == IndexEncodingLegacy {
+		var id ID
+		for i := 0; i+IDSize <= len(entry); i += IDSize {
+			copy(id[:], entry[i:i+IDSize])
+			cb(id)
+		}
+		return
+	}
+
+	if entry.Encoding() == IndexEncodingRoaring {
+		decodeBitmapEntry(entry).forEach(func(seq uint64) {
+			cb(IDFromSequence(seq))
+		})
+		return
+	}
+
+	view := decodeSortedEntry(entry)
+	for i := 0; i < view.count; i++ {
+		cb(IDFromSequence(view.at(i)))
+	}
+}
+
+// Count returns the number of IDs contained within the IndexEntry
+func (entry IndexEntry) Count() int {
+	if len(entry) == 0 {
+		return 0
+	}
+
+	if entry.Encoding() == IndexEncodingLegacy {
+		return len(entry) / IDSize
+	}
+
+	count, n := binary.Uvarint(entry[1:])
+	if n <= 0 {
+		panic(fmt.Sprintf("malformed IndexEntry count, entry=%v", entry))
+	}
+	return int(count)
+}
+
+// GetIDs returns all IDs in the entry.
+//
+// Provided array slice will be resized if necessary or a new one
+// will be created if passed nil. Updated slice will be returned.
+func (entry IndexEntry) GetIDs(ids []ID) []ID {
+
+	idCount := entry.Count()
+	if ids == nil || cap(ids) < idCount {
+		ids = make([]ID, idCount)
+	}
+	ids = ids[:0]
+
+	entry.ForEachID(func(id ID) {
+		ids = append(ids, id)
+	})
+
+	return ids
+}
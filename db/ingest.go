@@ -0,0 +1,535 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// ingestCheckpointKey holds the change ID following the last page
+// committed by Ingest in the settings bucket
+const ingestCheckpointKey = "ingestCheckpoint"
+
+// DefaultIngestPrefetch is the number of pages fetched ahead of those
+// being decoded when none is provided
+const DefaultIngestPrefetch = 4
+
+// DefaultIngestBatch is the most pages committed in a single write when
+// none is provided
+const DefaultIngestBatch = 8
+
+// ingestStashBuffer is the most stashes of a page decoded ahead of
+// the writer, bounding the memory used by pages waiting to be written
+const ingestStashBuffer = 64
+
+// IngestCheckpoint returns the change ID Ingest continues from, empty if
+// nothing has been ingested
+func IngestCheckpoint(db *bolt.DB) (string, error) {
+	var changeID string
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(settingsBucket))
+		if b == nil {
+			return errors.Errorf("%s bucket not found", settingsBucket)
+		}
+		changeID = string(b.Get([]byte(ingestCheckpointKey)))
+		return nil
+	})
+	return changeID, err
+}
+
+// putIngestCheckpoint records the change ID Ingest continues from
+func putIngestCheckpoint(changeID string, tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return errors.Errorf("%s bucket not found", settingsBucket)
+	}
+	return b.Put([]byte(ingestCheckpointKey), []byte(changeID))
+}
+
+// IngestOptions determines how Ingest fetches and stores updates
+type IngestOptions struct {
+	// Change to start from, the checkpoint of an earlier Ingest when empty
+	ChangeID string
+	// Pages fetched ahead of those being decoded and decoded ahead of
+	// those being written, DefaultIngestPrefetch when less than 1
+	Prefetch int
+	// Pages decoded concurrently, runtime.NumCPU when less than 1
+	Decoders int
+	// Most pages committed in a single write, DefaultIngestBatch when
+	// less than 1
+	Batch int
+	// Called after each write when non-nil
+	Progress func(IngestStats)
+	// Snapshots of the database are taken on this schedule while
+	// ingesting when non-nil, see RunSnapshots
+	Snapshots *SnapshotSchedule
+	// Called with the outcome of each snapshot when non-nil
+	Snapshotted func(*BackupReport, error)
+}
+
+// IngestStats represents the work done by Ingest and where it is
+// waiting, which shows the stage holding it back
+type IngestStats struct {
+	// Pages passing through each stage
+	Fetched, Decoded, Written int
+	// Writes made, each of up to Batch pages
+	Batches int
+	// Combined stats of every page written
+	Stats StashUpdateStats
+	// Pages waiting to be decoded and written as of the last write
+	DecodeQueue, WriteQueue int
+	// Time fetching spent waiting on decoders and decoders spent waiting
+	// on the writer. Either growing means the following stage is behind.
+	FetchBlocked, DecodeBlocked time.Duration
+	// Time the writer spent waiting for pages, growing when keeping up
+	WriteIdle time.Duration
+	// Change ID following the last page written
+	NextChangeID string
+	Took         time.Duration
+}
+
+func (s IngestStats) String() string {
+	return fmt.Sprintf("ingested %d pages in %d writes in %s, next id=%s\n"+
+		"  %d fetched, %d decoded | queued %d to decode, %d to write\n"+
+		"  fetch blocked %s | decode blocked %s | write idle %s\n%s",
+		s.Written, s.Batches, s.Took, s.NextChangeID,
+		s.Fetched, s.Decoded, s.DecodeQueue, s.WriteQueue,
+		s.FetchBlocked, s.DecodeBlocked, s.WriteIdle, s.Stats)
+}
+
+// ingestStash is a single stash decoded from a page or the failure
+// decoding it
+type ingestStash struct {
+	stash stash.Stash
+	err   error
+}
+
+// ingestPage is a single page passing through the pipeline
+type ingestPage struct {
+	// Position of the page, pages are written strictly in this order
+	seq      int
+	changeID string
+	next     string
+	// When the page was fetched, which is when its stashes were seen
+	when time.Time
+	// Page as fetched, held until written so it can be decoded again
+	raw []byte
+	// Stashes of the page in order as they are decoded, closed once
+	// every stash has been decoded or decoding fails
+	stashes chan ingestStash
+}
+
+// each passes each stash of the page to add in order, stopping at the
+// first failure. Stashes are received from the page's decoder unless
+// redecode is set, when they are decoded again from raw.
+func (page ingestPage) each(redecode bool, add func(stash.Stash) error) error {
+	if !redecode {
+		for decoded := range page.stashes {
+			if decoded.err != nil {
+				return decoded.err
+			}
+			if err := add(decoded.stash); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	dec := stash.NewStashDecoder(bytes.NewReader(page.raw))
+	for {
+		var s stash.Stash
+		err := dec.Next(&s)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := add(s); err != nil {
+			return err
+		}
+	}
+}
+
+// discard drains the stashes of a page which will not be written so
+// its decoder can move on
+func (page ingestPage) discard() {
+	for range page.stashes {
+	}
+}
+
+// ingester holds the state shared by each stage of Ingest
+type ingester struct {
+	options IngestOptions
+	fetcher *stash.Fetcher
+	db      *bolt.DB
+	start   time.Time
+
+	fetched chan ingestPage
+	decoded chan ingestPage
+
+	lock  sync.Mutex
+	stats IngestStats
+	// First failure of any stage
+	err error
+}
+
+// fail records the first failure of any stage
+func (in *ingester) fail(err error) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.err == nil {
+		in.err = err
+	}
+}
+
+// update modifies the stats under lock
+func (in *ingester) update(modify func(stats *IngestStats)) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	modify(&in.stats)
+}
+
+// snapshot returns a copy of the stats as of now
+func (in *ingester) snapshot() IngestStats {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	stats := in.stats
+	stats.DecodeQueue = len(in.fetched)
+	stats.WriteQueue = len(in.decoded)
+	stats.Took = time.Since(in.start)
+	return stats
+}
+
+// fetch requests pages in order until ctx is done, requesting each page
+// as soon as the previous one arrives
+func (in *ingester) fetch(ctx context.Context, changeID string) {
+	defer close(in.fetched)
+
+	for seq := 0; ; {
+		raw, err := in.fetcher.FetchRaw(ctx, changeID)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			in.fail(errors.Wrapf(err, "failed to fetch id=%s", changeID))
+			return
+		}
+		next, err := stash.PeekNextChangeID(raw)
+		if err != nil {
+			in.fail(errors.Wrapf(err, "failed to read id=%s", changeID))
+			return
+		}
+		// Caught up to the latest change, nothing new to add
+		if next == changeID {
+			continue
+		}
+
+		page := ingestPage{
+			seq:      seq,
+			changeID: changeID,
+			next:     next,
+			when:     time.Now(),
+			raw:      raw,
+		}
+		blocked := time.Now()
+		select {
+		case in.fetched <- page:
+		case <-ctx.Done():
+			return
+		}
+		in.update(func(stats *IngestStats) {
+			stats.Fetched++
+			stats.FetchBlocked += time.Since(blocked)
+		})
+		seq++
+		changeID = next
+	}
+}
+
+// decode decodes and cleans pages a stash at a time until fetching
+// stops. Each page is passed on as soon as decoding starts and its
+// stashes follow as they are decoded, so at most ingestStashBuffer of
+// its decoded stashes wait on the writer.
+func (in *ingester) decode() {
+	for page := range in.fetched {
+		page.stashes = make(chan ingestStash, ingestStashBuffer)
+
+		blocked := time.Now()
+		in.decoded <- page
+		waited := time.Since(blocked)
+
+		dec := stash.NewStashDecoder(bytes.NewReader(page.raw))
+		for {
+			var decoded ingestStash
+			decoded.err = dec.Next(&decoded.stash)
+			if decoded.err == io.EOF {
+				break
+			}
+			blocked := time.Now()
+			page.stashes <- decoded
+			waited += time.Since(blocked)
+			if decoded.err != nil {
+				break
+			}
+		}
+		close(page.stashes)
+
+		in.update(func(stats *IngestStats) {
+			stats.Decoded++
+			stats.DecodeBlocked += waited
+		})
+	}
+}
+
+// commit writes consecutive pages alongside the change ID following
+// them in a single update, so a stopped Ingest resumes exactly where
+// the last update ended. When a page fails to decode, the pages before
+// it are decoded again and written without it.
+func (in *ingester) commit(pages []ingestPage) error {
+	broken, err := in.store(pages, false)
+	if err != nil && broken > 0 {
+		if _, err := in.store(pages[:broken], true); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// store writes pages in a single update, compacting and storing each
+// stash as it is decoded. On failure, the position of the page which
+// failed to decode is returned or -1 when writing failed otherwise.
+func (in *ingester) store(pages []ingestPage, redecode bool) (int, error) {
+	var total StashUpdateStats
+	last := pages[len(pages)-1]
+	broken := -1
+
+	err := in.db.Update(func(tx *bolt.Tx) error {
+		for i, page := range pages {
+			// Stashes are seen when their page was fetched, even once
+			// emptied of items
+			seen := TimeToTimestamp(page.when)
+			var failed error
+			err := page.each(redecode, func(s stash.Stash) error {
+				stashes, items, err := stashStashToCompact([]stash.Stash{s},
+					page.when, tx)
+				if err != nil {
+					failed = errors.Wrapf(err,
+						"failed to convert fat stashes to compact, id=%s", page.changeID)
+					return failed
+				}
+				stats, err := addStashesSeen(stashes, items, seen, tx)
+				if err != nil {
+					failed = errors.Wrapf(err, "failed to store stashes, id=%s",
+						page.changeID)
+					return failed
+				}
+				if stats != nil {
+					total.add(*stats)
+				}
+				return nil
+			})
+			if failed != nil {
+				return failed
+			}
+			if err != nil {
+				broken = i
+				return errors.Wrapf(err, "failed to decode id=%s", page.changeID)
+			}
+		}
+
+		if err := putIngestCheckpoint(last.next, tx); err != nil {
+			return errors.Wrap(err, "failed to record ingest checkpoint")
+		}
+		return nil
+	})
+	if err != nil {
+		return broken, err
+	}
+
+	in.update(func(stats *IngestStats) {
+		stats.Written += len(pages)
+		stats.Batches++
+		stats.Stats.add(total)
+		stats.NextChangeID = last.next
+	})
+	return broken, nil
+}
+
+// write commits decoded pages strictly in order until decoding stops.
+// Once anything fails nothing further is committed, though the stashes
+// of every page are still drained so earlier stages can finish.
+func (in *ingester) write(cancel context.CancelFunc) {
+	pending := make(map[int]ingestPage)
+	next := 0
+	failed := false
+
+	for {
+		idle := time.Now()
+		page, ok := <-in.decoded
+		in.update(func(stats *IngestStats) {
+			stats.WriteIdle += time.Since(idle)
+		})
+		if !ok {
+			return
+		}
+		if failed {
+			page.discard()
+			continue
+		}
+		pending[page.seq] = page
+
+		// Gather whatever else is ready without waiting
+	drain:
+		for len(pending) < in.options.Batch*2 {
+			select {
+			case page, ok := <-in.decoded:
+				if !ok {
+					break drain
+				}
+				pending[page.seq] = page
+			default:
+				break drain
+			}
+		}
+
+		for !failed {
+			var batch []ingestPage
+			for len(batch) < in.options.Batch {
+				page, ok := pending[next]
+				if !ok {
+					break
+				}
+				batch = append(batch, page)
+				delete(pending, next)
+				next++
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := in.commit(batch); err != nil {
+				in.fail(err)
+				failed = true
+				for _, page := range batch {
+					page.discard()
+				}
+				break
+			}
+			if in.options.Progress != nil {
+				in.options.Progress(in.snapshot())
+			}
+		}
+		if failed {
+			cancel()
+			for seq, page := range pending {
+				page.discard()
+				delete(pending, seq)
+			}
+		}
+	}
+}
+
+// Ingest fetches updates starting from options.ChangeID, or where an
+// earlier Ingest stopped, and stores them until ctx is done.
+//
+// Fetching, decoding and writing run concurrently, connected by queues
+// of options.Prefetch pages. The next page is requested as soon as the
+// previous arrives while options.Decoders decode and clean pages in
+// parallel. Pages are held only as fetched; each stash is decoded,
+// compacted and stored in turn rather than holding a page's decoded
+// stashes all at once. A single writer commits
+// pages strictly in the order they were fetched, up to options.Batch in
+// a single transaction alongside the change ID following the last of
+// them.
+//
+// When options.Snapshots is set, snapshots are taken on its schedule
+// until Ingest returns.
+//
+// Once ctx is done fetching stops and every page already fetched is
+// written before returning. When any stage fails, nothing after the last
+// page committed before the failure is written and the failure is
+// returned.
+func Ingest(ctx context.Context, fetcher *stash.Fetcher,
+	options IngestOptions, db *bolt.DB) (*IngestStats, error) {
+
+	if options.Prefetch < 1 {
+		options.Prefetch = DefaultIngestPrefetch
+	}
+	if options.Decoders < 1 {
+		options.Decoders = runtime.NumCPU()
+	}
+	if options.Batch < 1 {
+		options.Batch = DefaultIngestBatch
+	}
+
+	if options.Snapshots != nil && options.Snapshots.Interval <= 0 {
+		return nil, errors.New("snapshot Interval must be positive")
+	}
+
+	changeID := options.ChangeID
+	if changeID == "" {
+		var err error
+		changeID, err = IngestCheckpoint(db)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ingest checkpoint")
+		}
+	}
+
+	in := &ingester{
+		options: options,
+		fetcher: fetcher,
+		db:      db,
+		start:   time.Now(),
+		fetched: make(chan ingestPage, options.Prefetch),
+		decoded: make(chan ingestPage, options.Prefetch),
+	}
+	in.stats.NextChangeID = changeID
+
+	// Failures stop fetching through their own cancellation, so ctx
+	// being done alone means stopping was requested
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var decoders sync.WaitGroup
+	for i := 0; i < options.Decoders; i++ {
+		decoders.Add(1)
+		go func() {
+			defer decoders.Done()
+			in.decode()
+		}()
+	}
+	go func() {
+		decoders.Wait()
+		close(in.decoded)
+	}()
+	go in.fetch(fetchCtx, changeID)
+
+	var snapshots sync.WaitGroup
+	stopSnapshots := make(chan struct{})
+	if options.Snapshots != nil {
+		snapshots.Add(1)
+		go func() {
+			defer snapshots.Done()
+			// Interval was checked above, so this only returns once stopped
+			RunSnapshots(*options.Snapshots, stopSnapshots,
+				options.Snapshotted, db)
+		}()
+	}
+
+	in.write(cancel)
+
+	close(stopSnapshots)
+	snapshots.Wait()
+
+	stats := in.snapshot()
+	return &stats, in.err
+}
@@ -17,6 +17,7 @@ const leagueNamespaceBucket string = "leagueNamespace"
 // Any league will always contain these
 var leagueSubBuckets = []string{
 	itemStoreBucket, indiceBucket, idTranslateBucket, stashBucket,
+	stashSeenBucket,
 }
 
 // getLeagueBucket returns the top-level bucket for a specific league
@@ -42,6 +43,13 @@ func getLeagueBucket(league LeagueHeapID, tx *bolt.Tx) *bolt.Bucket {
 		if err := addLeagueSubBuckets(leagueBucket, tx); err != nil {
 			panic(fmt.Sprintf("cannot create league sub buckets, err=%s", err))
 		}
+		// Record the granularity so changing the default later
+		// doesn't change how existing leagues are keyed
+		err = leagueBucket.Put([]byte(indexGranularityKey),
+			[]byte{byte(DefaultIndexGranularity)})
+		if err != nil {
+			panic(fmt.Sprintf("cannot set league index granularity, err=%s", err))
+		}
 	}
 	return leagueBucket
 }
@@ -191,6 +199,18 @@ func ListLeagues(db *bolt.DB) ([]string, error) {
 
 }
 
+// inflateLeague returns the string represenation of the given LeagueHeapID
+func inflateLeague(id LeagueHeapID, tx *bolt.Tx) string {
+	// Fetch the inverter bucket
+	var inverter *bolt.Bucket
+	if inverter = tx.Bucket([]byte(leagueHeapInverseBucket)); inverter == nil {
+		panic(fmt.Sprintf("%s does not exist when assumed", leagueHeapInverseBucket))
+	}
+
+	// Fetch the string from the inverter
+	return string(inverter.Get(id.ToBytes()))
+}
+
 // InflateLeague returns the string represenation of the given LeagueHeapID
 //
 // If you are providing a valid LeagueHeapID, this should never fail.
@@ -199,17 +219,7 @@ func InflateLeague(id LeagueHeapID, db *bolt.DB) string {
 	var result string
 
 	db.View(func(tx *bolt.Tx) error {
-
-		// Fetch the inverter bucket
-		var inverter *bolt.Bucket
-		if inverter = tx.Bucket([]byte(leagueHeapInverseBucket)); inverter == nil {
-			panic(fmt.Sprintf("%s does not exist when assumed", leagueHeapInverseBucket))
-		}
-
-		// Fetch the string from the inverter
-		resultBytes := inverter.Get(id.ToBytes())
-		result = string(resultBytes)
-
+		result = inflateLeague(id, tx)
 		return nil
 	})
 
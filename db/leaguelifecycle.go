@@ -0,0 +1,553 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// DefaultLeagueMergeBatchSize is a sane number of items to move
+// between leagues in a single write transaction.
+const DefaultLeagueMergeBatchSize = 1000
+
+// LeagueOpReport represents the work done, or would be done on a dry run,
+// by an operation on an entire league.
+type LeagueOpReport struct {
+	// Operation performed
+	Op     string
+	DryRun bool
+	// League operated on
+	League string
+	// League items were moved into or the new name of the league,
+	// empty if not applicable.
+	Into string
+	// Number of items affected
+	Items int
+	// Number of stashes affected
+	Stashes int
+	// Number of items and stashes which already existed in Into
+	Collisions int
+	// Number of write transactions used to move items
+	Batches int
+}
+
+func (r LeagueOpReport) String() string {
+	verb := r.Op
+	if r.DryRun {
+		verb = fmt.Sprintf("would %s", r.Op)
+	}
+	target := r.League
+	if r.Into != "" {
+		target = fmt.Sprintf("%s into %s", r.League, r.Into)
+	}
+	return fmt.Sprintf(`%s %s
+  %d items | %d stashes | %d collisions | %d batches`,
+		verb, target, r.Items, r.Stashes, r.Collisions, r.Batches)
+}
+
+// countLeague fills in the number of items and stashes in a league
+func countLeague(league LeagueHeapID, report *LeagueOpReport, tx *bolt.Tx) {
+	report.Items += getLeagueItemBucket(league, tx).Stats().KeyN
+	report.Stashes += getStashMetaBucket(league, tx).Stats().KeyN
+}
+
+// dropLeague removes a league's namespace and its entry on the LeagueHeap
+func dropLeague(name string, league LeagueHeapID, tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(leagueNamespaceBucket))
+	if root == nil {
+		return errors.Errorf("%s not found", leagueNamespaceBucket)
+	}
+	if err := root.DeleteBucket(league.ToBytes()); err != nil &&
+		err != bolt.ErrBucketNotFound {
+		return errors.Wrap(err, "failed to delete league bucket")
+	}
+
+	heap := tx.Bucket([]byte(leagueHeapBucket))
+	if heap == nil {
+		return errors.Errorf("%s not found", leagueHeapBucket)
+	}
+	inverter := tx.Bucket([]byte(leagueHeapInverseBucket))
+	if inverter == nil {
+		return errors.Errorf("%s not found", leagueHeapInverseBucket)
+	}
+	if err := heap.Delete([]byte(name)); err != nil {
+		return errors.Wrap(err, "failed to remove league from heap")
+	}
+	if err := inverter.Delete(league.ToBytes()); err != nil {
+		return errors.Wrap(err, "failed to remove league from inverse heap")
+	}
+
+	return nil
+}
+
+// DropLeague removes a league and everything stored under it
+func DropLeague(name string, dryRun bool, db *bolt.DB) (*LeagueOpReport, error) {
+	report := &LeagueOpReport{Op: "drop", DryRun: dryRun, League: name}
+
+	update := db.Update
+	if dryRun {
+		update = db.View
+	}
+	err := update(func(tx *bolt.Tx) error {
+		league, err := getLeague(name, tx)
+		if err != nil {
+			return err
+		}
+		countLeague(league, report, tx)
+
+		if dryRun {
+			return nil
+		}
+		return dropLeague(name, league, tx)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to drop league=%s", name)
+	}
+
+	return report, nil
+}
+
+// RenameLeague changes the name a league is stored under
+//
+// The new name must not already be in use, MergeLeague handles that case.
+func RenameLeague(from, to string, dryRun bool,
+	db *bolt.DB) (*LeagueOpReport, error) {
+
+	report := &LeagueOpReport{Op: "rename", DryRun: dryRun,
+		League: from, Into: to}
+
+	update := db.Update
+	if dryRun {
+		update = db.View
+	}
+	err := update(func(tx *bolt.Tx) error {
+		league, err := getLeague(from, tx)
+		if err != nil {
+			return err
+		}
+		if _, err := getLeague(to, tx); err == nil {
+			return errors.Errorf("league=%s already exists", to)
+		}
+		countLeague(league, report, tx)
+
+		if dryRun {
+			return nil
+		}
+
+		// Only the heap refers to a league by name
+		heap := tx.Bucket([]byte(leagueHeapBucket))
+		if heap == nil {
+			return errors.Errorf("%s not found", leagueHeapBucket)
+		}
+		inverter := tx.Bucket([]byte(leagueHeapInverseBucket))
+		if inverter == nil {
+			return errors.Errorf("%s not found", leagueHeapInverseBucket)
+		}
+		if err := heap.Delete([]byte(from)); err != nil {
+			return errors.Wrap(err, "failed to remove old name from heap")
+		}
+		if err := heap.Put([]byte(to), league.ToBytes()); err != nil {
+			return errors.Wrap(err, "failed to add new name to heap")
+		}
+		return inverter.Put(league.ToBytes(), []byte(to))
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to rename league=%s", from)
+	}
+
+	return report, nil
+}
+
+// LeagueArchive is an exported league, self-contained such that it
+// can be read without the database it came from.
+type LeagueArchive struct {
+	League  string
+	Stashes []Stash
+	Items   []Item
+	// Every string referenced by Items
+	Strings map[StringHeapID]string
+}
+
+// writeLeagueArchive exports a league to w
+//
+// The archive is a snappy compressed stream of messagepack values:
+//
+//	[league name][stash count][stashes...][item count][items...]
+//	[string count]([StringHeapID][string])...
+func writeLeagueArchive(name string, league LeagueHeapID, w io.Writer,
+	tx *bolt.Tx) error {
+
+	compressed := snappy.NewBufferedWriter(w)
+	en := msgp.NewWriter(compressed)
+
+	if err := en.WriteString(name); err != nil {
+		return errors.Wrap(err, "failed to write league name")
+	}
+
+	meta := getStashMetaBucket(league, tx)
+	if err := en.WriteArrayHeader(uint32(meta.Stats().KeyN)); err != nil {
+		return errors.Wrap(err, "failed to write stash count")
+	}
+	err := meta.ForEach(func(k, v []byte) error {
+		var stash Stash
+		if _, err := stash.UnmarshalMsg(v); err != nil {
+			return errors.Wrap(err, "failed to Unmarshal Stash")
+		}
+		return stash.EncodeMsg(en)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to write stashes")
+	}
+
+	// Track strings as we go so they can follow the items
+	strings := make(map[StringHeapID]struct{})
+	items := getLeagueItemBucket(league, tx)
+	if err := en.WriteArrayHeader(uint32(items.Stats().KeyN)); err != nil {
+		return errors.Wrap(err, "failed to write item count")
+	}
+	err = items.ForEach(func(k, v []byte) error {
+		var item Item
+		if _, err := item.UnmarshalMsg(v); err != nil {
+			return errors.Wrap(err, "failed to Unmarshal Item")
+		}
+		for _, id := range []StringHeapID{item.Name, item.TypeLine, item.Note,
+			item.RootType, item.RootFlavor} {
+			strings[id] = struct{}{}
+		}
+		for _, mod := range item.Mods {
+			strings[mod.Mod] = struct{}{}
+		}
+		return item.EncodeMsg(en)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to write items")
+	}
+
+	inverter := tx.Bucket([]byte(stringHeapInverseBucket))
+	if inverter == nil {
+		return errors.Errorf("%s not found", stringHeapInverseBucket)
+	}
+	if err := en.WriteMapHeader(uint32(len(strings))); err != nil {
+		return errors.Wrap(err, "failed to write string count")
+	}
+	for id := range strings {
+		if err := en.WriteUint32(uint32(id)); err != nil {
+			return errors.Wrap(err, "failed to write StringHeapID")
+		}
+		if err := en.WriteStringFromBytes(inverter.Get(id.ToBytes())); err != nil {
+			return errors.Wrap(err, "failed to write string")
+		}
+	}
+
+	if err := en.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush archive")
+	}
+	return compressed.Close()
+}
+
+// ReadLeagueArchive reads a league exported by ArchiveLeague
+func ReadLeagueArchive(r io.Reader) (*LeagueArchive, error) {
+	dc := msgp.NewReader(snappy.NewReader(r))
+
+	var archive LeagueArchive
+	var err error
+	if archive.League, err = dc.ReadString(); err != nil {
+		return nil, errors.Wrap(err, "failed to read league name")
+	}
+
+	stashCount, err := dc.ReadArrayHeader()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read stash count")
+	}
+	archive.Stashes = make([]Stash, stashCount)
+	for i := range archive.Stashes {
+		if err := archive.Stashes[i].DecodeMsg(dc); err != nil {
+			return nil, errors.Wrap(err, "failed to read stash")
+		}
+	}
+
+	itemCount, err := dc.ReadArrayHeader()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read item count")
+	}
+	archive.Items = make([]Item, itemCount)
+	for i := range archive.Items {
+		if err := archive.Items[i].DecodeMsg(dc); err != nil {
+			return nil, errors.Wrap(err, "failed to read item")
+		}
+	}
+
+	stringCount, err := dc.ReadMapHeader()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read string count")
+	}
+	archive.Strings = make(map[StringHeapID]string, stringCount)
+	for i := uint32(0); i < stringCount; i++ {
+		id, err := dc.ReadUint32()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read StringHeapID")
+		}
+		if archive.Strings[StringHeapID(id)], err = dc.ReadString(); err != nil {
+			return nil, errors.Wrap(err, "failed to read string")
+		}
+	}
+
+	return &archive, nil
+}
+
+// ArchiveLeague exports a league to w then drops it
+//
+// Both happen in a single transaction so nothing added to the league
+// can be lost between the export and the drop. On a dry run, nothing
+// is written to w.
+func ArchiveLeague(name string, w io.Writer, dryRun bool,
+	db *bolt.DB) (*LeagueOpReport, error) {
+
+	report := &LeagueOpReport{Op: "archive", DryRun: dryRun, League: name}
+
+	update := db.Update
+	if dryRun {
+		update = db.View
+	}
+	err := update(func(tx *bolt.Tx) error {
+		league, err := getLeague(name, tx)
+		if err != nil {
+			return err
+		}
+		countLeague(league, report, tx)
+
+		if dryRun {
+			return nil
+		}
+		if err := writeLeagueArchive(name, league, w, tx); err != nil {
+			return errors.Wrap(err, "failed to export league")
+		}
+		return dropLeague(name, league, tx)
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to archive league=%s", name)
+	}
+
+	return report, nil
+}
+
+// mergeItems moves up to limit items from one league into another
+//
+// Each item is assigned an ID by the target league's translator, so
+// IDs never collide. When an item is already present in the target, the
+// copy added latest by When is kept and the other dropped.
+//
+// Returns the number of items moved, zero implies none remain.
+func mergeItems(from, to LeagueHeapID, limit int,
+	report *LeagueOpReport, tx *bolt.Tx) (int, error) {
+
+	source := getLeagueItemBucket(from, tx)
+	target := getLeagueItemBucket(to, tx)
+
+	var items []Item
+	var ids []ID
+	c := source.Cursor()
+	for k, v := c.First(); k != nil && len(items) < limit; k, v = c.Next() {
+		var item Item
+		if _, err := item.UnmarshalMsg(v); err != nil {
+			return 0, errors.Wrap(err, "failed to Unmarshal Item")
+		}
+		items = append(items, item)
+		ids = append(ids, item.ID)
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	if err := removeItems(ids, from, tx); err != nil {
+		return 0, errors.Wrap(err, "failed to remove items from source")
+	}
+
+	var replaced []ID
+	var collisions int
+	var moved []Item
+	for _, item := range items {
+		id, err := getTranslation(to, item.GGGID, tx)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to translate item")
+		}
+		if existingSerial := target.Get(id[:]); existingSerial != nil {
+			collisions++
+
+			var existing Item
+			if _, err := existing.UnmarshalMsg(existingSerial); err != nil {
+				return 0, errors.Wrap(err, "failed to Unmarshal Item")
+			}
+			// Keep whichever copy is newer, the target's on a tie
+			if bytes.Compare(existing.When[:], item.When[:]) >= 0 {
+				continue
+			}
+			replaced = append(replaced, id)
+		}
+		item.ID = id
+		item.League = to
+		moved = append(moved, item)
+	}
+	if err := removeItems(replaced, to, tx); err != nil {
+		return 0, errors.Wrap(err, "failed to remove replaced items")
+	}
+	if _, err := addItems(moved, tx); err != nil {
+		return 0, errors.Wrap(err, "failed to add items to target")
+	}
+
+	report.Items += len(items)
+	report.Collisions += collisions
+	return len(items), nil
+}
+
+// mergeStashes moves every stash from one league into another
+//
+// Stashes present in both have their items combined.
+func mergeStashes(from, to LeagueHeapID, report *LeagueOpReport,
+	dryRun bool, tx *bolt.Tx) error {
+
+	source := getStashMetaBucket(from, tx)
+	target := getStashMetaBucket(to, tx)
+	sourceSeen := getStashSeenBucket(from, tx)
+	targetSeen := getStashSeenBucket(to, tx)
+
+	return source.ForEach(func(k, v []byte) error {
+		report.Stashes++
+
+		var stash Stash
+		if _, err := stash.UnmarshalMsg(v); err != nil {
+			return errors.Wrap(err, "failed to Unmarshal Stash")
+		}
+		stash.League = to
+
+		if existingSerial := target.Get(k); existingSerial != nil {
+			report.Collisions++
+
+			var existing Stash
+			if _, err := existing.UnmarshalMsg(existingSerial); err != nil {
+				return errors.Wrap(err, "failed to Unmarshal Stash")
+			}
+			present := make(map[GGGID]struct{}, len(stash.Items))
+			for _, id := range stash.Items {
+				present[id] = struct{}{}
+			}
+			for _, id := range existing.Items {
+				if _, ok := present[id]; !ok {
+					stash.Items = append(stash.Items, id)
+				}
+			}
+		}
+		if dryRun {
+			return nil
+		}
+
+		serial, err := stash.MarshalMsg(nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to Marshal Stash")
+		}
+		if err := target.Put(k, serial); err != nil {
+			return errors.Wrap(err, "failed to add stash to target")
+		}
+
+		// Keep the latest time the stash was seen
+		seen := sourceSeen.Get(k)
+		if existing := targetSeen.Get(k); existing != nil &&
+			bytes.Compare(existing, seen) > 0 {
+			seen = existing
+		}
+		if seen != nil {
+			seen = append([]byte(nil), seen...)
+			if err := targetSeen.Put(k, seen); err != nil {
+				return errors.Wrap(err, "failed to add stash seen time")
+			}
+		}
+		return nil
+	})
+}
+
+// MergeLeague moves every item and stash from one league into another
+// and then drops the emptied league. This is what happens when a
+// temporary league ends.
+//
+// Items are moved in batches of at most batchSize, each in its own
+// write transaction; DefaultLeagueMergeBatchSize is used when
+// batchSize is less than 1.
+func MergeLeague(from, to string, batchSize int, dryRun bool,
+	db *bolt.DB) (*LeagueOpReport, error) {
+
+	if from == to {
+		return nil, errors.New("cannot merge a league into itself")
+	}
+	if batchSize < 1 {
+		batchSize = DefaultLeagueMergeBatchSize
+	}
+
+	report := &LeagueOpReport{Op: "merge", DryRun: dryRun,
+		League: from, Into: to}
+
+	leagueIDs, err := GetLeagues([]string{from, to}, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find leagues")
+	}
+	source, target := leagueIDs[0], leagueIDs[1]
+
+	if dryRun {
+		err := db.View(func(tx *bolt.Tx) error {
+			translator := getIDTranslateItemBucket(target, tx)
+			items := getLeagueItemBucket(target, tx)
+			err := getLeagueItemBucket(source, tx).ForEach(func(k, v []byte) error {
+				var item Item
+				if _, err := item.UnmarshalMsg(v); err != nil {
+					return errors.Wrap(err, "failed to Unmarshal Item")
+				}
+				report.Items++
+				if id := translator.Get(item.GGGID[:]); id != nil &&
+					items.Get(id) != nil {
+					report.Collisions++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return mergeStashes(source, target, report, true, tx)
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed dry run")
+		}
+		return report, nil
+	}
+
+	for {
+		var moved int
+		err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			moved, err = mergeItems(source, target, batchSize, report, tx)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to merge items")
+		}
+		if moved == 0 {
+			break
+		}
+		report.Batches++
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := mergeStashes(source, target, report, false, tx); err != nil {
+			return errors.Wrap(err, "failed to merge stashes")
+		}
+		return dropLeague(from, source, tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,667 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// CurrentSchemaVersion is the layout of the database this build
+// reads and writes.
+//
+// This covers the serialization of every stored value, the layout of
+// every key, and the bucket topology. Any change to those must bump
+// this and add a migration bringing older databases up to date.
+const CurrentSchemaVersion = 5
+
+// schemaVersionKey holds the schema version of the database in
+// the settings bucket
+const schemaVersionKey = "schemaVersion"
+
+// migrationProgressKey holds the progress of the migration currently
+// being applied in the settings bucket, if any.
+const migrationProgressKey = "migrationProgress"
+
+// getSchemaVersion returns the schema version of the database the
+// transaction is on.
+//
+// Databases created before the schema version was recorded are
+// version 0.
+func getSchemaVersion(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return 0, errors.Errorf("%s bucket not found", settingsBucket)
+	}
+
+	value := b.Get([]byte(schemaVersionKey))
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != 4 {
+		return 0, errors.Errorf("malformed %s setting, value=%v",
+			schemaVersionKey, value)
+	}
+	return int(btoi32(value)), nil
+}
+
+// putSchemaVersion records the schema version of the database
+// the transaction is on
+func putSchemaVersion(version int, tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return errors.Errorf("%s bucket not found", settingsBucket)
+	}
+	return b.Put([]byte(schemaVersionKey), i32tob(uint32(version)))
+}
+
+// GetSchemaVersion returns the schema version of the database
+func GetSchemaVersion(db *bolt.DB) (int, error) {
+	var version int
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = getSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// stampSchemaVersion records the current schema version on a database
+// without one if it holds no data, as there is nothing to migrate.
+func stampSchemaVersion(tx *bolt.Tx) error {
+	settings := tx.Bucket([]byte(settingsBucket))
+	if settings.Get([]byte(schemaVersionKey)) != nil {
+		return nil
+	}
+
+	for _, name := range []string{stringHeapBucket, leagueNamespaceBucket} {
+		if k, _ := tx.Bucket([]byte(name)).Cursor().First(); k != nil {
+			return nil
+		}
+	}
+	return putSchemaVersion(CurrentSchemaVersion, tx)
+}
+
+// getMigrationProgress returns the progress recorded by the migration
+// currently being applied, nil if none has been recorded.
+func getMigrationProgress(tx *bolt.Tx) []byte {
+	value := tx.Bucket([]byte(settingsBucket)).Get([]byte(migrationProgressKey))
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+// putMigrationProgress records the progress of the migration
+// currently being applied.
+func putMigrationProgress(progress []byte, tx *bolt.Tx) error {
+	return tx.Bucket([]byte(settingsBucket)).
+		Put([]byte(migrationProgressKey), progress)
+}
+
+// migration upgrades the database to Version from the version before it
+type migration struct {
+	// Schema version of the database once the migration is applied
+	Version     int
+	Description string
+	// step applies a bounded amount of the migration, returning true
+	// once the migration has been completely applied.
+	//
+	// Each step runs in its own write transaction. Any progress must
+	// be recorded with putMigrationProgress so an interrupted migration
+	// continues where it left off.
+	step func(tx *bolt.Tx) (bool, error)
+}
+
+// migrations holds every migration in the order they are applied
+//
+// The migration at index i upgrades a database from version i.
+var migrations = []migration{
+	{
+		Version:     1,
+		Description: "ensure league sub-buckets and remove stray item store buckets",
+		step:        migrateLeagueBuckets,
+	},
+	{
+		Version:     2,
+		Description: "rewrite legacy index entries with a header",
+		step:        migrateLegacyIndexEntries,
+	},
+	{
+		Version:     3,
+		Description: "record the index granularity of each league",
+		step:        migrateIndexGranularity,
+	},
+	{
+		Version:     4,
+		Description: "convert timestamps to an epoch offset and sequence then rebuild each index",
+		step:        migrateTimestamps,
+	},
+	{
+		Version:     5,
+		Description: "store the bundled bases as the first version items are classified by",
+		step:        migrateBases,
+	},
+}
+
+// forEachLeagueBucket calls cb with the key and bucket of every league
+func forEachLeagueBucket(tx *bolt.Tx, cb func(k []byte, b *bolt.Bucket) error) error {
+	root := tx.Bucket([]byte(leagueNamespaceBucket))
+	if root == nil {
+		return errors.Errorf("%s not found", leagueNamespaceBucket)
+	}
+	return root.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return cb(k, root.Bucket(k))
+	})
+}
+
+// migrateLeagueBuckets adds any missing sub-buckets to each league
+// and removes the league buckets opening a database used to create
+// inside of each item store.
+func migrateLeagueBuckets(tx *bolt.Tx) (bool, error) {
+	err := forEachLeagueBucket(tx, func(k []byte, leagueBucket *bolt.Bucket) error {
+		if err := checkLeague(leagueBucket, tx); err != nil {
+			return err
+		}
+
+		items := leagueBucket.Bucket([]byte(itemStoreBucket))
+		var stray [][]byte
+		err := items.ForEach(func(k, v []byte) error {
+			if v == nil {
+				stray = append(stray, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range stray {
+			if err := items.DeleteBucket(name); err != nil {
+				return errors.Wrap(err, "failed to remove stray bucket")
+			}
+		}
+		return nil
+	})
+	return err == nil, err
+}
+
+// migrateIndexBatchSize is the number of index entries rewritten in
+// a single step of migrateLegacyIndexEntries before progress is recorded.
+const migrateIndexBatchSize = 10000
+
+// migrateLegacyIndexEntries rewrites every legacy index entry with the
+// database's IndexEncoding.
+//
+// Progress is recorded as the path of the last mod bucket completed,
+// the league followed by the root type, root flavor, and mod keys.
+// As each key has a fixed width, comparing paths orders them the same
+// way as walking the buckets.
+func migrateLegacyIndexEntries(tx *bolt.Tx) (bool, error) {
+	encoding, err := getIndexEncoding(tx)
+	if err != nil {
+		return false, err
+	}
+	last := getMigrationProgress(tx)
+
+	var rewritten int
+	var path []byte
+	err = forEachLeagueBucket(tx, func(league []byte, leagueBucket *bolt.Bucket) error {
+		if rewritten >= migrateIndexBatchSize {
+			return nil
+		}
+		return forEachModBucket(leagueBucket.Bucket([]byte(indiceBucket)),
+			func(key []byte, modBucket *bolt.Bucket) error {
+				if rewritten >= migrateIndexBatchSize {
+					return nil
+				}
+				current := append(append([]byte{}, league...), key...)
+				if last != nil && bytes.Compare(current, last) <= 0 {
+					return nil
+				}
+
+				n, err := rewriteLegacyEntries(modBucket, encoding)
+				if err != nil {
+					return err
+				}
+				rewritten += n
+				path = current
+				return nil
+			})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if rewritten < migrateIndexBatchSize {
+		return true, nil
+	}
+	return false, putMigrationProgress(path, tx)
+}
+
+// forEachModBucket calls cb with every mod bucket in an index along
+// with the concatenation of the root type, root flavor, and mod keys
+// leading to it.
+func forEachModBucket(indices *bolt.Bucket,
+	cb func(key []byte, b *bolt.Bucket) error) error {
+
+	return indices.ForEach(func(rootType, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		rootTypeBucket := indices.Bucket(rootType)
+		return rootTypeBucket.ForEach(func(rootFlavor, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			rootFlavorBucket := rootTypeBucket.Bucket(rootFlavor)
+			return rootFlavorBucket.ForEach(func(mod, v []byte) error {
+				if v != nil {
+					return nil
+				}
+				key := make([]byte, 0, len(rootType)+len(rootFlavor)+len(mod))
+				key = append(append(append(key, rootType...), rootFlavor...), mod...)
+				return cb(key, rootFlavorBucket.Bucket(mod))
+			})
+		})
+	})
+}
+
+// rewriteLegacyEntries rewrites every legacy entry in a mod bucket
+// with the provided encoding, returning the number rewritten.
+//
+// Legacy entries without any IDs are removed.
+func rewriteLegacyEntries(modBucket *bolt.Bucket,
+	encoding IndexEncoding) (int, error) {
+
+	// Writing to a bucket while iterating over it is unsafe,
+	// so find every legacy entry first.
+	var keys [][]byte
+	var entries []IndexEntry
+	err := modBucket.ForEach(func(k, v []byte) error {
+		if v != nil && IndexEntry(v).Encoding() == IndexEncodingLegacy {
+			keys = append(keys, append([]byte{}, k...))
+			entries = append(entries, IndexEntry(append([]byte{}, v...)))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, k := range keys {
+		entry := IndexEntryMergeAs(entries[i], nil, nil, encoding)
+		if entry == nil {
+			err = modBucket.Delete(k)
+		} else {
+			err = modBucket.Put(k, entry)
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to rewrite index entry")
+		}
+	}
+	return len(keys), nil
+}
+
+// migrateIndexGranularity records the granularity every league, and
+// every index being rebuilt, was keyed by before it was configurable.
+func migrateIndexGranularity(tx *bolt.Tx) (bool, error) {
+	granularity := []byte{byte(DefaultIndexGranularity)}
+	err := forEachLeagueBucket(tx, func(k []byte, leagueBucket *bolt.Bucket) error {
+		if leagueBucket.Get([]byte(indexGranularityKey)) == nil {
+			err := leagueBucket.Put([]byte(indexGranularityKey), granularity)
+			if err != nil {
+				return err
+			}
+		}
+
+		reindex := leagueBucket.Bucket([]byte(reindexBucket))
+		if reindex == nil || reindex.Get(reindexGranularityKey) != nil {
+			return nil
+		}
+		return reindex.Put(reindexGranularityKey, granularity)
+	})
+	return err == nil, err
+}
+
+// legacyTimestampSize is the size of a Timestamp before it held an
+// epoch offset and sequence, the low 4 bytes of unix seconds.
+const legacyTimestampSize = 4
+
+// convertLegacyTimestamp returns the Timestamp of a legacy Timestamp
+//
+// Items of a page were not told apart, so each is given a sequence of zero.
+func convertLegacyTimestamp(legacy []byte) Timestamp {
+	return TimeToTimestamp(time.Unix(int64(btoi32(legacy)), 0))
+}
+
+// convertLegacyItem converts the When of a serialized Item holding
+// a legacy Timestamp, returning nil if it has already been converted.
+//
+// When is the last field of an Item, so its legacy form is the final
+// bytes of the Item as a msgpack bin8 header followed by the Timestamp.
+func convertLegacyItem(serial []byte) ([]byte, error) {
+	var item Item
+	if _, err := item.UnmarshalMsg(serial); err == nil {
+		return nil, nil
+	}
+
+	n := len(serial) - legacyTimestampSize - 2
+	if n < 0 || serial[n] != 0xc4 || serial[n+1] != legacyTimestampSize {
+		return nil, errors.New("malformed item, no legacy timestamp found")
+	}
+	when := convertLegacyTimestamp(serial[n+2:])
+	converted := msgp.AppendBytes(append([]byte{}, serial[:n]...), when[:])
+
+	if _, err := item.UnmarshalMsg(converted); err != nil {
+		return nil, errors.Wrap(err, "failed to Unmarshal converted Item")
+	}
+	return converted, nil
+}
+
+// convertLeagueTimestamps converts the legacy Timestamps of up to budget
+// items in a league with IDs after the provided ID, and the legacy
+// Timestamps of when each stash was last seen once every item is done.
+//
+// Returns whether the league is done and the ID of the last item converted.
+func convertLeagueTimestamps(league LeagueHeapID, after []byte, budget *int,
+	tx *bolt.Tx) (bool, []byte, error) {
+
+	items := getLeagueItemBucket(league, tx)
+	c := items.Cursor()
+	k, v := c.First()
+	if len(after) > 0 {
+		k, v = c.Seek(after)
+		if k != nil && bytes.Equal(k, after) {
+			k, v = c.Next()
+		}
+	}
+
+	// Writing to a bucket while iterating over it is unsafe,
+	// so find every converted item first.
+	var keys, values [][]byte
+	for ; k != nil && *budget > 0; k, v = c.Next() {
+		// Ignore nested buckets
+		if v == nil {
+			continue
+		}
+		converted, err := convertLegacyItem(v)
+		if err != nil {
+			return false, nil, errors.Wrapf(err, "failed to convert item, id=%v", k)
+		}
+		after = append([]byte{}, k...)
+		*budget--
+		if converted != nil {
+			keys = append(keys, after)
+			values = append(values, converted)
+		}
+	}
+	done := k == nil
+	for i, key := range keys {
+		if err := items.Put(key, values[i]); err != nil {
+			return false, nil, errors.Wrap(err, "failed to update item")
+		}
+	}
+	if !done {
+		return false, after, nil
+	}
+
+	keys, values = nil, nil
+	seen := getStashSeenBucket(league, tx)
+	err := seen.ForEach(func(k, v []byte) error {
+		if len(v) == legacyTimestampSize {
+			when := convertLegacyTimestamp(v)
+			keys = append(keys, append([]byte{}, k...))
+			values = append(values, when[:])
+		}
+		return nil
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	for i, key := range keys {
+		if err := seen.Put(key, values[i]); err != nil {
+			return false, nil, errors.Wrap(err, "failed to update stash seen time")
+		}
+	}
+
+	// Any reindex in progress was keyed by the legacy Timestamps, so
+	// the league is rebuilt from scratch at the granularity it targeted.
+	state, err := getReindexState(league, tx)
+	if err != nil || state == nil {
+		return true, after, err
+	}
+	if err := abandonReindex(league, tx); err != nil {
+		return false, nil, err
+	}
+	return true, after, putIndexGranularity(league, state.Granularity, tx)
+}
+
+// rebuildLeagueIndex rebuilds the index of a league in place with up to
+// budget items, returning true once the index has been rebuilt.
+//
+// Progress is kept as a reindex of the league.
+func rebuildLeagueIndex(league LeagueHeapID, budget *int,
+	tx *bolt.Tx) (bool, error) {
+
+	state, err := getReindexState(league, tx)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		state = &reindexState{}
+		if state.Granularity, err = getIndexGranularity(league, tx); err != nil {
+			return false, err
+		}
+		if err := startReindex(league, state, tx); err != nil {
+			return false, err
+		}
+	}
+
+	var report ReindexReport
+	done, err := reindexItems(league, state, *budget, &report, tx)
+	if err != nil {
+		return false, err
+	}
+	*budget -= report.Items
+	if !done {
+		return false, nil
+	}
+	return true, finishReindex(league, state, tx)
+}
+
+// migrateTimestampsBatchSize is the number of items converted or
+// indexed in a single step of migrateTimestamps.
+const migrateTimestampsBatchSize = 1000
+
+// Phases of migrateTimestamps, every league goes through
+// a phase before any league moves to the next.
+const (
+	timestampsPhaseConvert byte = iota
+	timestampsPhaseReindex
+)
+
+// migrateTimestamps converts every legacy Timestamp then rebuilds the
+// index of each league, as index keys are derived from Timestamps.
+//
+// Progress is recorded as the phase followed by the league in progress
+// and, when converting, the ID of the last item converted in it.
+func migrateTimestamps(tx *bolt.Tx) (bool, error) {
+	root := tx.Bucket([]byte(leagueNamespaceBucket))
+	if root == nil {
+		return false, errors.Errorf("%s not found", leagueNamespaceBucket)
+	}
+
+	phase := timestampsPhaseConvert
+	var league, after []byte
+	if progress := getMigrationProgress(tx); progress != nil {
+		phase = progress[0]
+		if len(progress) >= 1+LeagueHeapIDSize {
+			league = progress[1 : 1+LeagueHeapIDSize]
+			after = progress[1+LeagueHeapIDSize:]
+		}
+	}
+
+	budget := migrateTimestampsBatchSize
+	c := root.Cursor()
+	k, v := c.First()
+	if league != nil {
+		k, v = c.Seek(league)
+	}
+	for ; k != nil; k, v = c.Next() {
+		if v != nil {
+			continue
+		}
+		id := LeagueHeapIDFromBytes(k)
+
+		var done bool
+		var err error
+		if phase == timestampsPhaseConvert {
+			done, after, err = convertLeagueTimestamps(id, after, &budget, tx)
+		} else {
+			done, err = rebuildLeagueIndex(id, &budget, tx)
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to migrate league=%d", id)
+		}
+		if !done {
+			progress := append([]byte{phase}, k...)
+			return false, putMigrationProgress(append(progress, after...), tx)
+		}
+		after = nil
+	}
+
+	if phase == timestampsPhaseConvert {
+		return false, putMigrationProgress([]byte{timestampsPhaseReindex}, tx)
+	}
+	return true, nil
+}
+
+// checkSchemaVersion ensures the database can be used by this build,
+// returning its schema version.
+//
+// When allowOutdated is set, databases with an older schema are
+// accepted so they can be migrated.
+func checkSchemaVersion(allowOutdated bool, db *bolt.DB) (int, error) {
+	version, err := GetSchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if version > CurrentSchemaVersion {
+		return 0, errors.Errorf("database has schema version %d, newer than %d supported by this build",
+			version, CurrentSchemaVersion)
+	}
+	if version < CurrentSchemaVersion && !allowOutdated {
+		return 0, errors.Errorf("database has schema version %d, older than %d, run migrate to upgrade it",
+			version, CurrentSchemaVersion)
+	}
+	return version, nil
+}
+
+// MigrationProgress is provided after each step of a migration
+type MigrationProgress struct {
+	// Schema version the migration upgrades to
+	Version     int
+	Description string
+	// Number of steps applied so far in this run
+	Steps int
+	// Whether the migration has been completely applied
+	Done bool
+}
+
+// MigrationReport represents the work done by Migrate
+type MigrationReport struct {
+	// Schema versions before and after migrating
+	From, To int
+	// Whether an earlier, interrupted migration was continued
+	Resumed bool
+	// Description of every migration applied
+	Applied []string
+	// Number of write transactions used
+	Steps int
+}
+
+func (r MigrationReport) String() string {
+	if len(r.Applied) == 0 {
+		return fmt.Sprintf("schema version %d is current, nothing to migrate", r.From)
+	}
+
+	var buf bytes.Buffer
+	verb := "migrated"
+	if r.Resumed {
+		verb = "resumed migrating"
+	}
+	fmt.Fprintf(&buf, "%s schema version %d to %d in %d steps",
+		verb, r.From, r.To, r.Steps)
+	for i, description := range r.Applied {
+		fmt.Fprintf(&buf, "\n  %d: %s", r.To-len(r.Applied)+i+1, description)
+	}
+	return buf.String()
+}
+
+// Migrate upgrades the database to CurrentSchemaVersion by applying each
+// migration after its schema version in order.
+//
+// Every step of a migration is applied in its own write transaction and
+// records its progress, so calling Migrate on a database whose migration
+// was interrupted continues where it left off. The schema version is only
+// advanced once a migration has been completely applied.
+//
+// progress, if non-nil, is called after every step.
+func Migrate(progress func(MigrationProgress), db *bolt.DB) (*MigrationReport, error) {
+	version, err := checkSchemaVersion(true, db)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{From: version, To: version}
+	err = db.View(func(tx *bolt.Tx) error {
+		report.Resumed = getMigrationProgress(tx) != nil
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read migration progress")
+	}
+
+	for version := report.From; version < CurrentSchemaVersion; version++ {
+		m := migrations[version]
+		var steps int
+		for done := false; !done; {
+			err := db.Update(func(tx *bolt.Tx) error {
+				var err error
+				if done, err = m.step(tx); err != nil || !done {
+					return err
+				}
+				settings := tx.Bucket([]byte(settingsBucket))
+				if err := settings.Delete([]byte(migrationProgressKey)); err != nil {
+					return err
+				}
+				return putSchemaVersion(m.Version, tx)
+			})
+			if err != nil {
+				return report, errors.Wrapf(err,
+					"failed to migrate to schema version %d", m.Version)
+			}
+			steps++
+			report.Steps++
+
+			if progress != nil {
+				progress(MigrationProgress{
+					Version:     m.Version,
+					Description: m.Description,
+					Steps:       steps,
+					Done:        done,
+				})
+			}
+		}
+		report.To = m.Version
+		report.Applied = append(report.Applied, m.Description)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,381 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// parquetMagic begins and ends every parquet file
+const parquetMagic = "PAR1"
+
+// parquetRowGroupSize is the number of rows buffered before they are
+// written out as a row group, bounding the memory used while writing
+const parquetRowGroupSize = 10000
+
+// parquetType is the physical type of a parquet column
+type parquetType int32
+
+const (
+	parquetBoolean   parquetType = 0
+	parquetInt64     parquetType = 2
+	parquetDouble    parquetType = 5
+	parquetByteArray parquetType = 6
+)
+
+// Converted types annotating how a physical type is interpreted
+const (
+	parquetNoConversion    int32 = -1
+	parquetUTF8            int32 = 0
+	parquetTimestampMillis int32 = 9
+)
+
+// Encodings and compression codecs, only the ones written are listed
+const (
+	parquetPlain  int32 = 0
+	parquetRLE    int32 = 3
+	parquetSnappy int32 = 1
+)
+
+// Thrift compact protocol types
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+// thriftWriter encodes thrift structs with the compact protocol,
+// which is how parquet metadata is serialized.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// Last field ID written in each struct being written
+	last []int16
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	t.buf.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+// list begins a list field of size elements of kind
+func (t *thriftWriter) list(id int16, kind byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | kind)
+		return
+	}
+	t.buf.WriteByte(0xf0 | kind)
+	t.varint(uint64(size))
+}
+
+// begin starts a struct, either as field id or as an element of a
+// list when id is 0
+func (t *thriftWriter) begin(id int16) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// parquetColumn is a single column of a flat parquet schema along
+// with the values of the row group being built
+type parquetColumn struct {
+	name      string
+	kind      parquetType
+	converted int32
+	optional  bool
+
+	// Values of the row group, PLAIN encoded except booleans
+	values bytes.Buffer
+	bools  []bool
+	// Whether each row has a value, only tracked when optional
+	defined []bool
+}
+
+// parquetChunk locates a column of a row group in the file
+type parquetChunk struct {
+	offset, size, compressed int64
+}
+
+type parquetRowGroup struct {
+	chunks []parquetChunk
+	rows   int64
+	size   int64
+}
+
+// parquetWriter streams rows of a flat schema into a parquet file
+//
+// Rows are buffered until a row group is full then written as one
+// snappy compressed page per column; the footer is written on close.
+type parquetWriter struct {
+	w       *countingWriter
+	columns []*parquetColumn
+	rows    int
+	groups  []parquetRowGroup
+}
+
+// newParquetWriter starts a parquet file on w with the provided columns
+func newParquetWriter(w io.Writer,
+	columns []*parquetColumn) (*parquetWriter, error) {
+
+	p := &parquetWriter{w: &countingWriter{w: w}, columns: columns}
+	if _, err := io.WriteString(p.w, parquetMagic); err != nil {
+		return nil, errors.Wrap(err, "failed to write parquet header")
+	}
+	return p, nil
+}
+
+// write adds a row, each value must be of its column's type or nil
+// for an optional column without a value
+func (p *parquetWriter) write(row []interface{}) error {
+	if len(row) != len(p.columns) {
+		return errors.Errorf("row has %d values, expected %d",
+			len(row), len(p.columns))
+	}
+
+	for i, value := range row {
+		column := p.columns[i]
+		if column.optional {
+			column.defined = append(column.defined, value != nil)
+		}
+		if value == nil {
+			if !column.optional {
+				return errors.Errorf("required column %s has no value",
+					column.name)
+			}
+			continue
+		}
+
+		var scratch [8]byte
+		switch v := value.(type) {
+		case bool:
+			column.bools = append(column.bools, v)
+		case int64:
+			binary.LittleEndian.PutUint64(scratch[:], uint64(v))
+			column.values.Write(scratch[:])
+		case float64:
+			binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(v))
+			column.values.Write(scratch[:])
+		case string:
+			binary.LittleEndian.PutUint32(scratch[:], uint32(len(v)))
+			column.values.Write(scratch[:4])
+			column.values.WriteString(v)
+		default:
+			return errors.Errorf("unsupported value %T for column %s",
+				value, column.name)
+		}
+	}
+
+	p.rows++
+	if p.rows >= parquetRowGroupSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// bitPack packs bools least significant bit first
+func bitPack(values []bool) []byte {
+	packed := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packed
+}
+
+// page returns the uncompressed data page of a column's buffered values
+func (column *parquetColumn) page() []byte {
+	var page bytes.Buffer
+
+	// Definition levels of width 1 as a single bit packed run of the
+	// RLE hybrid encoding, prefixed by its length
+	if column.optional {
+		var header [binary.MaxVarintLen64]byte
+		groups := (len(column.defined) + 7) / 8
+		n := binary.PutUvarint(header[:], uint64(groups)<<1|1)
+		levels := append(header[:n], bitPack(column.defined)...)
+
+		var length [4]byte
+		binary.LittleEndian.PutUint32(length[:], uint32(len(levels)))
+		page.Write(length[:])
+		page.Write(levels)
+	}
+
+	if column.kind == parquetBoolean {
+		page.Write(bitPack(column.bools))
+	} else {
+		page.Write(column.values.Bytes())
+	}
+	return page.Bytes()
+}
+
+// flush writes the buffered rows as a row group
+func (p *parquetWriter) flush() error {
+	if p.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{rows: int64(p.rows)}
+	for _, column := range p.columns {
+		page := column.page()
+		compressed := snappy.Encode(nil, page)
+
+		var header thriftWriter
+		header.begin(0)
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(compressed)))
+		header.begin(5)
+		header.i32(1, int32(p.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		chunk := parquetChunk{
+			offset:     p.w.n,
+			size:       int64(header.buf.Len() + len(page)),
+			compressed: int64(header.buf.Len() + len(compressed)),
+		}
+		if _, err := p.w.Write(header.buf.Bytes()); err != nil {
+			return errors.Wrap(err, "failed to write parquet page header")
+		}
+		if _, err := p.w.Write(compressed); err != nil {
+			return errors.Wrap(err, "failed to write parquet page")
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.size
+
+		column.values.Reset()
+		column.bools = column.bools[:0]
+		column.defined = column.defined[:0]
+	}
+
+	p.groups = append(p.groups, group)
+	p.rows = 0
+	return nil
+}
+
+// close writes any buffered rows and the footer describing the file
+func (p *parquetWriter) close() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	var meta thriftWriter
+	meta.begin(0)
+	meta.i32(1, 1)
+
+	meta.list(2, thriftStruct, len(p.columns)+1)
+	meta.begin(0)
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(p.columns)))
+	meta.end()
+	for _, column := range p.columns {
+		repetition := int32(0) // REQUIRED
+		if column.optional {
+			repetition = 1 // OPTIONAL
+		}
+		meta.begin(0)
+		meta.i32(1, int32(column.kind))
+		meta.i32(3, repetition)
+		meta.str(4, column.name)
+		if column.converted != parquetNoConversion {
+			meta.i32(6, column.converted)
+		}
+		meta.end()
+	}
+
+	var rows int64
+	for _, group := range p.groups {
+		rows += group.rows
+	}
+	meta.i64(3, rows)
+
+	meta.list(4, thriftStruct, len(p.groups))
+	for _, group := range p.groups {
+		meta.begin(0)
+		meta.list(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			meta.begin(0)
+			meta.i64(2, chunk.offset)
+			meta.begin(3)
+			meta.i32(1, int32(column.kind))
+			meta.list(2, thriftI32, 2)
+			meta.zigzag(int64(parquetPlain))
+			meta.zigzag(int64(parquetRLE))
+			meta.list(3, thriftBinary, 1)
+			meta.binary(column.name)
+			meta.i32(4, parquetSnappy)
+			meta.i64(5, group.rows)
+			meta.i64(6, chunk.size)
+			meta.i64(7, chunk.compressed)
+			meta.i64(9, chunk.offset)
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, group.size)
+		meta.i64(3, group.rows)
+		meta.end()
+	}
+	meta.str(6, "poeitemstore")
+	meta.end()
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(meta.buf.Len()))
+	for _, b := range [][]byte{meta.buf.Bytes(), length[:], []byte(parquetMagic)} {
+		if _, err := p.w.Write(b); err != nil {
+			return errors.Wrap(err, "failed to write parquet footer")
+		}
+	}
+	return nil
+}
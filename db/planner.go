@@ -0,0 +1,196 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Query is a search which can be run against the database
+// to find item IDs.
+type Query interface {
+	Run(db *bolt.DB) ([]ID, error)
+}
+
+// QueryStrategy determines how a planned query is executed
+type QueryStrategy int
+
+const (
+	// StrategyIndex walks the mod indices using an IndexQuery
+	StrategyIndex QueryStrategy = iota
+	// StrategyItemStore scans the item store using an ItemStoreQuery
+	StrategyItemStore
+)
+
+func (s QueryStrategy) String() string {
+	switch s {
+	case StrategyIndex:
+		return "index"
+	case StrategyItemStore:
+		return "itemstore"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// QueryPlan is the result of planning a query, it contains
+// the chosen Query alongside the estimates which led to it.
+type QueryPlan struct {
+	Strategy QueryStrategy
+	// Mods and their unscaled minimum values ordered
+	// from most to least selective
+	Mods      []StringHeapID
+	MinValues []uint16
+	// Estimated number of index entries for each mod
+	//
+	// Positionally related to Mods
+	Estimates []int
+	// Total index entries we expect to visit and the size of the
+	// item store we would otherwise scan
+	IndexCost, StoreCost int
+	// Query to actually run
+	Query Query
+}
+
+func (plan *QueryPlan) String() string {
+	return fmt.Sprintf("strategy=%s, indexCost=%d, storeCost=%d, estimates=%v",
+		plan.Strategy, plan.IndexCost, plan.StoreCost, plan.Estimates)
+}
+
+// DefaultMaxStatsAge is the default age after which a QueryPlanner
+// will recollect the stats for a league.
+const DefaultMaxStatsAge = time.Minute * 10
+
+// QueryPlanner chooses between an IndexQuery and an ItemStoreQuery
+// based off of per-league statistics.
+//
+// A QueryPlanner is safe for concurrent use.
+type QueryPlanner struct {
+	// MaxStatsAge is how long collected stats are considered valid
+	MaxStatsAge time.Duration
+
+	lock    sync.Mutex
+	leagues map[LeagueHeapID]*LeagueStats
+}
+
+// NewQueryPlanner returns a QueryPlanner with no cached statistics
+func NewQueryPlanner(maxStatsAge time.Duration) *QueryPlanner {
+	return &QueryPlanner{
+		MaxStatsAge: maxStatsAge,
+		leagues:     make(map[LeagueHeapID]*LeagueStats),
+	}
+}
+
+// Refresh recollects the statistics for a league regardless
+// of their age.
+func (p *QueryPlanner) Refresh(league LeagueHeapID, db *bolt.DB) error {
+	stats, err := CollectLeagueStats(league, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to collect league stats")
+	}
+
+	p.lock.Lock()
+	p.leagues[league] = stats
+	p.lock.Unlock()
+
+	return nil
+}
+
+// Stats returns the cached statistics for a league, collecting
+// them if they are missing or too old.
+func (p *QueryPlanner) Stats(league LeagueHeapID,
+	db *bolt.DB) (*LeagueStats, error) {
+
+	p.lock.Lock()
+	stats, ok := p.leagues[league]
+	p.lock.Unlock()
+	if ok && time.Since(stats.Collected) < p.MaxStatsAge {
+		return stats, nil
+	}
+
+	if err := p.Refresh(league, db); err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.leagues[league], nil
+}
+
+// modEstimate allows sorting mods by their selectivity
+type modEstimate struct {
+	mod      StringHeapID
+	minValue uint16
+	estimate int
+}
+
+// Plan determines the cheapest way to execute the described search
+// and returns the resulting QueryPlan.
+//
+// Mod cursors are ordered by their selectivity. When the index would
+// visit more entries than the item store holds, a filtered scan
+// of the item store is chosen instead.
+func (p *QueryPlanner) Plan(rootType, rootFlavor StringHeapID,
+	mods []StringHeapID, minModValues []uint16,
+	league LeagueHeapID,
+	maxDesired int, db *bolt.DB) (*QueryPlan, error) {
+
+	if len(mods) != len(minModValues) {
+		return nil, errors.Errorf("each mod must have a minimum value, %d!=%d",
+			len(mods), len(minModValues))
+	}
+
+	stats, err := p.Stats(league, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// Estimate how many entries each mod would visit
+	estimates := make([]modEstimate, len(mods))
+	for i, mod := range mods {
+		estimates[i] = modEstimate{mod: mod, minValue: minModValues[i]}
+
+		// Missing stats means no items have this mod, any
+		// cursor for it would be empty
+		modStats, ok := stats.Mod(rootType, rootFlavor, mod)
+		if !ok {
+			continue
+		}
+		scaled := minModValues[i] * ItemModAverageScaleFactor
+		estimates[i].estimate = modStats.EstimateAtLeast(scaled)
+	}
+	sort.SliceStable(estimates, func(i, j int) bool {
+		return estimates[i].estimate < estimates[j].estimate
+	})
+
+	plan := &QueryPlan{
+		Mods:      make([]StringHeapID, len(estimates)),
+		MinValues: make([]uint16, len(estimates)),
+		Estimates: make([]int, len(estimates)),
+		StoreCost: stats.Items,
+	}
+	for i, e := range estimates {
+		plan.Mods[i] = e.mod
+		plan.MinValues[i] = e.minValue
+		plan.Estimates[i] = e.estimate
+		plan.IndexCost += e.estimate
+	}
+
+	if plan.IndexCost > plan.StoreCost {
+		plan.Strategy = StrategyItemStore
+		query := NewItemStoreQuery(rootType, rootFlavor,
+			plan.Mods, plan.MinValues, league, maxDesired)
+		plan.Query = &query
+	} else {
+		plan.Strategy = StrategyIndex
+		query := NewIndexQuery(rootType, rootFlavor,
+			plan.Mods, plan.MinValues, league, maxDesired)
+		plan.Query = &query
+	}
+
+	return plan, nil
+}
@@ -3,46 +3,48 @@ package db
 // The minimum size for an entry in the pool
 var poolMinEntrySize = 100
 
-// IDMapPool represents a thread-safe pool of reusable
-// sets for IndexQuery
-type IDMapPool struct {
-	bufs chan map[ID]struct{}
+// Resettable is a value which can be cleared and reused by a Pool
+type Resettable interface {
+	// Reset clears the value while retaining any allocated memory
+	Reset()
 }
 
-// NewIDMapPool creates a properly initialized IDMapPool
-func NewIDMapPool(maxPerSize int) IDMapPool {
-	p := IDMapPool{
-		bufs: make(chan map[ID]struct{}, maxPerSize),
+// Pool represents a thread-safe pool of reusable sets
+// and contexts for queries.
+type Pool struct {
+	bufs chan Resettable
+	// Creates a fresh buffer when none are available
+	create func() Resettable
+}
+
+// NewPool creates a properly initialized Pool
+//
+// create is called to make a fresh buffer whenever the pool is empty.
+func NewPool(maxSize int, create func() Resettable) Pool {
+	p := Pool{
+		bufs:   make(chan Resettable, maxSize),
+		create: create,
 	}
 	return p
 }
 
 // Borrow returns a pre-allocated buffer in the pool
 // or a fresh buffer if none are available
-func (p *IDMapPool) Borrow(minLen int) map[ID]struct{} {
-	var buf map[ID]struct{}
+func (p *Pool) Borrow() Resettable {
 	select {
-	case buf = <-p.bufs:
+	case buf := <-p.bufs:
+		return buf
 	default:
-		if minLen < poolMinEntrySize {
-			minLen = poolMinEntrySize
-		}
-		buf = make(map[ID]struct{}, minLen)
-	}
-
-	// Clear out the map
-	for k := range buf {
-		delete(buf, k)
+		return p.create()
 	}
-
-	return buf
 }
 
-// Give returns a buffer to the set
+// Give returns a buffer to the pool after resetting it
 //
 // If we have more buffers than we are configured to handle,
 // further provided buffers are tossed out.
-func (p *IDMapPool) Give(buf map[ID]struct{}) {
+func (p *Pool) Give(buf Resettable) {
+	buf.Reset()
 	select {
 	case p.bufs <- buf:
 	default:
@@ -50,3 +52,118 @@ func (p *IDMapPool) Give(buf map[ID]struct{}) {
 		// so the GC takes care of it
 	}
 }
+
+// idCountSlot is a single slot of an idCountSet
+type idCountSlot struct {
+	id    ID
+	count int
+	// Slots from any other generation are empty
+	generation uint32
+}
+
+// idCountSet counts how many times each ID has been seen
+//
+// This is an open addressing hash table where each slot records the
+// generation it was written in. Resetting the set only advances the
+// generation, so clearing is O(1) regardless of how large the set grew.
+type idCountSet struct {
+	slots      []idCountSlot
+	mask       uint64
+	generation uint32
+	size       int
+}
+
+// newIDCountSet returns an idCountSet able to hold at least
+// minLen IDs before growing.
+func newIDCountSet(minLen int) *idCountSet {
+	if minLen < poolMinEntrySize {
+		minLen = poolMinEntrySize
+	}
+	capacity := 1
+	for capacity < minLen*2 {
+		capacity <<= 1
+	}
+
+	return &idCountSet{
+		slots:      make([]idCountSlot, capacity),
+		mask:       uint64(capacity - 1),
+		generation: 1,
+	}
+}
+
+// index returns the ideal slot for an ID
+func (s *idCountSet) index(id ID) uint64 {
+	// Fibonacci hashing spreads sequential IDs across the table
+	h := idToSeq(id) * 0x9E3779B97F4A7C15
+	return (h ^ h>>32) & s.mask
+}
+
+// Increment adds one to the count of an ID, returning the new count
+func (s *idCountSet) Increment(id ID) int {
+	// Keep the load factor at most one half
+	if (s.size+1)*2 > len(s.slots) {
+		s.grow()
+	}
+
+	for i := s.index(id); ; i = (i + 1) & s.mask {
+		slot := &s.slots[i]
+		if slot.generation != s.generation {
+			*slot = idCountSlot{id, 1, s.generation}
+			s.size++
+			return 1
+		}
+		if slot.id == id {
+			slot.count++
+			return slot.count
+		}
+	}
+}
+
+// Get returns the count of an ID
+func (s *idCountSet) Get(id ID) int {
+	for i := s.index(id); ; i = (i + 1) & s.mask {
+		slot := &s.slots[i]
+		if slot.generation != s.generation {
+			return 0
+		}
+		if slot.id == id {
+			return slot.count
+		}
+	}
+}
+
+// Len returns the number of IDs in the set
+func (s *idCountSet) Len() int {
+	return s.size
+}
+
+// grow doubles the number of slots, rehashing every live slot
+func (s *idCountSet) grow() {
+	old := s.slots
+	s.slots = make([]idCountSlot, len(old)*2)
+	s.mask = uint64(len(s.slots) - 1)
+
+	for _, slot := range old {
+		if slot.generation != s.generation {
+			continue
+		}
+		i := s.index(slot.id)
+		for s.slots[i].generation == s.generation {
+			i = (i + 1) & s.mask
+		}
+		s.slots[i] = slot
+	}
+}
+
+// Reset empties the set
+func (s *idCountSet) Reset() {
+	s.size = 0
+	s.generation++
+	if s.generation == 0 {
+		// Wrapped around, stale slots could now appear live
+		for i := range s.slots {
+			s.slots[i].generation = 0
+		}
+		s.generation = 1
+	}
+}
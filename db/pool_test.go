@@ -0,0 +1,87 @@
+package db
+
+import "testing"
+
+func TestIDCountSet(t *testing.T) {
+	set := newIDCountSet(0)
+
+	// Enough IDs to force the set to grow several times
+	count := poolMinEntrySize * 10
+	for round := 1; round <= 3; round++ {
+		for i := uint64(0); i < uint64(count); i++ {
+			if got := set.Increment(IDFromSequence(i)); got != round {
+				t.Fatalf("expected count %d for %d, got %d", round, i, got)
+			}
+		}
+	}
+	if set.Len() != count {
+		t.Fatalf("expected %d ids, got %d", count, set.Len())
+	}
+	if set.Get(IDFromSequence(uint64(count))) != 0 {
+		t.Fatalf("set contains id never added")
+	}
+
+	set.Reset()
+	if set.Len() != 0 || set.Get(IDFromSequence(5)) != 0 {
+		t.Fatalf("set not empty after Reset")
+	}
+	if got := set.Increment(IDFromSequence(5)); got != 1 {
+		t.Fatalf("expected count 1 after Reset, got %d", got)
+	}
+
+	// Wrapping the generation must not revive stale slots
+	set.generation = ^uint32(0)
+	set.Increment(IDFromSequence(7))
+	set.Reset()
+	if set.Get(IDFromSequence(7)) != 0 {
+		t.Fatalf("stale slot survived generation wrap")
+	}
+}
+
+func TestPoolReset(t *testing.T) {
+	pool := NewPool(1, func() Resettable {
+		return newIDCountSet(0)
+	})
+
+	set := pool.Borrow().(*idCountSet)
+	set.Increment(IDFromSequence(1))
+	pool.Give(set)
+
+	reused := pool.Borrow().(*idCountSet)
+	if reused != set {
+		t.Fatalf("pool did not reuse returned set")
+	}
+	if reused.Len() != 0 {
+		t.Fatalf("pooled set not reset")
+	}
+}
+
+// benchSetSize approximates the sets built by a query with
+// several mods over a few strides.
+const benchSetSize = LookupItemsMultiModStrideLength * 3 * 4
+
+func BenchmarkIDCountSetReuse(b *testing.B) {
+	set := newIDCountSet(benchSetSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for seq := uint64(0); seq < benchSetSize; seq++ {
+			set.Increment(IDFromSequence(seq))
+		}
+		set.Reset()
+	}
+}
+
+func BenchmarkIDMapClear(b *testing.B) {
+	set := make(map[ID]int, benchSetSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for seq := uint64(0); seq < benchSetSize; seq++ {
+			set[IDFromSequence(seq)]++
+		}
+		for id := range set {
+			delete(set, id)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// reindexBucket exists directly under a league only while it is
+// being reindexed and holds the progress of the rebuild.
+const reindexBucket string = "reindex"
+
+// shadowIndexBucket exists directly under a league only while its
+// index is being rebuilt alongside the existing index.
+const shadowIndexBucket string = "indicesShadow"
+
+var reindexShadowKey = []byte("shadow")
+var reindexLastKey = []byte("last")
+var reindexGranularityKey = []byte("granularity")
+
+// DefaultReindexBatchSize is a sane number of items to index
+// in a single write transaction.
+const DefaultReindexBatchSize = 1000
+
+// reindexState is the progress of a league being reindexed
+type reindexState struct {
+	// Whether the index is being rebuilt in the shadow index
+	Shadow bool
+	// The last item indexed, nil if none have been
+	Last *ID
+	// IndexGranularity the index is being rebuilt with
+	Granularity IndexGranularity
+}
+
+// passed determines if the rebuild has already indexed an ID
+func (state *reindexState) passed(id ID) bool {
+	return state.Last != nil && bytes.Compare(id[:], state.Last[:]) <= 0
+}
+
+// getReindexState returns the progress of a league being reindexed
+// or nil if it is not being reindexed.
+func getReindexState(league LeagueHeapID, tx *bolt.Tx) (*reindexState, error) {
+	b := getLeagueBucket(league, tx).Bucket([]byte(reindexBucket))
+	if b == nil {
+		return nil, nil
+	}
+
+	state := &reindexState{
+		Shadow: bytes.Equal(b.Get(reindexShadowKey), []byte{1}),
+	}
+	granularity := b.Get(reindexGranularityKey)
+	if len(granularity) != 1 ||
+		IndexGranularity(granularity[0]) > MaxIndexGranularity {
+		return nil, errors.Errorf("malformed reindex granularity, granularity=%v",
+			granularity)
+	}
+	state.Granularity = IndexGranularity(granularity[0])
+	if last := b.Get(reindexLastKey); last != nil {
+		if len(last) != IDSize {
+			return nil, errors.Errorf("malformed reindex progress, last=%v", last)
+		}
+		state.Last = &ID{}
+		copy(state.Last[:], last)
+	}
+	return state, nil
+}
+
+// putReindexState records the progress of a league being reindexed
+func putReindexState(league LeagueHeapID, state *reindexState,
+	tx *bolt.Tx) error {
+
+	b, err := getLeagueBucket(league, tx).
+		CreateBucketIfNotExists([]byte(reindexBucket))
+	if err != nil {
+		return errors.Wrap(err, "failed to create reindex bucket")
+	}
+
+	shadow := []byte{0}
+	if state.Shadow {
+		shadow = []byte{1}
+	}
+	if err := b.Put(reindexShadowKey, shadow); err != nil {
+		return errors.Wrap(err, "failed to record reindex mode")
+	}
+	err = b.Put(reindexGranularityKey, []byte{byte(state.Granularity)})
+	if err != nil {
+		return errors.Wrap(err, "failed to record reindex granularity")
+	}
+	if state.Last == nil {
+		return nil
+	}
+	last := *state.Last
+	return errors.Wrap(b.Put(reindexLastKey, last[:]),
+		"failed to record reindex progress")
+}
+
+// getLeagueShadowIndexBucket returns the bucket corresponding
+// to a specific league's shadow index.
+//
+// Will either panic or return a valid bucket.
+func getLeagueShadowIndexBucket(league LeagueHeapID, tx *bolt.Tx) *bolt.Bucket {
+	shadow := getLeagueBucket(league, tx).Bucket([]byte(shadowIndexBucket))
+	if shadow == nil {
+		panic(fmt.Sprintf("%s bucket not found when expected", shadowIndexBucket))
+	}
+
+	return shadow
+}
+
+// ReindexOptions determines how a league is reindexed
+type ReindexOptions struct {
+	// Build the index alongside the existing index and swap it in once
+	// complete. Otherwise, the existing index is dropped up front and
+	// queries see a partial index until the rebuild completes.
+	Shadow bool
+	// Maximum number of items indexed in a single write transaction,
+	// DefaultReindexBatchSize is used when less than 1
+	BatchSize int
+	// IndexGranularity the index is rebuilt with, nil keeps
+	// the league's current granularity
+	Granularity *IndexGranularity
+}
+
+// ReindexProgress is provided after each batch of a reindex
+type ReindexProgress struct {
+	League string
+	// Number of items indexed so far
+	Items int
+	// Number of items left to index when this run started
+	Total int
+}
+
+// ReindexReport represents the work done by Reindex
+type ReindexReport struct {
+	League      string
+	Shadow      bool
+	Granularity IndexGranularity
+	// Whether an earlier, interrupted reindex was continued
+	Resumed bool
+	// Number of items indexed and the index entries added for them
+	Items, Entries int
+	// Number of write transactions used
+	Batches int
+}
+
+func (r ReindexReport) String() string {
+	mode := "in place"
+	if r.Shadow {
+		mode = "in shadow"
+	}
+	verb := "reindexed"
+	if r.Resumed {
+		verb = "resumed reindexing"
+	}
+	return fmt.Sprintf("%s league %s %s with %s buckets: %d items | %d entries | %d batches",
+		verb, r.League, mode, r.Granularity.Duration(),
+		r.Items, r.Entries, r.Batches)
+}
+
+// startReindex clears the index being built and records that
+// the league is being reindexed
+//
+// When reindexing in place, the league's granularity changes immediately
+// as its index is cleared.
+func startReindex(league LeagueHeapID, state *reindexState,
+	tx *bolt.Tx) error {
+
+	name := indiceBucket
+	if state.Shadow {
+		name = shadowIndexBucket
+	} else if err := putIndexGranularity(league, state.Granularity, tx); err != nil {
+		return errors.Wrap(err, "failed to set index granularity")
+	}
+
+	leagueBucket := getLeagueBucket(league, tx)
+	if leagueBucket.Bucket([]byte(name)) != nil {
+		if err := leagueBucket.DeleteBucket([]byte(name)); err != nil {
+			return errors.Wrapf(err, "failed to remove %s bucket", name)
+		}
+	}
+	if _, err := leagueBucket.CreateBucket([]byte(name)); err != nil {
+		return errors.Wrapf(err, "failed to create %s bucket", name)
+	}
+
+	return putReindexState(league, state, tx)
+}
+
+// countRemaining returns the number of items a reindex has yet to index
+func countRemaining(league LeagueHeapID, state *reindexState,
+	tx *bolt.Tx) int {
+
+	c := getLeagueItemBucket(league, tx).Cursor()
+	k, v := c.First()
+	if state.Last != nil {
+		k, v = c.Seek(state.Last[:])
+		if k != nil && bytes.Equal(k, state.Last[:]) {
+			k, v = c.Next()
+		}
+	}
+
+	var remaining int
+	for ; k != nil; k, v = c.Next() {
+		if v != nil {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// reindexItems indexes up to limit items following the last item
+// indexed, returning true once every item has been indexed.
+func reindexItems(league LeagueHeapID, state *reindexState, limit int,
+	report *ReindexReport, tx *bolt.Tx) (bool, error) {
+
+	batch, err := newIndexBatch(tx)
+	if err != nil {
+		return false, err
+	}
+
+	c := getLeagueItemBucket(league, tx).Cursor()
+	k, v := c.First()
+	if state.Last != nil {
+		k, v = c.Seek(state.Last[:])
+		if k != nil && bytes.Equal(k, state.Last[:]) {
+			k, v = c.Next()
+		}
+	}
+
+	var last ID
+	var count int
+	for ; k != nil && count < limit; k, v = c.Next() {
+		// Ignore nested buckets
+		if v == nil {
+			continue
+		}
+		var item Item
+		if _, err := item.UnmarshalMsg(v); err != nil {
+			return false, errors.Wrap(err, "failed to Unmarshal Item")
+		}
+		if err := batch.addTo(item, state.Shadow); err != nil {
+			return false, err
+		}
+		report.Entries += len(item.Mods)
+		last = item.ID
+		count++
+	}
+	done := k == nil
+
+	if err := batch.write(); err != nil {
+		return false, err
+	}
+	report.Items += count
+	if count > 0 {
+		state.Last = &last
+	}
+
+	return done, putReindexState(league, state, tx)
+}
+
+// copyBucketContents copies everything in src, including nested
+// buckets, into dst.
+func copyBucketContents(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			// Values are only valid for the life of the transaction
+			// and writes could invalidate them before it ends.
+			return dst.Put(k, append([]byte{}, v...))
+		}
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucketContents(nested, src.Bucket(k))
+	})
+}
+
+// finishReindex swaps in the shadow index and its granularity, when
+// used, and records the league is no longer being reindexed.
+func finishReindex(league LeagueHeapID, state *reindexState,
+	tx *bolt.Tx) error {
+
+	leagueBucket := getLeagueBucket(league, tx)
+
+	if state.Shadow {
+		if err := leagueBucket.DeleteBucket([]byte(indiceBucket)); err != nil {
+			return errors.Wrapf(err, "failed to remove %s bucket", indiceBucket)
+		}
+		indices, err := leagueBucket.CreateBucket([]byte(indiceBucket))
+		if err != nil {
+			return errors.Wrapf(err, "failed to create %s bucket", indiceBucket)
+		}
+		err = copyBucketContents(indices, getLeagueShadowIndexBucket(league, tx))
+		if err != nil {
+			return errors.Wrap(err, "failed to copy shadow index")
+		}
+		if err := leagueBucket.DeleteBucket([]byte(shadowIndexBucket)); err != nil {
+			return errors.Wrapf(err, "failed to remove %s bucket", shadowIndexBucket)
+		}
+		if err := putIndexGranularity(league, state.Granularity, tx); err != nil {
+			return errors.Wrap(err, "failed to set index granularity")
+		}
+	}
+
+	return errors.Wrapf(leagueBucket.DeleteBucket([]byte(reindexBucket)),
+		"failed to remove %s bucket", reindexBucket)
+}
+
+// abandonReindex discards the progress of a league being reindexed
+// along with its shadow index, if any.
+//
+// When reindexing in place, the index is left partially rebuilt.
+func abandonReindex(league LeagueHeapID, tx *bolt.Tx) error {
+	leagueBucket := getLeagueBucket(league, tx)
+	for _, name := range []string{reindexBucket, shadowIndexBucket} {
+		if leagueBucket.Bucket([]byte(name)) == nil {
+			continue
+		}
+		if err := leagueBucket.DeleteBucket([]byte(name)); err != nil {
+			return errors.Wrapf(err, "failed to remove %s bucket", name)
+		}
+	}
+	return nil
+}
+
+// Reindex rebuilds the index of a league from its item store
+//
+// Items are indexed in batches of at most options.BatchSize, each in its
+// own write transaction. Progress is recorded with each batch, so
+// calling Reindex on a league whose reindex was interrupted continues
+// where it left off, in the mode it was started with.
+//
+// The index is rebuilt with options.Granularity, which becomes the
+// league's granularity, or the league's current granularity if unset.
+//
+// Ingestion may continue while a league is reindexed; the reindex
+// finishes in the same transaction as its last batch. progress, if
+// non-nil, is called after every batch.
+func Reindex(name string, options ReindexOptions,
+	progress func(ReindexProgress), db *bolt.DB) (*ReindexReport, error) {
+
+	if options.BatchSize < 1 {
+		options.BatchSize = DefaultReindexBatchSize
+	}
+	if options.Granularity != nil && *options.Granularity > MaxIndexGranularity {
+		return nil, errors.Errorf("index granularity %d exceeds maximum of %d",
+			*options.Granularity, MaxIndexGranularity)
+	}
+
+	leagueIDs, err := GetLeagues([]string{name}, db)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to find league %s", name)
+	}
+	league := leagueIDs[0]
+
+	report := &ReindexReport{League: name}
+	var state *reindexState
+	var total int
+	err = db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if state, err = getReindexState(league, tx); err != nil {
+			return err
+		}
+		if state != nil {
+			report.Resumed = true
+		} else {
+			state = &reindexState{Shadow: options.Shadow}
+			if options.Granularity != nil {
+				state.Granularity = *options.Granularity
+			} else if state.Granularity, err = getIndexGranularity(league, tx); err != nil {
+				return err
+			}
+			if err := startReindex(league, state, tx); err != nil {
+				return err
+			}
+		}
+		total = countRemaining(league, state, tx)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start reindex")
+	}
+	report.Shadow = state.Shadow
+	report.Granularity = state.Granularity
+
+	for done := false; !done; {
+		err := db.Update(func(tx *bolt.Tx) error {
+			var err error
+			done, err = reindexItems(league, state, options.BatchSize,
+				report, tx)
+			if err != nil || !done {
+				return err
+			}
+			// Finish alongside the last batch, an item added between
+			// them would follow state.Last and never be indexed
+			return finishReindex(league, state, tx)
+		})
+		if err != nil {
+			return report, errors.Wrap(err, "failed to reindex items")
+		}
+		report.Batches++
+
+		if progress != nil {
+			progress(ReindexProgress{
+				League: name,
+				Items:  report.Items,
+				Total:  total,
+			})
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// replayCheckpointKey holds the last change of a ChangeSet replayed into
+// the database in the settings bucket, as the time it was processed at
+// in unix nanoseconds followed by its change ID
+const replayCheckpointKey = "replayCheckpoint"
+
+// DefaultReplayStep is the time between changes of a replayed ChangeSet
+// when none is provided, roughly how often changes are fetched
+const DefaultReplayStep = 4 * time.Second
+
+// replayCheckpoint is the last change replayed into the database
+type replayCheckpoint struct {
+	ChangeID string
+	When     time.Time
+}
+
+// getReplayCheckpoint returns the last change replayed, nil if nothing
+// has been replayed
+func getReplayCheckpoint(tx *bolt.Tx) (*replayCheckpoint, error) {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return nil, errors.Errorf("%s bucket not found", settingsBucket)
+	}
+
+	value := b.Get([]byte(replayCheckpointKey))
+	if value == nil {
+		return nil, nil
+	}
+	if len(value) < 8 {
+		return nil, errors.Errorf("malformed %s setting, value=%v",
+			replayCheckpointKey, value)
+	}
+	return &replayCheckpoint{
+		ChangeID: string(value[8:]),
+		When:     time.Unix(0, int64(btoi64(value[:8]))).UTC(),
+	}, nil
+}
+
+// putReplayCheckpoint records the last change replayed
+func putReplayCheckpoint(checkpoint replayCheckpoint, tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return errors.Errorf("%s bucket not found", settingsBucket)
+	}
+
+	value := i64tob(uint64(checkpoint.When.UnixNano()))
+	value = append(value, checkpoint.ChangeID...)
+	return b.Put([]byte(replayCheckpointKey), value)
+}
+
+// ReplayOptions determines how ReplayChangeSet adds changes
+type ReplayOptions struct {
+	// Time the first change is processed at, the current time when zero
+	Start time.Time
+	// Time between each change, DefaultReplayStep when not positive
+	Step time.Duration
+	// Process every change at the time given by Start and Step even
+	// when the time it was fetched was recorded
+	Synthetic bool
+	// When positive, changes are added in real time sped up by Pace,
+	// waiting the time between each divided by Pace; otherwise as fast
+	// as possible
+	Pace float64
+	// Ignore the checkpoint of an earlier replay, starting from
+	// the first change
+	FromStart bool
+	// Called after each change is added when non-nil
+	Progress func(ReplayProgress)
+}
+
+// ReplayProgress is provided after each change is added
+type ReplayProgress struct {
+	// Position of the change in the ChangeSet
+	Index    int
+	ChangeID string
+	When     time.Time
+	Stats    StashUpdateStats
+}
+
+// ReplayReport represents the work done by ReplayChangeSet
+type ReplayReport struct {
+	// Change the replay continued after, empty if started from the first
+	ResumedAfter string
+	// Number of changes added and skipped as already replayed
+	Changes, Skipped int
+	// Times the first and last change added were processed at
+	First, Last time.Time
+	// Combined stats of every change added
+	Stats StashUpdateStats
+	Took  time.Duration
+}
+
+func (r ReplayReport) String() string {
+	resumed := ""
+	if r.ResumedAfter != "" {
+		resumed = fmt.Sprintf(", resumed after %s skipping %d,",
+			r.ResumedAfter, r.Skipped)
+	}
+	return fmt.Sprintf("replayed %d changes%s in %s\n  processed from %s to %s\n%s",
+		r.Changes, resumed, r.Took,
+		r.First.Format(time.RFC3339), r.Last.Format(time.RFC3339), r.Stats)
+}
+
+// ReplayChangeSet adds every change of a ChangeSet or change archive in
+// order, as each would have been added when fetched.
+//
+// Each change is processed at the time it was fetched when that was
+// recorded, as change archives do, unless options.Synthetic is set.
+// Otherwise change i is processed at options.Start plus i times
+// options.Step.
+//
+// A checkpoint is recorded alongside each change, so replaying the same
+// ChangeSet again continues after the last change added with the times
+// the remaining changes would have had given the same Step.
+func ReplayChangeSet(set stash.ChangeReader, options ReplayOptions,
+	db *bolt.DB) (*ReplayReport, error) {
+
+	if options.Step <= 0 {
+		options.Step = DefaultReplayStep
+	}
+	if options.Start.IsZero() {
+		options.Start = time.Now()
+	}
+	report := &ReplayReport{}
+	ids := set.ChangeIDs()
+
+	first := 0
+	if !options.FromStart {
+		var checkpoint *replayCheckpoint
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			checkpoint, err = getReplayCheckpoint(tx)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read replay checkpoint")
+		}
+		if checkpoint != nil {
+			index, ok := set.IndexOf(checkpoint.ChangeID)
+			if !ok {
+				return nil, errors.Errorf("checkpoint change %s is not in the ChangeSet, replay from the start instead",
+					checkpoint.ChangeID)
+			}
+			first = index + 1
+			options.Start = checkpoint.When.Add(-time.Duration(index) * options.Step)
+			report.ResumedAfter = checkpoint.ChangeID
+			report.Skipped = first
+		}
+	}
+
+	start := time.Now()
+	var paceFrom time.Time
+	for i := first; i < len(ids); i++ {
+		when := set.FetchedAt(i)
+		if options.Synthetic || when.IsZero() {
+			when = options.Start.Add(time.Duration(i) * options.Step)
+		}
+
+		if options.Pace > 0 {
+			if i == first {
+				paceFrom = when
+			}
+			wait := time.Duration(float64(when.Sub(paceFrom)) / options.Pace)
+			time.Sleep(time.Until(start.Add(wait)))
+		}
+
+		comp, err := set.ChangeAt(i)
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to read change %s", ids[i])
+		}
+		resp, err := comp.Decompress()
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to decompress change %s", ids[i])
+		}
+		var stats *StashUpdateStats
+		err = db.Update(func(tx *bolt.Tx) error {
+			stashes, items, err := stashStashToCompact(resp.Stashes, when, tx)
+			if err != nil {
+				return errors.Wrap(err, "failed to convert fat stashes to compact")
+			}
+			stats, err = addStashes(stashes, items, tx)
+			if err != nil {
+				return errors.Wrap(err, "failed to store stashes")
+			}
+
+			err = putReplayCheckpoint(replayCheckpoint{
+				ChangeID: ids[i],
+				When:     when,
+			}, tx)
+			return errors.Wrap(err, "failed to record replay checkpoint")
+		})
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to store change %s", ids[i])
+		}
+
+		progress := ReplayProgress{Index: i, ChangeID: ids[i], When: when}
+		if stats != nil {
+			progress.Stats = *stats
+		}
+		if report.Changes == 0 {
+			report.First = when
+		}
+		report.Changes++
+		report.Last = when
+		report.Stats.add(progress.Stats)
+		if options.Progress != nil {
+			options.Progress(progress)
+		}
+	}
+
+	report.Took = time.Since(start)
+	return report, nil
+}
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+const stashSeenBucket string = "stashSeen"
+
+// getStashSeenBucket returns the bucket corresponding to a specific
+// league holding when each stash was last seen in an update
+//
+// Will either panic or return a valid bucket.
+func getStashSeenBucket(league LeagueHeapID, tx *bolt.Tx) *bolt.Bucket {
+	// Grab league bucket
+	leagueBucket := getLeagueBucket(league, tx)
+
+	// This can never fail, its a guarantee that the stashSeenBucket was
+	// registered and will always appear on a valid leagueBucket
+	seen := leagueBucket.Bucket([]byte(stashSeenBucket))
+	if seen == nil {
+		panic(fmt.Sprintf("%s bucket not found when expected", stashSeenBucket))
+	}
+
+	return seen
+}
+
+// getStashSeen returns when a stash was last seen in an update
+//
+// Stashes last seen before this was tracked have no time recorded,
+// in which case false is returned.
+func getStashSeen(id GGGID, league LeagueHeapID,
+	tx *bolt.Tx) (Timestamp, bool) {
+
+	var when Timestamp
+	value := getStashSeenBucket(league, tx).Get(id[:])
+	if len(value) != TimestampSize {
+		return when, false
+	}
+	copy(when[:], value)
+	return when, true
+}
+
+// updateTimestamp returns the latest When of an update's items, the
+// time the update was processed at.
+//
+// If no items are present, the current time is used.
+func updateTimestamp(items [][]Item) Timestamp {
+	var latest Timestamp
+	var found bool
+	for _, stashItems := range items {
+		for _, item := range stashItems {
+			if !found || bytes.Compare(item.When[:], latest[:]) > 0 {
+				latest = item.When
+				found = true
+			}
+		}
+	}
+	if !found {
+		return NewTimestamp()
+	}
+	return latest
+}
+
+// RetentionBasis determines what the age of an item is measured from
+type RetentionBasis int
+
+const (
+	// RetainByItem measures age from when the item was added, Item.When
+	RetainByItem RetentionBasis = iota
+	// RetainByStash measures age from when the item's stash was last
+	// seen in an update, falling back to Item.When if never recorded
+	RetainByStash
+)
+
+func (basis RetentionBasis) String() string {
+	switch basis {
+	case RetainByItem:
+		return "item"
+	case RetainByStash:
+		return "stash"
+	default:
+		return fmt.Sprintf("RetentionBasis(%d)", int(basis))
+	}
+}
+
+// DefaultPruneBatchSize is a sane number of items to remove
+// in a single write transaction.
+//
+// Larger batches are more efficient but hold the write lock longer.
+const DefaultPruneBatchSize = 1000
+
+// RetentionPolicy determines which items are expired
+type RetentionPolicy struct {
+	// Items older than MaxAge are expired
+	MaxAge time.Duration
+	// What the age of an item is measured from
+	Basis RetentionBasis
+	// Maximum number of items removed in a single write transaction,
+	// DefaultPruneBatchSize is used when less than 1
+	BatchSize int
+}
+
+// expired determines if an item is expired relative to a cutoff
+func (policy RetentionPolicy) expired(item Item, cutoff time.Time,
+	tx *bolt.Tx) bool {
+
+	when := item.When
+	if policy.Basis == RetainByStash {
+		if seen, ok := getStashSeen(item.Stash, item.League, tx); ok {
+			when = seen
+		}
+	}
+	return when.ToTime().Before(cutoff)
+}
+
+// LeaguePruneReport holds the work done pruning a single league
+type LeaguePruneReport struct {
+	League LeagueHeapID
+	// Number of items expired
+	Items int
+	// Number of stashes left without any items and removed
+	Stashes int
+	// Number of write transactions used
+	Batches int
+}
+
+// PruneReport represents the work done, or would be done on
+// a dry run, by Prune.
+type PruneReport struct {
+	DryRun  bool
+	Policy  RetentionPolicy
+	Leagues []LeaguePruneReport
+}
+
+func (r PruneReport) String() string {
+	verb := "pruned"
+	if r.DryRun {
+		verb = "would prune"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s items older than %s by %s",
+		verb, r.Policy.MaxAge, r.Policy.Basis)
+	for _, league := range r.Leagues {
+		fmt.Fprintf(&buf, "\n  league %d: %d items | %d stashes | %d batches",
+			league.League, league.Items, league.Stashes, league.Batches)
+	}
+	return buf.String()
+}
+
+// findExpired returns up to limit expired items in a league with
+// IDs after the provided ID.
+//
+// Also returns whether the end of the league was reached.
+func findExpired(policy RetentionPolicy, cutoff time.Time,
+	league LeagueHeapID, after *ID, limit int,
+	tx *bolt.Tx) ([]Item, bool, error) {
+
+	expired := make([]Item, 0, limit)
+
+	c := getLeagueItemBucket(league, tx).Cursor()
+	var k, v []byte
+	if after == nil {
+		k, v = c.First()
+	} else {
+		k, v = c.Seek(after[:])
+		if k != nil && bytes.Equal(k, after[:]) {
+			k, v = c.Next()
+		}
+	}
+
+	for ; k != nil; k, v = c.Next() {
+		if len(expired) >= limit {
+			return expired, false, nil
+		}
+
+		// Ignore nested buckets
+		if v == nil {
+			continue
+		}
+		var item Item
+		if _, err := item.UnmarshalMsg(v); err != nil {
+			return nil, false,
+				errors.Wrap(err, "failed to Unmarshal Item from heap")
+		}
+		if policy.expired(item, cutoff, tx) {
+			expired = append(expired, item)
+		}
+	}
+
+	return expired, true, nil
+}
+
+// pruneItems removes expired items from the item store, their indices,
+// their stashes, and the id translator.
+//
+// Items are checked again as they could have changed since they
+// were found; only those still present and expired are removed.
+func pruneItems(policy RetentionPolicy, cutoff time.Time,
+	candidates []Item, league LeagueHeapID,
+	report *LeaguePruneReport, tx *bolt.Tx) error {
+
+	itemBucket := getLeagueItemBucket(league, tx)
+
+	ids := make([]ID, 0, len(candidates))
+	byStash := make(map[GGGID]map[GGGID]struct{})
+	for _, candidate := range candidates {
+		itemBytes := itemBucket.Get(candidate.ID[:])
+		if itemBytes == nil {
+			continue
+		}
+		var item Item
+		if _, err := item.UnmarshalMsg(itemBytes); err != nil {
+			return errors.Wrap(err, "failed to Unmarshal Item from heap")
+		}
+		if !policy.expired(item, cutoff, tx) {
+			continue
+		}
+
+		ids = append(ids, item.ID)
+		removed, ok := byStash[item.Stash]
+		if !ok {
+			removed = make(map[GGGID]struct{})
+			byStash[item.Stash] = removed
+		}
+		removed[item.GGGID] = struct{}{}
+	}
+
+	if err := removeItems(ids, league, tx); err != nil {
+		return errors.Wrap(err, "failed to removeItems")
+	}
+	report.Items += len(ids)
+
+	// Drop the removed items from their stashes so the next update
+	// of that stash considers them new rather than removed.
+	meta := getStashMetaBucket(league, tx)
+	seen := getStashSeenBucket(league, tx)
+	translator := getIDTranslateItemBucket(league, tx)
+	for stashID, removed := range byStash {
+		for id := range removed {
+			if err := translator.Delete(id[:]); err != nil {
+				return errors.Wrap(err, "failed to remove id translation")
+			}
+		}
+
+		serial := meta.Get(stashID[:])
+		if serial == nil {
+			continue
+		}
+		var stash Stash
+		if _, err := stash.UnmarshalMsg(serial); err != nil {
+			return errors.Wrap(err, "failed to Unmarshal Stash")
+		}
+		kept := stash.Items[:0]
+		for _, id := range stash.Items {
+			if _, ok := removed[id]; !ok {
+				kept = append(kept, id)
+			}
+		}
+		stash.Items = kept
+
+		if len(stash.Items) == 0 {
+			if err := meta.Delete(stashID[:]); err != nil {
+				return errors.Wrap(err, "failed to remove stash")
+			}
+			if err := seen.Delete(stashID[:]); err != nil {
+				return errors.Wrap(err, "failed to remove stash seen time")
+			}
+			report.Stashes++
+			continue
+		}
+
+		serial, err := stash.MarshalMsg(nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to Marshal Stash")
+		}
+		if err := meta.Put(stashID[:], serial); err != nil {
+			return errors.Wrap(err, "failed to update stash")
+		}
+	}
+
+	return nil
+}
+
+// pruneLeague expires items in a single league
+func pruneLeague(policy RetentionPolicy, cutoff time.Time,
+	league LeagueHeapID, dryRun bool,
+	db *bolt.DB) (LeaguePruneReport, error) {
+
+	report := LeaguePruneReport{League: league}
+
+	// Number of expired items in each stash, only tracked on a dry run
+	// to determine which stashes would be emptied.
+	dryStashes := make(map[GGGID]int)
+
+	var after *ID
+	for {
+		// Find a batch with a read transaction so writers are only
+		// blocked for the removal itself
+		var batch []Item
+		var done bool
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			batch, done, err = findExpired(policy, cutoff, league, after,
+				policy.BatchSize, tx)
+			return err
+		})
+		if err != nil {
+			return report, errors.Wrap(err, "failed to find expired items")
+		}
+
+		if len(batch) > 0 {
+			last := batch[len(batch)-1].ID
+			after = &last
+
+			if dryRun {
+				report.Items += len(batch)
+				for _, item := range batch {
+					dryStashes[item.Stash]++
+				}
+			} else {
+				err = db.Update(func(tx *bolt.Tx) error {
+					return pruneItems(policy, cutoff, batch, league, &report, tx)
+				})
+				if err != nil {
+					return report, errors.Wrap(err, "failed to prune items")
+				}
+				report.Batches++
+			}
+		}
+
+		if done {
+			break
+		}
+	}
+
+	if !dryRun {
+		return report, nil
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := getStashMetaBucket(league, tx)
+		for stashID, expired := range dryStashes {
+			serial := meta.Get(stashID[:])
+			if serial == nil {
+				continue
+			}
+			var stash Stash
+			if _, err := stash.UnmarshalMsg(serial); err != nil {
+				return errors.Wrap(err, "failed to Unmarshal Stash")
+			}
+			if expired >= len(stash.Items) {
+				report.Stashes++
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// Prune removes every item expired under the provided policy as of now
+// across all leagues.
+//
+// Items are removed in batches of at most policy.BatchSize, each in
+// its own write transaction, so readers and writers are never blocked for
+// long. When dryRun is set, nothing is removed and the report contains
+// what would have been.
+func Prune(policy RetentionPolicy, now time.Time, dryRun bool,
+	db *bolt.DB) (*PruneReport, error) {
+
+	if policy.MaxAge <= 0 {
+		return nil, errors.New("retention policy MaxAge must be positive")
+	}
+	if policy.BatchSize < 1 {
+		policy.BatchSize = DefaultPruneBatchSize
+	}
+
+	leagueStrings, err := ListLeagues(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list leagues")
+	}
+	leagueIDs, err := GetLeagues(leagueStrings, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert league strings to ids")
+	}
+
+	cutoff := now.Add(-policy.MaxAge)
+	report := &PruneReport{DryRun: dryRun, Policy: policy}
+	for _, league := range leagueIDs {
+		leagueReport, err := pruneLeague(policy, cutoff, league, dryRun, db)
+		if err != nil {
+			return report, errors.Wrapf(err, "failed to prune league=%d", league)
+		}
+		report.Leagues = append(report.Leagues, leagueReport)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+const settingsBucket = "settings"
+
+// indexEncodingKey holds the IndexEncoding new index entries are written as
+const indexEncodingKey = "indexEncoding"
+
+// DefaultIndexEncoding is the IndexEncoding used when none has been set
+const DefaultIndexEncoding = IndexEncodingSorted
+
+// getIndexEncoding returns the IndexEncoding index entries are
+// written as with the database the transaction is on.
+func getIndexEncoding(tx *bolt.Tx) (IndexEncoding, error) {
+	b := tx.Bucket([]byte(settingsBucket))
+	if b == nil {
+		return 0, errors.Errorf("%s bucket not found", settingsBucket)
+	}
+
+	value := b.Get([]byte(indexEncodingKey))
+	if value == nil {
+		return DefaultIndexEncoding, nil
+	}
+	if len(value) != 1 {
+		return 0, errors.Errorf("malformed %s setting, value=%v",
+			indexEncodingKey, value)
+	}
+	return IndexEncoding(value[0]), nil
+}
+
+// GetIndexEncoding returns the IndexEncoding index entries are written as
+func GetIndexEncoding(db *bolt.DB) (IndexEncoding, error) {
+	var encoding IndexEncoding
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		encoding, err = getIndexEncoding(tx)
+		return err
+	})
+	return encoding, err
+}
+
+// SetIndexEncoding sets the IndexEncoding index entries are written as
+//
+// Existing entries are not rewritten; each entry is converted the next
+// time an item sharing it is indexed or deindexed.
+func SetIndexEncoding(encoding IndexEncoding, db *bolt.DB) error {
+	if encoding != IndexEncodingSorted && encoding != IndexEncodingRoaring {
+		return errors.Errorf("cannot write index entries as encoding %d",
+			encoding)
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(settingsBucket))
+		if b == nil {
+			return errors.Errorf("%s bucket not found", settingsBucket)
+		}
+		return b.Put([]byte(indexEncodingKey), []byte{byte(encoding)})
+	})
+}
+
+// indexGranularityKey holds the IndexGranularity of a league's index
+// directly within the league's bucket
+const indexGranularityKey = "indexGranularity"
+
+// getIndexGranularity returns the IndexGranularity a league's
+// index is keyed by
+func getIndexGranularity(league LeagueHeapID,
+	tx *bolt.Tx) (IndexGranularity, error) {
+
+	value := getLeagueBucket(league, tx).Get([]byte(indexGranularityKey))
+	if value == nil {
+		return DefaultIndexGranularity, nil
+	}
+	if len(value) != 1 || IndexGranularity(value[0]) > MaxIndexGranularity {
+		return 0, errors.Errorf("malformed %s setting, league=%d value=%v",
+			indexGranularityKey, league, value)
+	}
+	return IndexGranularity(value[0]), nil
+}
+
+// putIndexGranularity records the IndexGranularity a league's
+// index is keyed by
+//
+// This must only change when the league's index is rebuilt.
+func putIndexGranularity(league LeagueHeapID, granularity IndexGranularity,
+	tx *bolt.Tx) error {
+
+	if granularity > MaxIndexGranularity {
+		return errors.Errorf("index granularity %d exceeds maximum of %d",
+			granularity, MaxIndexGranularity)
+	}
+	return getLeagueBucket(league, tx).
+		Put([]byte(indexGranularityKey), []byte{byte(granularity)})
+}
+
+// GetIndexGranularity returns the IndexGranularity a league's
+// index is keyed by
+//
+// This can only be changed by rebuilding the league's index with Reindex.
+func GetIndexGranularity(name string, db *bolt.DB) (IndexGranularity, error) {
+	var granularity IndexGranularity
+	err := db.View(func(tx *bolt.Tx) error {
+		league, err := getLeague(name, tx)
+		if err != nil {
+			return err
+		}
+		granularity, err = getIndexGranularity(league, tx)
+		return err
+	})
+	return granularity, err
+}
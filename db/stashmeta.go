@@ -60,6 +60,16 @@ func (s *StashUpdateStats) Compare(other *StashUpdateStats) error {
 	return nil
 }
 
+// add accumulates the work done in other
+func (s *StashUpdateStats) add(other StashUpdateStats) {
+	s.Added += other.Added
+	s.Updated += other.Updated
+	s.Intact += other.Intact
+	s.Items.Added += other.Items.Added
+	s.Items.Removed += other.Items.Removed
+	s.Items.Kept += other.Items.Kept
+}
+
 func (s StashUpdateStats) String() string {
 	return fmt.Sprintf(`stashes: %d added | %d updated | %d intact
   items: %d added | %d removed | %d kept`,
@@ -153,6 +163,32 @@ func stashDiffUpdate(oldSerial []byte, newStash Stash, newItems []Item,
 func AddStashes(stashes []Stash, items [][]Item,
 	db *bolt.DB) (*StashUpdateStats, error) {
 
+	// Silently exit when no items stashes to add
+	if len(stashes) < 1 {
+		return nil, nil
+	}
+
+	var stats *StashUpdateStats
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		stats, err = addStashes(stashes, items, tx)
+		return err
+	})
+	return stats, err
+
+}
+
+// addStashes behaves as AddStashes within tx
+func addStashes(stashes []Stash, items [][]Item,
+	tx *bolt.Tx) (*StashUpdateStats, error) {
+	return addStashesSeen(stashes, items, updateTimestamp(items), tx)
+}
+
+// addStashesSeen behaves as addStashes, recording each stash as seen at
+// seen rather than when the latest of the update's items was added
+func addStashesSeen(stashes []Stash, items [][]Item, seen Timestamp,
+	tx *bolt.Tx) (*StashUpdateStats, error) {
+
 	// Silently exit when no items stashes to add
 	if len(stashes) < 1 {
 		return nil, nil
@@ -164,42 +200,40 @@ func AddStashes(stashes []Stash, items [][]Item,
 
 	stats := StashUpdateStats{}
 
-	return &stats, db.Update(func(tx *bolt.Tx) error {
+	// Add all of the stash metadata to the stashMeta
+	for i, stash := range stashes {
 
-		// Add all of the stash metadata to the stashMeta
-		for i, stash := range stashes {
+		// Serialize the stash
+		serial, err := stash.MarshalMsg(nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to Marshal Stash")
+		}
 
-			// Serialize the stash
-			serial, err := stash.MarshalMsg(nil)
-			if err != nil {
-				return errors.Wrap(err, "failed to Marshal Stash")
-			}
+		meta := getStashMetaBucket(stash.League, tx)
 
-			meta := getStashMetaBucket(stash.League, tx)
-
-			// Check for a pre-existing stash
-			oldSerial := meta.Get(stash.ID[:])
-			if oldSerial == nil {
-				// Handle trivial case of just needing to add the entire stash
-				// Add the items for this stash
-				if _, err := addItems(items[i], tx); err != nil {
-					return errors.Wrapf(err, "failed to add items for stash id=%s",
-						stash.ID)
-				}
-				stats.Added++
-				stats.Items.Added += len(items[i])
-			} else {
-				// Handle trivial case of just needing to add the entire stash
-				meta.Put(stash.ID[:], serial)
-				// Take care of diffing the stash
-				stashDiffUpdate(oldSerial, stash, items[i], &stats, tx)
+		// Check for a pre-existing stash
+		oldSerial := meta.Get(stash.ID[:])
+		if oldSerial == nil {
+			// Handle trivial case of just needing to add the entire stash
+			// Add the items for this stash
+			if _, err := addItems(items[i], tx); err != nil {
+				return nil, errors.Wrapf(err, "failed to add items for stash id=%s",
+					stash.ID)
 			}
-
-			// Then update the metadata
+			stats.Added++
+			stats.Items.Added += len(items[i])
+		} else {
+			// Handle trivial case of just needing to add the entire stash
 			meta.Put(stash.ID[:], serial)
-
+			// Take care of diffing the stash
+			stashDiffUpdate(oldSerial, stash, items[i], &stats, tx)
 		}
-		return nil
-	})
 
+		// Then update the metadata
+		meta.Put(stash.ID[:], serial)
+		// Record when each stash was seen for retention
+		getStashSeenBucket(stash.League, tx).Put(stash.ID[:], seen[:])
+
+	}
+	return &stats, nil
 }
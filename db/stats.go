@@ -0,0 +1,171 @@
+package db
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// ModStatsHistogramShift is the number of rightward shifts applied to
+// a scaled mod value to determine which histogram bucket it falls in.
+//
+// 5 represents buckets 32 scaled units wide, ~3 unscaled units
+const ModStatsHistogramShift = 5
+
+// ValueBucket is a single bucket of a ModStats histogram
+type ValueBucket struct {
+	Floor uint16 // Lowest scaled value which can fall in this bucket
+	IDs   int    // Number of IDs with a value inside this bucket
+}
+
+// ModStats summarizes the contents of a single mod index bucket
+type ModStats struct {
+	Keys int // Number of index keys present
+	IDs  int // Number of IDs across every key
+	// Histogram of IDs by value, ascending by Floor
+	Histogram []ValueBucket
+}
+
+// add registers an index entry with the given value as part of the stats.
+//
+// Entries must be added in ascending value order, which is the order
+// a cursor walks over a mod index bucket.
+func (stats *ModStats) add(value uint16, ids int) {
+	stats.Keys++
+	stats.IDs += ids
+
+	floor := (value >> ModStatsHistogramShift) << ModStatsHistogramShift
+	last := len(stats.Histogram) - 1
+	if last >= 0 && stats.Histogram[last].Floor == floor {
+		stats.Histogram[last].IDs += ids
+		return
+	}
+	stats.Histogram = append(stats.Histogram, ValueBucket{floor, ids})
+}
+
+// EstimateAtLeast returns the estimated number of IDs with
+// a value of at least the provided, scaled minimum.
+//
+// The bucket containing the minimum is counted in its entirety, so this
+// never underestimates.
+func (stats *ModStats) EstimateAtLeast(min uint16) int {
+	floor := (min >> ModStatsHistogramShift) << ModStatsHistogramShift
+
+	var estimate int
+	for i := len(stats.Histogram) - 1; i >= 0; i-- {
+		if stats.Histogram[i].Floor < floor {
+			break
+		}
+		estimate += stats.Histogram[i].IDs
+	}
+	return estimate
+}
+
+// modStatsKey uniquely identifies a mod index bucket within a league
+type modStatsKey struct {
+	rootType, rootFlavor, mod StringHeapID
+}
+
+// LeagueStats holds statistics for every index bucket
+// and the item store of a single league.
+type LeagueStats struct {
+	League    LeagueHeapID
+	Items     int       // Number of items in the item store
+	Collected time.Time // When these stats were gathered
+	mods      map[modStatsKey]*ModStats
+}
+
+// Mod returns the stats for the given mod index bucket
+// or ok is false if no such bucket existed at collection time.
+func (stats *LeagueStats) Mod(rootType, rootFlavor,
+	mod StringHeapID) (*ModStats, bool) {
+
+	modStats, ok := stats.mods[modStatsKey{rootType, rootFlavor, mod}]
+	return modStats, ok
+}
+
+// collectModStats walks a single mod index bucket
+func collectModStats(b *bolt.Bucket) (*ModStats, error) {
+	stats := &ModStats{}
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		// Ignore nested buckets
+		if v == nil {
+			continue
+		}
+		values, err := decodeModIndexKey(k)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode mod index key")
+		}
+		if len(values) == 0 {
+			return nil,
+				errors.Errorf("decoded item mod index key to no values, key=%v", k)
+		}
+		stats.add(values[0], IndexEntry(v).Count())
+	}
+
+	return stats, nil
+}
+
+// collectLeagueStats gathers statistics on a league
+// inside an existing transaction.
+func collectLeagueStats(league LeagueHeapID, tx *bolt.Tx) (*LeagueStats, error) {
+
+	stats := &LeagueStats{
+		League:    league,
+		Items:     getLeagueItemBucket(league, tx).Stats().KeyN,
+		Collected: time.Now(),
+		mods:      make(map[modStatsKey]*ModStats),
+	}
+
+	// The index is nested as rootType -> rootFlavor -> mod
+	indices := getLeagueIndexBucket(league, tx)
+	return stats, indices.ForEach(func(rootType, v []byte) error {
+		rootTypeBucket := indices.Bucket(rootType)
+		if rootTypeBucket == nil {
+			return nil
+		}
+		return rootTypeBucket.ForEach(func(rootFlavor, v []byte) error {
+			rootFlavorBucket := rootTypeBucket.Bucket(rootFlavor)
+			if rootFlavorBucket == nil {
+				return nil
+			}
+			return rootFlavorBucket.ForEach(func(mod, v []byte) error {
+				modBucket := rootFlavorBucket.Bucket(mod)
+				if modBucket == nil {
+					return nil
+				}
+
+				modStats, err := collectModStats(modBucket)
+				if err != nil {
+					return err
+				}
+				key := modStatsKey{
+					StringHeapIDFromBytes(rootType),
+					StringHeapIDFromBytes(rootFlavor),
+					StringHeapIDFromBytes(mod),
+				}
+				stats.mods[key] = modStats
+				return nil
+			})
+		})
+	})
+}
+
+// CollectLeagueStats gathers statistics for every index bucket
+// in the provided league.
+//
+// This walks the entire index of the league, so it should be
+// run sparingly and its results cached.
+func CollectLeagueStats(league LeagueHeapID,
+	db *bolt.DB) (*LeagueStats, error) {
+
+	var stats *LeagueStats
+	err := db.View(func(tx *bolt.Tx) (err error) {
+		stats, err = collectLeagueStats(league, tx)
+		return err
+	})
+	return stats, err
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// stringHeapCondemnedBucket holds every StringHeapID found to be
+// unreferenced by the previous string collection
+const stringHeapCondemnedBucket string = "stringHeapCondemned"
+
+// pardonString removes a StringHeapID from the condemned set
+//
+// This must be called whenever an existing string is handed out
+// so it cannot be swept before whatever is using it is stored.
+func pardonString(id []byte, tx *bolt.Tx) error {
+	condemned := tx.Bucket([]byte(stringHeapCondemnedBucket))
+	if condemned == nil {
+		return errors.Errorf("%s not found", stringHeapCondemnedBucket)
+	}
+	if condemned.Get(id) == nil {
+		return nil
+	}
+	return condemned.Delete(id)
+}
+
+// StringGCReport represents the work done, or would be done on
+// a dry run, by CollectStrings.
+type StringGCReport struct {
+	DryRun bool
+	// Number of strings referenced by at least one item
+	Live int
+	// Number of unreferenced strings condemned to be swept next collection
+	Condemned int
+	// Number of strings removed from the heap
+	Swept int
+	// Size of the keys and values removed from both heap buckets
+	BytesReclaimed int
+}
+
+func (r StringGCReport) String() string {
+	verb := "swept"
+	if r.DryRun {
+		verb = "would sweep"
+	}
+	return fmt.Sprintf("strings: %d live | %d condemned | %s %d, reclaiming %d bytes",
+		r.Live, r.Condemned, verb, r.Swept, r.BytesReclaimed)
+}
+
+// markStrings adds every StringHeapID referenced by an item in
+// any league to the live set.
+//
+// Stashes store their account names inline and indices only exist
+// for mods present on items, so items are the only references.
+func markStrings(live map[StringHeapID]struct{}, tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(leagueNamespaceBucket))
+	if root == nil {
+		return errors.Errorf("%s not found", leagueNamespaceBucket)
+	}
+
+	return root.ForEach(func(k, v []byte) error {
+		// Leagues are all nested buckets
+		if v != nil {
+			return nil
+		}
+		items := getLeagueItemBucket(LeagueHeapIDFromBytes(k), tx)
+		return items.ForEach(func(k, v []byte) error {
+			// Ignore nested buckets
+			if v == nil {
+				return nil
+			}
+			var item Item
+			if _, err := item.UnmarshalMsg(v); err != nil {
+				return errors.Wrap(err, "failed to Unmarshal Item")
+			}
+			live[item.Name] = struct{}{}
+			live[item.TypeLine] = struct{}{}
+			live[item.Note] = struct{}{}
+			live[item.RootType] = struct{}{}
+			live[item.RootFlavor] = struct{}{}
+			for _, mod := range item.Mods {
+				live[mod.Mod] = struct{}{}
+			}
+			return nil
+		})
+	})
+}
+
+// CollectStrings removes strings no longer referenced by any item
+// from the StringHeap.
+//
+// Collection happens in two phases to remain safe against concurrent
+// ingestion: strings are converted to StringHeapIDs in a separate
+// transaction from storing the items using them. An unreferenced string
+// is first condemned; it is only swept if it remains unreferenced by the
+// next collection and has not been handed out by the StringHeap since.
+//
+// Marking and sweeping happen in a single write transaction, so
+// ingestion waits for the collection to finish.
+func CollectStrings(dryRun bool, db *bolt.DB) (*StringGCReport, error) {
+	report := &StringGCReport{DryRun: dryRun}
+
+	update := db.Update
+	if dryRun {
+		update = db.View
+	}
+	err := update(func(tx *bolt.Tx) error {
+		live := make(map[StringHeapID]struct{})
+		if err := markStrings(live, tx); err != nil {
+			return errors.Wrap(err, "failed to mark strings")
+		}
+		report.Live = len(live)
+
+		heap := tx.Bucket([]byte(stringHeapBucket))
+		if heap == nil {
+			return errors.Errorf("%s not found", stringHeapBucket)
+		}
+		inverter := tx.Bucket([]byte(stringHeapInverseBucket))
+		if inverter == nil {
+			return errors.Errorf("%s not found", stringHeapInverseBucket)
+		}
+		condemned := tx.Bucket([]byte(stringHeapCondemnedBucket))
+		if condemned == nil {
+			return errors.Errorf("%s not found", stringHeapCondemnedBucket)
+		}
+
+		// Collect what changes first, buckets cannot be
+		// modified while we iterate over them
+		var sweep, condemn, pardon [][]byte
+		err := inverter.ForEach(func(k, v []byte) error {
+			id := StringHeapIDFromBytes(k)
+			_, isLive := live[id]
+			wasCondemned := condemned.Get(k) != nil
+
+			switch {
+			case isLive && wasCondemned:
+				pardon = append(pardon, k)
+			case isLive:
+			case wasCondemned:
+				sweep = append(sweep, k)
+				// Each string is a key in one bucket and a value in the other
+				report.BytesReclaimed += 2 * (len(k) + len(v))
+			default:
+				condemn = append(condemn, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to sweep strings")
+		}
+		report.Swept = len(sweep)
+		report.Condemned = len(condemn)
+
+		if dryRun {
+			return nil
+		}
+
+		for _, k := range sweep {
+			if err := heap.Delete(inverter.Get(k)); err != nil {
+				return errors.Wrap(err, "failed to remove string from heap")
+			}
+			if err := inverter.Delete(k); err != nil {
+				return errors.Wrap(err, "failed to remove string from inverse heap")
+			}
+			if err := condemned.Delete(k); err != nil {
+				return errors.Wrap(err, "failed to remove swept string")
+			}
+		}
+		for _, k := range pardon {
+			if err := condemned.Delete(k); err != nil {
+				return errors.Wrap(err, "failed to pardon string")
+			}
+		}
+		for _, k := range condemn {
+			if err := condemned.Put(k, []byte{}); err != nil {
+				return errors.Wrap(err, "failed to condemn string")
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to collect strings")
+	}
+
+	return report, nil
+}
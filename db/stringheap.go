@@ -29,6 +29,10 @@ func setString(index string, tx *bolt.Tx) (StringHeapID, error) {
 
 	// If it already exists, early exit
 	if result := heap.Get([]byte(index)); result != nil {
+		// A condemned string is about to be referenced again
+		if err := pardonString(result, tx); err != nil {
+			return 0, err
+		}
 		return StringHeapIDFromBytes(result), nil
 	}
 
@@ -161,6 +165,18 @@ func GetStrings(indices []string, db *bolt.DB) ([]StringHeapID, error) {
 	})
 }
 
+// inflateString returns the string represenation of the given StringHeapID
+func inflateString(id StringHeapID, tx *bolt.Tx) string {
+	// Fetch the inverter bucket
+	var inverter *bolt.Bucket
+	if inverter = tx.Bucket([]byte(stringHeapInverseBucket)); inverter == nil {
+		panic(fmt.Sprintf("%s does not exist when assumed", stringHeapInverseBucket))
+	}
+
+	// Fetch the string from the inverter
+	return string(inverter.Get(id.ToBytes()))
+}
+
 // InflateString returns the string represenation of the given StringHeapID
 //
 // If you are providing a valid StringHeapID, this should never fail.
@@ -169,17 +185,7 @@ func InflateString(id StringHeapID, db *bolt.DB) string {
 	var result string
 
 	db.View(func(tx *bolt.Tx) error {
-
-		// Fetch the inverter bucket
-		var inverter *bolt.Bucket
-		if inverter = tx.Bucket([]byte(stringHeapInverseBucket)); inverter == nil {
-			panic(fmt.Sprintf("%s does not exist when assumed", stringHeapInverseBucket))
-		}
-
-		// Fetch the string from the inverter
-		resultBytes := inverter.Get(id.ToBytes())
-		result = string(resultBytes)
-
+		result = inflateString(id, tx)
 		return nil
 	})
 
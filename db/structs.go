@@ -55,14 +55,25 @@ func (id LeagueHeapID) ToBytes() []byte {
 	return i16tob(uint16(id))
 }
 
-// TimestampSize is the number of bytes used by Timestamp
-//
-// This is sized to minimize waste while keeping accuracy
+// TimestampEpoch is the earliest time a Timestamp can represent
 //
-// We discard the first 4 bytes as they're useless for our purposes.
-const TimestampSize = 8 - 4
+// Offsetting from this rather than the unix epoch lets the seconds
+// of a Timestamp fit in 4 bytes until 2149.
+var TimestampEpoch = time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// timestampSecondsSize is the number of bytes of a Timestamp
+// holding seconds since TimestampEpoch
+const timestampSecondsSize = 4
 
-// Timestamp is a compact represenation of a unix timestamp
+// TimestampSize is the number of bytes used by Timestamp
+const TimestampSize = timestampSecondsSize + 4
+
+// Timestamp is a compact represenation of a point in time which
+// is totally ordered within a database.
+//
+// This is laid out as [seconds since TimestampEpoch, sequence], both
+// big endian, so comparing bytes orders Timestamps. Items added in the
+// same page share the same seconds and are told apart by their sequence.
 type Timestamp [TimestampSize]byte
 
 // NewTimestamp returns a Timestamp at the current time
@@ -71,41 +82,72 @@ func NewTimestamp() Timestamp {
 }
 
 // TimeToTimestamp returns a Timestamp representing the passed time.Time
+// with a sequence of zero
+//
+// Sub-second precision is discarded and times before TimestampEpoch
+// are clamped to it.
 func TimeToTimestamp(when time.Time) Timestamp {
-	secs := when.Unix()
-
-	nowBytes := i64tob(uint64(secs))
-	nowTrunc := nowBytes[TimestampSize:]
+	secs := when.Unix() - TimestampEpoch.Unix()
+	if secs < 0 {
+		secs = 0
+	}
+	return timestampAt(uint32(secs), 0)
+}
 
+// timestampAt returns the Timestamp at the provided seconds
+// since TimestampEpoch and sequence.
+func timestampAt(secs, sequence uint32) Timestamp {
 	var ts Timestamp
-	copy(ts[:], nowTrunc)
+	copy(ts[:timestampSecondsSize], i32tob(secs))
+	copy(ts[timestampSecondsSize:], i32tob(sequence))
 	return ts
 }
 
-// TimestampBucketAccuracyReduction is the number of rightward shifts
-// applied to a Timestamp to discretely bucket it for Indexing.
-const TimestampBucketAccuracyReduction = 7 // 7 representing ~2.1 minute buckets
+// seconds returns the seconds since TimestampEpoch of a Timestamp
+func (ts Timestamp) seconds() uint32 {
+	return btoi32(ts[:timestampSecondsSize])
+}
+
+// Sequence returns the position of a Timestamp among those
+// sharing its second
+func (ts Timestamp) Sequence() uint32 {
+	return btoi32(ts[timestampSecondsSize:])
+}
+
+// IndexGranularity is the number of rightward shifts applied to a
+// Timestamp to discretely bucket it for Indexing.
+//
+// Coarser buckets let more items share each index entry, which suits
+// leagues with a low ingest rate.
+type IndexGranularity uint8
+
+// DefaultIndexGranularity is the IndexGranularity of new leagues
+const DefaultIndexGranularity IndexGranularity = 7 // 7 representing ~2.1 minute buckets
+
+// MaxIndexGranularity places every Timestamp in the same bucket
+const MaxIndexGranularity IndexGranularity = timestampSecondsSize * 8
+
+// Duration returns the span of time covered by a single bucket
+func (g IndexGranularity) Duration() time.Duration {
+	return time.Second << g
+}
 
 // TruncateToIndexBucket returns its reduced accuracy form such that
 // it can be used to bucket Timestamps into discrete index buckets.
-func (ts Timestamp) TruncateToIndexBucket() []byte {
-	// Convert the timestamp to a 64 bit int for easier shifting.
-	base := make([]byte, 8)
-	copy(base[TimestampSize:], ts[:])
-	rel := btoi64(base)
-	shifted := rel >> TimestampBucketAccuracyReduction
+//
+// Only the seconds are kept, so every Timestamp of a page shares a bucket.
+func (ts Timestamp) TruncateToIndexBucket(granularity IndexGranularity) []byte {
+	// Widen before shifting so MaxIndexGranularity is a full shift
+	shifted := uint64(ts.seconds()) >> granularity
 	// Return the byte-wise version
-	return i64tob(shifted)[TimestampSize:]
+	return i64tob(shifted)[8-timestampSecondsSize:]
 }
 
 // ToTime converts a compact Timestamp to a time.Time
+//
+// The sequence has no meaning as a time, so it is discarded.
 func (ts Timestamp) ToTime() time.Time {
-	// Size the initial array with preceding zeroes
-	fatBytes := make([]byte, 8-TimestampSize)
-	// Jam the compact portion on
-	fatBytes = append(fatBytes, ts[:]...)
-	fatUint := btoi64(fatBytes)
-	return time.Unix(int64(fatUint), 0)
+	return TimestampEpoch.Add(time.Duration(ts.seconds()) * time.Second)
 }
 
 // GGGIDSize is the size in bytes a derived ID can be
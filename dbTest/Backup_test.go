@@ -0,0 +1,257 @@
+package dbTest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/boltdb/bolt"
+)
+
+// tempBackupDir returns a directory for backups which the caller
+// must remove
+func tempBackupDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "gothingBackup")
+	if err != nil {
+		t.Fatalf("failed to create TempDir, err=%s", err)
+	}
+	return dir
+}
+
+// Test a compressed backup restores everything changed after it was taken
+func TestBackupRestore11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	search := QueryBootsMovespeedFireResist.Clone()
+	query, _ := MultiModSearchToIndexQuery(search, bdb, t)
+	before, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	initial, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	path := bdb.Path()
+
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+	backupPath := filepath.Join(dir, "backup.db.snappy")
+	backup, err := db.Backup(backupPath, true, bdb)
+	if err != nil {
+		t.Fatalf("failed Backup, err=%s", err)
+	}
+	t.Logf("%s", backup)
+	if backup.Written >= backup.Size {
+		t.Fatalf("compressed backup is not smaller, report=%s", backup)
+	}
+
+	if _, err := db.DropLeague(search.League, false, bdb); err != nil {
+		t.Fatalf("failed DropLeague, err=%s", err)
+	}
+
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+	report, err := db.Restore(backupPath, path)
+	if err != nil {
+		t.Fatalf("failed Restore, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if !report.Compressed || report.Migrated != nil {
+		t.Fatalf("unexpected report, report=%s", report)
+	}
+
+	restored, err := db.Boot(path)
+	if err != nil {
+		t.Fatalf("failed to open restored db, err=%s", err)
+	}
+	defer restored.Close()
+
+	count, err := db.ItemStoreCount(restored)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	if count != initial {
+		t.Fatalf("expected %d items after restore, got %d", initial, count)
+	}
+
+	query, league := MultiModSearchToIndexQuery(search, restored, t)
+	after, err := query.Run(restored)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("expected %d results after restore, got %d",
+			len(before), len(after))
+	}
+	if !search.Satisfies(QueryResultsToItems(after, league, restored, t)) {
+		t.Fatalf("results do not satisfy MultiModSearch after restore")
+	}
+}
+
+// Test an inconsistent backup is refused and the database left untouched
+func TestRestoreRefusesInconsistent(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	initial, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+	backupPath := filepath.Join(dir, "backup.db")
+	if _, err := db.Backup(backupPath, false, bdb); err != nil {
+		t.Fatalf("failed Backup, err=%s", err)
+	}
+
+	// Remove every item from underneath its stash and index
+	backup, err := bolt.Open(backupPath, 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open backup, err=%s", err)
+	}
+	err = backup.Update(func(tx *bolt.Tx) error {
+		leagues := tx.Bucket([]byte("leagueNamespace"))
+		return leagues.ForEach(func(k, v []byte) error {
+			league := leagues.Bucket(k)
+			if err := league.DeleteBucket([]byte("itemStore")); err != nil {
+				return err
+			}
+			_, err := league.CreateBucket([]byte("itemStore"))
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed to damage backup, err=%s", err)
+	}
+	if err := backup.Close(); err != nil {
+		t.Fatalf("failed to close backup, err=%s", err)
+	}
+
+	path := bdb.Path()
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+	if _, err := db.Restore(backupPath, path); err == nil {
+		t.Fatalf("restored an inconsistent backup")
+	}
+
+	untouched, err := db.Boot(path)
+	if err != nil {
+		t.Fatalf("failed to open db after refused restore, err=%s", err)
+	}
+	defer untouched.Close()
+	count, err := db.ItemStoreCount(untouched)
+	if err != nil {
+		t.Fatalf("failed to count items after refused restore, err=%s", err)
+	}
+	if count != initial {
+		t.Fatalf("expected %d items after refused restore, got %d",
+			initial, count)
+	}
+}
+
+// Test scheduled snapshots only keep the most recent
+func TestSnapshotKeep(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	schedule := db.SnapshotSchedule{
+		Dir:      tempBackupDir(t),
+		Interval: time.Hour,
+		Keep:     2,
+		Compress: true,
+	}
+	defer os.RemoveAll(schedule.Dir)
+
+	var taken []string
+	for i := 0; i < 4; i++ {
+		report, err := schedule.Snapshot(
+			TimeOfStart.Add(time.Duration(i)*schedule.Interval), bdb)
+		if err != nil {
+			t.Fatalf("failed Snapshot, err=%s", err)
+		}
+		taken = append(taken, report.Path)
+	}
+
+	kept, err := db.Snapshots(schedule.Dir)
+	if err != nil {
+		t.Fatalf("failed Snapshots, err=%s", err)
+	}
+	if len(kept) != schedule.Keep {
+		t.Fatalf("expected %d snapshots kept, got %d", schedule.Keep, len(kept))
+	}
+	for i, path := range kept {
+		if path != taken[len(taken)-schedule.Keep+i] {
+			t.Fatalf("expected newest snapshots kept, got %v", kept)
+		}
+	}
+
+	// Every snapshot kept is restorable
+	path := bdb.Path()
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+	if _, err := db.Restore(kept[len(kept)-1], path); err != nil {
+		t.Fatalf("failed Restore, err=%s", err)
+	}
+}
+
+// Test a database too damaged to open is replaced by its backup
+func TestRestoreDamaged(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+	path := bdb.Path()
+
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+	backupPath := filepath.Join(dir, "backup.db")
+	if _, err := db.Backup(backupPath, false, bdb); err != nil {
+		t.Fatalf("failed Backup, err=%s", err)
+	}
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+
+	// Overwrite the meta pages so bolt refuses the file
+	if err := ioutil.WriteFile(path, make([]byte, 8192), 0600); err != nil {
+		t.Fatalf("failed to damage db, err=%s", err)
+	}
+	if damaged, err := db.Boot(path); err == nil {
+		damaged.Close()
+		t.Fatalf("opened a damaged db")
+	}
+
+	if _, err := db.Restore(backupPath, path); err != nil {
+		t.Fatalf("failed Restore, err=%s", err)
+	}
+	restored, err := db.Boot(path)
+	if err != nil {
+		t.Fatalf("failed to open restored db, err=%s", err)
+	}
+	defer restored.Close()
+}
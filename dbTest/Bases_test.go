@@ -0,0 +1,175 @@
+package dbTest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+)
+
+// gggItemData is a small dump in the format of GGG's item data
+const gggItemData = `{"result":[
+	{"label":"Accessories","entries":[
+		{"type":"Iron Ring"},
+		{"type":"Vermillion Ring"},
+		{"name":"Circle of Anguish","type":"Vermillion Ring","flags":{"unique":true}}
+	]},
+	{"label":"Armour","entries":[
+		{"type":"Sallet"},
+		{"type":"Sacrificial Garb"}
+	]},
+	{"label":"Heist","entries":[
+		{"type":"Thieving Widget"}
+	]}
+]}`
+
+// bundledBases are a few bases in the format of the bundled baseInfo.json
+const bundledBases = `[
+	{"root":"Armour","flavors":[{"flavor":"Body","bases":["Sacrificial Garb"]}]}
+]`
+
+// addTypelines stores a stash holding an item of each typeLine
+func addTypelines(typeLines []string, bdb *bolt.DB, t testing.TB) {
+	s := stash.Stash{AccountName: "bases", ID: "basesStash"}
+	for i, typeLine := range typeLines {
+		s.Items = append(s.Items, stash.Item{
+			ID:       string(rune('a'+i)) + "basesItem",
+			League:   "Standard",
+			TypeLine: typeLine,
+		})
+	}
+	if err := stash.CleanStash(&s); err != nil {
+		t.Fatalf("failed to clean stash, err=%s", err)
+	}
+
+	cStashes, cItems, err := db.StashStashToCompact([]stash.Stash{s},
+		TimeOfStart, bdb)
+	if err != nil {
+		t.Fatalf("failed to convert fat stashes to compact, err=%s", err)
+	}
+	if _, err := db.AddStashes(cStashes, cItems, bdb); err != nil {
+		t.Fatalf("failed to AddStashes, err=%s", err)
+	}
+}
+
+// Test loading bases from GGG's item data, storing them as a new version
+// which is used once the database is reopened, and reporting typeLines
+// which fail to classify along the way
+//
+// This changes the bases every item is classified by, so it must not
+// run alongside anything else.
+func TestBasesLoadAndStore(t *testing.T) {
+
+	defer stash.SetBases(stash.DefaultBases())
+
+	bdb := NewTempDatabase(t)
+	versions, err := db.ListBases(bdb)
+	if err != nil {
+		t.Fatalf("failed to list bases, err=%s", err)
+	}
+	if len(versions) != 1 || !versions[0].Current ||
+		versions[0].Hash != stash.DefaultBases().Hash() {
+		t.Fatalf("fresh database does not use the bundled bases, versions=%v",
+			versions)
+	}
+
+	addTypelines([]string{"Vermillion Ring", "Iron Ring",
+		"<<set:MS>><<set:M>><<set:S>>Superior Vermillion Ring",
+		"Thieving Widget of the Whale"}, bdb, t)
+	unknown, err := db.ListUnknownTypelines(bdb)
+	if err != nil {
+		t.Fatalf("failed to list unknown typeLines, err=%s", err)
+	}
+	if len(unknown) != 2 || unknown[0].TypeLine != "Vermillion Ring" ||
+		unknown[0].Count != 2 || unknown[0].Version != 1 ||
+		unknown[1].TypeLine != "Thieving Widget" || unknown[1].Count != 1 {
+		t.Fatalf("unexpected unknown typeLines, unknown=%v", unknown)
+	}
+
+	// Later files of a directory take precedence
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+	files := map[string]string{"1.json": gggItemData, "2.json": bundledBases}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+		if err != nil {
+			t.Fatalf("failed to write %s, err=%s", name, err)
+		}
+	}
+	loaded, err := stash.LoadBases(dir)
+	if err != nil {
+		t.Fatalf("failed to load bases, err=%s", err)
+	}
+	set := stash.CurrentBases().Merge(loaded)
+
+	expected := []struct {
+		typeLine, flavor, root string
+	}{
+		{"Vermillion Ring", "Ring", "Jewelry"},
+		{"Thieving Widget", "Heist", "Heist"},
+		{"Sacrificial Garb", "Body", "Armour"},
+		// Guessed from the dump, so the existing flavor is kept
+		{"Sallet", "Helmet", "Armour"},
+	}
+	for _, e := range expected {
+		flavor, root, ok := set.MatchTypeline(e.typeLine)
+		if !ok || flavor != e.flavor || root != e.root {
+			t.Fatalf("typeLine %s resolved to flavor=%s root=%s ok=%t, expected flavor=%s root=%s",
+				e.typeLine, flavor, root, ok, e.flavor, e.root)
+		}
+	}
+
+	version, err := db.StoreBases(set, dir, bdb)
+	if err != nil {
+		t.Fatalf("failed to store bases, err=%s", err)
+	}
+	if version != 2 {
+		t.Fatalf("stored bases as version %d, expected 2", version)
+	}
+	if again, err := db.StoreBases(set, dir, bdb); err != nil || again != version {
+		t.Fatalf("storing equal bases gave version %d, err=%v", again, err)
+	}
+
+	// Reopening uses the stored version rather than the bundled bases
+	path := bdb.Path()
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+	stash.SetBases(stash.DefaultBases())
+	reopened, err := db.Boot(path)
+	if err != nil {
+		t.Fatalf("failed to reopen db, err=%s", err)
+	}
+	defer reopened.Close()
+	if _, _, ok := stash.MatchTypeline("Vermillion Ring"); !ok {
+		t.Fatalf("reopened db does not use stored bases")
+	}
+
+	addTypelines([]string{"Vermillion Ring"}, reopened, t)
+	unknown, err = db.ListUnknownTypelines(reopened)
+	if err != nil {
+		t.Fatalf("failed to list unknown typeLines, err=%s", err)
+	}
+	if unknown[0].TypeLine != "Vermillion Ring" || unknown[0].Count != 2 {
+		t.Fatalf("classified typeLine recorded as unknown, unknown=%v", unknown)
+	}
+
+	// Returning to the bundled bases
+	if err := db.UseBases(1, reopened); err != nil {
+		t.Fatalf("failed to use bases, err=%s", err)
+	}
+	if stash.CurrentBases().Hash() != stash.DefaultBases().Hash() {
+		t.Fatalf("using version 1 did not return to the bundled bases")
+	}
+	versions, err = db.ListBases(reopened)
+	if err != nil {
+		t.Fatalf("failed to list bases, err=%s", err)
+	}
+	if len(versions) != 2 || !versions[0].Current || versions[1].Current {
+		t.Fatalf("unexpected versions after use, versions=%v", versions)
+	}
+}
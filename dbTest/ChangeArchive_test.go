@@ -0,0 +1,182 @@
+package dbTest
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Everlag/poeitemstore/stash"
+)
+
+// checkArchive ensures the archive at path holds exactly the changes
+// of set, in order and retrievable by ID
+func checkArchive(path string, set stash.ChangeSet,
+	t testing.TB) *stash.ChangeArchive {
+
+	archive, err := stash.OpenChangeArchive(path)
+	if err != nil {
+		t.Fatalf("failed OpenChangeArchive, err=%s", err)
+	}
+	defer archive.Close()
+
+	ids := set.ChangeIDs()
+	if archive.Len() != len(ids) || archive.Size != set.Size {
+		t.Fatalf("expected %d changes of %d bytes, got %d of %d bytes",
+			len(ids), set.Size, archive.Len(), archive.Size)
+	}
+	for i, id := range archive.ChangeIDs() {
+		if id != ids[i] {
+			t.Fatalf("change %d has id=%s, expected %s", i, id, ids[i])
+		}
+		comp, err := archive.GetCompByChangeID(id)
+		if err != nil {
+			t.Fatalf("failed GetCompByChangeID, err=%s", err)
+		}
+		if !bytes.Equal(comp.Content, set.Changes[i].Content) {
+			t.Fatalf("change %s differs from the ChangeSet", id)
+		}
+	}
+	if _, err := archive.GetCompByChangeID("missing"); err == nil {
+		t.Fatalf("found change missing from the archive")
+	}
+	return archive
+}
+
+// Test a change archive holds every change it was given, including those
+// appended after it was reopened and those of a writer which never closed
+func TestChangeArchive11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	ids := set.ChangeIDs()
+	half := len(ids) / 2
+
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes.archive")
+
+	w, err := stash.CreateChangeArchive(path)
+	if err != nil {
+		t.Fatalf("failed CreateChangeArchive, err=%s", err)
+	}
+	for i := 0; i < half; i++ {
+		if err := w.AddResponse(ids[i], set.Changes[i]); err != nil {
+			t.Fatalf("failed AddResponse, err=%s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close archive, err=%s", err)
+	}
+
+	// Append the remainder without closing, as a crashed writer would,
+	// then leave a partially written change behind it
+	w, err = stash.AppendChangeArchive(path)
+	if err != nil {
+		t.Fatalf("failed AppendChangeArchive, err=%s", err)
+	}
+	if w.Len() != half {
+		t.Fatalf("reopened archive has %d changes, expected %d", w.Len(), half)
+	}
+	for i := half; i < len(ids); i++ {
+		if err := w.AddResponse(ids[i], set.Changes[i]); err != nil {
+			t.Fatalf("failed AddResponse, err=%s", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("failed to open archive, err=%s", err)
+	}
+	f.Write([]byte{1, 0, 0, 1, 0, 0})
+	f.Close()
+
+	if archive := checkArchive(path, set, t); !archive.Recovered {
+		t.Fatalf("unclosed archive was not recovered")
+	}
+
+	// Reopening drops the partial change and closing restores the index
+	w, err = stash.AppendChangeArchive(path)
+	if err != nil {
+		t.Fatalf("failed AppendChangeArchive, err=%s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close archive, err=%s", err)
+	}
+	if archive := checkArchive(path, set, t); archive.Recovered {
+		t.Fatalf("closed archive was recovered")
+	}
+
+	// Archives are opened lazily, seeking to each change by ID
+	reader, err := stash.OpenChangeSet(path)
+	if err != nil {
+		t.Fatalf("failed OpenChangeSet, err=%s", err)
+	}
+	defer reader.Close()
+	if _, ok := reader.(*stash.ChangeArchive); !ok {
+		t.Fatalf("OpenChangeSet read archive as %T", reader)
+	}
+	if len(reader.ChangeIDs()) != len(set.Changes) {
+		t.Fatalf("OpenChangeSet read %d changes, expected %d",
+			len(reader.ChangeIDs()), len(set.Changes))
+	}
+	last := ids[len(ids)-1]
+	index, ok := reader.IndexOf(last)
+	if !ok {
+		t.Fatalf("OpenChangeSet missing change %s", last)
+	}
+	comp, err := reader.ChangeAt(index)
+	if err != nil {
+		t.Fatalf("failed ChangeAt, err=%s", err)
+	}
+	if !bytes.Equal(comp.Content, set.Changes[index].Content) {
+		t.Fatalf("change %s differs from the ChangeSet", last)
+	}
+}
+
+// Test a saved ChangeSet opens as a ChangeSet with the changes it held
+func TestChangeSetSaveAndOpen(t *testing.T) {
+
+	t.Parallel()
+
+	set := stash.NewChangeSet()
+	response := stash.Response{
+		NextChangeID: "next",
+		Stashes: []stash.Stash{{
+			ID:    "stash",
+			Items: []stash.Item{{ID: "item", TypeLine: "Iron Ring"}},
+		}},
+	}
+	comp, err := stash.NewCompressedResponse(&response)
+	if err != nil {
+		t.Fatalf("failed to compress response, err=%s", err)
+	}
+	set.AddResponse("change", *comp)
+
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes.msgp")
+	if err := set.Save(path); err != nil {
+		t.Fatalf("failed to save ChangeSet, err=%s", err)
+	}
+
+	reader, err := stash.OpenChangeSet(path)
+	if err != nil {
+		t.Fatalf("failed OpenChangeSet, err=%s", err)
+	}
+	defer reader.Close()
+	if _, ok := reader.(*stash.ChangeSet); !ok {
+		t.Fatalf("OpenChangeSet read ChangeSet as %T", reader)
+	}
+	index, ok := reader.IndexOf("change")
+	if !ok {
+		t.Fatalf("saved ChangeSet missing its change")
+	}
+	opened, err := reader.ChangeAt(index)
+	if err != nil {
+		t.Fatalf("failed ChangeAt, err=%s", err)
+	}
+	if !bytes.Equal(opened.Content, comp.Content) {
+		t.Fatalf("saved change differs from the original")
+	}
+}
@@ -0,0 +1,75 @@
+package dbTest
+
+import (
+	"testing"
+
+	"github.com/Everlag/poeitemstore/db"
+)
+
+// Test compacting with renumbering keeps every item reachable
+// through the index
+func TestCompactDB11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	// Dropping a league leaves nothing behind to copy
+	if _, err := db.DropLeague("Legacy", false, bdb); err != nil {
+		t.Fatalf("failed DropLeague, err=%s", err)
+	}
+
+	search := QueryBootsMovespeedFireResist.Clone()
+	search.League = "Standard"
+	query, _ := MultiModSearchToIndexQuery(search, bdb, t)
+	before, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	initial, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	path := bdb.Path()
+
+	report, err := db.CompactDB(bdb, true)
+	if err != nil {
+		t.Fatalf("failed CompactDB, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if report.SizeAfter > report.SizeBefore {
+		t.Fatalf("compaction grew database, report=%s", report)
+	}
+
+	compacted, err := db.Boot(path)
+	if err != nil {
+		t.Fatalf("failed to open compacted db, err=%s", err)
+	}
+	defer compacted.Close()
+
+	count, err := db.ItemStoreCount(compacted)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	if count != initial {
+		t.Fatalf("expected %d items after compaction, got %d", initial, count)
+	}
+
+	query, league := MultiModSearchToIndexQuery(search, compacted, t)
+	after, err := query.Run(compacted)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("expected %d results after compaction, got %d",
+			len(before), len(after))
+	}
+	if !search.Satisfies(QueryResultsToItems(after, league, compacted, t)) {
+		t.Fatalf("results do not satisfy MultiModSearch after compaction")
+	}
+}
@@ -0,0 +1,279 @@
+package dbTest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// Test every item is exported as CSV and parquet, and a filtered
+// JSON Lines export holds exactly the items satisfying its query
+func TestExport11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	total, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	leagues, err := db.ListLeagues(bdb)
+	if err != nil {
+		t.Fatalf("failed to list leagues, err=%s", err)
+	}
+
+	var exported int
+	for _, league := range leagues {
+		var buf bytes.Buffer
+		report, err := db.ExportLeague(league, nil, db.ExportCSV, &buf, bdb)
+		if err != nil {
+			t.Fatalf("failed ExportLeague, err=%s", err)
+		}
+		t.Logf("%s", report)
+
+		records, err := csv.NewReader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("failed to read csv export, err=%s", err)
+		}
+		if len(records)-1 != report.Items {
+			t.Fatalf("expected %d rows, got %d", report.Items, len(records)-1)
+		}
+		for _, record := range records[1:] {
+			if record[0] != league || record[3] == "" {
+				t.Fatalf("row missing league or account, row=%v", record)
+			}
+		}
+		exported += report.Items
+
+		buf.Reset()
+		parquet, err := db.ExportLeague(league, nil, db.ExportParquet, &buf, bdb)
+		if err != nil {
+			t.Fatalf("failed ExportLeague, err=%s", err)
+		}
+		serial := buf.Bytes()
+		if parquet.Items != report.Items ||
+			!bytes.HasPrefix(serial, []byte("PAR1")) ||
+			!bytes.HasSuffix(serial, []byte("PAR1")) {
+			t.Fatalf("malformed parquet export, report=%s", parquet)
+		}
+		checkParquetExport(serial, records, t)
+	}
+	if exported != total {
+		t.Fatalf("expected %d items exported, got %d", total, exported)
+	}
+
+	search := QueryBootsMovespeedFireResist.Clone()
+	search.MaxDesired = total
+	filter, _ := MultiModSearchToItemStoreQuery(search, bdb, t)
+	expected, err := filter.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed ItemStoreQuery.Run, err=%s", err)
+	}
+
+	var buf bytes.Buffer
+	report, err := db.ExportLeague(search.League, &filter, db.ExportJSONLines,
+		&buf, bdb)
+	if err != nil {
+		t.Fatalf("failed ExportLeague, err=%s", err)
+	}
+	t.Logf("%s", report)
+
+	var items []stash.Item
+	lines := bufio.NewScanner(&buf)
+	for lines.Scan() {
+		var line struct {
+			Stash string          `json:"stash"`
+			Item  json.RawMessage `json:"item"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+			t.Fatalf("failed to read jsonl export, err=%s", err)
+		}
+		var item stash.Item
+		if err := item.UnmarshalJSON(line.Item); err != nil {
+			t.Fatalf("failed to unmarshal exported item, err=%s", err)
+		}
+		if line.Stash == "" {
+			t.Fatalf("exported item missing stash")
+		}
+		items = append(items, item)
+	}
+	if len(items) != len(expected) || len(items) == 0 {
+		t.Fatalf("expected %d filtered items, got %d", len(expected), len(items))
+	}
+	if !search.Satisfies(items) {
+		t.Fatalf("exported items do not satisfy MultiModSearch")
+	}
+}
+
+// thriftStruct is a decoded thrift struct keyed by field ID
+type thriftStruct map[int16]interface{}
+
+// thriftReader decodes the subset of the thrift compact protocol
+// written by the parquet exporter
+type thriftReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftReader) byte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, errors.New("unexpected end of thrift data")
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *thriftReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errors.New("malformed thrift varint")
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *thriftReader) zigzag() (int64, error) {
+	v, err := r.varint()
+	return int64(v>>1) ^ -int64(v&1), err
+}
+
+func (r *thriftReader) value(kind byte) (interface{}, error) {
+	switch kind {
+	case 5, 6: // i32, i64
+		return r.zigzag()
+	case 8: // binary
+		size, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		if r.pos+int(size) > len(r.buf) {
+			return nil, errors.New("thrift binary overruns data")
+		}
+		r.pos += int(size)
+		return string(r.buf[r.pos-int(size) : r.pos]), nil
+	case 9: // list
+		header, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = r.varint(); err != nil {
+				return nil, err
+			}
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			if list[i], err = r.value(header & 0xf); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case 12: // struct
+		return r.structure()
+	}
+	return nil, errors.Errorf("unsupported thrift type %d", kind)
+}
+
+func (r *thriftReader) structure() (thriftStruct, error) {
+	fields := thriftStruct{}
+	var last int16
+	for {
+		header, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if header == 0 {
+			return fields, nil
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			long, err := r.zigzag()
+			if err != nil {
+				return nil, err
+			}
+			id = int16(long)
+		}
+		if fields[id], err = r.value(header & 0xf); err != nil {
+			return nil, err
+		}
+		last = id
+	}
+}
+
+// checkParquetExport decodes the footer of a parquet export and checks
+// its row count and schema match the CSV export of the same league,
+// along with the values of its id column
+func checkParquetExport(serial []byte, records [][]string, t *testing.T) {
+	footer := len(serial) - 8
+	size := int(binary.LittleEndian.Uint32(serial[footer:]))
+	meta, err := (&thriftReader{buf: serial[footer-size : footer]}).structure()
+	if err != nil {
+		t.Fatalf("failed to decode parquet footer, err=%s", err)
+	}
+
+	if rows := meta[3].(int64); rows != int64(len(records)-1) {
+		t.Fatalf("parquet footer has %d rows, expected %d",
+			rows, len(records)-1)
+	}
+	// The first schema element is the root holding the columns
+	schema := meta[2].([]interface{})
+	if len(schema)-1 != len(records[0]) {
+		t.Fatalf("parquet schema has %d columns, expected %d",
+			len(schema)-1, len(records[0]))
+	}
+	for i, name := range records[0] {
+		if found := schema[i+1].(thriftStruct)[4]; found != name {
+			t.Fatalf("parquet column %d is %v, expected %s", i, found, name)
+		}
+	}
+
+	// Read the PLAIN encoded ids from each row group's page
+	const idColumn = 1
+	var ids []string
+	for _, group := range meta[4].([]interface{}) {
+		chunks := group.(thriftStruct)[1].([]interface{})
+		chunk := chunks[idColumn].(thriftStruct)[3].(thriftStruct)
+		reader := &thriftReader{buf: serial, pos: int(chunk[9].(int64))}
+		header, err := reader.structure()
+		if err != nil {
+			t.Fatalf("failed to decode parquet page header, err=%s", err)
+		}
+		compressed := int(header[3].(int64))
+		page, err := snappy.Decode(nil,
+			serial[reader.pos:reader.pos+compressed])
+		if err != nil {
+			t.Fatalf("failed to decompress parquet page, err=%s", err)
+		}
+		for len(page) > 0 {
+			length := int(binary.LittleEndian.Uint32(page))
+			ids = append(ids, string(page[4:4+length]))
+			page = page[4+length:]
+		}
+	}
+	if len(ids) != len(records)-1 {
+		t.Fatalf("parquet id column has %d values, expected %d",
+			len(ids), len(records)-1)
+	}
+	for i, record := range records[1:] {
+		if ids[i] != record[idColumn] {
+			t.Fatalf("parquet row %d has id %s, expected %s",
+				i, ids[i], record[idColumn])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package dbTest
+
+import (
+	"testing"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/boltdb/bolt"
+)
+
+// runFsck runs Fsck and fails the test if it errors
+func runFsck(repair bool, bdb *bolt.DB, t testing.TB) *db.FsckReport {
+	report, err := db.Fsck(repair, bdb)
+	if err != nil {
+		t.Fatalf("failed Fsck, err=%s", err)
+	}
+	t.Logf("%s", report)
+	return report
+}
+
+// Test fsck finds nothing wrong after ingesting updates then finds
+// and repairs items removed from underneath their stashes
+func TestFsck11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	if report := runFsck(false, bdb, t); report.Total() != 0 {
+		t.Fatalf("found problems in consistent database")
+	}
+
+	// Removing items directly leaves their stashes referencing them
+	search := QueryBootsMovespeedFireResist.Clone()
+	query, league := MultiModSearchToIndexQuery(search, bdb, t)
+	ids, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if len(ids) == 0 {
+		t.Fatalf("found no items to remove")
+	}
+	if err := db.RemoveItems(ids, league, bdb); err != nil {
+		t.Fatalf("failed RemoveItems, err=%s", err)
+	}
+
+	report := runFsck(false, bdb, t)
+	if report.DanglingStashItems != len(ids) || report.Total() != len(ids) {
+		t.Fatalf("expected %d dangling stash items, report=%s", len(ids), report)
+	}
+
+	repaired := runFsck(true, bdb, t)
+	if repaired.Total() != report.Total() {
+		t.Fatalf("repair found different problems, check=%s, repair=%s",
+			report, repaired)
+	}
+
+	if report := runFsck(false, bdb, t); report.Total() != 0 {
+		t.Fatalf("problems remain after repair")
+	}
+}
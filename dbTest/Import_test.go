@@ -0,0 +1,136 @@
+package dbTest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+)
+
+// changeSetToJSONLines writes every change of a ChangeSet as JSON Lines,
+// either a stash.Response or each of its stash.Stash per line
+func changeSetToJSONLines(set stash.ChangeSet, stashes bool,
+	t testing.TB) *bytes.Buffer {
+
+	var buf bytes.Buffer
+	for _, comp := range set.Changes {
+		resp, err := comp.Decompress()
+		if err != nil {
+			t.Fatalf("failed to decompress stash.Compressed, err=%s", err)
+		}
+
+		if !stashes {
+			serial, err := resp.MarshalJSON()
+			if err != nil {
+				t.Fatalf("failed to marshal response, err=%s", err)
+			}
+			buf.Write(serial)
+			buf.WriteByte('\n')
+			continue
+		}
+		for _, s := range resp.Stashes {
+			serial, err := s.MarshalJSON()
+			if err != nil {
+				t.Fatalf("failed to marshal stash, err=%s", err)
+			}
+			buf.Write(serial)
+			buf.WriteByte('\n')
+		}
+	}
+	return &buf
+}
+
+// itemStoreContents returns every stored item keyed by league and ID
+func itemStoreContents(bdb *bolt.DB) map[string]string {
+	contents := make(map[string]string)
+	bdb.View(func(tx *bolt.Tx) error {
+		leagues := tx.Bucket([]byte("leagueNamespace"))
+		return leagues.ForEach(func(league, v []byte) error {
+			items := leagues.Bucket(league).Bucket([]byte("itemStore"))
+			return items.ForEach(func(k, v []byte) error {
+				contents[string(league)+string(k)] = string(v)
+				return nil
+			})
+		})
+	})
+	return contents
+}
+
+// Test importing a ChangeSet as responses or stashes results in the same
+// items as adding it directly, and is deterministic given a start time
+func TestImport11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+
+	direct := NewTempDatabase(t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, direct, t)
+	expected, err := db.ItemStoreCount(direct)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+
+	options := db.ImportOptions{Start: TimeOfStart, Step: time.Minute}
+	var imported []*bolt.DB
+	for _, stashes := range []bool{false, false, true} {
+		bdb := NewTempDatabase(t)
+		lines := changeSetToJSONLines(set, stashes, t)
+		report, err := db.ImportJSONLines(lines, options, bdb)
+		if err != nil {
+			t.Fatalf("failed ImportJSONLines, err=%s", err)
+		}
+		t.Logf("%s", report)
+		if stashes && report.Responses != 0 ||
+			!stashes && report.Responses != len(set.Changes) {
+			t.Fatalf("unexpected records read, report=%s", report)
+		}
+
+		count, err := db.ItemStoreCount(bdb)
+		if err != nil {
+			t.Fatalf("failed to count items, err=%s", err)
+		}
+		if count != expected {
+			t.Fatalf("expected %d items imported, got %d", expected, count)
+		}
+		imported = append(imported, bdb)
+	}
+
+	// Importing the same records from the same start is identical
+	first, second := itemStoreContents(imported[0]), itemStoreContents(imported[1])
+	if len(first) != len(second) {
+		t.Fatalf("repeated import has %d items, expected %d",
+			len(second), len(first))
+	}
+	for k, v := range first {
+		if second[k] != v {
+			t.Fatalf("repeated import differs")
+		}
+	}
+
+	search := QueryBootsMovespeedFireResist.Clone()
+	query, _ := MultiModSearchToIndexQuery(search, direct, t)
+	before, err := query.Run(direct)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	for _, bdb := range imported {
+		query, league := MultiModSearchToIndexQuery(search, bdb, t)
+		after, err := query.Run(bdb)
+		if err != nil {
+			t.Fatalf("failed IndexQuery.Run, err=%s", err)
+		}
+		if len(after) != len(before) {
+			t.Fatalf("expected %d results after import, got %d",
+				len(before), len(after))
+		}
+		if !search.Satisfies(QueryResultsToItems(after, league, bdb, t)) {
+			t.Fatalf("results do not satisfy MultiModSearch after import")
+		}
+	}
+}
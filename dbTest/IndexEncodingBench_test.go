@@ -0,0 +1,71 @@
+package dbTest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/boltdb/bolt"
+)
+
+// benchIndexEncodings are the IndexEncodings compared by benchmarks
+var benchIndexEncodings = map[string]db.IndexEncoding{
+	"Sorted":  db.IndexEncodingSorted,
+	"Roaring": db.IndexEncodingRoaring,
+}
+
+// setupBenchDBWithEncoding prepares a database with index entries
+// written as the provided encoding and a ChangeSet located at path.
+func setupBenchDBWithEncoding(path string, delta time.Duration,
+	encoding db.IndexEncoding, b *testing.B) *bolt.DB {
+
+	bdb := NewTempDatabase(b)
+	if err := db.SetIndexEncoding(encoding, bdb); err != nil {
+		b.Fatalf("failed to set index encoding, err=%s", err)
+	}
+
+	set := GetChangeSet(path, b)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, delta, bdb, b)
+
+	return bdb
+}
+
+// BenchmarkIndexEncodingQuery runs five queries on databases using
+// each encoding, logging the size of each database on disk.
+func BenchmarkIndexEncodingQuery(b *testing.B) {
+
+	deltas := map[string]time.Duration{
+		"Dense":  IndexQueryBenchShortDelta,
+		"Sparse": IndexQueryBenchLongDelta,
+	}
+
+	for deltaName, delta := range deltas {
+		for encodingName, encoding := range benchIndexEncodings {
+			delta, encoding := delta, encoding
+			b.Run(deltaName+encodingName, func(b *testing.B) {
+				bdb := setupBenchDBWithEncoding("testSet - 11 updates.msgp",
+					delta, encoding, b)
+
+				info, err := os.Stat(bdb.Path())
+				if err != nil {
+					b.Fatalf("failed to stat database, err=%s", err)
+				}
+				b.Logf("%s database is %d bytes on disk", encodingName, info.Size())
+
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					runBenchQuery(QueryBootsMovespeedFireResist.Clone(), bdb, b)
+					runBenchQuery(QueryAmuletColdCritMulti.Clone(), bdb, b)
+					runBenchQuery(QueryRingStrengthIntES.Clone(), bdb, b)
+					runBenchQuery(QueryQuiverCritChance.Clone(), bdb, b)
+					runBenchQuery(QueryHelmetRecoveryES.Clone(), bdb, b)
+				}
+			})
+		}
+	}
+}
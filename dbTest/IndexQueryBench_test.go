@@ -311,3 +311,92 @@ func BenchmarkMultiLeagueIndexQuerySlow(b *testing.B) {
 		}
 	})
 }
+
+// runBenchParallelQuery runs a provided search across several leagues
+// using a ParallelIndexQuery in the context of a benchmark
+func runBenchParallelQuery(search cmd.MultiModSearch, leagues []string,
+	bdb *bolt.DB, b *testing.B) {
+
+	query, _ := MultiModSearchToParallelIndexQuery(search, leagues,
+		db.DefaultParallelQueryWorkers, bdb, b)
+
+	results, err := query.Run(bdb)
+	if err != nil {
+		b.Fatalf("failed ParallelIndexQuery.Run, err=%s", err)
+	}
+
+	// Sanity check
+	if len(results) > 0 {
+		benchQueryResult = results[0].IDs
+	}
+	if len(benchQueryResult) < search.MaxDesired {
+		b.Fatalf("failed to find enough results in query")
+	}
+}
+
+// BenchmarkMultiLeagueParallelIndexQuery runs the same queries as
+// BenchmarkMultiLeagueIndexQueryFast with each search covering both leagues
+// in a single ParallelIndexQuery.
+//
+// This allows direct comparison against the serial path.
+func BenchmarkMultiLeagueParallelIndexQuery(b *testing.B) {
+	queries := []cmd.MultiModSearch{
+		QueryBootsMovespeedFireResist,
+		QueryAmuletColdCritMulti,
+		QueryRingStrengthIntES,
+		QueryQuiverCritChance,
+		QueryHelmetRecoveryES,
+	}
+	leagues := []string{"Legacy", "Standard"}
+
+	b.Run("Dense", func(b *testing.B) {
+		bdb := setupBenchDB("testSet - 11 updates.msgp",
+			IndexQueryBenchShortDelta, b)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			for _, q := range queries {
+				runBenchParallelQuery(q.Clone(), leagues, bdb, b)
+			}
+		}
+	})
+
+	b.Run("Sparse", func(b *testing.B) {
+		bdb := setupBenchDB("testSet - 11 updates.msgp",
+			IndexQueryBenchLongDelta, b)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			for _, q := range queries {
+				runBenchParallelQuery(q.Clone(), leagues, bdb, b)
+			}
+		}
+	})
+}
+
+// BenchmarkConcurrentIndexQuery runs five queries on the database
+// from many goroutines at once.
+//
+// Query contexts are pooled, so allocations per query should
+// remain low as concurrency increases.
+func BenchmarkConcurrentIndexQuery(b *testing.B) {
+	bdb := setupBenchDB("testSet - 11 updates.msgp",
+		IndexQueryBenchShortDelta, b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			runBenchQuery(QueryBootsMovespeedFireResist.Clone(), bdb, b)
+			runBenchQuery(QueryAmuletColdCritMulti.Clone(), bdb, b)
+			runBenchQuery(QueryRingStrengthIntES.Clone(), bdb, b)
+			runBenchQuery(QueryQuiverCritChance.Clone(), bdb, b)
+			runBenchQuery(QueryHelmetRecoveryES.Clone(), bdb, b)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package dbTest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+)
+
+// changeSetServer serves the first available changes of set as pages of
+// a stash api, with id "i" pointing to "i+1". Past those it responds as
+// the api does once caught up, calling caughtUp when non-nil. The page
+// at broken, when non-negative, has a valid next_change_id but stashes
+// which fail to decode.
+func changeSetServer(set stash.ChangeSet, available, broken int,
+	caughtUp func(), t testing.TB) *httptest.Server {
+
+	pages := make([][]byte, available)
+	for i, comp := range set.Changes[:available] {
+		response, err := comp.Decompress()
+		if err != nil {
+			t.Fatalf("failed to decompress change %d, err=%s", i, err)
+		}
+		response.NextChangeID = strconv.Itoa(i + 1)
+		pages[i], err = response.MarshalJSON()
+		if err != nil {
+			t.Fatalf("failed to encode change %d, err=%s", i, err)
+		}
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		id := r.URL.Query().Get("id")
+		i, err := strconv.Atoi(id)
+		switch {
+		case id == "":
+			i = 0
+		case err != nil:
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case i == broken:
+			fmt.Fprintf(w, `{"next_change_id":"%d","stashes":[{"id":`, i+1)
+		case i >= len(pages):
+			if caughtUp != nil {
+				caughtUp()
+			}
+			fmt.Fprintf(w, `{"next_change_id":"%s","stashes":[]}`, id)
+		default:
+			w.Write(pages[i])
+		}
+	}))
+}
+
+// ingestFetcher returns a Fetcher requesting from server without waiting
+func ingestFetcher(server *httptest.Server) *stash.Fetcher {
+	client := stash.NewClient()
+	client.BaseURL = server.URL
+	fetcher := stash.NewFetcher(client)
+	fetcher.Wait = 0
+	fetcher.Retries = 0
+	return fetcher
+}
+
+// ingestUntilCaughtUp ingests the first available changes of set served
+// as the stash api, stopping once caught up
+func ingestUntilCaughtUp(set stash.ChangeSet, available int,
+	options db.IngestOptions, bdb *bolt.DB,
+	t testing.TB) (*db.IngestStats, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := changeSetServer(set, available, -1, cancel, t)
+	defer server.Close()
+
+	return db.Ingest(ctx, ingestFetcher(server), options, bdb)
+}
+
+// testIngestChangeSet ingests the changes of set as they become
+// available, resuming from the checkpoint each time, then compares the result to adding set
+// directly
+func testIngestChangeSet(set stash.ChangeSet, t *testing.T) {
+
+	direct := NewTempDatabase(t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, direct, t)
+	expected, err := db.ItemStoreCount(direct)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+
+	// Only a few changes are available at first
+	bdb := NewTempDatabase(t)
+	first := 3
+	options := db.IngestOptions{Prefetch: 2, Decoders: 3, Batch: 2}
+	stats, err := ingestUntilCaughtUp(set, first, options, bdb, t)
+	if err != nil {
+		t.Fatalf("failed Ingest, err=%s", err)
+	}
+	t.Logf("%s", stats)
+	if stats.Written != first {
+		t.Fatalf("ingest wrote %d pages, expected %d", stats.Written, first)
+	}
+	checkpoint, err := db.IngestCheckpoint(bdb)
+	if err != nil {
+		t.Fatalf("failed to read checkpoint, err=%s", err)
+	}
+	if checkpoint != strconv.Itoa(first) {
+		t.Fatalf("checkpoint is %s after writing %d pages", checkpoint, first)
+	}
+
+	// Resume from the checkpoint once the rest are available
+	stats, err = ingestUntilCaughtUp(set, len(set.Changes), options, bdb, t)
+	if err != nil {
+		t.Fatalf("failed Ingest, err=%s", err)
+	}
+	t.Logf("%s", stats)
+	if stats.Written != len(set.Changes)-first {
+		t.Fatalf("resumed ingest wrote %d pages, expected %d",
+			stats.Written, len(set.Changes)-first)
+	}
+
+	count, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	if count != expected {
+		t.Fatalf("expected %d items ingested, got %d", expected, count)
+	}
+}
+
+// testIngestBrokenPage ingests set with a page which fails to decode,
+// ensuring nothing after the last page before it is written
+func testIngestBrokenPage(set stash.ChangeSet, t *testing.T) {
+
+	broken := len(set.Changes) / 2
+	server := changeSetServer(set, len(set.Changes), broken, nil, t)
+	defer server.Close()
+
+	bdb := NewTempDatabase(t)
+	options := db.IngestOptions{Prefetch: 4, Decoders: 4, Batch: 3}
+	stats, err := db.Ingest(context.Background(), ingestFetcher(server),
+		options, bdb)
+	if err == nil {
+		t.Fatalf("ingesting a broken page succeeded")
+	}
+	if !strings.Contains(err.Error(), "id="+strconv.Itoa(broken)) {
+		t.Fatalf("failure does not name broken page, err=%s", err)
+	}
+	if stats.Written != broken {
+		t.Fatalf("wrote %d pages, expected only the %d before the broken page",
+			stats.Written, broken)
+	}
+	checkpoint, err := db.IngestCheckpoint(bdb)
+	if err != nil {
+		t.Fatalf("failed to read checkpoint, err=%s", err)
+	}
+	if checkpoint != strconv.Itoa(broken) {
+		t.Fatalf("checkpoint is %s, expected the broken page %d",
+			checkpoint, broken)
+	}
+}
+
+// testIngestSnapshots ingests set while taking snapshots, ensuring
+// snapshots stop once Ingest returns
+func testIngestSnapshots(set stash.ChangeSet, t *testing.T) {
+
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+
+	// Keep ingesting until at least one snapshot has been taken
+	var lock sync.Mutex
+	taken := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := changeSetServer(set, len(set.Changes), -1, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if taken > 0 {
+			cancel()
+		}
+	}, t)
+	defer server.Close()
+
+	bdb := NewTempDatabase(t)
+	options := db.IngestOptions{
+		Snapshots: &db.SnapshotSchedule{
+			Dir:      dir,
+			Interval: 10 * time.Millisecond,
+			Keep:     2,
+		},
+		Snapshotted: func(report *db.BackupReport, err error) {
+			if err != nil {
+				t.Errorf("failed to take snapshot, err=%s", err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			taken++
+		},
+	}
+	stats, err := db.Ingest(ctx, ingestFetcher(server), options, bdb)
+	if err != nil {
+		t.Fatalf("failed Ingest, err=%s", err)
+	}
+	if stats.Written != len(set.Changes) {
+		t.Fatalf("ingest wrote %d pages, expected %d",
+			stats.Written, len(set.Changes))
+	}
+
+	lock.Lock()
+	stopped := taken
+	lock.Unlock()
+	time.Sleep(5 * options.Snapshots.Interval)
+	lock.Lock()
+	defer lock.Unlock()
+	if taken != stopped {
+		t.Fatalf("%d snapshots taken after Ingest returned", taken-stopped)
+	}
+
+	paths, err := db.Snapshots(dir)
+	if err != nil {
+		t.Fatalf("failed to list snapshots, err=%s", err)
+	}
+	if len(paths) < 1 || len(paths) > options.Snapshots.Keep {
+		t.Fatalf("expected between 1 and %d snapshots kept, found %d",
+			options.Snapshots.Keep, len(paths))
+	}
+}
+
+// Test ingesting a ChangeSet served as the stash api results in the same
+// items as adding it directly, resuming where a stopped ingest left off
+func TestIngest11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	testIngestChangeSet(set, t)
+}
+
+// Test a page which fails to decode stops an ingest without writing
+// any page following it
+func TestIngest11UpdatesBrokenPage(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	testIngestBrokenPage(set, t)
+}
+
+// Test snapshots are taken while ingesting and stop alongside it
+func TestIngest11UpdatesSnapshots(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	testIngestSnapshots(set, t)
+}
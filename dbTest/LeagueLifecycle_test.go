@@ -0,0 +1,226 @@
+package dbTest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+)
+
+// hasLeague determines if a league is still listed in the database
+func hasLeague(league string, bdb *bolt.DB, t testing.TB) bool {
+	leagues, err := db.ListLeagues(bdb)
+	if err != nil {
+		t.Fatalf("failed to list leagues, err=%s", err)
+	}
+	for _, name := range leagues {
+		if name == league {
+			return true
+		}
+	}
+	return false
+}
+
+// Test merging a league moves its items such that they can
+// be found in the target league
+func TestLeagueMerge11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	initial, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+
+	dryReport, err := db.MergeLeague("Legacy", "Standard", 100, true, bdb)
+	if err != nil {
+		t.Fatalf("failed dry run MergeLeague, err=%s", err)
+	}
+	t.Logf("%s", dryReport)
+	if dryReport.Items == 0 {
+		t.Fatalf("dry run found no items to merge")
+	}
+	if !hasLeague("Legacy", bdb, t) {
+		t.Fatalf("dry run removed league")
+	}
+
+	report, err := db.MergeLeague("Legacy", "Standard", 100, false, bdb)
+	if err != nil {
+		t.Fatalf("failed MergeLeague, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if report.Items != dryReport.Items || report.Stashes != dryReport.Stashes ||
+		report.Collisions != dryReport.Collisions {
+		t.Fatalf("mismatched dry run and merge, dry=%+v, got=%+v",
+			dryReport, report)
+	}
+	if hasLeague("Legacy", bdb, t) {
+		t.Fatalf("merged league still present")
+	}
+
+	// Only items present in both leagues are lost
+	count, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	if count > initial || count < initial-report.Collisions {
+		t.Fatalf("expected %d items less at most %d collisions, got %d",
+			initial, report.Collisions, count)
+	}
+
+	// Merged items must be found in their new league
+	search := QueryBootsMovespeedFireResist.Clone()
+	search.League = "Standard"
+	query, league := MultiModSearchToIndexQuery(search, bdb, t)
+	ids, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if len(ids) == 0 {
+		t.Fatalf("failed to find merged items")
+	}
+	if !search.Satisfies(QueryResultsToItems(ids, league, bdb, t)) {
+		t.Fatalf("merged results do not satisfy MultiModSearch")
+	}
+}
+
+// addMergeRing stores a stash in league holding a single ring with
+// strength of value, added at when
+func addMergeRing(league, stashID string, value uint16, when time.Time,
+	bdb *bolt.DB, t testing.TB) {
+
+	s := stash.Stash{AccountName: "merge", ID: stashID, Items: []stash.Item{{
+		ID:       "mergeItem",
+		League:   league,
+		TypeLine: "Iron Ring",
+		ExplicitMods: []stash.ItemMod{
+			{Template: []byte("+# to Strength"), Values: []uint16{value}},
+		},
+	}}}
+	if err := stash.CleanStash(&s); err != nil {
+		t.Fatalf("failed to clean stash, err=%s", err)
+	}
+	cStashes, cItems, err := db.StashStashToCompact([]stash.Stash{s},
+		when, bdb)
+	if err != nil {
+		t.Fatalf("failed to convert fat stashes to compact, err=%s", err)
+	}
+	if _, err := db.AddStashes(cStashes, cItems, bdb); err != nil {
+		t.Fatalf("failed to AddStashes, err=%s", err)
+	}
+}
+
+// Test merging an item present in both leagues keeps the newer copy
+// whichever league it is in
+func TestLeagueMergeKeepsNewer(t *testing.T) {
+
+	t.Parallel()
+
+	for _, sourceNewer := range []bool{true, false} {
+		bdb := NewTempDatabase(t)
+
+		// The newer copy has the greater strength
+		older, newer := TimeOfStart, TimeOfStart.Add(time.Hour)
+		sourceWhen, targetWhen := older, newer
+		sourceValue, targetValue := uint16(10), uint16(30)
+		if sourceNewer {
+			sourceWhen, targetWhen = newer, older
+			sourceValue, targetValue = targetValue, sourceValue
+		}
+		addMergeRing("Legacy", "sourceStash", sourceValue, sourceWhen, bdb, t)
+		addMergeRing("Standard", "targetStash", targetValue, targetWhen, bdb, t)
+
+		report, err := db.MergeLeague("Legacy", "Standard", 100, false, bdb)
+		if err != nil {
+			t.Fatalf("failed MergeLeague, err=%s", err)
+		}
+		if report.Items != 1 || report.Collisions != 1 {
+			t.Fatalf("expected 1 item colliding, sourceNewer=%t, got=%+v",
+				sourceNewer, report)
+		}
+
+		count, err := db.ItemStoreCount(bdb)
+		if err != nil {
+			t.Fatalf("failed to count items, err=%s", err)
+		}
+		if count != 1 {
+			t.Fatalf("expected a single copy of the item, got %d", count)
+		}
+
+		search := QueryRingStrengthIntES.Clone()
+		search.League = "Standard"
+		search.Mods = []string{"+# to Strength"}
+		search.MinValues = []uint16{20}
+		query, _ := MultiModSearchToIndexQuery(search, bdb, t)
+		ids, err := query.Run(bdb)
+		if err != nil {
+			t.Fatalf("failed IndexQuery.Run, err=%s", err)
+		}
+		if len(ids) != 1 {
+			t.Fatalf("newer copy not kept, sourceNewer=%t", sourceNewer)
+		}
+	}
+}
+
+// Test archiving a league exports everything it held before dropping it
+func TestLeagueArchive11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	var buf bytes.Buffer
+	dryReport, err := db.ArchiveLeague("Legacy", &buf, true, bdb)
+	if err != nil {
+		t.Fatalf("failed dry run ArchiveLeague, err=%s", err)
+	}
+	if buf.Len() != 0 || !hasLeague("Legacy", bdb, t) {
+		t.Fatalf("dry run changed something")
+	}
+
+	report, err := db.ArchiveLeague("Legacy", &buf, false, bdb)
+	if err != nil {
+		t.Fatalf("failed ArchiveLeague, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if *dryReport != (db.LeagueOpReport{Op: report.Op, DryRun: true,
+		League: report.League, Items: report.Items, Stashes: report.Stashes}) {
+		t.Fatalf("mismatched dry run and archive, dry=%+v, got=%+v",
+			dryReport, report)
+	}
+	if hasLeague("Legacy", bdb, t) {
+		t.Fatalf("archived league still present")
+	}
+
+	archive, err := db.ReadLeagueArchive(&buf)
+	if err != nil {
+		t.Fatalf("failed to read archive, err=%s", err)
+	}
+	if archive.League != "Legacy" || len(archive.Items) != report.Items ||
+		len(archive.Stashes) != report.Stashes {
+		t.Fatalf("archive does not match report, league=%s items=%d stashes=%d",
+			archive.League, len(archive.Items), len(archive.Stashes))
+	}
+	for _, item := range archive.Items {
+		for _, mod := range item.Mods {
+			if _, ok := archive.Strings[mod.Mod]; !ok {
+				t.Fatalf("archive missing mod string, id=%d", mod.Mod)
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package dbTest
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/boltdb/bolt"
+)
+
+// downgradeToUnversioned rewrites a database as it would have been
+// stored before its schema version was recorded.
+//
+// Every index entry is written without a header, each league is missing
+// a sub-bucket and its index granularity, each item store has a stray
+// bucket, and each item has a legacy timestamp of 4 bytes of unix seconds.
+// Index keys are left alone as migrating rebuilds every index.
+//
+// Returns when each item was added, keyed by its league and ID.
+func downgradeToUnversioned(bdb *bolt.DB, t testing.TB) map[string]time.Time {
+	added := make(map[string]time.Time)
+	err := bdb.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("settings")).
+			Delete([]byte("schemaVersion")); err != nil {
+			return err
+		}
+
+		leagues := tx.Bucket([]byte("leagueNamespace"))
+		return leagues.ForEach(func(k, v []byte) error {
+			league := leagues.Bucket(k)
+			if err := league.Delete([]byte("indexGranularity")); err != nil {
+				return err
+			}
+			if err := league.DeleteBucket([]byte("stashSeen")); err != nil {
+				return err
+			}
+			if err := downgradeItems(league.Bucket([]byte("itemStore")), k,
+				added); err != nil {
+				return err
+			}
+			_, err := league.Bucket([]byte("itemStore")).
+				CreateBucket([]byte("indices"))
+			if err != nil {
+				return err
+			}
+			return forEachIndexEntry(league.Bucket([]byte("indices")),
+				func(b *bolt.Bucket, k []byte, entry db.IndexEntry) error {
+					var legacy []byte
+					for _, id := range entry.GetIDs(nil) {
+						legacy = append(legacy, id[:]...)
+					}
+					return b.Put(k, legacy)
+				})
+		})
+	})
+	if err != nil {
+		t.Fatalf("failed to downgrade database, err=%s", err)
+	}
+	return added
+}
+
+// downgradeItems rewrites the timestamp of every item in an item store
+// as a legacy timestamp, recording when each was added.
+func downgradeItems(items *bolt.Bucket, league []byte,
+	added map[string]time.Time) error {
+
+	var keys, values [][]byte
+	err := items.ForEach(func(k, v []byte) error {
+		var item db.Item
+		if _, err := item.UnmarshalMsg(v); err != nil {
+			return err
+		}
+		added[string(league)+string(k)] = item.When.ToTime()
+
+		// When is serialized last as a bin8 header and its bytes
+		legacy := append([]byte{}, v[:len(v)-2-db.TimestampSize]...)
+		legacy = append(legacy, 0xc4, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(legacy[len(legacy)-4:],
+			uint32(item.When.ToTime().Unix()))
+
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, legacy)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if err := items.Put(k, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkItemsAdded ensures every item was added when expected
+func checkItemsAdded(bdb *bolt.DB, added map[string]time.Time, t testing.TB) {
+	var count int
+	bdb.View(func(tx *bolt.Tx) error {
+		leagues := tx.Bucket([]byte("leagueNamespace"))
+		return leagues.ForEach(func(league, v []byte) error {
+			items := leagues.Bucket(league).Bucket([]byte("itemStore"))
+			return items.ForEach(func(k, v []byte) error {
+				var item db.Item
+				if _, err := item.UnmarshalMsg(v); err != nil {
+					t.Fatalf("failed to Unmarshal Item, err=%s", err)
+				}
+				expected := added[string(league)+string(k)]
+				if !item.When.ToTime().Equal(expected) {
+					t.Fatalf("expected item added at %s, got %s",
+						expected, item.When.ToTime())
+				}
+				count++
+				return nil
+			})
+		})
+	})
+	if count != len(added) {
+		t.Fatalf("expected %d items, got %d", len(added), count)
+	}
+}
+
+// forEachIndexEntry calls cb with every entry in an index
+//
+// cb may modify the bucket it is provided the entry from.
+func forEachIndexEntry(indices *bolt.Bucket,
+	cb func(b *bolt.Bucket, k []byte, entry db.IndexEntry) error) error {
+
+	if indices == nil {
+		return nil
+	}
+	var keys [][]byte
+	indices.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	for _, k := range keys {
+		if nested := indices.Bucket(k); nested != nil {
+			if err := forEachIndexEntry(nested, cb); err != nil {
+				return err
+			}
+			continue
+		}
+		entry := db.IndexEntry(append([]byte{}, indices.Get(k)...))
+		if err := cb(indices, k, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interruptedMigrate starts a migration and abandons it after its first step
+func interruptedMigrate(bdb *bolt.DB, t testing.TB) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(errInterrupt); !ok {
+				panic(r)
+			}
+		}
+	}()
+	db.Migrate(func(db.MigrationProgress) {
+		panic(errInterrupt{})
+	}, bdb)
+	t.Fatalf("migration was not interrupted")
+}
+
+// Test an unversioned database is refused until migrated, after which
+// it is consistent, keeps when each item was added, and answers
+// queries identically
+func TestMigrate11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	search := QueryBootsMovespeedFireResist.Clone()
+	query, _ := MultiModSearchToIndexQuery(search, bdb, t)
+	before, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	path := bdb.Path()
+
+	added := downgradeToUnversioned(bdb, t)
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+
+	if outdated, err := db.Boot(path); err == nil {
+		outdated.Close()
+		t.Fatalf("opened a database with an outdated schema")
+	}
+	migrating, err := db.BootForMigration(path)
+	if err != nil {
+		t.Fatalf("failed to open db for migration, err=%s", err)
+	}
+
+	// Interrupt the first attempt so the second resumes
+	interruptedMigrate(migrating, t)
+	report, err := db.Migrate(nil, migrating)
+	if err != nil {
+		t.Fatalf("failed Migrate, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if report.From < 1 || report.To != db.CurrentSchemaVersion {
+		t.Fatalf("unexpected report, report=%s", report)
+	}
+	if err := migrating.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+
+	migrated, err := db.Boot(path)
+	if err != nil {
+		t.Fatalf("failed to open migrated db, err=%s", err)
+	}
+	defer migrated.Close()
+
+	if fsck := runFsck(false, migrated, t); fsck.Total() != 0 {
+		t.Fatalf("migration left problems")
+	}
+	checkItemsAdded(migrated, added, t)
+	migrated.View(func(tx *bolt.Tx) error {
+		leagues := tx.Bucket([]byte("leagueNamespace"))
+		return leagues.ForEach(func(k, v []byte) error {
+			return forEachIndexEntry(leagues.Bucket(k).Bucket([]byte("indices")),
+				func(b *bolt.Bucket, k []byte, entry db.IndexEntry) error {
+					if entry.Encoding() == db.IndexEncodingLegacy {
+						t.Fatalf("legacy index entry remains after migration")
+					}
+					return nil
+				})
+		})
+	})
+
+	query, league := MultiModSearchToIndexQuery(search, migrated, t)
+	after, err := query.Run(migrated)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("expected %d results after migration, got %d",
+			len(before), len(after))
+	}
+	if !search.Satisfies(QueryResultsToItems(after, league, migrated, t)) {
+		t.Fatalf("results do not satisfy MultiModSearch after migration")
+	}
+}
+
+// Test a database with a newer schema is refused
+func TestMigrateRefusesNewer(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+	path := bdb.Path()
+
+	err := bdb.Update(func(tx *bolt.Tx) error {
+		version := []byte{0, 0, 0, db.CurrentSchemaVersion + 1}
+		return tx.Bucket([]byte("settings")).
+			Put([]byte("schemaVersion"), version)
+	})
+	if err != nil {
+		t.Fatalf("failed to set schema version, err=%s", err)
+	}
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("failed to close db, err=%s", err)
+	}
+
+	for _, boot := range []func(string) (*bolt.DB, error){
+		db.Boot, db.BootForMigration,
+	} {
+		if newer, err := boot(path); err == nil {
+			newer.Close()
+			t.Fatalf("opened a database with a newer schema")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package dbTest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Everlag/poeitemstore/cmd"
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/boltdb/bolt"
+)
+
+// MultiModSearchToParallelIndexQuery converts a MultiModSearch
+// into a ParallelIndexQuery over the provided leagues. The League
+// of the search is ignored.
+func MultiModSearchToParallelIndexQuery(search cmd.MultiModSearch,
+	leagues []string, workers int,
+	bdb *bolt.DB, t testing.TB) (db.ParallelIndexQuery, []db.LeagueHeapID) {
+
+	if len(search.MinValues) != len(search.Mods) {
+		t.Fatalf("each mod must have a minvalue")
+	}
+
+	// Lookup the root, flavor, and mod
+	strings := []string{search.RootType, search.RootFlavor}
+	ids, err := db.GetStrings(strings, bdb)
+	if err != nil {
+		t.Fatalf("failed to fetch rootType or RootFlavor id, err=%s\n", err)
+	}
+	modIds, err := db.GetStrings(search.Mods, bdb)
+	if err != nil {
+		t.Fatalf("failed to fetch mod id, err=%s\n", err)
+	}
+
+	leagueIDs, err := db.GetLeagues(leagues, bdb)
+	if err != nil {
+		t.Fatalf("failed to fetch league, err=%s\n", err)
+	}
+
+	return db.NewParallelIndexQuery(ids[0], ids[1],
+		modIds, search.MinValues, leagueIDs, search.MaxDesired,
+		workers), leagueIDs
+}
+
+// Test a ParallelIndexQuery is correct and deterministic across leagues
+func TestParallelIndexQuery11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	leagues := []string{"Legacy", "Standard"}
+
+	searches := map[string]cmd.MultiModSearch{
+		"MovespeedFireResist": QueryBootsMovespeedFireResist,
+		"ColdCritMulti":       QueryAmuletColdCritMulti,
+		"RingStrengthIntES":   QueryRingStrengthIntES,
+	}
+	for name, search := range searches {
+		search := search.Clone()
+		t.Run(name, func(t *testing.T) {
+			query, _ := MultiModSearchToParallelIndexQuery(search, leagues,
+				db.DefaultParallelQueryWorkers, bdb, t)
+			results, err := query.Run(bdb)
+			if err != nil {
+				t.Fatalf("failed ParallelIndexQuery.Run, err=%s", err)
+			}
+			if len(results) != len(leagues) {
+				t.Fatalf("expected %d league results, got %d",
+					len(leagues), len(results))
+			}
+
+			for i, result := range results {
+				leagueSearch := search.Clone()
+				leagueSearch.League = leagues[i]
+				foundItems := QueryResultsToItems(result.IDs, result.League, bdb, t)
+				if !leagueSearch.Satisfies(foundItems) {
+					t.Fatalf("results for %s do not satisfy MultiModSearch",
+						leagues[i])
+				}
+			}
+
+			// Scheduling must never change the output
+			serialQuery, _ := MultiModSearchToParallelIndexQuery(search, leagues,
+				1, bdb, t)
+			serialResults, err := serialQuery.Run(bdb)
+			if err != nil {
+				t.Fatalf("failed ParallelIndexQuery.Run, err=%s", err)
+			}
+			if !reflect.DeepEqual(results, serialResults) {
+				t.Fatalf("mismatched results between 1 and %d workers",
+					db.DefaultParallelQueryWorkers)
+			}
+		})
+	}
+}
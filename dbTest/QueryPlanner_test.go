@@ -0,0 +1,199 @@
+package dbTest
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/Everlag/poeitemstore/cmd"
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+)
+
+// MultiModSearchToQueryPlan converts a MultiModSearch
+// into a QueryPlan using the provided planner. It also returns the league
+// because you usually need that...
+func MultiModSearchToQueryPlan(search cmd.MultiModSearch,
+	planner *db.QueryPlanner,
+	bdb *bolt.DB, t testing.TB) (*db.QueryPlan, db.LeagueHeapID) {
+
+	if len(search.MinValues) != len(search.Mods) {
+		t.Fatalf("each mod must have a minvalue")
+	}
+
+	// Lookup the root, flavor, and mod
+	strings := []string{search.RootType, search.RootFlavor}
+	ids, err := db.GetStrings(strings, bdb)
+	if err != nil {
+		t.Fatalf("failed to fetch rootType or RootFlavor id, err=%s\n", err)
+	}
+	modIds, err := db.GetStrings(search.Mods, bdb)
+	if err != nil {
+		t.Fatalf("failed to fetch mod id, err=%s\n", err)
+	}
+
+	// And we we need to fetch the league
+	leagueIDs, err := db.GetLeagues([]string{search.League}, bdb)
+	if err != nil {
+		t.Fatalf("failed to fetch league, err=%s\n", err)
+	}
+
+	plan, err := planner.Plan(ids[0], ids[1],
+		modIds, search.MinValues, leagueIDs[0], search.MaxDesired, bdb)
+	if err != nil {
+		t.Fatalf("failed to plan query, err=%s\n", err)
+	}
+
+	return plan, leagueIDs[0]
+}
+
+// Test planned queries produce correct results regardless
+// of which strategy is chosen
+func TestQueryPlanner11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	planner := db.NewQueryPlanner(db.DefaultMaxStatsAge)
+
+	searches := map[string]cmd.MultiModSearch{
+		"MovespeedFireResist": QueryBootsMovespeedFireResist,
+		"ColdCritMulti":       QueryAmuletColdCritMulti,
+		"RingStrengthIntES":   QueryRingStrengthIntES,
+		"QuiverCritChance":    QueryQuiverCritChance,
+		"HelmetRecoveryES":    QueryHelmetRecoveryES,
+	}
+	for name, search := range searches {
+		search := search.Clone()
+		t.Run(name, func(t *testing.T) {
+			plan, league := MultiModSearchToQueryPlan(search, planner, bdb, t)
+			t.Logf("plan: %s", plan)
+
+			// Mods must be ordered from most to least selective
+			if !sort.IntsAreSorted(plan.Estimates) {
+				t.Fatalf("mods not ordered by selectivity, estimates=%v",
+					plan.Estimates)
+			}
+
+			ids, err := plan.Query.Run(bdb)
+			if err != nil {
+				t.Fatalf("failed to run planned query, err=%s", err)
+			}
+
+			foundItems := QueryResultsToItems(ids, league, bdb, t)
+			if !search.Satisfies(foundItems) {
+				t.Fatalf("planned query results do not satisfy MultiModSearch")
+			}
+		})
+	}
+}
+
+// Test a search matching nearly every item of a tiny league scans the
+// item store and finds the same items an IndexQuery would
+func TestQueryPlannerTinyLeague(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	search := cmd.MultiModSearch{
+		MaxDesired: 10,
+		RootType:   "Jewelry",
+		RootFlavor: "Ring",
+		League:     "Tiny",
+		Mods: []string{
+			"+# to Strength",
+			"+# to Intelligence",
+		},
+		MinValues: []uint16{
+			5,
+			5,
+		},
+	}
+
+	// Every ring but the last has both mods above their minimum
+	s := stash.Stash{AccountName: "planner", ID: "plannerStash"}
+	for i := 0; i < 6; i++ {
+		value := uint16(10 + i)
+		if i == 5 {
+			value = 1
+		}
+		item := stash.Item{
+			ID:       strconv.Itoa(i) + "plannerItem",
+			League:   search.League,
+			TypeLine: "Iron Ring",
+		}
+		for _, mod := range search.Mods {
+			item.ExplicitMods = append(item.ExplicitMods, stash.ItemMod{
+				Template: []byte(mod),
+				Values:   []uint16{value},
+			})
+		}
+		s.Items = append(s.Items, item)
+	}
+	if err := stash.CleanStash(&s); err != nil {
+		t.Fatalf("failed to clean stash, err=%s", err)
+	}
+	cStashes, cItems, err := db.StashStashToCompact([]stash.Stash{s},
+		TimeOfStart, bdb)
+	if err != nil {
+		t.Fatalf("failed to convert fat stashes to compact, err=%s", err)
+	}
+	if _, err := db.AddStashes(cStashes, cItems, bdb); err != nil {
+		t.Fatalf("failed to AddStashes, err=%s", err)
+	}
+
+	planner := db.NewQueryPlanner(db.DefaultMaxStatsAge)
+	plan, league := MultiModSearchToQueryPlan(search, planner, bdb, t)
+	t.Logf("plan: %s", plan)
+	if plan.Strategy != db.StrategyItemStore {
+		t.Fatalf("tiny league not planned as an item store scan, plan: %s",
+			plan)
+	}
+
+	ids, err := plan.Query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed to run planned query, err=%s", err)
+	}
+	roots, err := db.GetStrings([]string{search.RootType, search.RootFlavor},
+		bdb)
+	if err != nil {
+		t.Fatalf("failed to fetch rootType or RootFlavor id, err=%s", err)
+	}
+	index := db.NewIndexQuery(roots[0], roots[1],
+		plan.Mods, plan.MinValues, league, search.MaxDesired)
+	indexIDs, err := index.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed to run index query, err=%s", err)
+	}
+
+	found := gggIDs(QueryResultsToItems(ids, league, bdb, t))
+	expected := gggIDs(QueryResultsToItems(indexIDs, league, bdb, t))
+	if len(found) != 5 || len(found) != len(expected) {
+		t.Fatalf("planned query found %d items, index query found %d, "+
+			"expected 5", len(found), len(expected))
+	}
+	for i := range found {
+		if found[i] != expected[i] {
+			t.Fatalf("planned query results differ from index query, "+
+				"found=%v expected=%v", found, expected)
+		}
+	}
+}
+
+// gggIDs returns the sorted GGG IDs of items
+func gggIDs(items []stash.Item) []string {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,257 @@
+package dbTest
+
+import (
+	"testing"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+)
+
+// errInterrupt is used to abandon a reindex partway through
+type errInterrupt struct{}
+
+// interruptedReindex starts a reindex and abandons it after its first batch
+func interruptedReindex(league string, options db.ReindexOptions,
+	bdb *bolt.DB, t testing.TB) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(errInterrupt); !ok {
+				panic(r)
+			}
+		}
+	}()
+	db.Reindex(league, options, func(db.ReindexProgress) {
+		panic(errInterrupt{})
+	}, bdb)
+	t.Fatalf("reindex was not interrupted")
+}
+
+// splitChangeSet returns the first n changes of a ChangeSet
+// and the changes following them
+func splitChangeSet(set stash.ChangeSet, n int) (stash.ChangeSet, stash.ChangeSet) {
+	first, rest := set, set
+	first.Changes, rest.Changes = set.Changes[:n], set.Changes[n:]
+	rest.ChangeIDToIndex = make(map[string]int)
+	for id, i := range set.ChangeIDToIndex {
+		if i >= n {
+			rest.ChangeIDToIndex[id] = i - n
+		}
+	}
+	return first, rest
+}
+
+// Test reindexing a league, both in place and in a shadow index,
+// rebuilds an index which is consistent and answers queries identically
+func TestReindex11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	search := QueryBootsMovespeedFireResist.Clone()
+	query, _ := MultiModSearchToIndexQuery(search, bdb, t)
+	before, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	entries, err := db.IndexEntryCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count index entries, err=%s", err)
+	}
+
+	for _, shadow := range []bool{false, true} {
+		options := db.ReindexOptions{Shadow: shadow, BatchSize: 100}
+
+		// Interrupt the first attempt so the second resumes
+		interruptedReindex(search.League, options, bdb, t)
+
+		var batches int
+		report, err := db.Reindex(search.League, options,
+			func(progress db.ReindexProgress) {
+				batches++
+				if progress.Items > progress.Total {
+					t.Fatalf("progress past total, %+v", progress)
+				}
+			}, bdb)
+		if err != nil {
+			t.Fatalf("failed Reindex, err=%s", err)
+		}
+		t.Logf("%s", report)
+		if !report.Resumed || report.Shadow != shadow ||
+			report.Batches != batches {
+			t.Fatalf("unexpected report, report=%s", report)
+		}
+
+		if fsck := runFsck(false, bdb, t); fsck.Total() != 0 {
+			t.Fatalf("reindex left problems")
+		}
+		count, err := db.IndexEntryCount(bdb)
+		if err != nil {
+			t.Fatalf("failed to count index entries, err=%s", err)
+		}
+		if count != entries {
+			t.Fatalf("expected %d index entries, got %d", entries, count)
+		}
+
+		query, league := MultiModSearchToIndexQuery(search, bdb, t)
+		after, err := query.Run(bdb)
+		if err != nil {
+			t.Fatalf("failed IndexQuery.Run, err=%s", err)
+		}
+		if len(after) != len(before) {
+			t.Fatalf("expected %d results after reindex, got %d",
+				len(before), len(after))
+		}
+		if !search.Satisfies(QueryResultsToItems(after, league, bdb, t)) {
+			t.Fatalf("results do not satisfy MultiModSearch after reindex")
+		}
+	}
+}
+
+// Test reindexing a league with a coarser granularity, with updates
+// arriving partway through, leaves no more index entries and answers
+// queries identically
+func TestReindexGranularity11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	first, rest := splitChangeSet(set, 6)
+	RunChangeSet(first, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	search := QueryBootsMovespeedFireResist.Clone()
+	granularity, err := db.GetIndexGranularity(search.League, bdb)
+	if err != nil {
+		t.Fatalf("failed to get index granularity, err=%s", err)
+	}
+	if granularity != db.DefaultIndexGranularity {
+		t.Fatalf("expected default granularity, got %d", granularity)
+	}
+
+	coarser := db.DefaultIndexGranularity + 4
+	options := db.ReindexOptions{Shadow: true, BatchSize: 100,
+		Granularity: &coarser}
+	interruptedReindex(search.League, options, bdb, t)
+
+	// Items added during the rebuild are keyed by the old granularity
+	// in the existing index and the new one in the shadow index
+	RunChangeSet(rest, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	report, err := db.Reindex(search.League, db.ReindexOptions{}, nil, bdb)
+	if err != nil {
+		t.Fatalf("failed Reindex, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if report.Granularity != coarser {
+		t.Fatalf("unexpected report, report=%s", report)
+	}
+	if granularity, err = db.GetIndexGranularity(search.League, bdb); err != nil {
+		t.Fatalf("failed to get index granularity, err=%s", err)
+	}
+	if granularity != coarser {
+		t.Fatalf("expected granularity %d, got %d", coarser, granularity)
+	}
+	if fsck := runFsck(false, bdb, t); fsck.Total() != 0 {
+		t.Fatalf("reindex left problems")
+	}
+
+	query, league := MultiModSearchToIndexQuery(search, bdb, t)
+	coarse, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if !search.Satisfies(QueryResultsToItems(coarse, league, bdb, t)) {
+		t.Fatalf("results do not satisfy MultiModSearch after reindex")
+	}
+	entries, err := db.IndexEntryCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count index entries, err=%s", err)
+	}
+
+	// Returning to the original granularity splits entries back apart
+	// and gives the same results
+	if _, err := db.Reindex(search.League, db.ReindexOptions{
+		Granularity: &granularity}, nil, bdb); err != nil {
+		t.Fatalf("failed Reindex, err=%s", err)
+	}
+	count, err := db.IndexEntryCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count index entries, err=%s", err)
+	}
+	if count < entries {
+		t.Fatalf("expected at least %d index entries, got %d", entries, count)
+	}
+	query, _ = MultiModSearchToIndexQuery(search, bdb, t)
+	fine, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if len(fine) != len(coarse) {
+		t.Fatalf("expected %d results at either granularity, got %d",
+			len(coarse), len(fine))
+	}
+}
+
+// Test items added as soon as a reindex writes its last batch are
+// indexed, both in place and in a shadow index
+func TestReindexIngestAtFinish11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	first, rest := splitChangeSet(set, 6)
+	search := QueryBootsMovespeedFireResist.Clone()
+
+	for _, shadow := range []bool{false, true} {
+		bdb := NewTempDatabase(t)
+		RunChangeSet(first, func(id string) error {
+			return nil
+		}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+		// Ingest once every item present at the start has been indexed
+		var ingested bool
+		options := db.ReindexOptions{Shadow: shadow, BatchSize: 100}
+		report, err := db.Reindex(search.League, options,
+			func(progress db.ReindexProgress) {
+				if ingested || progress.Items < progress.Total {
+					return
+				}
+				ingested = true
+				RunChangeSet(rest, func(id string) error {
+					return nil
+				}, TimeOfStart.Add(TestTimeDeltas*6), TestTimeDeltas, bdb, t)
+			}, bdb)
+		if err != nil {
+			t.Fatalf("failed Reindex, err=%s", err)
+		}
+		t.Logf("%s", report)
+		if !ingested {
+			t.Fatalf("reindex never reported its last batch")
+		}
+
+		if fsck := runFsck(false, bdb, t); fsck.Total() != 0 {
+			t.Fatalf("items added after the last batch were not indexed")
+		}
+		query, league := MultiModSearchToIndexQuery(search, bdb, t)
+		results, err := query.Run(bdb)
+		if err != nil {
+			t.Fatalf("failed IndexQuery.Run, err=%s", err)
+		}
+		if !search.Satisfies(QueryResultsToItems(results, league, bdb, t)) {
+			t.Fatalf("results do not satisfy MultiModSearch after reindex")
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package dbTest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+)
+
+// Test replaying a ChangeSet results in the same items as adding it
+// directly, continuing after the last change when interrupted
+func TestReplay11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+
+	direct := NewTempDatabase(t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, direct, t)
+	expected, err := db.ItemStoreCount(direct)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+
+	bdb := NewTempDatabase(t)
+	options := db.ReplayOptions{Start: TimeOfStart, Step: time.Minute}
+
+	// Interrupt the replay after a few changes
+	interrupted := 3
+	options.Progress = func(p db.ReplayProgress) {
+		if p.Index == interrupted-1 {
+			panic("interrupted")
+		}
+	}
+	func() {
+		defer func() {
+			recover()
+		}()
+		db.ReplayChangeSet(&set, options, bdb)
+	}()
+
+	var last time.Time
+	options.Progress = func(p db.ReplayProgress) {
+		if !p.When.After(last) {
+			t.Fatalf("change %d processed at %s, not after %s",
+				p.Index, p.When, last)
+		}
+		last = p.When
+	}
+	report, err := db.ReplayChangeSet(&set, options, bdb)
+	if err != nil {
+		t.Fatalf("failed ReplayChangeSet, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if report.Skipped != interrupted || report.ResumedAfter == "" ||
+		report.Changes != len(set.Changes)-interrupted {
+		t.Fatalf("replay did not resume after change %d, report=%s",
+			interrupted, report)
+	}
+	expectedFirst := TimeOfStart.Add(time.Duration(interrupted) * time.Minute)
+	if !report.First.Equal(expectedFirst) {
+		t.Fatalf("resumed change processed at %s, expected %s",
+			report.First, expectedFirst)
+	}
+
+	count, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	if count != expected {
+		t.Fatalf("expected %d items replayed, got %d", expected, count)
+	}
+
+	// Nothing remains once every change is replayed
+	options.Progress = nil
+	report, err = db.ReplayChangeSet(&set, options, bdb)
+	if err != nil {
+		t.Fatalf("failed ReplayChangeSet, err=%s", err)
+	}
+	if report.Changes != 0 || report.Skipped != len(set.Changes) {
+		t.Fatalf("completed replay added changes, report=%s", report)
+	}
+}
+
+// testReplayRecorded replays an archive of set recording when every change
+// but one was fetched, with and without its index, ensuring recorded
+// times are used unless synthetic times are requested
+func testReplayRecorded(set stash.ChangeSet, t *testing.T) {
+
+	dir := tempBackupDir(t)
+	defer os.RemoveAll(dir)
+
+	// Change unrecorded is added without a time
+	unrecorded := len(set.Changes) / 2
+	recorded := func(i int) time.Time {
+		return TimeOfStart.Add(time.Hour + time.Duration(i)*7*time.Second)
+	}
+	step := time.Minute
+	synthetic := func(i int) time.Time {
+		return TimeOfStart.Add(time.Duration(i) * step)
+	}
+
+	for _, closed := range []bool{true, false} {
+		path := filepath.Join(dir, "changes.archive")
+		w, err := stash.CreateChangeArchive(path)
+		if err != nil {
+			t.Fatalf("failed CreateChangeArchive, err=%s", err)
+		}
+		for i, id := range set.ChangeIDs() {
+			if i == unrecorded {
+				err = w.AddResponse(id, set.Changes[i])
+			} else {
+				err = w.AddFetchedResponse(id, set.Changes[i], recorded(i))
+			}
+			if err != nil {
+				t.Fatalf("failed to add change %s, err=%s", id, err)
+			}
+		}
+		if closed {
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to close archive, err=%s", err)
+			}
+		}
+
+		archive, err := stash.OpenChangeArchive(path)
+		if err != nil {
+			t.Fatalf("failed OpenChangeArchive, err=%s", err)
+		}
+		for _, useSynthetic := range []bool{false, true} {
+			options := db.ReplayOptions{
+				Start:     TimeOfStart,
+				Step:      step,
+				Synthetic: useSynthetic,
+			}
+			options.Progress = func(p db.ReplayProgress) {
+				expected := recorded(p.Index)
+				if useSynthetic || p.Index == unrecorded {
+					expected = synthetic(p.Index)
+				}
+				if !p.When.Equal(expected) {
+					t.Fatalf("change %d processed at %s, expected %s, synthetic=%t closed=%t",
+						p.Index, p.When, expected, useSynthetic, closed)
+				}
+			}
+			report, err := db.ReplayChangeSet(archive, options,
+				NewTempDatabase(t))
+			if err != nil {
+				t.Fatalf("failed ReplayChangeSet, err=%s", err)
+			}
+			if report.Changes != len(set.Changes) {
+				t.Fatalf("replayed %d changes, expected %d",
+					report.Changes, len(set.Changes))
+			}
+		}
+		archive.Close()
+		if !closed {
+			w.Close()
+		}
+		os.Remove(path)
+	}
+}
+
+// Test replaying a change archive processes each change at the time it
+// was fetched when recorded
+func TestReplay11UpdatesRecorded(t *testing.T) {
+
+	t.Parallel()
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	testReplayRecorded(set, t)
+}
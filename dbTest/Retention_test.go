@@ -0,0 +1,104 @@
+package dbTest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/boltdb/bolt"
+)
+
+// pruneTotals sums a PruneReport across leagues
+func pruneTotals(report *db.PruneReport) (items, stashes, batches int) {
+	for _, league := range report.Leagues {
+		items += league.Items
+		stashes += league.Stashes
+		batches += league.Batches
+	}
+	return
+}
+
+// runPrune runs Prune and fails the test on error
+func runPrune(policy db.RetentionPolicy, now time.Time, dryRun bool,
+	bdb *bolt.DB, t testing.TB) *db.PruneReport {
+
+	report, err := db.Prune(policy, now, dryRun, bdb)
+	if err != nil {
+		t.Fatalf("failed to Prune, err=%s", err)
+	}
+	t.Logf("%s", report)
+	return report
+}
+
+// Test expiring items removes them from the store and indices while
+// a dry run reports the same work without changing anything
+func TestPrune11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	initial, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+
+	for _, basis := range []db.RetentionBasis{db.RetainByItem, db.RetainByStash} {
+		// Nothing has aged past the policy yet
+		policy := db.RetentionPolicy{MaxAge: time.Hour, Basis: basis}
+		report := runPrune(policy, TimeOfStart.Add(time.Minute), false, bdb, t)
+		if items, _, _ := pruneTotals(report); items != 0 {
+			t.Fatalf("pruned %d items by %s before any expired", items, basis)
+		}
+	}
+
+	// Everything is expired an hour later
+	policy := db.RetentionPolicy{
+		MaxAge:    time.Minute,
+		Basis:     db.RetainByStash,
+		BatchSize: 100,
+	}
+	later := TimeOfStart.Add(time.Hour)
+
+	dryReport := runPrune(policy, later, true, bdb, t)
+	dryItems, dryStashes, dryBatches := pruneTotals(dryReport)
+	if dryItems != initial {
+		t.Fatalf("dry run expected to prune %d items, got %d", initial, dryItems)
+	}
+	if dryBatches != 0 {
+		t.Fatalf("dry run performed %d write batches", dryBatches)
+	}
+	if count, _ := db.ItemStoreCount(bdb); count != initial {
+		t.Fatalf("dry run changed item count from %d to %d", initial, count)
+	}
+
+	report := runPrune(policy, later, false, bdb, t)
+	items, stashes, batches := pruneTotals(report)
+	if items != dryItems || stashes != dryStashes {
+		t.Fatalf("mismatched dry run and prune, dry=%d items %d stashes, got=%d items %d stashes",
+			dryItems, dryStashes, items, stashes)
+	}
+	if batches < initial/policy.BatchSize {
+		t.Fatalf("expected at least %d batches, got %d",
+			initial/policy.BatchSize, batches)
+	}
+	if count, _ := db.ItemStoreCount(bdb); count != 0 {
+		t.Fatalf("expected no items after prune, got %d", count)
+	}
+
+	// Nothing should remain in the index either
+	query, _ := MultiModSearchToIndexQuery(QueryBootsMovespeedFireResist.Clone(),
+		bdb, t)
+	ids, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("found %d items in the index after prune", len(ids))
+	}
+}
@@ -0,0 +1,126 @@
+package dbTest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+)
+
+// Test streaming a response yields exactly the stashes of decoding it
+// whole, and importing the stream stores the same items
+func TestStashDecoder11Stashes(t *testing.T) {
+
+	t.Parallel()
+
+	f, err := GetTestData("11Stashes.json")
+	if err != nil {
+		t.Fatalf("failed to fetch '11Stashes.json', err=%s", err)
+	}
+	raw, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to read '11Stashes.json', err=%s", err)
+	}
+
+	whole, err := stash.RespFromJSON(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed RespFromJSON, err=%s", err)
+	}
+	streamed, err := stash.NewStashDecoder(bytes.NewReader(raw)).Response()
+	if err != nil {
+		t.Fatalf("failed to stream response, err=%s", err)
+	}
+	if streamed.NextChangeID != whole.NextChangeID {
+		t.Fatalf("streamed NextChangeID=%s, expected %s",
+			streamed.NextChangeID, whole.NextChangeID)
+	}
+	if !reflect.DeepEqual(streamed.Stashes, whole.Stashes) {
+		t.Fatalf("streamed stashes differ from decoding whole")
+	}
+
+	direct := NewTempDatabase(t)
+	cStashes, cItems := GetTestStashUpdate("11Stashes.json", direct, t)
+	if _, err := db.AddStashes(cStashes, cItems, direct); err != nil {
+		t.Fatalf("failed to AddStashes, err=%s", err)
+	}
+	expected, err := db.ItemStoreCount(direct)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+
+	bdb := NewTempDatabase(t)
+	dec := stash.NewStashDecoder(bytes.NewReader(raw))
+	report, err := db.ImportStashes(dec, TimeOfStart, 3, bdb)
+	if err != nil {
+		t.Fatalf("failed ImportStashes, err=%s", err)
+	}
+	t.Logf("%s", report)
+	if report.Stashes != len(whole.Stashes) {
+		t.Fatalf("imported %d stashes, expected %d",
+			report.Stashes, len(whole.Stashes))
+	}
+	count, err := db.ItemStoreCount(bdb)
+	if err != nil {
+		t.Fatalf("failed to count items, err=%s", err)
+	}
+	if count != expected {
+		t.Fatalf("expected %d items imported, got %d", expected, count)
+	}
+}
+
+// getStashResponse returns the content of the recorded StashResponse.json
+func getStashResponse(b *testing.B) []byte {
+	raw, err := ioutil.ReadFile(filepath.Join("..", stash.TestResponseLoc))
+	if err != nil {
+		b.Fatalf("failed to read '%s', err=%s", stash.TestResponseLoc, err)
+	}
+	return raw
+}
+
+// BenchmarkDecodeResponseWhole determines how fast a recorded response
+// is decoded into a single stash.Response
+func BenchmarkDecodeResponseWhole(b *testing.B) {
+
+	raw := getStashResponse(b)
+
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := stash.RespFromJSON(bytes.NewReader(raw)); err != nil {
+			b.Fatalf("failed RespFromJSON, err=%s", err)
+		}
+	}
+}
+
+// BenchmarkDecodeResponseStream determines how fast a recorded response
+// is decoded a stash at a time, which bounds memory to a single stash
+func BenchmarkDecodeResponseStream(b *testing.B) {
+
+	raw := getStashResponse(b)
+
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		dec := stash.NewStashDecoder(bytes.NewReader(raw))
+		var s stash.Stash
+		for {
+			err := dec.Next(&s)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("failed to stream response, err=%s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package dbTest
+
+import (
+	"testing"
+
+	"github.com/Everlag/poeitemstore/db"
+)
+
+// Test collecting strings after dropping a league only removes
+// strings it alone referenced and leaves the remaining league usable
+func TestCollectStrings11Updates(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	set := GetChangeSet("testSet - 11 updates.msgp", t)
+	RunChangeSet(set, func(id string) error {
+		return nil
+	}, TimeOfStart, TestTimeDeltas, bdb, t)
+
+	// Items removed during ingest can leave strings behind,
+	// two collections are needed to condemn then sweep them
+	for i := 0; i < 2; i++ {
+		if _, err := db.CollectStrings(false, bdb); err != nil {
+			t.Fatalf("failed CollectStrings, err=%s", err)
+		}
+	}
+	report, err := db.CollectStrings(false, bdb)
+	if err != nil {
+		t.Fatalf("failed CollectStrings, err=%s", err)
+	}
+	if report.Condemned != 0 || report.Swept != 0 {
+		t.Fatalf("collected referenced strings, report=%s", report)
+	}
+
+	if _, err := db.DropLeague("Legacy", false, bdb); err != nil {
+		t.Fatalf("failed DropLeague, err=%s", err)
+	}
+
+	// Strings unique to the dropped league are only condemned at first
+	condemnReport, err := db.CollectStrings(false, bdb)
+	if err != nil {
+		t.Fatalf("failed CollectStrings, err=%s", err)
+	}
+	t.Logf("%s", condemnReport)
+	if condemnReport.Condemned == 0 || condemnReport.Swept != 0 {
+		t.Fatalf("expected only condemned strings, report=%s", condemnReport)
+	}
+
+	dryReport, err := db.CollectStrings(true, bdb)
+	if err != nil {
+		t.Fatalf("failed dry run CollectStrings, err=%s", err)
+	}
+	if dryReport.Swept != condemnReport.Condemned {
+		t.Fatalf("dry run expected to sweep %d strings, report=%s",
+			condemnReport.Condemned, dryReport)
+	}
+
+	sweepReport, err := db.CollectStrings(false, bdb)
+	if err != nil {
+		t.Fatalf("failed CollectStrings, err=%s", err)
+	}
+	t.Logf("%s", sweepReport)
+	if sweepReport.Swept != dryReport.Swept ||
+		sweepReport.BytesReclaimed != dryReport.BytesReclaimed ||
+		sweepReport.BytesReclaimed == 0 {
+		t.Fatalf("mismatched dry run and sweep, dry=%s, got=%s",
+			dryReport, sweepReport)
+	}
+
+	// Nothing remains to be collected
+	report, err = db.CollectStrings(false, bdb)
+	if err != nil {
+		t.Fatalf("failed CollectStrings, err=%s", err)
+	}
+	if report.Condemned != 0 || report.Swept != 0 {
+		t.Fatalf("expected nothing left to collect, report=%s", report)
+	}
+
+	// The remaining league must still be searchable
+	search := QueryBootsMovespeedFireResist.Clone()
+	search.League = "Standard"
+	query, league := MultiModSearchToIndexQuery(search, bdb, t)
+	ids, err := query.Run(bdb)
+	if err != nil {
+		t.Fatalf("failed IndexQuery.Run, err=%s", err)
+	}
+	if !search.Satisfies(QueryResultsToItems(ids, league, bdb, t)) {
+		t.Fatalf("results do not satisfy MultiModSearch after collection")
+	}
+}
@@ -0,0 +1,181 @@
+package dbTest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/db"
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/boltdb/bolt"
+)
+
+// Test Timestamps keep their time and order well past when unix
+// seconds overflow 4 bytes
+func TestTimestampPast2106(t *testing.T) {
+
+	t.Parallel()
+
+	times := []time.Time{
+		db.TimestampEpoch,
+		TimeOfStart,
+		time.Date(2106, time.February, 7, 6, 28, 15, 0, time.UTC),
+		time.Date(2106, time.February, 7, 6, 28, 16, 0, time.UTC),
+		time.Date(2140, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	var previous db.Timestamp
+	for i, when := range times {
+		ts := db.TimeToTimestamp(when)
+		if !ts.ToTime().Equal(when) {
+			t.Fatalf("expected %s, got %s", when, ts.ToTime())
+		}
+		if i > 0 && bytes.Compare(previous[:], ts[:]) >= 0 {
+			t.Fatalf("%s not ordered after %s", when, times[i-1])
+		}
+		previous = ts
+	}
+}
+
+// Test every item is given its own Timestamp ordered by when it was
+// processed, even across pages processed at the same time
+func TestTimestampSequenceSingleStash(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+
+	var previous *db.Timestamp
+	for page := 0; page < 2; page++ {
+		_, items := GetTestStashUpdate("singleStash.json", bdb, t)
+		for _, stashItems := range items {
+			for _, item := range stashItems {
+				when := item.When
+				if !when.ToTime().Equal(TimeOfStart) {
+					t.Fatalf("expected item at %s, got %s",
+						TimeOfStart, when.ToTime())
+				}
+				if previous != nil && bytes.Compare(previous[:], when[:]) >= 0 {
+					t.Fatalf("item sequence %d not after %d",
+						when.Sequence(), previous.Sequence())
+				}
+				previous = &when
+			}
+		}
+	}
+	if previous == nil {
+		t.Fatalf("no items found")
+	}
+}
+
+// importTimestampStashes imports a stash of two items for each of ids
+// as its own update, the first at start and each following a minute later
+func importTimestampStashes(ids []string, start time.Time, bdb *bolt.DB,
+	t testing.TB) {
+
+	var lines bytes.Buffer
+	for _, id := range ids {
+		s := stash.Stash{AccountName: "timestamps", ID: id}
+		for i := 0; i < 2; i++ {
+			s.Items = append(s.Items, stash.Item{
+				ID:       fmt.Sprintf("%s-%d", id, i),
+				League:   "Standard",
+				TypeLine: "Iron Ring",
+			})
+		}
+		serial, err := s.MarshalJSON()
+		if err != nil {
+			t.Fatalf("failed to marshal stash, err=%s", err)
+		}
+		lines.Write(serial)
+		lines.WriteByte('\n')
+	}
+
+	options := db.ImportOptions{Start: start, Step: time.Minute, BatchSize: 1}
+	if _, err := db.ImportJSONLines(&lines, options, bdb); err != nil {
+		t.Fatalf("failed ImportJSONLines, err=%s", err)
+	}
+}
+
+// Test items imported at times before the newest items already stored
+// keep those times, while items sharing a second with earlier items
+// continue that second's sequence
+func TestTimestampImportPast(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+	newer := TimeOfStart.Add(time.Hour)
+	importTimestampStashes([]string{"newer"}, newer, bdb, t)
+	importTimestampStashes([]string{"past0", "past1"}, TimeOfStart, bdb, t)
+	importTimestampStashes([]string{"again"}, newer, bdb, t)
+
+	expected := map[string]struct {
+		when     time.Time
+		sequence uint32
+	}{
+		"newer-0": {newer, 0}, "newer-1": {newer, 1},
+		"past0-0": {TimeOfStart, 0}, "past0-1": {TimeOfStart, 1},
+		"past1-0": {TimeOfStart.Add(time.Minute), 0},
+		"past1-1": {TimeOfStart.Add(time.Minute), 1},
+		"again-0": {newer, 2}, "again-1": {newer, 3},
+	}
+	found := make(map[db.GGGID]bool)
+	for _, v := range itemStoreContents(bdb) {
+		var item db.Item
+		if _, err := item.UnmarshalMsg([]byte(v)); err != nil {
+			t.Fatalf("failed to unmarshal item, err=%s", err)
+		}
+		found[item.GGGID] = true
+		for id, e := range expected {
+			if item.GGGID != db.GGGIDFromUID(id) {
+				continue
+			}
+			if !item.When.ToTime().Equal(e.when) ||
+				item.When.Sequence() != e.sequence {
+				t.Fatalf("item %s at %s sequence %d, expected %s sequence %d",
+					id, item.When.ToTime(), item.When.Sequence(),
+					e.when, e.sequence)
+			}
+		}
+	}
+	for id := range expected {
+		if !found[db.GGGIDFromUID(id)] {
+			t.Fatalf("item %s not stored", id)
+		}
+	}
+}
+
+// Test the sequences of seconds long before the newest are pruned while
+// the newest second still continues its sequence
+func TestTimestampSequencesPruned(t *testing.T) {
+
+	t.Parallel()
+
+	bdb := NewTempDatabase(t)
+	newer := TimeOfStart.Add(2 * time.Hour)
+	importTimestampStashes([]string{"old0", "old1"}, TimeOfStart, bdb, t)
+	importTimestampStashes([]string{"newer"}, newer, bdb, t)
+	importTimestampStashes([]string{"again"}, newer, bdb, t)
+
+	var kept int
+	bdb.View(func(tx *bolt.Tx) error {
+		kept = tx.Bucket([]byte("timestampSequences")).Stats().KeyN
+		return nil
+	})
+	if kept != 1 {
+		t.Fatalf("expected only the newest second's sequence, found %d", kept)
+	}
+
+	for _, v := range itemStoreContents(bdb) {
+		var item db.Item
+		if _, err := item.UnmarshalMsg([]byte(v)); err != nil {
+			t.Fatalf("failed to unmarshal item, err=%s", err)
+		}
+		if item.GGGID == db.GGGIDFromUID("again-1") && item.When.Sequence() != 3 {
+			t.Fatalf("expected sequence 3 after pruning, got %d",
+				item.When.Sequence())
+		}
+	}
+}
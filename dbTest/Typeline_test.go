@@ -0,0 +1,102 @@
+package dbTest
+
+import (
+	"testing"
+
+	"github.com/Everlag/poeitemstore/stash"
+)
+
+// typeLineCases are typeLines alongside the flavor and root they
+// resolve to
+var typeLineCases = []struct {
+	typeLine, flavor, root string
+}{
+	// Plain bases
+	{"Iron Ring", "Ring", "Jewelry"},
+	{"Crude Bow", "Bow", "Weapon"},
+	{"Fireball", "Gem", "Gem"},
+	{"Chaos Orb", "Currency", "Currency"},
+	{"Rain of Chaos", "Card", "Card"},
+	{"Deafening Essence of Anger", "Currency", "Currency"},
+	// Quality and markup
+	{"Superior Vaal Fireball", "Gem", "Gem"},
+	{"Superior Fingerless Silk Gloves", "Gloves", "Armour"},
+	{"<<set:MS>><<set:M>><<set:S>>Beach Map", "Map", "Map"},
+	// Magic prefixes and suffixes
+	{"Seething Divine Life Flask of Staunching", "Flask", "Flask"},
+	{"Catalysing Amethyst Ring of the Lynx", "Ring", "Jewelry"},
+	{"Fingerless Silk Gloves of the Lynx", "Gloves", "Armour"},
+	{"Bubbling Hallowed Life Flask of Heat", "Flask", "Flask"},
+	{"Mirrored Beach Map of Skeletons", "Map", "Map"},
+	{"Shaped Beach Map", "Map", "Map"},
+	// Bases introduced after our list
+	{"Haunted Mansion Map", "Map", "Map"},
+	{"Bubbling Ultimate Life Flask of Heat", "Flask", "Flask"},
+	{"Awakened Added Fire Damage Support", "Gem", "Gem"},
+	{"Orb of Horizons", "Currency", "Currency"},
+	{"Primitive Chaotic Resonator", "Currency", "Currency"},
+}
+
+// Test typeLines resolve to the expected flavor and root
+func TestMatchTypeline(t *testing.T) {
+
+	t.Parallel()
+
+	for _, c := range typeLineCases {
+		// Repeat as resolution was once dependent on map order
+		for i := 0; i < 10; i++ {
+			flavor, root, ok := stash.MatchTypeline(c.typeLine)
+			if !ok || flavor != c.flavor || root != c.root {
+				t.Fatalf("typeLine %s resolved to flavor=%s root=%s ok=%t, expected flavor=%s root=%s",
+					c.typeLine, flavor, root, ok, c.flavor, c.root)
+			}
+		}
+	}
+}
+
+// Test items matching no base are kept under stash.UnknownRoot rather
+// than failing the entire response
+func TestCleanResponseUnknownTypeline(t *testing.T) {
+
+	t.Parallel()
+
+	flavor, root, ok := stash.MatchTypeline("Mysterious Trinket")
+	if ok || flavor != stash.UnknownFlavor || root != stash.UnknownRoot {
+		t.Fatalf("unknown typeLine resolved to flavor=%s root=%s ok=%t",
+			flavor, root, ok)
+	}
+
+	response := stash.Response{
+		Stashes: []stash.Stash{{
+			ID: "stash",
+			Items: []stash.Item{
+				{ID: "known", TypeLine: "Iron Ring"},
+				{ID: "unknown", TypeLine: "Mysterious Trinket"},
+			},
+		}},
+	}
+	if err := stash.CleanResponse(&response); err != nil {
+		t.Fatalf("failed to clean response with unknown item, err=%s", err)
+	}
+	items := response.Stashes[0].Items
+	if items[0].RootType != "Jewelry" || items[0].RootFlavor != "Ring" {
+		t.Fatalf("known item resolved to flavor=%s root=%s",
+			items[0].RootFlavor, items[0].RootType)
+	}
+	if items[1].RootType != stash.UnknownRoot ||
+		items[1].RootFlavor != stash.UnknownFlavor {
+		t.Fatalf("unknown item resolved to flavor=%s root=%s",
+			items[1].RootFlavor, items[1].RootType)
+	}
+}
+
+// BenchmarkMatchTypeline determines how fast typeLines are resolved,
+// including those falling through to a prefix or suffix search
+func BenchmarkMatchTypeline(b *testing.B) {
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c := typeLineCases[i%len(typeLineCases)]
+		stash.MatchTypeline(c.typeLine)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"os"
+	"os/signal"
 
 	"flag"
 
@@ -14,59 +16,72 @@ import (
 )
 
 // FetchAndCompress fetches a given changeID and returns its compressed
-// representation alongside its NextChangeID field
-func FetchAndCompress(changeID string) (string,
-	*stash.CompressedResponse, error) {
-	response, err := stash.FetchUpdate(changeID)
+// representation alongside the Response it was compressed from
+func FetchAndCompress(ctx context.Context, fetcher *stash.Fetcher,
+	changeID string) (*stash.Response, *stash.CompressedResponse, error) {
+	response, err := fetcher.Fetch(ctx, changeID)
 	if err != nil {
-		return "", nil, errors.Wrap(err, "failed to fetch update")
+		return nil, nil, errors.Wrap(err, "failed to fetch update")
 	}
 
 	comp, err := stash.NewCompressedResponse(response)
-	return response.NextChangeID, comp, err
+	return response, comp, err
 }
 
-// FetchTillLimit grabs and saves stash updates starting from
-// the provided changeID until the storage space used exceeds
-// the provided limit in terms of bytes.
-func FetchTillLimit(changeID string,
-	sizeLimit int) (*stash.ChangeSet, error) {
-
-	set := stash.NewChangeSet()
-
-	var comp *stash.CompressedResponse
-	var err error
-	for set.Size < sizeLimit {
+// FetchTillLimit grabs and appends stash updates to the archive
+// starting from the provided changeID until the compressed size of the
+// updates fetched exceeds the provided limit in terms of bytes.
+// Returns the number of bytes fetched.
+//
+// Each update is written as it is fetched, so everything fetched
+// before an error remains in the archive. Once caught up to the latest
+// update, the empty updates returned until another is available are
+// not archived. Fetching stops early when ctx is done.
+func FetchTillLimit(ctx context.Context, changeID string, sizeLimit int,
+	fetcher *stash.Fetcher, archiver *Archiver) (int, error) {
+
+	var fetched int
+	for fetched < sizeLimit {
 		fmt.Printf("id=%s fetching\n", changeID)
-		changeID, comp, err = FetchAndCompress(changeID)
+		response, comp, err := FetchAndCompress(ctx, fetcher, changeID)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to fetch and compress")
+			return fetched, errors.Wrap(err, "failed to fetch and compress")
 		}
+		fetchedAt := time.Now()
+		if len(response.Stashes) == 0 && response.NextChangeID == changeID {
+			continue
+		}
+		changeID = response.NextChangeID
 
-		set.AddResponse(changeID, *comp)
-		fmt.Printf("fetched size=%d; total size=%d\n", comp.Size, set.Size)
-
-		// Wait so not DOSing
-		time.Sleep(WaitDuration)
+		if err := archiver.AddResponse(changeID, *comp, fetchedAt); err != nil {
+			return fetched, errors.Wrap(err, "failed to append to archive")
+		}
+		fetched += comp.Size
+		fmt.Printf("fetched size=%d; total size=%d\n", comp.Size, fetched)
 	}
 
-	return &set, nil
+	return fetched, nil
 }
 
 // Unpack extracts the given Response with the provided changeID
-// from the ChangeSet at the specific path
+// from the ChangeSet or change archive at the specific path
 func Unpack(changeID, path string) (*stash.Response, error) {
 
+	// Only the requested change of an archive is read
 	set, err := stash.OpenChangeSet(path)
 	if err != nil {
-		return nil,
-			errors.Wrap(err, "failed to open changeset")
+		return nil, errors.Wrap(err, "failed to open changeset")
 	}
+	defer set.Close()
 
-	comp, ok := set.GetCompByChangeID(changeID)
+	index, ok := set.IndexOf(changeID)
 	if !ok {
 		return nil, errors.New("failed to find response with corresponding id")
 	}
+	comp, err := set.ChangeAt(index)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response with corresponding id")
+	}
 
 	resp, err := comp.Decompress()
 	if err != nil {
@@ -100,17 +115,29 @@ func SaveResponse(changeID string, resp stash.Response) error {
 	return nil
 }
 
-// WaitDuration is the time spent between update requests
+// WaitDuration is the minimum time spent between update requests
 //
 // This is required to not get rate limited...
 const WaitDuration = time.Second * 4
 
 func main() {
 
-	size := flag.Int("maxsize", -1, "Maximum stored size in bytes")
-	path := flag.String("dest", "", "location for content")
-	changeID := flag.String("id", "", "starting changeID(optional)")
+	size := flag.Int("maxsize", -1, "Maximum size fetched in bytes")
+	path := flag.String("dest", "",
+		"location for content, a directory when rotating")
+	changeID := flag.String("id", "",
+		"starting changeID(optional), resumes after the last archived when empty")
 	unpackWhich := flag.Bool("unpack", false, "changeID to extract(optional)")
+	rotateSize := flag.Int("rotatesize", 0,
+		"start a new archive after this many bytes(optional)")
+	rotateEvery := flag.Duration("rotateevery", 0,
+		"start a new archive after this long(optional)")
+	endpoint := flag.String("endpoint", stash.StashAPIBase,
+		"URL of the stash api(optional)")
+	userAgent := flag.String("useragent", stash.DefaultUserAgent,
+		"user agent identifying the scraper(optional)")
+	token := flag.String("token", os.Getenv(stash.TokenEnv),
+		"OAuth bearer token(optional), read from $"+stash.TokenEnv+" when absent")
 
 	flag.Parse()
 
@@ -119,10 +146,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	if *changeID == "" {
-		fmt.Println("empty id, using default changeID")
-	}
-
 	if *unpackWhich {
 		fmt.Printf("unpacking changeid to %s.json\n", *changeID)
 		resp, err := Unpack(*changeID, *path)
@@ -145,18 +168,56 @@ func main() {
 		os.Exit(1)
 	}
 
-	set, err := FetchTillLimit(*changeID, *size)
+	archiver := NewArchiver(*path, *rotateSize, *rotateEvery)
+	lastID, err := archiver.Open()
 	if err != nil {
-		fmt.Printf("encountered error while fetching, err=%s\n", err)
+		fmt.Printf("failed to open archive, err=%s\n", err)
 		os.Exit(1)
 	}
+	switch {
+	case *changeID != "":
+	case lastID != "":
+		fmt.Printf("resuming after last archived id=%s\n", lastID)
+		*changeID = lastID
+	default:
+		fmt.Println("empty id, using default changeID")
+	}
 
-	err = set.Save(*path)
-	if err != nil {
-		fmt.Printf("failed to save compressed set, err=%s\n", err)
+	client := stash.NewClient()
+	client.BaseURL = *endpoint
+	client.UserAgent = *userAgent
+	if *token != "" {
+		client.Tokens = stash.StaticToken(*token)
+	}
+
+	// Interrupting stops fetching so the archive is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		fmt.Println("interrupted, closing archive")
+		cancel()
+	}()
+
+	fetcher := stash.NewFetcher(client)
+	fetcher.Wait = WaitDuration
+	fetcher.Retrying = func(changeID string, wait time.Duration, err error) {
+		fmt.Printf("id=%s retrying in %s, err=%s\n", changeID, wait, err)
+	}
+
+	fetched, fetchErr := FetchTillLimit(ctx, *changeID, *size, fetcher, archiver)
+	// The index is written even after an error so the archive
+	// holds everything fetched
+	if err := archiver.Close(); err != nil {
+		fmt.Printf("failed to close archive, err=%s\n", err)
+		os.Exit(1)
+	}
+	if fetchErr != nil {
+		fmt.Printf("encountered error while fetching, err=%s\n", fetchErr)
 		os.Exit(1)
 	}
 
-	fmt.Printf("done, %d bytes fetched\n", set.Size)
+	fmt.Printf("done, %d bytes fetched\n", fetched)
 
 }
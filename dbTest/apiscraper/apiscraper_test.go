@@ -0,0 +1,348 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/pkg/errors"
+)
+
+// standIn is a local stash api which throttles requests as scripted.
+// Each change ID is a number and the next change ID is one greater.
+type standIn struct {
+	sync.Mutex
+	// Status of each request in order, http.StatusOK once exhausted
+	script []int
+	// Compress responses when the client accepts gzip
+	gzip bool
+	// IDs requested in order
+	requested []string
+	// Headers of the last request
+	header http.Header
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	id := r.URL.Query().Get("id")
+	s.requested = append(s.requested, id)
+	s.header = r.Header
+
+	w.Header().Set("X-Rate-Limit-Rules", "Ip")
+	w.Header().Set("X-Rate-Limit-Ip", "10:60:120")
+	w.Header().Set("X-Rate-Limit-Ip-State", "1:60:0")
+
+	status := http.StatusOK
+	if len(s.script) > 0 {
+		status, s.script = s.script[0], s.script[1:]
+	}
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "7")
+	}
+	var body io.Writer = w
+	if s.gzip && r.Header.Get("Accept-Encoding") == "gzip" {
+		w.Header().Set("Content-Encoding", "gzip")
+		comp := gzip.NewWriter(w)
+		defer comp.Close()
+		body = comp
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		fmt.Fprintf(body, "status %d", status)
+		return
+	}
+
+	next, _ := strconv.Atoi(id)
+	fmt.Fprintf(body, `{"next_change_id":"%d","stashes":[]}`, next+1)
+}
+
+// fakeClock stands in for the time of a Fetcher or Archiver, sleeping
+// only advances it
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+	return ctx.Err()
+}
+
+// newTestFetcher returns a Fetcher for server on clock
+func newTestFetcher(server *httptest.Server, clock *fakeClock) *stash.Fetcher {
+	client := stash.NewClient()
+	client.BaseURL = server.URL
+	f := stash.NewFetcher(client)
+	f.Wait = WaitDuration
+	f.Backoff = time.Second
+	f.Sleep = clock.Sleep
+	f.Now = clock.Now
+	return f
+}
+
+// Test throttled and failing requests are retried after the longest of
+// the backoff, Retry-After and advertised rate limit
+func TestFetchThrottled(t *testing.T) {
+
+	api := &standIn{script: []int{
+		http.StatusTooManyRequests,
+		http.StatusServiceUnavailable,
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	fetcher := newTestFetcher(server, clock)
+
+	response, err := fetcher.Fetch(context.Background(), "41")
+	if err != nil {
+		t.Fatalf("failed Fetch, err=%s", err)
+	}
+	if response.NextChangeID != "42" {
+		t.Fatalf("unexpected NextChangeID=%s", response.NextChangeID)
+	}
+
+	// Retry-After, then the 60:10 rate limit exceeding the 2s backoff
+	expected := []time.Duration{time.Second * 7, time.Second * 6}
+	if !reflect.DeepEqual(clock.slept, expected) {
+		t.Fatalf("waited %v, expected %v", clock.slept, expected)
+	}
+	if len(api.requested) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(api.requested))
+	}
+
+	// The next request is paced by the rate limit
+	if _, err := fetcher.Fetch(context.Background(), "42"); err != nil {
+		t.Fatalf("failed Fetch, err=%s", err)
+	}
+	if waited := clock.slept[len(clock.slept)-1]; waited != time.Second*6 {
+		t.Fatalf("waited %s between requests, expected 6s", waited)
+	}
+}
+
+// Test the client identifies itself, authenticates and decompresses
+// responses, returning a StatusError for anything unsuccessful
+func TestClientRequests(t *testing.T) {
+
+	api := &standIn{gzip: true, script: []int{http.StatusUnauthorized}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := stash.NewClient()
+	client.BaseURL = server.URL
+	client.UserAgent = "scraper test"
+	client.Tokens = stash.StaticToken("secret")
+
+	_, _, err := client.Fetch(context.Background(), "7")
+	status, ok := errors.Cause(err).(*stash.StatusError)
+	if !ok {
+		t.Fatalf("unauthorized did not return StatusError, err=%s", err)
+	}
+	if status.StatusCode != http.StatusUnauthorized || status.Temporary() ||
+		status.Body != "status 401" {
+		t.Fatalf("unexpected StatusError, err=%s", status)
+	}
+
+	response, _, err := client.Fetch(context.Background(), "7")
+	if err != nil {
+		t.Fatalf("failed Fetch, err=%s", err)
+	}
+	if response.NextChangeID != "8" {
+		t.Fatalf("unexpected NextChangeID=%s", response.NextChangeID)
+	}
+	if api.header.Get("User-Agent") != "scraper test" ||
+		api.header.Get("Authorization") != "Bearer secret" {
+		t.Fatalf("request missing user agent or token, header=%v", api.header)
+	}
+
+	dec, _, err := client.Stream(context.Background(), "8")
+	if err != nil {
+		t.Fatalf("failed Stream, err=%s", err)
+	}
+	streamed, err := dec.Response()
+	dec.Close()
+	if err != nil {
+		t.Fatalf("failed to read stream, err=%s", err)
+	}
+	if streamed.NextChangeID != "9" {
+		t.Fatalf("unexpected streamed NextChangeID=%s", streamed.NextChangeID)
+	}
+
+	// A cancelled fetch is not retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fetcher := newTestFetcher(server, &fakeClock{now: time.Unix(0, 0)})
+	if _, err := fetcher.Fetch(ctx, "8"); err == nil {
+		t.Fatalf("cancelled Fetch succeeded")
+	}
+	if len(api.requested) != 3 {
+		t.Fatalf("cancelled Fetch made requests")
+	}
+}
+
+// Test requests are abandoned once out of retries, or immediately when
+// the failure is not worth retrying
+func TestFetchGivesUp(t *testing.T) {
+
+	api := &standIn{script: []int{
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusInternalServerError,
+		http.StatusNotFound,
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	fetcher := newTestFetcher(server, clock)
+	fetcher.Retries = 2
+
+	if _, err := fetcher.Fetch(context.Background(), "1"); err == nil {
+		t.Fatalf("Fetch succeeded after exhausting retries")
+	}
+	if len(api.requested) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(api.requested))
+	}
+
+	if _, err := fetcher.Fetch(context.Background(), "1"); err == nil {
+		t.Fatalf("Fetch succeeded after not found")
+	}
+	if len(api.requested) != 4 {
+		t.Fatalf("not found was retried")
+	}
+}
+
+// Test the wait derived from rate limit headers
+func TestRateLimitWait(t *testing.T) {
+
+	cases := []struct {
+		limit, state string
+		expected     time.Duration
+	}{
+		{"10:60:120", "1:60:0", time.Second * 6},
+		{"10:60:120", "10:60:0", time.Second * 60},
+		{"10:60:120", "11:60:120", time.Second * 120},
+		{"45:60:60,240:240:900", "1:60:0,1:240:0", time.Second * 4 / 3},
+		{"malformed", "", 0},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		header.Set("X-Rate-Limit-Rules", "Ip")
+		header.Set("X-Rate-Limit-Ip", c.limit)
+		header.Set("X-Rate-Limit-Ip-State", c.state)
+		if wait := stash.RateLimitWait(header); wait != c.expected {
+			t.Fatalf("limit=%s state=%s waits %s, expected %s",
+				c.limit, c.state, wait, c.expected)
+		}
+	}
+
+	now := time.Unix(1000, 0).UTC()
+	status := &stash.StatusError{Header: http.Header{}}
+	status.Header.Set("Retry-After", now.Add(time.Minute).Format(http.TimeFormat))
+	if wait := status.RetryAfter(now); wait != time.Minute {
+		t.Fatalf("Retry-After date waits %s, expected 1m", wait)
+	}
+}
+
+// Test fetching rotates archives by size and resumes after the last
+// archived change
+func TestFetchRotateResume(t *testing.T) {
+
+	api := &standIn{script: []int{http.StatusTooManyRequests}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gothingArchive")
+	if err != nil {
+		t.Fatalf("failed to create TempDir, err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	fetcher := newTestFetcher(server, clock)
+
+	// Every change is larger than a single byte, so each is archived alone
+	open := func() (*Archiver, string) {
+		archiver := NewArchiver(dir, 1, 0)
+		archiver.now = clock.Now
+		lastID, err := archiver.Open()
+		if err != nil {
+			t.Fatalf("failed to open archiver, err=%s", err)
+		}
+		return archiver, lastID
+	}
+
+	archiver, lastID := open()
+	if lastID != "" {
+		t.Fatalf("empty archive resumes after id=%s", lastID)
+	}
+	if _, err := FetchTillLimit(context.Background(), "", 1, fetcher, archiver); err != nil {
+		t.Fatalf("failed FetchTillLimit, err=%s", err)
+	}
+	// Stop without closing, as a crashed scraper would
+	archiver, lastID = open()
+	if lastID != "1" {
+		t.Fatalf("resumed after id=%s, expected 1", lastID)
+	}
+	fetched, err := FetchTillLimit(context.Background(), lastID, 1, fetcher, archiver)
+	if err != nil {
+		t.Fatalf("failed FetchTillLimit, err=%s", err)
+	}
+	if err := archiver.Close(); err != nil {
+		t.Fatalf("failed to close archiver, err=%s", err)
+	}
+	if fetched == 0 {
+		t.Fatalf("nothing fetched")
+	}
+
+	archiver, lastID = open()
+	defer archiver.Close()
+	if lastID != "2" {
+		t.Fatalf("resumed after id=%s, expected 2", lastID)
+	}
+	expected := []string{"", "", "1"}
+	if !reflect.DeepEqual(api.requested, expected) {
+		t.Fatalf("requested %v, expected %v", api.requested, expected)
+	}
+
+	archives, err := archiver.Archives()
+	if err != nil {
+		t.Fatalf("failed to list archives, err=%s", err)
+	}
+	if len(archives) != 2 {
+		t.Fatalf("expected 2 archives, got %d", len(archives))
+	}
+	for i, path := range archives {
+		archive, err := stash.OpenChangeArchive(path)
+		if err != nil {
+			t.Fatalf("failed OpenChangeArchive, err=%s", err)
+		}
+		ids := archive.ChangeIDs()
+		fetched := archive.FetchedAt(0)
+		archive.Close()
+		if len(ids) != 1 || ids[0] != strconv.Itoa(i+1) {
+			t.Fatalf("archive %d holds %v", i, ids)
+		}
+		if fetched.IsZero() {
+			t.Fatalf("archive %d does not record when its change was fetched", i)
+		}
+	}
+}
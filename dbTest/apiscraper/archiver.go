@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Everlag/poeitemstore/stash"
+	"github.com/pkg/errors"
+)
+
+// archivePrefix begins the name of every rotated archive, which is
+// followed by when it was started so archives sort chronologically
+const archivePrefix = "changes-"
+
+// archiveSuffix ends the name of every rotated archive
+const archiveSuffix = ".archive"
+
+// archiveTimeFormat is when an archive was started in its name
+const archiveTimeFormat = "20060102T150405.000Z"
+
+// Archiver appends fetched changes to a change archive, starting a new
+// archive when the current one is too large or too old if rotating
+type Archiver struct {
+	// Path of the archive or, when rotating, the directory of archives
+	Path string
+	// Size in bytes after which a new archive is started, when positive
+	RotateSize int
+	// Age after which a new archive is started, when positive
+	RotateEvery time.Duration
+
+	current *stash.ChangeArchiveWriter
+	// When current was started
+	started time.Time
+
+	// Replaced when testing
+	now func() time.Time
+}
+
+// NewArchiver returns an Archiver writing to path, rotating when
+// either of size or every are positive
+func NewArchiver(path string, size int, every time.Duration) *Archiver {
+	return &Archiver{
+		Path:        path,
+		RotateSize:  size,
+		RotateEvery: every,
+		now:         time.Now,
+	}
+}
+
+// rotating returns whether new archives are started
+func (a *Archiver) rotating() bool {
+	return a.RotateSize > 0 || a.RotateEvery > 0
+}
+
+// Archives returns the paths of the rotated archives in the directory,
+// oldest first
+func (a *Archiver) Archives() ([]string, error) {
+	entries, err := ioutil.ReadDir(a.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list archives")
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, archivePrefix) ||
+			!strings.HasSuffix(name, archiveSuffix) {
+			continue
+		}
+		paths = append(paths, filepath.Join(a.Path, name))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// start begins a new rotated archive as of now
+func (a *Archiver) start() error {
+	now := a.now().UTC()
+	name := archivePrefix + now.Format(archiveTimeFormat) + archiveSuffix
+	// Appending ensures an archive started within the same millisecond
+	// is continued rather than truncated
+	w, err := stash.AppendChangeArchive(filepath.Join(a.Path, name))
+	if err != nil {
+		return errors.Wrap(err, "failed to start archive")
+	}
+	a.current, a.started = w, now
+	return nil
+}
+
+// Open opens the archive changes are added to, continuing the latest
+// archive when one exists. Returns the ID of the last change archived,
+// which is the NextChangeID to fetch, empty if nothing was archived.
+func (a *Archiver) Open() (string, error) {
+	if !a.rotating() {
+		w, err := stash.AppendChangeArchive(a.Path)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to open archive")
+		}
+		a.current, a.started = w, a.now()
+		return w.LastChangeID(), nil
+	}
+
+	if err := os.MkdirAll(a.Path, 0777); err != nil {
+		return "", errors.Wrap(err, "failed to create archive directory")
+	}
+	archives, err := a.Archives()
+	if err != nil {
+		return "", err
+	}
+	if len(archives) == 0 {
+		return "", a.start()
+	}
+
+	latest := archives[len(archives)-1]
+	w, err := stash.AppendChangeArchive(latest)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open archive %s", latest)
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(latest),
+		archivePrefix), archiveSuffix)
+	started, err := time.Parse(archiveTimeFormat, stamp)
+	if err != nil {
+		started = a.now()
+	}
+	a.current, a.started = w, started
+	return w.LastChangeID(), nil
+}
+
+// AddResponse appends another CompressedResponse fetched at the provided
+// time, first starting a new archive if the current one is due to be
+// rotated
+func (a *Archiver) AddResponse(changeID string,
+	comp stash.CompressedResponse, fetched time.Time) error {
+
+	if a.current == nil {
+		return errors.New("archive not open")
+	}
+
+	due := a.RotateSize > 0 && a.current.Size >= a.RotateSize ||
+		a.RotateEvery > 0 && a.now().Sub(a.started) >= a.RotateEvery
+	if a.rotating() && a.current.Len() > 0 && due {
+		if err := a.current.Close(); err != nil {
+			return errors.Wrap(err, "failed to close rotated archive")
+		}
+		a.current = nil
+		if err := a.start(); err != nil {
+			return err
+		}
+	}
+
+	return a.current.AddFetchedResponse(changeID, comp, fetched)
+}
+
+// Close closes the current archive, writing its index
+func (a *Archiver) Close() error {
+	if a.current == nil {
+		return nil
+	}
+	err := a.current.Close()
+	a.current = nil
+	return err
+}
@@ -8,17 +8,34 @@ import (
 
 	"github.com/Everlag/poeitemstore/cmd"
 	"github.com/Everlag/poeitemstore/db"
+	"github.com/boltdb/bolt"
 )
 
 func main() {
 
-	db, err := db.Boot("")
+	// The database being restored may be too damaged or outdated
+	// to open, so restore runs without it
+	if cmd.Restoring() {
+		run(nil)
+		return
+	}
+
+	boot := db.Boot
+	if cmd.Migrating() {
+		boot = db.BootForMigration
+	}
+	db, err := boot("")
 	if err != nil {
 		fmt.Printf("failed to open db, err=%s\n", err)
 		os.Exit(-1)
 	}
 	defer db.Close()
 
+	run(db)
+}
+
+// run handles the command and reports how long it took
+func run(db *bolt.DB) {
 	start := time.Now()
 	cmd.HandleCommands(db)
 
@@ -0,0 +1,577 @@
+package stash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tinylib/msgp/msgp"
+)
+
+// A change archive is an append-only file of changes. It begins with
+// archiveMagic followed by a frame per change, written as each change is
+// added. Closing an archive appends a frame holding the index of every
+// change and a footer locating that index.
+//
+// Every frame is a kind byte, the big endian uint32 length and CRC32 of its
+// payload, then the payload. A change payload is the msgp encoded change
+// ID followed by the snappy compressed msgp Response as CompressedResponse
+// holds it and, when recorded, the time the change was fetched in unix
+// nanoseconds. An index payload is a msgp array of ID, offset, size and
+// fetch time per change, the fetch time being absent from archives
+// written before it was recorded and zero when not recorded. The footer
+// is the big endian uint64 offset of the index frame followed by
+// archiveFooterMagic.
+//
+// An archive which was never closed, or whose tail was cut short, has no
+// usable index and is recovered by reading its frames from the start up
+// to the first incomplete or corrupt frame.
+const (
+	archiveMagic       = "POECHGS1"
+	archiveFooterMagic = "POECHGIX"
+
+	archiveFrameHeaderSize = 9
+	archiveFooterSize      = 16
+
+	archiveChangeFrame byte = 1
+	archiveIndexFrame  byte = 2
+)
+
+// ChangeReader provides the changes of a ChangeSet or change archive in
+// the order they were added
+type ChangeReader interface {
+	// ChangeIDs returns the ID of every change by position
+	ChangeIDs() []string
+	// ChangeAt returns the change at position i
+	ChangeAt(i int) (*CompressedResponse, error)
+	// IndexOf returns the position of a change.
+	// Follows the _, ok pattern ala maps if not found
+	IndexOf(changeID string) (int, bool)
+	// FetchedAt returns when the change at position i was fetched,
+	// the zero time if that was not recorded
+	FetchedAt(i int) time.Time
+	// Close releases anything held open to read changes
+	Close() error
+}
+
+// archiveEntry locates a single change inside an archive
+type archiveEntry struct {
+	ChangeID string
+	// Offset of the change's frame
+	Offset int64
+	// Size of the compressed change
+	Size int
+	// When the change was fetched, zero if not recorded
+	Fetched time.Time
+}
+
+// appendArchiveFrame appends a complete frame holding payload to dst
+func appendArchiveFrame(dst []byte, kind byte, payload []byte) []byte {
+	var header [archiveFrameHeaderSize]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[5:9], crc32.ChecksumIEEE(payload))
+	dst = append(dst, header[:]...)
+	return append(dst, payload...)
+}
+
+// readArchiveFrame reads the frame at offset of an archive of the
+// provided size, returning its kind and payload
+func readArchiveFrame(r io.ReaderAt, offset, size int64) (byte, []byte, error) {
+	var header [archiveFrameHeaderSize]byte
+	if _, err := r.ReadAt(header[:], offset); err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to read frame header at %d", offset)
+	}
+	length := int64(binary.BigEndian.Uint32(header[1:5]))
+	if offset+archiveFrameHeaderSize+length > size {
+		return 0, nil, errors.Errorf("frame at %d extends past the archive", offset)
+	}
+	payload := make([]byte, length)
+	_, err := r.ReadAt(payload, offset+archiveFrameHeaderSize)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to read frame at %d", offset)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[5:9]) {
+		return 0, nil, errors.Errorf("frame at %d fails its checksum", offset)
+	}
+	return header[0], payload, nil
+}
+
+// fetchedNanos returns a fetch time as stored in an archive
+func fetchedNanos(fetched time.Time) int64 {
+	if fetched.IsZero() {
+		return 0
+	}
+	return fetched.UnixNano()
+}
+
+// fetchedTime returns a fetch time stored in an archive
+func fetchedTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos).UTC()
+}
+
+// encodeArchiveChange returns the payload of a change frame
+func encodeArchiveChange(changeID string, comp CompressedResponse,
+	fetched time.Time) []byte {
+
+	payload := msgp.AppendString(nil, changeID)
+	payload = msgp.AppendBytes(payload, comp.Content)
+	if fetched.IsZero() {
+		return payload
+	}
+	return msgp.AppendInt64(payload, fetchedNanos(fetched))
+}
+
+// decodeArchiveChange reads the payload of a change frame
+func decodeArchiveChange(payload []byte) (string, *CompressedResponse,
+	time.Time, error) {
+
+	changeID, rest, err := msgp.ReadStringBytes(payload)
+	if err != nil {
+		return "", nil, time.Time{}, errors.Wrap(err, "failed to decode change ID")
+	}
+	content, rest, err := msgp.ReadBytesBytes(rest, nil)
+	if err != nil {
+		return "", nil, time.Time{}, errors.Wrap(err, "failed to decode change")
+	}
+	var nanos int64
+	if len(rest) > 0 {
+		nanos, _, err = msgp.ReadInt64Bytes(rest)
+		if err != nil {
+			return "", nil, time.Time{},
+				errors.Wrap(err, "failed to decode fetch time")
+		}
+	}
+	return changeID, &CompressedResponse{
+		Content: content,
+		Size:    len(content),
+	}, fetchedTime(nanos), nil
+}
+
+// encodeArchiveIndex returns the payload of an index frame
+func encodeArchiveIndex(entries []archiveEntry) []byte {
+	payload := msgp.AppendArrayHeader(nil, uint32(len(entries)))
+	for _, entry := range entries {
+		payload = msgp.AppendArrayHeader(payload, 4)
+		payload = msgp.AppendString(payload, entry.ChangeID)
+		payload = msgp.AppendInt64(payload, entry.Offset)
+		payload = msgp.AppendInt(payload, entry.Size)
+		payload = msgp.AppendInt64(payload, fetchedNanos(entry.Fetched))
+	}
+	return payload
+}
+
+// decodeArchiveIndex reads the payload of an index frame
+func decodeArchiveIndex(payload []byte) ([]archiveEntry, error) {
+	count, payload, err := msgp.ReadArrayHeaderBytes(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode index length")
+	}
+	entries := make([]archiveEntry, count)
+	for i := range entries {
+		var fields uint32
+		fields, payload, err = msgp.ReadArrayHeaderBytes(payload)
+		if err != nil || fields != 3 && fields != 4 {
+			return nil, errors.Errorf("malformed index entry %d", i)
+		}
+		entry := &entries[i]
+		entry.ChangeID, payload, err = msgp.ReadStringBytes(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode index entry %d", i)
+		}
+		entry.Offset, payload, err = msgp.ReadInt64Bytes(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode index entry %d", i)
+		}
+		entry.Size, payload, err = msgp.ReadIntBytes(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode index entry %d", i)
+		}
+		if fields == 3 {
+			continue
+		}
+		var nanos int64
+		nanos, payload, err = msgp.ReadInt64Bytes(payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode index entry %d", i)
+		}
+		entry.Fetched = fetchedTime(nanos)
+	}
+	return entries, nil
+}
+
+// readArchiveIndex returns the entries of the index located by the footer
+// of an archive of the provided size and the offset the index begins at.
+// Returns a zero offset when the archive has no usable index.
+func readArchiveIndex(r io.ReaderAt, size int64) ([]archiveEntry, int64) {
+	if size < int64(len(archiveMagic))+archiveFooterSize {
+		return nil, 0
+	}
+	var footer [archiveFooterSize]byte
+	if _, err := r.ReadAt(footer[:], size-archiveFooterSize); err != nil {
+		return nil, 0
+	}
+	if string(footer[8:]) != archiveFooterMagic {
+		return nil, 0
+	}
+
+	offset := int64(binary.BigEndian.Uint64(footer[:8]))
+	if offset < int64(len(archiveMagic)) || offset >= size-archiveFooterSize {
+		return nil, 0
+	}
+	kind, payload, err := readArchiveFrame(r, offset, size)
+	if err != nil || kind != archiveIndexFrame {
+		return nil, 0
+	}
+	entries, err := decodeArchiveIndex(payload)
+	if err != nil {
+		return nil, 0
+	}
+	return entries, offset
+}
+
+// scanArchive reads every complete change frame from the start of an
+// archive of the provided size, returning their entries and the offset
+// following the last of them.
+func scanArchive(r io.ReaderAt, size int64) ([]archiveEntry, int64) {
+	var entries []archiveEntry
+	offset := int64(len(archiveMagic))
+	for offset < size {
+		kind, payload, err := readArchiveFrame(r, offset, size)
+		if err != nil || kind != archiveChangeFrame {
+			break
+		}
+		changeID, comp, fetched, err := decodeArchiveChange(payload)
+		if err != nil {
+			break
+		}
+		entries = append(entries, archiveEntry{
+			ChangeID: changeID,
+			Offset:   offset,
+			Size:     comp.Size,
+			Fetched:  fetched,
+		})
+		offset += archiveFrameHeaderSize + int64(len(payload))
+	}
+	return entries, offset
+}
+
+// readArchive returns the entries of the archive in f and the offset
+// following its last change, recovering them by scanning when the
+// archive has no usable index.
+func readArchive(f *os.File, size int64) (entries []archiveEntry, end int64,
+	recovered bool, err error) {
+
+	magic := make([]byte, len(archiveMagic))
+	if _, err := f.ReadAt(magic, 0); err != nil || string(magic) != archiveMagic {
+		return nil, 0, false, errors.New("not a change archive")
+	}
+
+	entries, end = readArchiveIndex(f, size)
+	if end > 0 {
+		return entries, end, false, nil
+	}
+	entries, end = scanArchive(f, size)
+	return entries, end, true, nil
+}
+
+// archiveSize returns the size of the archive in f
+func archiveSize(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to stat archive")
+	}
+	return info.Size(), nil
+}
+
+// IsChangeArchive returns whether the file at path is a change archive
+// rather than a ChangeSet saved whole
+func IsChangeArchive(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to read file")
+	}
+	return bytes.Equal(magic, []byte(archiveMagic)), nil
+}
+
+// ChangeArchive reads the changes of a change archive as they are
+// requested rather than holding them in memory
+type ChangeArchive struct {
+	f       *os.File
+	size    int64
+	entries []archiveEntry
+	// Position in entries of each ID, the latest if repeated
+	positions map[string]int
+	// Whether the archive had no usable index, so was read frame by frame.
+	// Any incomplete or corrupt tail is ignored.
+	Recovered bool
+	// Total size of every compressed change
+	Size int
+}
+
+// OpenChangeArchive opens the change archive at the provided path,
+// reading only its index
+func OpenChangeArchive(path string) (*ChangeArchive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+
+	size, err := archiveSize(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	entries, _, recovered, err := readArchive(f, size)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+
+	archive := &ChangeArchive{
+		f:         f,
+		size:      size,
+		entries:   entries,
+		positions: make(map[string]int),
+		Recovered: recovered,
+	}
+	for i, entry := range entries {
+		archive.positions[entry.ChangeID] = i
+		archive.Size += entry.Size
+	}
+	return archive, nil
+}
+
+// Len returns the number of changes in the archive
+func (archive *ChangeArchive) Len() int {
+	return len(archive.entries)
+}
+
+// ChangeIDs returns the ID of every change by position
+func (archive *ChangeArchive) ChangeIDs() []string {
+	ids := make([]string, len(archive.entries))
+	for i, entry := range archive.entries {
+		ids[i] = entry.ChangeID
+	}
+	return ids
+}
+
+// IndexOf returns the position of a change.
+// Follows the _, ok pattern ala maps if not found
+func (archive *ChangeArchive) IndexOf(changeID string) (int, bool) {
+	i, ok := archive.positions[changeID]
+	return i, ok
+}
+
+// ChangeAt reads the change at position i
+func (archive *ChangeArchive) ChangeAt(i int) (*CompressedResponse, error) {
+	if i < 0 || i >= len(archive.entries) {
+		return nil, errors.Errorf("change %d out of range, %d changes",
+			i, len(archive.entries))
+	}
+	entry := archive.entries[i]
+
+	kind, payload, err := readArchiveFrame(archive.f, entry.Offset, archive.size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read change %s", entry.ChangeID)
+	}
+	if kind != archiveChangeFrame {
+		return nil, errors.Errorf("frame of change %s is not a change",
+			entry.ChangeID)
+	}
+	changeID, comp, _, err := decodeArchiveChange(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read change %s", entry.ChangeID)
+	}
+	if changeID != entry.ChangeID {
+		return nil, errors.Errorf("index has change %s where %s is stored",
+			entry.ChangeID, changeID)
+	}
+	return comp, nil
+}
+
+// FetchedAt returns when the change at position i was fetched, the zero
+// time if that was not recorded
+func (archive *ChangeArchive) FetchedAt(i int) time.Time {
+	if i < 0 || i >= len(archive.entries) {
+		return time.Time{}
+	}
+	return archive.entries[i].Fetched
+}
+
+// GetCompByChangeID reads the change with the provided changeID
+func (archive *ChangeArchive) GetCompByChangeID(changeID string) (*CompressedResponse,
+	error) {
+
+	i, ok := archive.positions[changeID]
+	if !ok {
+		return nil, errors.Errorf("change %s not in archive", changeID)
+	}
+	return archive.ChangeAt(i)
+}
+
+// ChangeSet reads every change into a ChangeSet. A ChangeSet does not
+// hold when each change was fetched, so those are lost.
+func (archive *ChangeArchive) ChangeSet() (*ChangeSet, error) {
+	set := NewChangeSet()
+	for i, entry := range archive.entries {
+		comp, err := archive.ChangeAt(i)
+		if err != nil {
+			return nil, err
+		}
+		set.AddResponse(entry.ChangeID, *comp)
+	}
+	return &set, nil
+}
+
+// Close closes the underlying file
+func (archive *ChangeArchive) Close() error {
+	return archive.f.Close()
+}
+
+// ChangeArchiveWriter appends changes to a change archive, writing each
+// as it is added so nothing is lost if the writer never closes
+type ChangeArchiveWriter struct {
+	f       *os.File
+	entries []archiveEntry
+	// Offset the next change is written at
+	offset int64
+	// Total size of every compressed change
+	Size int
+}
+
+// CreateChangeArchive creates an empty change archive at the provided
+// path, truncating anything already there
+func CreateChangeArchive(path string) (*ChangeArchiveWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	if _, err := f.Write([]byte(archiveMagic)); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to write archive header")
+	}
+	return &ChangeArchiveWriter{f: f, offset: int64(len(archiveMagic))}, nil
+}
+
+// AppendChangeArchive opens the change archive at the provided path to
+// add further changes, creating it if missing. The index of an archive
+// which was closed is dropped until it is closed again and anything
+// following the last complete change of one which was not is truncated.
+func AppendChangeArchive(path string) (*ChangeArchiveWriter, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return CreateChangeArchive(path)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open file")
+	}
+	size, err := archiveSize(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	entries, end, _, err := readArchive(f, size)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to truncate archive")
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to seek archive")
+	}
+
+	w := &ChangeArchiveWriter{f: f, entries: entries, offset: end}
+	for _, entry := range entries {
+		w.Size += entry.Size
+	}
+	return w, nil
+}
+
+// Len returns the number of changes in the archive
+func (w *ChangeArchiveWriter) Len() int {
+	return len(w.entries)
+}
+
+// LastChangeID returns the ID of the last change added, empty if the
+// archive holds none
+func (w *ChangeArchiveWriter) LastChangeID() string {
+	if len(w.entries) == 0 {
+		return ""
+	}
+	return w.entries[len(w.entries)-1].ChangeID
+}
+
+// AddResponse appends another CompressedResponse and syncs it to disk
+// without recording when it was fetched
+func (w *ChangeArchiveWriter) AddResponse(changeID string,
+	comp CompressedResponse) error {
+
+	return w.AddFetchedResponse(changeID, comp, time.Time{})
+}
+
+// AddFetchedResponse appends another CompressedResponse fetched at the
+// provided time and syncs it to disk
+func (w *ChangeArchiveWriter) AddFetchedResponse(changeID string,
+	comp CompressedResponse, fetched time.Time) error {
+
+	frame := appendArchiveFrame(nil, archiveChangeFrame,
+		encodeArchiveChange(changeID, comp, fetched))
+	if _, err := w.f.Write(frame); err != nil {
+		return errors.Wrapf(err, "failed to write change %s", changeID)
+	}
+	if err := w.f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync change %s", changeID)
+	}
+
+	w.entries = append(w.entries, archiveEntry{
+		ChangeID: changeID,
+		Offset:   w.offset,
+		Size:     len(comp.Content),
+		Fetched:  fetched,
+	})
+	w.offset += int64(len(frame))
+	w.Size += len(comp.Content)
+	return nil
+}
+
+// Close writes the index and footer then closes the underlying file
+func (w *ChangeArchiveWriter) Close() error {
+	tail := appendArchiveFrame(nil, archiveIndexFrame,
+		encodeArchiveIndex(w.entries))
+	var footer [archiveFooterSize]byte
+	binary.BigEndian.PutUint64(footer[:8], uint64(w.offset))
+	copy(footer[8:], archiveFooterMagic)
+	tail = append(tail, footer[:]...)
+
+	if _, err := w.f.Write(tail); err != nil {
+		w.f.Close()
+		return errors.Wrap(err, "failed to write archive index")
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return errors.Wrap(err, "failed to sync archive index")
+	}
+	return w.f.Close()
+}
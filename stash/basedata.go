@@ -0,0 +1,315 @@
+package stash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BaseSet is a complete set of bases alongside the flavor and root
+// each resolves to.
+//
+// The bases bundled with the package are available from DefaultBases,
+// newer bases can be loaded at runtime with LoadBases and used for every
+// typeLine resolved with SetBases.
+type BaseSet struct {
+	bases    map[string]baseInfo
+	resolver baseResolver
+	// Bases whose flavor and root were guessed from their name
+	guessed map[string]bool
+	hash    string
+}
+
+// newBaseSet returns a BaseSet of the bases, guessed may be nil
+func newBaseSet(bases map[string]baseInfo, guessed map[string]bool) *BaseSet {
+	set := &BaseSet{
+		bases:    bases,
+		resolver: newBaseResolver(bases),
+		guessed:  guessed,
+	}
+	raw, _ := set.MarshalJSON()
+	sum := sha256.Sum256(raw)
+	set.hash = hex.EncodeToString(sum[:8])
+	return set
+}
+
+// lookup returns the bases as a baseLookup with every root, flavor and
+// base sorted so equal sets always serialize the same way
+func (set *BaseSet) lookup() baseLookup {
+	flavors := make(map[string]map[string][]string)
+	for base, info := range set.bases {
+		if flavors[info.root] == nil {
+			flavors[info.root] = make(map[string][]string)
+		}
+		flavors[info.root][info.flavor] = append(flavors[info.root][info.flavor], base)
+	}
+
+	bl := make(baseLookup, 0, len(flavors))
+	for rootName, rootFlavors := range flavors {
+		r := root{Root: rootName}
+		for flavorName, bases := range rootFlavors {
+			sort.Strings(bases)
+			r.Flavors = append(r.Flavors, flavor{Flavor: flavorName, Bases: bases})
+		}
+		sort.Slice(r.Flavors, func(i, j int) bool {
+			return r.Flavors[i].Flavor < r.Flavors[j].Flavor
+		})
+		bl = append(bl, r)
+	}
+	sort.Slice(bl, func(i, j int) bool {
+		return bl[i].Root < bl[j].Root
+	})
+	return bl
+}
+
+// MarshalJSON returns the set in the format of the bundled baseInfo.json,
+// which ParseBases reads back
+func (set *BaseSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(set.lookup())
+}
+
+// Hash identifies the bases of the set, equal sets share a Hash
+func (set *BaseSet) Hash() string {
+	return set.hash
+}
+
+// Len returns the number of bases in the set
+func (set *BaseSet) Len() int {
+	return len(set.bases)
+}
+
+// MatchTypeline returns a flavor and root for a discovered base
+// or ok is false, in which case they are UnknownFlavor and UnknownRoot.
+func (set *BaseSet) MatchTypeline(typeline string) (flavor, root string, ok bool) {
+	return set.resolver.typeLineToRootAndFlavor(typeline)
+}
+
+// Merge returns a set of the bases of both sets, preferring those of
+// over. Bases whose flavor over could only guess keep the flavor and
+// root of the set.
+func (set *BaseSet) Merge(over *BaseSet) *BaseSet {
+	bases := make(map[string]baseInfo, len(set.bases))
+	guessed := make(map[string]bool)
+	for base, info := range set.bases {
+		bases[base] = info
+		if set.guessed[base] {
+			guessed[base] = true
+		}
+	}
+	for base, info := range over.bases {
+		if _, ok := bases[base]; ok && over.guessed[base] {
+			continue
+		}
+		bases[base] = info
+		if over.guessed[base] {
+			guessed[base] = true
+		} else {
+			delete(guessed, base)
+		}
+	}
+	return newBaseSet(bases, guessed)
+}
+
+// gggItemData is the item data dump GGG provides for the trade site at
+// https://www.pathofexile.com/api/trade/data/items
+type gggItemData struct {
+	Result []struct {
+		Label   string `json:"label"`
+		Entries []struct {
+			Type string `json:"type"`
+		} `json:"entries"`
+	} `json:"result"`
+}
+
+// gggLabelRule resolves the bases of a GGG item data label
+type gggLabelRule struct {
+	// Flavor and root of bases matching none of suffixes
+	flavor, root string
+	// Whether flavor is only a guess for bases matching none of suffixes
+	guess bool
+	// Suffixes of the bases of each flavor and root, tried in order
+	suffixes []gggSuffix
+}
+
+// gggSuffix assigns a flavor and root to bases with any of suffixes
+type gggSuffix struct {
+	flavor, root string
+	suffixes     []string
+}
+
+// gggLabelRules resolve each GGG item data label we know of. Labels
+// which are not present resolve to their label as their root and flavor.
+//
+// The dump does not break equipment down as far as we do, so flavors
+// are guessed from the common suffixes of their bases.
+var gggLabelRules = map[string]gggLabelRule{
+	"Accessories": {"Jewelry", "Jewelry", true, []gggSuffix{
+		{"Ring", "Jewelry", []string{" Ring"}},
+		{"Amulet", "Jewelry", []string{" Amulet", " Talisman"}},
+		{"Belt", "Armour", []string{" Belt", " Sash", " Vise"}},
+	}},
+	"Armour": {"Armour", "Armour", true, []gggSuffix{
+		{"Quiver", "Armour", []string{" Quiver"}},
+		{"Shield", "Armour", []string{" Shield", " Buckler"}},
+		{"Boots", "Armour", []string{" Boots", " Greaves", " Slippers", " Shoes"}},
+		{"Gloves", "Armour", []string{" Gloves", " Gauntlets", " Mitts"}},
+		{"Helmet", "Armour", []string{" Helmet", " Helm", " Hood", " Cap",
+			" Mask", " Circlet", " Crown", " Sallet", " Tricorne"}},
+	}},
+	"Weapons": {"Weapon", "Weapon", true, []gggSuffix{
+		{"Bow", "Weapon", []string{" Bow"}},
+		{"Claw", "Weapon", []string{" Claw"}},
+		{"Dagger", "Weapon", []string{" Dagger", " Knife"}},
+		{"Wand", "Weapon", []string{" Wand"}},
+		{"Sceptre", "Weapon", []string{" Sceptre"}},
+		{"Staff", "Weapon", []string{" Staff", " Quarterstaff"}},
+	}},
+	"Cards":        {"Card", "Card", false, nil},
+	"Currency":     {"Currency", "Currency", false, nil},
+	"Flasks":       {"Flask", "Flask", false, nil},
+	"Gems":         {"Gem", "Gem", false, nil},
+	"Jewels":       {"Jewel", "Jewel", false, nil},
+	"Maps":         {"Map", "Map", false, nil},
+	"Leaguestones": {"Leaguestone", "Leaguestone", false, nil},
+	"Prophecies":   {"Prophecy", "Prophecy", false, nil},
+}
+
+// resolve returns the flavor and root of a base with the label, and
+// whether they are only a guess
+func (rule gggLabelRule) resolve(base string) (baseInfo, bool) {
+	for _, suffix := range rule.suffixes {
+		for _, s := range suffix.suffixes {
+			if strings.HasSuffix(base, s) {
+				return baseInfo{suffix.flavor, suffix.root}, false
+			}
+		}
+	}
+	return baseInfo{rule.flavor, rule.root}, rule.guess
+}
+
+// parseGGGItemData returns the bases of a GGG item data dump
+func parseGGGItemData(raw []byte) (*BaseSet, error) {
+	var data gggItemData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, errors.Wrap(err, "failed to decode item data")
+	}
+
+	bases := make(map[string]baseInfo)
+	guessed := make(map[string]bool)
+	for _, label := range data.Result {
+		rule, ok := gggLabelRules[label.Label]
+		if !ok {
+			rule = gggLabelRule{flavor: label.Label, root: label.Label}
+		}
+		// Uniques repeat the type of their base
+		for _, entry := range label.Entries {
+			if entry.Type == "" {
+				continue
+			}
+			info, guess := rule.resolve(entry.Type)
+			bases[entry.Type] = info
+			if guess {
+				guessed[entry.Type] = true
+			}
+		}
+	}
+	if len(bases) == 0 {
+		return nil, errors.New("item data contains no bases")
+	}
+	return newBaseSet(bases, guessed), nil
+}
+
+// ParseBases returns the bases of either the format of the bundled
+// baseInfo.json or of GGG's item data dump
+func ParseBases(raw []byte) (*BaseSet, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '{' {
+		return parseGGGItemData(raw)
+	}
+
+	var bl baseLookup
+	if err := json.Unmarshal(raw, &bl); err != nil {
+		return nil, errors.Wrap(err, "failed to decode bases")
+	}
+	bases := bl.toBases()
+	if len(bases) == 0 {
+		return nil, errors.New("bases contain no bases")
+	}
+	return newBaseSet(bases, nil), nil
+}
+
+// LoadBases reads the bases at path, which is either a single file
+// ParseBases reads or a directory of them. Every .json file of a
+// directory is merged in order of name, so later files take precedence.
+func LoadBases(path string) (*BaseSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat bases")
+	}
+
+	paths := []string{path}
+	if info.IsDir() {
+		paths, err = filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list bases")
+		}
+		if len(paths) == 0 {
+			return nil, errors.Errorf("no .json files in %s", path)
+		}
+		sort.Strings(paths)
+	}
+
+	var set *BaseSet
+	for _, p := range paths {
+		raw, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", p)
+		}
+		loaded, err := ParseBases(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", p)
+		}
+		if set == nil {
+			set = loaded
+		} else {
+			set = set.Merge(loaded)
+		}
+	}
+	return set, nil
+}
+
+// defaultBases are those bundled with the package
+var defaultBases *BaseSet
+
+// currentBases are used by MatchTypeline, guarded by basesLock
+var currentBases *BaseSet
+var basesLock sync.RWMutex
+
+// DefaultBases returns the bases bundled with the package
+func DefaultBases() *BaseSet {
+	return defaultBases
+}
+
+// CurrentBases returns the bases MatchTypeline resolves with
+func CurrentBases() *BaseSet {
+	basesLock.RLock()
+	defer basesLock.RUnlock()
+	return currentBases
+}
+
+// SetBases sets the bases MatchTypeline resolves with, and so those
+// every item cleaned from then on is classified by
+func SetBases(set *BaseSet) {
+	basesLock.Lock()
+	defer basesLock.Unlock()
+	currentBases = set
+}
@@ -47,95 +47,236 @@ type root struct {
 
 type baseLookup []root
 
-// toInverter converts a baseLookup to a baseInverter
-func (bl baseLookup) toInverter() baseInverter {
+func getBaseLookup() (*baseLookup, error) {
+	raw, err := Asset("assets/baseInfo.json")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch baseInfo.json")
+	}
+
+	var bl baseLookup
+	err = json.Unmarshal(raw, &bl)
+	return &bl, err
+}
+
+// UnknownRoot and UnknownFlavor are given to items whose typeLine
+// matches no known base
+const (
+	UnknownRoot   = "Unknown"
+	UnknownFlavor = "Unknown"
+)
+
+// affixRoots are the roots whose items can be magic, so their
+// typeLines can carry a prefix and suffix around the base. Everything
+// else, gems and currency and such, only ever match their base exactly.
+var affixRoots = map[string]bool{
+	"Armour":      true,
+	"Weapon":      true,
+	"Jewelry":     true,
+	"Jewel":       true,
+	"Flask":       true,
+	"Map":         true,
+	"Leaguestone": true,
+}
+
+// baseInfo is what a single base resolves to
+type baseInfo struct {
+	flavor, root string
+}
 
-	basesToFlavors := make(map[string]string)
-	flavorsToRoots := make(map[string]string)
+// baseTrie is a trie over the words of the bases of affixRoots
+type baseTrie struct {
+	children map[string]*baseTrie
+	// Base ending at this node, empty when none does
+	base string
+}
+
+// insert adds the base to the trie
+func (t *baseTrie) insert(base string) {
+	node := t
+	for _, word := range strings.Fields(base) {
+		child, ok := node.children[word]
+		if !ok {
+			child = &baseTrie{children: make(map[string]*baseTrie)}
+			node.children[word] = child
+		}
+		node = child
+	}
+	node.base = base
+}
+
+// longestMatch returns the longest base made of consecutive words.
+// When bases of equal length match, the last is taken as prefixes
+// precede the base.
+func (t *baseTrie) longestMatch(words []string) (string, bool) {
+	var match string
+	for start := range words {
+		node := t
+		for _, word := range words[start:] {
+			node = node.children[word]
+			if node == nil {
+				break
+			}
+			if node.base != "" && len(node.base) >= len(match) {
+				match = node.base
+			}
+		}
+	}
+	return match, match != ""
+}
+
+// typeLineRule resolves typeLines of a known shape whose base is not
+// in our list, usually as it was introduced after the list was made
+type typeLineRule struct {
+	flavor, root string
+	matches      func(typeLine string) bool
+}
 
+// hasSuffix returns a rule matcher for any of the suffixes
+func hasSuffix(suffixes ...string) func(string) bool {
+	return func(typeLine string) bool {
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(typeLine, suffix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// typeLineRules are tried in order once a typeLine matches no base
+var typeLineRules = []typeLineRule{
+	{"Map", "Map", hasSuffix(" Map")},
+	{"Flask", "Flask", hasSuffix(" Flask")},
+	{"Gem", "Gem", hasSuffix(" Support")},
+	{"Leaguestone", "Leaguestone", hasSuffix(" Leaguestone")},
+	{"Currency", "Currency", func(typeLine string) bool {
+		return strings.HasPrefix(typeLine, "Orb of ") ||
+			strings.Contains(typeLine, "Essence of ") ||
+			hasSuffix(" Orb", " Shard", " Fossil", " Resonator")(typeLine)
+	}},
+}
+
+// baseResolver resolves the typeLine of an item to its flavor and root
+type baseResolver struct {
+	bases map[string]baseInfo
+	trie  *baseTrie
+}
+
+// toBases returns what each base in the baseLookup resolves to
+func (bl baseLookup) toBases() map[string]baseInfo {
+	bases := make(map[string]baseInfo)
+	// Bases listed more than once resolve to their last listing
 	for _, root := range bl {
 		for _, flavor := range root.Flavors {
-			flavorsToRoots[flavor.Flavor] = root.Root
-
 			for _, base := range flavor.Bases {
-				basesToFlavors[base] = flavor.Flavor
+				bases[base] = baseInfo{flavor.Flavor, root.Root}
 			}
 		}
 	}
+	return bases
+}
 
-	return baseInverter{
-		flavorsToRoots: flavorsToRoots,
-		basesToFlavors: basesToFlavors,
+// newBaseResolver returns a baseResolver for the bases
+func newBaseResolver(bases map[string]baseInfo) baseResolver {
+	resolver := baseResolver{
+		bases: bases,
+		trie:  &baseTrie{children: make(map[string]*baseTrie)},
 	}
-
+	for base, info := range bases {
+		if affixRoots[info.root] {
+			resolver.trie.insert(base)
+		}
+	}
+	return resolver
 }
 
-func getBaseLookup() (*baseLookup, error) {
-	raw, err := Asset("assets/baseInfo.json")
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to fetch baseInfo.json")
+// stripTypeLine removes everything GGG places on a typeLine which is not
+// part of the base or its affixes, such as the <<set:MS>> markup
+// preceding some and the Superior of items with quality
+func stripTypeLine(typeLine string) string {
+	for strings.HasPrefix(typeLine, "<<") {
+		end := strings.Index(typeLine, ">>")
+		if end < 0 {
+			break
+		}
+		typeLine = typeLine[end+len(">>"):]
 	}
+	typeLine = strings.TrimSpace(typeLine)
+	return strings.TrimPrefix(typeLine, "Superior ")
+}
 
-	var bl baseLookup
-	err = json.Unmarshal(raw, &bl)
-	return &bl, err
+// withoutSuffix returns typeLine before the suffix of a magic item, or
+// typeLine itself when it has none
+func withoutSuffix(typeLine string) string {
+	if i := strings.LastIndex(typeLine, " of "); i >= 0 {
+		return typeLine[:i]
+	}
+	return typeLine
 }
 
-type baseInverter struct {
-	basesToFlavors map[string]string
-	flavorsToRoots map[string]string
+// TypeLineBase returns the part of a typeLine which can name its base,
+// stripped as MatchTypeline strips it and without the suffix of a magic
+// item, so items sharing a base share it even when matching no base.
+func TypeLineBase(typeLine string) string {
+	return withoutSuffix(stripTypeLine(typeLine))
 }
 
 // typeLineToRootAndFlavor takes a given TypeLine on an item
 // and converts it to a root and flavor.
 //
-// This even handles the super mangled typeLines that GGG sometimes includes...
-func (inv baseInverter) typeLineToRootAndFlavor(typeLine string) (flavor,
+// This even handles the super mangled typeLines that GGG sometimes
+// includes, and the prefix and suffix of magic items. TypeLines matching
+// no base resolve to UnknownFlavor and UnknownRoot with ok false.
+func (res baseResolver) typeLineToRootAndFlavor(typeLine string) (flavor,
 	root string, ok bool) {
 
+	typeLine = stripTypeLine(typeLine)
+
 	// First we try a direct match
-	flavor, ok = inv.basesToFlavors[typeLine]
-	if ok {
-		// Resolve the root and return
-		root = inv.flavorsToRoots[flavor]
-		return
+	if info, ok := res.bases[typeLine]; ok {
+		return info.flavor, info.root, true
 	}
 
-	// If direct match failed, we need an exhaustive substring search
-	// This hurts performance but usually is fairly rare :|
-	for propBase, propFlavor := range inv.basesToFlavors {
-		if strings.Contains(typeLine, propBase) {
-			flavor = propFlavor
-			break
-		}
+	// Magic items are named 'prefix base of suffix', so look before the
+	// suffix first as it can contain words of other bases
+	var candidates []string
+	if base := withoutSuffix(typeLine); base != typeLine {
+		candidates = append(candidates, base)
 	}
-	if len(flavor) == 0 {
-		ok = false
-		return
+	candidates = append(candidates, typeLine)
+	for _, candidate := range candidates {
+		if base, ok := res.trie.longestMatch(strings.Fields(candidate)); ok {
+			info := res.bases[base]
+			return info.flavor, info.root, true
+		}
 	}
 
-	// Resolve a correct flavor to base easily
-	root = inv.flavorsToRoots[flavor]
-	ok = true
-	return
+	for _, rule := range typeLineRules {
+		for _, candidate := range candidates {
+			if rule.matches(candidate) {
+				return rule.flavor, rule.root, true
+			}
+		}
+	}
 
+	return UnknownFlavor, UnknownRoot, false
 }
 
-// Singleton inverter the package uses
-var inverter baseInverter
-
 // MatchTypeline returns a flavor and root for a discovered base
-// or ok is false.
+// or ok is false, in which case they are UnknownFlavor and UnknownRoot.
+//
+// Bases are those of CurrentBases.
 func MatchTypeline(typeline string) (flavor, root string, ok bool) {
-	return inverter.typeLineToRootAndFlavor(typeline)
+	return CurrentBases().MatchTypeline(typeline)
 }
 
-// Prep our singleton inverter
+// Prep our bundled bases
 func init() {
 	bl, err := getBaseLookup()
 	if err != nil {
 		panic(fmt.Sprintf("failed to deserialize baseLookup on stash init, err=%s", err))
 	}
 
-	inverter = bl.toInverter()
+	defaultBases = newBaseSet(bl.toBases(), nil)
+	currentBases = defaultBases
 }
@@ -0,0 +1,274 @@
+package stash
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/pkg/errors"
+)
+
+// OAuthStashAPIBase is the URL the stash api is located at for clients
+// authenticating with an OAuth bearer token
+const OAuthStashAPIBase string = "https://api.pathofexile.com/public-stash-tabs"
+
+// DefaultUserAgent identifies requests made by this package, the api asks
+// that every client describe itself and how its author can be contacted
+const DefaultUserAgent string = "poeitemstore (+https://github.com/Everlag/poeitemstore)"
+
+// DefaultTimeout bounds how long a single request may take, including
+// reading the body of a response
+const DefaultTimeout = time.Minute
+
+// TokenEnv is the environment variable commands read an OAuth bearer
+// token from when one is not otherwise provided
+const TokenEnv = "POE_STASH_TOKEN"
+
+// statusErrorBodyLimit bounds how much of the body of an unsuccessful
+// response is kept in a StatusError
+const statusErrorBodyLimit = 512
+
+// TokenSource provides the OAuth bearer token each request is made with
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// StaticToken is a TokenSource always providing the same token
+type StaticToken string
+
+// Token returns the token
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// StatusError is returned when the stash api responds with anything but
+// 200 OK
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Header     http.Header
+	// Start of the body, often describing what went wrong
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("stash api responded %s", e.Status)
+	}
+	return fmt.Sprintf("stash api responded %s, body=%s", e.Status, e.Body)
+}
+
+// Temporary returns whether the same request may succeed later, when
+// throttled or the api failed
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode >= http.StatusInternalServerError
+}
+
+// RetryAfter returns how long the Retry-After header asks to wait as of
+// now, zero when absent or malformed
+func (e *StatusError) RetryAfter(now time.Time) time.Duration {
+	value := e.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+// Client requests stash updates from the stash api
+type Client struct {
+	// URL of the stash api
+	BaseURL string
+	// Sent with every request, DefaultUserAgent when empty
+	UserAgent string
+	// Provides the bearer token for each request when non-nil
+	Tokens TokenSource
+	// Bound on a single request when positive
+	Timeout time.Duration
+	// Client requests are made with, http.DefaultClient when nil
+	HTTP *http.Client
+}
+
+// NewClient returns a Client for the public stash api at StashAPIBase
+// with sane defaults. Authenticated clients provide Tokens and
+// use OAuthStashAPIBase.
+func NewClient() *Client {
+	return &Client{
+		BaseURL:   StashAPIBase,
+		UserAgent: DefaultUserAgent,
+		Timeout:   DefaultTimeout,
+	}
+}
+
+// DefaultClient is the Client used by FetchUpdate
+var DefaultClient = NewClient()
+
+// endpoint returns the URL of the update indicated by the changeID
+func (c *Client) endpoint(changeID string) string {
+	if changeID == "" {
+		return c.BaseURL
+	}
+	return fmt.Sprintf("%s?id=%s", c.BaseURL, url.QueryEscape(changeID))
+}
+
+// readCloser closes each of closers once its reader is closed
+type readCloser struct {
+	io.Reader
+	closers []func() error
+}
+
+func (r *readCloser) Close() error {
+	var first error
+	for _, closer := range r.closers {
+		if err := closer(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// open requests the update indicated by the changeID, returning the
+// decompressed body of a successful response alongside its headers.
+// The body must be closed, which also ends the request's timeout.
+func (c *Client) open(ctx context.Context,
+	changeID string) (io.ReadCloser, http.Header, error) {
+
+	cancel := func() {}
+	if c.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.endpoint(changeID), nil)
+	if err != nil {
+		cancel()
+		return nil, nil, errors.Wrap(err, "failed to create request")
+	}
+	req = req.WithContext(ctx)
+
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	// Setting Accept-Encoding ourselves leaves decompression to us
+	req.Header.Set("Accept-Encoding", "gzip")
+	if c.Tokens != nil {
+		token, err := c.Tokens.Token()
+		if err != nil {
+			cancel()
+			return nil, nil, errors.Wrap(err, "failed to get token")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, errors.Wrap(err, "failed to call stash api")
+	}
+
+	body := &readCloser{
+		Reader: resp.Body,
+		closers: []func() error{resp.Body.Close, func() error {
+			cancel()
+			return nil
+		}},
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		decomp, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			body.Close()
+			return nil, resp.Header, errors.Wrap(err, "failed to decompress response")
+		}
+		body.Reader = decomp
+		body.closers = append([]func() error{decomp.Close}, body.closers...)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer body.Close()
+		start, _ := ioutil.ReadAll(io.LimitReader(body, statusErrorBodyLimit))
+		return nil, resp.Header, &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Header:     resp.Header,
+			Body:       string(start),
+		}
+	}
+
+	return body, resp.Header, nil
+}
+
+// Fetch grabs the update indicated by the changeID alongside the headers
+// it was sent with. If empty changeID is provided, it grabs the
+// default update.
+//
+// Responses other than 200 OK are returned as a *StatusError, which
+// errors.Cause recovers from the returned error.
+func (c *Client) Fetch(ctx context.Context,
+	changeID string) (*Response, http.Header, error) {
+
+	body, header, err := c.open(ctx, changeID)
+	if err != nil {
+		return nil, header, err
+	}
+	defer body.Close()
+
+	var response Response
+	err = easyjson.UnmarshalFromReader(body, &response)
+	if err != nil {
+		return nil, header, errors.Wrap(err, "failed to decode stash tab response")
+	}
+
+	return &response, header, CleanResponse(&response)
+}
+
+// FetchRaw grabs the update indicated by the changeID as Fetch does,
+// returning it still JSON encoded.
+func (c *Client) FetchRaw(ctx context.Context,
+	changeID string) ([]byte, http.Header, error) {
+
+	body, header, err := c.open(ctx, changeID)
+	if err != nil {
+		return nil, header, err
+	}
+	defer body.Close()
+
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, header, errors.Wrap(err, "failed to read stash tab response")
+	}
+	return raw, header, nil
+}
+
+// Stream requests the update indicated by the changeID as Fetch does,
+// returning a StashDecoder reading its stashes as they arrive rather
+// than the entire Response. The decoder must be closed.
+func (c *Client) Stream(ctx context.Context,
+	changeID string) (*StashDecoder, http.Header, error) {
+
+	body, header, err := c.open(ctx, changeID)
+	if err != nil {
+		return nil, header, err
+	}
+
+	dec := NewStashDecoder(body)
+	dec.closer = body
+	return dec, header, nil
+}
@@ -8,6 +8,7 @@ package stash
 import (
 	"bytes"
 	"os"
+	"time"
 
 	"github.com/golang/snappy"
 	"github.com/pkg/errors"
@@ -41,9 +42,49 @@ func (changes *ChangeSet) AddResponse(changeID string,
 	changes.ChangeIDToIndex[changeID] = len(changes.Changes) - 1
 }
 
-// Save stores the marshalled ChangeSet's at the provided location
+// ChangeIDs returns the ID of every change by position
+func (changes *ChangeSet) ChangeIDs() []string {
+	ids := make([]string, len(changes.Changes))
+	for id, index := range changes.ChangeIDToIndex {
+		if index >= 0 && index < len(ids) {
+			ids[index] = id
+		}
+	}
+	return ids
+}
+
+// ChangeAt returns the change at position i
+func (changes *ChangeSet) ChangeAt(i int) (*CompressedResponse, error) {
+	if i < 0 || i >= len(changes.Changes) {
+		return nil, errors.Errorf("change %d out of range, %d changes",
+			i, len(changes.Changes))
+	}
+	return &changes.Changes[i], nil
+}
+
+// IndexOf returns the position of a change.
+// Follows the _, ok pattern ala maps if not found
+func (changes *ChangeSet) IndexOf(changeID string) (int, bool) {
+	index, ok := changes.ChangeIDToIndex[changeID]
+	return index, ok
+}
+
+// FetchedAt always returns the zero time as a ChangeSet does not record
+// when its changes were fetched
+func (changes *ChangeSet) FetchedAt(i int) time.Time {
+	return time.Time{}
+}
+
+// Close does nothing as a ChangeSet is held entirely in memory
+func (changes *ChangeSet) Close() error {
+	return nil
+}
+
+// Save stores the marshalled ChangeSet's at the provided location,
+// replacing anything already there
 func (changes *ChangeSet) Save(path string) error {
-	f, err := os.OpenFile(path, os.O_CREATE, 0777)
+	// msgp.WriteFile maps the file, so it must be opened for reading too
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
 	if err != nil {
 		return errors.Wrap(err, "failed to open file")
 	}
@@ -77,12 +118,28 @@ func (changes *ChangeSet) GetCompByChangeID(changeID string) (*CompressedRespons
 
 }
 
-// OpenChangeSet attempts to open a ChangeSet at the provided path
-func OpenChangeSet(path string) (*ChangeSet, error) {
+// OpenChangeSet opens the ChangeSet or change archive at the provided
+// path. An archive's changes are read only as requested, seeking to each
+// through its index, while a ChangeSet saved whole is read into memory.
+func OpenChangeSet(path string) (ChangeReader, error) {
+	isArchive, err := IsChangeArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	// Avoid returning a nil pointer as a non-nil ChangeReader
+	if isArchive {
+		archive, err := OpenChangeArchive(path)
+		if err != nil {
+			return nil, err
+		}
+		return archive, nil
+	}
+
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open file")
 	}
+	defer f.Close()
 
 	var set ChangeSet
 	err = msgp.ReadFile(&set, f)
@@ -0,0 +1,233 @@
+package stash
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultFetchWait is the minimum time between requests made by a
+// Fetcher when the api advertises no stricter rate limit
+const DefaultFetchWait = time.Second
+
+// Fetcher requests stash updates through a Client, pacing requests to
+// stay inside the advertised rate limits and retrying those which are
+// throttled or fail.
+//
+// A Fetcher is not safe for concurrent use.
+type Fetcher struct {
+	Client *Client
+	// Minimum time between requests, raised when the rate limits
+	// advertised by the api allow fewer requests
+	Wait time.Duration
+	// Number of times a single update is retried before giving up
+	Retries int
+	// Wait before the first retry, doubling with each following retry up
+	// to MaxBackoff. A longer Retry-After from the api takes precedence.
+	Backoff, MaxBackoff time.Duration
+	// Called before each retry when non-nil
+	Retrying func(changeID string, wait time.Duration, err error)
+
+	// Sleep waits between requests and Now provides the current time,
+	// both replaceable when testing
+	Sleep func(context.Context, time.Duration) error
+	Now   func() time.Time
+
+	// Earliest time the next request is made
+	next time.Time
+}
+
+// NewFetcher returns a Fetcher using client with sane defaults
+func NewFetcher(client *Client) *Fetcher {
+	return &Fetcher{
+		Client:     client,
+		Wait:       DefaultFetchWait,
+		Retries:    8,
+		Backoff:    time.Second * 2,
+		MaxBackoff: time.Minute * 5,
+		Sleep:      sleepContext,
+		Now:        time.Now,
+	}
+}
+
+// sleepContext waits for d or until ctx is done, whichever is first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimit is a single rule of a rate limit header, either the limit
+// or the current state of a client against that limit
+type rateLimit struct {
+	// Requests allowed, or made when a state
+	Hits int
+	// Period the requests are counted over
+	Period time.Duration
+	// Restriction applied when exceeded, or active when a state
+	Restriction time.Duration
+}
+
+// parseRateLimits parses a rate limit header of comma separated
+// hits:period:restriction rules, periods in seconds
+func parseRateLimits(header string) []rateLimit {
+	var limits []rateLimit
+	for _, rule := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(rule), ":")
+		if len(fields) != 3 {
+			continue
+		}
+		var values [3]int
+		var err error
+		for i, field := range fields {
+			if values[i], err = strconv.Atoi(field); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		limits = append(limits, rateLimit{
+			Hits:        values[0],
+			Period:      time.Duration(values[1]) * time.Second,
+			Restriction: time.Duration(values[2]) * time.Second,
+		})
+	}
+	return limits
+}
+
+// RateLimitWait returns how long to wait before the next request given
+// the X-Rate-Limit headers of a response.
+//
+// Requests are spread evenly across the period of each limit. When a
+// limit is already reached the entire period is waited, and when
+// restricted the restriction is waited.
+func RateLimitWait(header http.Header) time.Duration {
+	var wait time.Duration
+	for _, rule := range strings.Split(header.Get("X-Rate-Limit-Rules"), ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		limits := parseRateLimits(header.Get("X-Rate-Limit-" + rule))
+		states := parseRateLimits(header.Get("X-Rate-Limit-" + rule + "-State"))
+		for i, limit := range limits {
+			if limit.Hits > 0 && limit.Period/time.Duration(limit.Hits) > wait {
+				wait = limit.Period / time.Duration(limit.Hits)
+			}
+			if i >= len(states) {
+				continue
+			}
+			state := states[i]
+			if state.Restriction > wait {
+				wait = state.Restriction
+			}
+			if state.Hits >= limit.Hits && limit.Period > wait {
+				wait = limit.Period
+			}
+		}
+	}
+	return wait
+}
+
+// attempt makes a single request using request, returning whether
+// a failed request should be retried and the wait asked for before it
+func (f *Fetcher) attempt(ctx context.Context,
+	request func() (http.Header, error)) (time.Duration, bool, error) {
+
+	header, err := request()
+	now := f.Now()
+
+	wait := RateLimitWait(header)
+	if wait < f.Wait {
+		wait = f.Wait
+	}
+	f.next = now.Add(wait)
+
+	if err == nil {
+		return 0, false, nil
+	}
+	if ctx.Err() != nil {
+		return 0, false, err
+	}
+	if status, ok := errors.Cause(err).(*StatusError); ok {
+		return status.RetryAfter(now), status.Temporary(), err
+	}
+	// Anything else is a network failure or a truncated response
+	return 0, true, err
+}
+
+// retry calls request until it succeeds, waiting as long as required
+// before each attempt
+func (f *Fetcher) retry(ctx context.Context, changeID string,
+	request func() (http.Header, error)) error {
+
+	for attempt := 0; ; attempt++ {
+		if wait := f.next.Sub(f.Now()); wait > 0 {
+			if err := f.Sleep(ctx, wait); err != nil {
+				return err
+			}
+		}
+
+		wait, retry, err := f.attempt(ctx, request)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= f.Retries {
+			return errors.Wrapf(err, "failed after %d attempts", attempt+1)
+		}
+
+		backoff := f.Backoff << uint(attempt)
+		if backoff > f.MaxBackoff || backoff <= 0 {
+			backoff = f.MaxBackoff
+		}
+		if wait > backoff {
+			backoff = wait
+		}
+		if next := f.Now().Add(backoff); next.After(f.next) {
+			f.next = next
+		}
+		if f.Retrying != nil {
+			f.Retrying(changeID, backoff, err)
+		}
+	}
+}
+
+// Fetch grabs the update indicated by the changeID, the default update
+// when empty, waiting as long as required before each attempt.
+func (f *Fetcher) Fetch(ctx context.Context,
+	changeID string) (*Response, error) {
+
+	var response *Response
+	err := f.retry(ctx, changeID, func() (http.Header, error) {
+		var header http.Header
+		var err error
+		response, header, err = f.Client.Fetch(ctx, changeID)
+		return header, err
+	})
+	return response, err
+}
+
+// FetchRaw grabs the update indicated by the changeID as Fetch does,
+// returning it still JSON encoded.
+func (f *Fetcher) FetchRaw(ctx context.Context,
+	changeID string) ([]byte, error) {
+
+	var raw []byte
+	err := f.retry(ctx, changeID, func() (http.Header, error) {
+		var header http.Header
+		var err error
+		raw, header, err = f.Client.FetchRaw(ctx, changeID)
+		return header, err
+	})
+	return raw, err
+}
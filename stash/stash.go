@@ -6,11 +6,10 @@ package stash
 //go:generate msgp
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"regexp"
 	"strconv"
@@ -187,7 +186,7 @@ type Response struct {
 }
 
 // StashAPIBase is the URL the stash api is located at
-const StashAPIBase string = "http://www.pathofexile.com/api/public-stash-tabs"
+const StashAPIBase string = "https://www.pathofexile.com/api/public-stash-tabs"
 
 // TestResponseLoc is where testing data is kept
 const TestResponseLoc string = "StashResponse.json"
@@ -206,36 +205,40 @@ func GetStored() (*Response, error) {
 // CleanResponse adds on Type data as well as ensures the response
 // will satisfy our expectations, as wildly unreasonable as they can be
 func CleanResponse(response *Response) error {
-	for _, stash := range response.Stashes {
-		for i, item := range stash.Items {
-			item.StashID = stash.ID
-			// Handle cases where the item is identified purely by its typeline
-			if len(item.Name) == 0 {
-				item.Name = item.TypeLine
-			}
-
-			if len(item.Note) == 0 {
-				item.Note = "unknown"
-			}
-
-			// Resolve the typeLine on an item to its flavor and root
-			flavor, root, ok := MatchTypeline(item.TypeLine)
-			if !ok {
-				fmt.Println(stash.ID)
-				fmt.Println(item)
-				return errors.Errorf("failed to discover flavor and root for Item, name=%s, typeline=%s, id=%s",
-					item.Name, item.TypeLine, item.ID)
-			}
-			item.RootType = root
-			item.RootFlavor = flavor
-
-			stash.Items[i] = item
+	for i := range response.Stashes {
+		if err := CleanStash(&response.Stashes[i]); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// CleanStash performs the cleaning of CleanResponse on a single stash
+func CleanStash(stash *Stash) error {
+	for i, item := range stash.Items {
+		item.StashID = stash.ID
+		// Handle cases where the item is identified purely by its typeline
+		if len(item.Name) == 0 {
+			item.Name = item.TypeLine
+		}
+
+		if len(item.Note) == 0 {
+			item.Note = "unknown"
+		}
+
+		// Resolve the typeLine on an item to its flavor and root,
+		// items we fail to resolve are kept under UnknownRoot
+		flavor, root, _ := MatchTypeline(item.TypeLine)
+		item.RootType = root
+		item.RootFlavor = flavor
+
+		stash.Items[i] = item
+	}
+
+	return nil
+}
+
 // RespFromJSON attempts to deserialize the provided data
 // and return it as a StashResponse
 func RespFromJSON(r io.Reader) (*Response, error) {
@@ -251,25 +254,10 @@ func RespFromJSON(r io.Reader) (*Response, error) {
 // FetchUpdate grabs the update indicated by the changeID.
 //
 // If empty changeID is provided, it grabs the default update.
+// Requests are made using DefaultClient.
 func FetchUpdate(changeID string) (*Response, error) {
-	endpoint := StashAPIBase
-	if changeID != "" {
-		endpoint = fmt.Sprintf("%s?id=%s", StashAPIBase, changeID)
-	}
-
-	resp, err := http.Get(endpoint)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to call stash api")
-	}
-	defer resp.Body.Close()
-
-	var response Response
-	err = easyjson.UnmarshalFromReader(resp.Body, &response)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to decode stash tab response")
-	}
-
-	return &response, CleanResponse(&response)
+	response, _, err := DefaultClient.Fetch(context.Background(), changeID)
+	return response, err
 }
 
 // FetchAndSetStore grabs the latest stash tab api update
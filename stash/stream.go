@@ -0,0 +1,192 @@
+package stash
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/mailru/easyjson/jlexer"
+	"github.com/pkg/errors"
+)
+
+// StashDecoder reads the stashes of a JSON encoded Response one at a
+// time, so a response never needs to be held in memory whole.
+//
+// The easyjson lexer requires the entire input up front, so the response
+// is walked with an encoding/json Decoder which only buffers the stash
+// currently being read. Each stash is then decoded with easyjson.
+type StashDecoder struct {
+	dec *json.Decoder
+	// Closed once the decoder is, when non-nil
+	closer io.Closer
+
+	nextChangeID string
+	// Whether the start of the response has been read
+	started bool
+	// Whether the stashes array is being read
+	inStashes bool
+	// Whether the entire response has been read
+	done bool
+}
+
+// NewStashDecoder returns a StashDecoder reading a Response from r
+func NewStashDecoder(r io.Reader) *StashDecoder {
+	return &StashDecoder{dec: json.NewDecoder(r)}
+}
+
+// delim reads the next token, requiring it to be the provided delimiter
+func (d *StashDecoder) delim(want json.Delim) error {
+	token, err := d.dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return errors.Errorf("expected %s, found %v", want, token)
+	}
+	return nil
+}
+
+// advance reads the keys of the response until the stashes array is
+// entered or the response ends
+func (d *StashDecoder) advance() error {
+	if !d.started {
+		if err := d.delim('{'); err != nil {
+			return errors.Wrap(err, "failed to read start of response")
+		}
+		d.started = true
+	}
+
+	for d.dec.More() {
+		token, err := d.dec.Token()
+		if err != nil {
+			return errors.Wrap(err, "failed to read response key")
+		}
+		key, _ := token.(string)
+
+		switch key {
+		case "next_change_id":
+			var id *string
+			if err := d.dec.Decode(&id); err != nil {
+				return errors.Wrap(err, "failed to decode next_change_id")
+			}
+			if id != nil {
+				d.nextChangeID = *id
+			}
+		case "stashes":
+			token, err := d.dec.Token()
+			if err != nil {
+				return errors.Wrap(err, "failed to read stashes")
+			}
+			if token == nil {
+				continue
+			}
+			if delim, ok := token.(json.Delim); !ok || delim != '[' {
+				return errors.Errorf("expected stashes array, found %v", token)
+			}
+			d.inStashes = true
+			return nil
+		default:
+			var skipped json.RawMessage
+			if err := d.dec.Decode(&skipped); err != nil {
+				return errors.Wrapf(err, "failed to skip %s", key)
+			}
+		}
+	}
+
+	if err := d.delim('}'); err != nil {
+		return errors.Wrap(err, "failed to read end of response")
+	}
+	d.done = true
+	return nil
+}
+
+// Next decodes and cleans the next stash into s, returning io.EOF once
+// every stash has been read.
+func (d *StashDecoder) Next(s *Stash) error {
+	for !d.done {
+		if !d.inStashes {
+			if err := d.advance(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !d.dec.More() {
+			if err := d.delim(']'); err != nil {
+				return errors.Wrap(err, "failed to read end of stashes")
+			}
+			d.inStashes = false
+			continue
+		}
+
+		var raw json.RawMessage
+		if err := d.dec.Decode(&raw); err != nil {
+			return errors.Wrap(err, "failed to read stash")
+		}
+		*s = Stash{}
+		lexer := jlexer.Lexer{Data: raw}
+		s.UnmarshalEasyJSON(&lexer)
+		if err := lexer.Error(); err != nil {
+			return errors.Wrap(err, "failed to decode stash")
+		}
+		return CleanStash(s)
+	}
+	return io.EOF
+}
+
+// NextChangeID returns the NextChangeID of the response, which is only
+// known once read. The stash api sends it before any stashes.
+func (d *StashDecoder) NextChangeID() string {
+	return d.nextChangeID
+}
+
+// Response reads every remaining stash into a Response
+func (d *StashDecoder) Response() (*Response, error) {
+	response := Response{Stashes: []Stash{}}
+	for {
+		var s Stash
+		err := d.Next(&s)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		response.Stashes = append(response.Stashes, s)
+	}
+	response.NextChangeID = d.nextChangeID
+	return &response, nil
+}
+
+// Close closes whatever the stashes are read from when the decoder
+// owns it, such as the body of a streamed response
+func (d *StashDecoder) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+// PeekNextChangeID returns the NextChangeID of a JSON encoded Response
+// without decoding its stashes. The stash api sends it first, so this
+// is cheap compared to decoding the entire response.
+func PeekNextChangeID(data []byte) (string, error) {
+	in := jlexer.Lexer{Data: data}
+	in.Delim('{')
+	for in.Ok() && !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if key == "next_change_id" && !in.IsNull() {
+			id := in.String()
+			if err := in.Error(); err != nil {
+				return "", errors.Wrap(err, "failed to decode next_change_id")
+			}
+			return id, nil
+		}
+		in.SkipRecursive()
+		in.WantComma()
+	}
+	if err := in.Error(); err != nil {
+		return "", errors.Wrap(err, "failed to decode response")
+	}
+	return "", errors.New("response has no next_change_id")
+}